@@ -0,0 +1,589 @@
+// Package auth logs operators into the simulator consoles, against a users
+// file or an OIDC issuer, and checks the role their requests need.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+type Role string
+
+const (
+	// RoleViewer can follow the simulator from the console without changing it.
+	RoleViewer Role = "viewer"
+	// RoleApprover can also approve and reject enrollments.
+	RoleApprover Role = "approver"
+	// RoleAdmin can configure the simulator.
+	RoleAdmin Role = "admin"
+)
+
+func ParseRole(role string) (Role, error) {
+	switch Role(strings.ToLower(strings.TrimSpace(role))) {
+	case RoleViewer:
+		return RoleViewer, nil
+	case RoleApprover:
+		return RoleApprover, nil
+	case RoleAdmin:
+		return RoleAdmin, nil
+	}
+	return "", fmt.Errorf("unknown role %s", role)
+}
+
+func (r Role) level() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleApprover:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// Allows tells whether the role includes the given one.
+func (r Role) Allows(required Role) bool {
+	return r.level() >= required.level()
+}
+
+type AuthMode string
+
+const (
+	// AuthModeNone keeps the consoles open, every client acts as an admin.
+	// It has to be asked for explicitly with Config.AllowAnonymous.
+	AuthModeNone  AuthMode = "NONE"
+	AuthModeLocal AuthMode = "LOCAL"
+	AuthModeOIDC  AuthMode = "OIDC"
+)
+
+func parseAuthMode(mode string) (AuthMode, error) {
+	switch AuthMode(strings.ToUpper(mode)) {
+	case "":
+		return "", fmt.Errorf("no auth mode configured, use %s, %s or %s", AuthModeLocal, AuthModeOIDC, AuthModeNone)
+	case AuthModeNone:
+		return AuthModeNone, nil
+	case AuthModeLocal:
+		return AuthModeLocal, nil
+	case AuthModeOIDC:
+		return AuthModeOIDC, nil
+	}
+	return "", fmt.Errorf("unknown auth mode %s", mode)
+}
+
+// Principal is the user, or API token, a request or command is run for.
+type Principal struct {
+	Username string `json:"username"`
+	Role     Role   `json:"role"`
+}
+
+var anonymousAdmin = &Principal{Username: "anonymous", Role: RoleAdmin}
+
+// AuditLog ties every change to the user that made it.
+func AuditLog(principal *Principal, action string, detail string) {
+	if detail != "" {
+		detail = " " + detail
+	}
+	log.Printf("audit: user=%s role=%s action=%s%s\n", principal.Username, principal.Role, action, detail)
+}
+
+// LocalUser is an entry of the users file. Passwords are stored as PBKDF2
+// hashes created with HashPassword.
+type LocalUser struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	Role         Role   `json:"role"`
+}
+
+func loadLocalUsers(path string) (map[string]LocalUser, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []LocalUser
+	err = json.Unmarshal(content, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string]LocalUser{}
+	for _, user := range entries {
+		if user.Username == "" {
+			return nil, errors.New("user without username")
+		}
+		user.Role, err = ParseRole(string(user.Role))
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", user.Username, err)
+		}
+		users[user.Username] = user
+	}
+	return users, nil
+}
+
+const (
+	passwordHashScheme     = "pbkdf2-sha256"
+	passwordHashIterations = 210000
+)
+
+func HashPassword(password string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key := pbkdf2.Key([]byte(password), salt, passwordHashIterations, sha256.Size, sha256.New)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, passwordHashIterations, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func verifyPassword(password, encodedHash string) bool {
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	key := pbkdf2.Key([]byte(password), salt, iterations, len(expected), sha256.New)
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+type authSession struct {
+	principal Principal
+	expiresAt time.Time
+}
+
+// Authenticator logs operators into the console, either against the users
+// file or an OIDC issuer, and keeps their sessions in memory.
+type Authenticator struct {
+	mode           AuthMode
+	users          map[string]LocalUser
+	oidc           *OIDCProvider
+	sessionTTL     time.Duration
+	allowedOrigins []string
+	apiTokens      map[string]*Principal
+	title          string
+	cookiePrefix   string
+	writeError     func(w http.ResponseWriter, statusCode int, message string)
+
+	lock     sync.Mutex
+	sessions map[string]authSession
+}
+
+type Config struct {
+	Mode string
+	// AllowAnonymous acknowledges that the NONE mode gives every client
+	// admin access, without it the NONE mode is refused.
+	AllowAnonymous bool
+	UsersFile      string
+	SessionTTL     time.Duration
+	AllowedOrigins []string
+	// APITokens authenticate scripts as admins with a bearer token.
+	APITokens []string
+	OIDC      OIDCConfig
+	// Title is shown on the login page.
+	Title string
+	// CookiePrefix keeps the cookies of simulators served from the same host
+	// apart.
+	CookiePrefix string
+	// ErrorWriter writes the errors of the protected routes, they are sent as
+	// {"error": message} by default.
+	ErrorWriter func(w http.ResponseWriter, statusCode int, message string)
+}
+
+func NewAuthenticator(config Config) (*Authenticator, error) {
+	mode, err := parseAuthMode(config.Mode)
+	if err != nil {
+		return nil, err
+	}
+	if mode == AuthModeNone && !config.AllowAnonymous {
+		return nil, errors.New("the NONE auth mode gives every client admin access and has to be allowed explicitly")
+	}
+
+	auth := &Authenticator{
+		mode:           mode,
+		sessionTTL:     config.SessionTTL,
+		allowedOrigins: []string{},
+		apiTokens:      map[string]*Principal{},
+		title:          config.Title,
+		cookiePrefix:   config.CookiePrefix,
+		writeError:     config.ErrorWriter,
+		sessions:       map[string]authSession{},
+	}
+	if auth.cookiePrefix == "" {
+		auth.cookiePrefix = "console"
+	}
+	if auth.writeError == nil {
+		auth.writeError = writeError
+	}
+
+	for _, origin := range config.AllowedOrigins {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			auth.allowedOrigins = append(auth.allowedOrigins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+
+	// API tokens act as admins, the index tells them apart in the audit log.
+	for i, token := range config.APITokens {
+		if token = strings.TrimSpace(token); token != "" {
+			auth.apiTokens[token] = &Principal{Username: fmt.Sprintf("api-token-%d", i+1), Role: RoleAdmin}
+		}
+	}
+
+	switch mode {
+	case AuthModeLocal:
+		if config.UsersFile == "" {
+			return nil, errors.New("local authentication requires a users file")
+		}
+		auth.users, err = loadLocalUsers(config.UsersFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading users file: %v", err)
+		}
+
+	case AuthModeOIDC:
+		auth.oidc, err = NewOIDCProvider(context.Background(), config.OIDC)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring OIDC: %v", err)
+		}
+		auth.oidc.stateCookieName = auth.cookiePrefix + "_oidc_state"
+	}
+
+	return auth, nil
+}
+
+func (a *Authenticator) Mode() AuthMode {
+	return a.mode
+}
+
+func (a *Authenticator) sessionCookieName() string {
+	return a.cookiePrefix + "_session"
+}
+
+func (a *Authenticator) newSession(principal Principal) string {
+	token := newRandomID() + newRandomID()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for id, session := range a.sessions {
+		if time.Now().After(session.expiresAt) {
+			delete(a.sessions, id)
+		}
+	}
+	a.sessions[token] = authSession{
+		principal: principal,
+		expiresAt: time.Now().Add(a.sessionTTL),
+	}
+	return token
+}
+
+func (a *Authenticator) session(r *http.Request) (string, *Principal) {
+	cookie, err := r.Cookie(a.sessionCookieName())
+	if err != nil {
+		return "", nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	session, ok := a.sessions[cookie.Value]
+	if !ok || time.Now().After(session.expiresAt) {
+		return "", nil
+	}
+	principal := session.principal
+	return cookie.Value, &principal
+}
+
+// Authenticate returns the principal of a request, from its API token or its
+// session cookie. Anonymous requests are admins when authentication is
+// disabled.
+func (a *Authenticator) Authenticate(r *http.Request) *Principal {
+	return a.authenticate(r, true)
+}
+
+func (a *Authenticator) authenticate(r *http.Request, allowAnonymous bool) *Principal {
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" {
+		for apiToken, principal := range a.apiTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) == 1 {
+				return principal
+			}
+		}
+	}
+
+	if a.mode == AuthModeNone {
+		if allowAnonymous {
+			return anonymousAdmin
+		}
+		return nil
+	}
+
+	_, principal := a.session(r)
+	return principal
+}
+
+// CheckOrigin accepts requests from the console served by the simulator itself
+// and from the configured origins. Clients that send no origin, such as
+// scripts, are not browsers and are let through.
+func (a *Authenticator) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	originUrl, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(originUrl.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range a.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, strings.TrimSuffix(origin, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+type principalContextKey struct{}
+
+// PrincipalFromContext returns the user authenticated by Require.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalContextKey{}).(*Principal)
+	return principal
+}
+
+// Require protects a console route: it checks the origin, the session and
+// the role, and passes the principal along in the request context.
+func (a *Authenticator) Require(role Role, next http.HandlerFunc) http.HandlerFunc {
+	return a.require(role, true, next)
+}
+
+// RequireAPI is like Require but always asks for an API token or a session,
+// even when authentication is disabled.
+func (a *Authenticator) RequireAPI(role Role, next http.HandlerFunc) http.HandlerFunc {
+	return a.require(role, false, next)
+}
+
+func (a *Authenticator) require(role Role, allowAnonymous bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.CheckOrigin(r) {
+			a.writeError(w, http.StatusForbidden, "Origin not allowed")
+			return
+		}
+
+		principal := a.authenticate(r, allowAnonymous)
+		if principal == nil {
+			a.writeError(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		if !principal.Role.Allows(role) {
+			a.writeError(w, http.StatusForbidden, fmt.Sprintf("The %s role is required", role))
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), principalContextKey{}, principal)))
+	}
+}
+
+// RequireConsole sends browsers without a session to the login page.
+func (a *Authenticator) RequireConsole(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.Authenticate(r) == nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *Authenticator) setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.sessionCookieName(),
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *Authenticator) startSession(w http.ResponseWriter, r *http.Request, principal Principal) {
+	token := a.newSession(principal)
+	a.setSessionCookie(w, r, token, time.Now().Add(a.sessionTTL))
+	AuditLog(&principal, "LOGIN", string(a.mode))
+}
+
+func (a *Authenticator) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/login", a.loginPageRoute).Methods("GET")
+	router.HandleFunc("/auth/login", a.loginRoute).Methods("POST")
+	router.HandleFunc("/auth/logout", a.logoutRoute).Methods("GET", "POST")
+	router.HandleFunc("/auth/me", a.meRoute).Methods("GET")
+	router.HandleFunc("/auth/oidc/login", a.oidcLoginRoute).Methods("GET")
+	router.HandleFunc("/auth/oidc/callback", a.oidcCallbackRoute).Methods("GET")
+}
+
+func newRandomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	writeJSON(w, statusCode, map[string]string{"error": message})
+}
+
+//go:embed login.html
+var loginPageTemplate string
+
+var loginPage = template.Must(template.New("login").Parse(loginPageTemplate))
+
+func (a *Authenticator) loginPageRoute(w http.ResponseWriter, r *http.Request) {
+	if a.mode == AuthModeNone {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	loginPage.Execute(w, map[string]interface{}{
+		"Title": a.title,
+		"Local": a.mode == AuthModeLocal,
+		"OIDC":  a.mode == AuthModeOIDC,
+		"Error": r.URL.Query().Get("error"),
+	})
+}
+
+// loginRoute logs in local users. Forms are redirected to the console, JSON
+// requests get the principal back.
+func (a *Authenticator) loginRoute(w http.ResponseWriter, r *http.Request) {
+	isForm := strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+	fail := func(statusCode int, message string) {
+		if isForm {
+			http.Redirect(w, r, "/login?error="+url.QueryEscape(message), http.StatusSeeOther)
+			return
+		}
+		a.writeError(w, statusCode, message)
+	}
+
+	if a.mode != AuthModeLocal {
+		fail(http.StatusNotFound, "Local login is disabled")
+		return
+	}
+	if !a.CheckOrigin(r) {
+		fail(http.StatusForbidden, "Origin not allowed")
+		return
+	}
+
+	var credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if isForm {
+		credentials.Username = r.PostFormValue("username")
+		credentials.Password = r.PostFormValue("password")
+	} else if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+		a.writeError(w, http.StatusBadRequest, "Error parsing request body")
+		return
+	}
+
+	user, ok := a.users[credentials.Username]
+	if !ok || !verifyPassword(credentials.Password, user.PasswordHash) {
+		log.Printf("audit: failed login for user=%s\n", credentials.Username)
+		fail(http.StatusUnauthorized, "Invalid username or password")
+		return
+	}
+
+	principal := Principal{Username: user.Username, Role: user.Role}
+	a.startSession(w, r, principal)
+	if isForm {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, http.StatusOK, principal)
+}
+
+func (a *Authenticator) logoutRoute(w http.ResponseWriter, r *http.Request) {
+	if token, principal := a.session(r); principal != nil {
+		a.lock.Lock()
+		delete(a.sessions, token)
+		a.lock.Unlock()
+		AuditLog(principal, "LOGOUT", "")
+	}
+
+	a.setSessionCookie(w, r, "", time.Unix(0, 0))
+	if r.Method == http.MethodGet {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Authenticator) meRoute(w http.ResponseWriter, r *http.Request) {
+	principal := a.Authenticate(r)
+	if principal == nil {
+		a.writeError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+	writeJSON(w, http.StatusOK, principal)
+}
+
+func (a *Authenticator) oidcLoginRoute(w http.ResponseWriter, r *http.Request) {
+	if a.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	a.oidc.startLogin(w, r)
+}
+
+func (a *Authenticator) oidcCallbackRoute(w http.ResponseWriter, r *http.Request) {
+	if a.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	principal, err := a.oidc.finishLogin(r)
+	if err != nil {
+		log.Println("OIDC login failed:", err)
+		http.Redirect(w, r, "/login?error="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+		return
+	}
+
+	a.startSession(w, r, *principal)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
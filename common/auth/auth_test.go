@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	// RFC 7914 PBKDF2-HMAC-SHA256 vector, as written by HashPassword.
+	rfcHash := "pbkdf2-sha256$4096$c2FsdA$xeR41ZKIyEGqUw22hFxMjZYok6ABzk4RpJY4c6qYE0o"
+	hash := HashPassword("s3cr3t")
+
+	tests := []struct {
+		name     string
+		password string
+		hash     string
+		want     bool
+	}{
+		{
+			name:     "round trip",
+			password: "s3cr3t",
+			hash:     hash,
+			want:     true,
+		},
+		{
+			name:     "wrong password",
+			password: "s3cr3t!",
+			hash:     hash,
+			want:     false,
+		},
+		{
+			name:     "empty password",
+			password: "",
+			hash:     hash,
+			want:     false,
+		},
+		{
+			name:     "known vector",
+			password: "password",
+			hash:     rfcHash,
+			want:     true,
+		},
+		{
+			name:     "known vector with wrong password",
+			password: "Password",
+			hash:     rfcHash,
+			want:     false,
+		},
+		{
+			name:     "unknown scheme",
+			password: "password",
+			hash:     strings.Replace(rfcHash, "pbkdf2-sha256", "pbkdf2-sha1", 1),
+			want:     false,
+		},
+		{
+			name:     "zero iterations",
+			password: "password",
+			hash:     "pbkdf2-sha256$0$c2FsdA$xeR41ZKIyEGqUw22hFxMjZYok6ABzk4RpJY4c6qYE0o",
+			want:     false,
+		},
+		{
+			name:     "invalid iterations",
+			password: "password",
+			hash:     "pbkdf2-sha256$many$c2FsdA$xeR41ZKIyEGqUw22hFxMjZYok6ABzk4RpJY4c6qYE0o",
+			want:     false,
+		},
+		{
+			name:     "invalid salt",
+			password: "password",
+			hash:     "pbkdf2-sha256$4096$!!$xeR41ZKIyEGqUw22hFxMjZYok6ABzk4RpJY4c6qYE0o",
+			want:     false,
+		},
+		{
+			name:     "invalid key",
+			password: "password",
+			hash:     "pbkdf2-sha256$4096$c2FsdA$!!",
+			want:     false,
+		},
+		{
+			name:     "missing parts",
+			password: "password",
+			hash:     "pbkdf2-sha256$4096$c2FsdA",
+			want:     false,
+		},
+		{
+			name:     "plain text",
+			password: "password",
+			hash:     "password",
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyPassword(tt.password, tt.hash); got != tt.want {
+				t.Errorf("verifyPassword() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashPasswordSalts(t *testing.T) {
+	if HashPassword("s3cr3t") == HashPassword("s3cr3t") {
+		t.Error("HashPassword() returned the same hash twice")
+	}
+}
+
+func TestNewAuthenticatorMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{
+			name:    "no mode",
+			config:  Config{},
+			wantErr: true,
+		},
+		{
+			name:    "none without acknowledgement",
+			config:  Config{Mode: "NONE"},
+			wantErr: true,
+		},
+		{
+			name:    "none with acknowledgement",
+			config:  Config{Mode: "none", AllowAnonymous: true},
+			wantErr: false,
+		},
+		{
+			name:    "local without users file",
+			config:  Config{Mode: "LOCAL"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown mode",
+			config:  Config{Mode: "LDAP", AllowAnonymous: true},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAuthenticator(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewAuthenticator() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
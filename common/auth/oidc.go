@@ -0,0 +1,464 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// RolesClaim is the dotted path of the claim listing the roles of the
+	// user, realm_access.roles for Keycloak based issuers such as Lamassu.
+	RolesClaim string
+	// RoleMapping maps the roles of the issuer to console roles, roles named
+	// after the console ones are used as they are.
+	RoleMapping        map[string]string
+	InsecureSkipVerify bool
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcPendingLogin struct {
+	nonce        string
+	codeVerifier string
+	expiresAt    time.Time
+}
+
+// OIDCProvider logs users in with the authorization code flow and verifies
+// the ID tokens returned by the issuer against its published keys.
+type OIDCProvider struct {
+	config          OIDCConfig
+	discovery       oidcDiscovery
+	httpClient      *http.Client
+	stateCookieName string
+
+	lock    sync.Mutex
+	keys    map[string]crypto.PublicKey
+	pending map[string]oidcPendingLogin
+}
+
+func NewOIDCProvider(ctx context.Context, config OIDCConfig) (*OIDCProvider, error) {
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("issuer, client id and redirect url are required")
+	}
+	if config.RolesClaim == "" {
+		config.RolesClaim = "realm_access.roles"
+	}
+
+	provider := &OIDCProvider{
+		config: config,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify},
+			},
+		},
+		stateCookieName: "console_oidc_state",
+		keys:            map[string]crypto.PublicKey{},
+		pending:         map[string]oidcPendingLogin{},
+	}
+
+	discoveryUrl := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	err := provider.getJSON(ctx, discoveryUrl, &provider.discovery)
+	if err != nil {
+		return nil, fmt.Errorf("error reading issuer metadata: %v", err)
+	}
+	if strings.TrimSuffix(provider.discovery.Issuer, "/") != strings.TrimSuffix(config.Issuer, "/") {
+		return nil, fmt.Errorf("issuer metadata is for %s", provider.discovery.Issuer)
+	}
+
+	err = provider.refreshKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with status code %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (p *OIDCProvider) refreshKeys(ctx context.Context) error {
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	err := p.getJSON(ctx, p.discovery.JWKSURI, &jwks)
+	if err != nil {
+		return fmt.Errorf("error reading issuer keys: %v", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, key := range jwks.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		switch key.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(key.N)
+			e, errE := base64.RawURLEncoding.DecodeString(key.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+		case "EC":
+			var curve elliptic.Curve
+			switch key.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(key.X)
+			y, errY := base64.RawURLEncoding.DecodeString(key.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[key.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	p.lock.Lock()
+	p.keys = keys
+	p.lock.Unlock()
+	return nil
+}
+
+func (p *OIDCProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.lock.Lock()
+	key, ok := p.keys[kid]
+	p.lock.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	// The issuer may have rotated its keys.
+	err := p.refreshKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	key, ok = p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+	return key, nil
+}
+
+func (p *OIDCProvider) startLogin(w http.ResponseWriter, r *http.Request) {
+	state := newRandomID()
+	login := oidcPendingLogin{
+		nonce:        newRandomID(),
+		codeVerifier: newRandomID() + newRandomID(),
+		expiresAt:    time.Now().Add(10 * time.Minute),
+	}
+
+	p.lock.Lock()
+	for id, pending := range p.pending {
+		if time.Now().After(pending.expiresAt) {
+			delete(p.pending, id)
+		}
+	}
+	p.pending[state] = login
+	p.lock.Unlock()
+
+	// The state is also bound to the browser so a callback can only be
+	// completed by the browser that started the login.
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.stateCookieName,
+		Value:    state,
+		Path:     "/auth/oidc",
+		Expires:  login.expiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(login.codeVerifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.config.ClientID)
+	params.Set("redirect_uri", p.config.RedirectURL)
+	params.Set("scope", "openid profile")
+	params.Set("state", state)
+	params.Set("nonce", login.nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	http.Redirect(w, r, p.discovery.AuthorizationEndpoint+"?"+params.Encode(), http.StatusFound)
+}
+
+func (p *OIDCProvider) finishLogin(r *http.Request) (*Principal, error) {
+	if errParam := r.URL.Query().Get("error"); errParam != "" {
+		return nil, fmt.Errorf("issuer returned %s", errParam)
+	}
+
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(p.stateCookieName)
+	if err != nil || cookie.Value != state {
+		return nil, errors.New("login state mismatch")
+	}
+
+	p.lock.Lock()
+	login, ok := p.pending[state]
+	delete(p.pending, state)
+	p.lock.Unlock()
+	if !ok || time.Now().After(login.expiresAt) {
+		return nil, errors.New("login expired")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", r.URL.Query().Get("code"))
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("client_id", p.config.ClientID)
+	form.Set("code_verifier", login.codeVerifier)
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	resp, err := p.httpClient.PostForm(p.discovery.TokenEndpoint, form)
+	if err != nil {
+		return nil, fmt.Errorf("error exchanging authorization code: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint responded with status code %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding token response: %v", err)
+	}
+
+	claims, err := p.verifyIDToken(r.Context(), tokens.IDToken, login.nonce)
+	if err != nil {
+		return nil, err
+	}
+	return p.principal(claims)
+}
+
+// verifyIDToken checks the signature and the standard claims of an ID token
+// and returns its claims.
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, token string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(headerBytes, &header)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token header: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature: %v", err)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+
+	claimsBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token claims: %v", err)
+	}
+	claims := map[string]interface{}{}
+	decoder := json.NewDecoder(strings.NewReader(string(claimsBytes)))
+	decoder.UseNumber()
+	err = decoder.Decode(&claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token claims: %v", err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != p.discovery.Issuer {
+		return nil, fmt.Errorf("ID token issued by %s", iss)
+	}
+	if !audienceContains(claims["aud"], p.config.ClientID) {
+		return nil, errors.New("ID token not issued for this client")
+	}
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	exp, _ := claims["exp"].(json.Number)
+	expiresAt, err := exp.Int64()
+	if err != nil || time.Now().After(time.Unix(expiresAt, 0).Add(time.Minute)) {
+		return nil, errors.New("ID token expired")
+	}
+
+	return claims, nil
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported ID token algorithm %s", alg)
+	}
+
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(key, hash, digest, signature, nil)
+		}
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %s does not match an RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return fmt.Errorf("invalid %s signature", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid ID token signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported signing key")
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, entry := range aud {
+			if entry == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimValues follows a dotted claim path and returns the strings found.
+func claimValues(claims map[string]interface{}, path string) []string {
+	var value interface{} = claims
+	for _, segment := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[segment]
+	}
+
+	switch value := value.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := []string{}
+		for _, entry := range value {
+			if s, ok := entry.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// principal picks the highest console role granted by the issuer.
+func (p *OIDCProvider) principal(claims map[string]interface{}) (*Principal, error) {
+	username, _ := claims["preferred_username"].(string)
+	if username == "" {
+		username, _ = claims["sub"].(string)
+	}
+
+	var role Role
+	for _, value := range claimValues(claims, p.config.RolesClaim) {
+		if mapped, ok := p.config.RoleMapping[value]; ok {
+			value = mapped
+		}
+		candidate, err := ParseRole(value)
+		if err == nil && candidate.level() > role.level() {
+			role = candidate
+		}
+	}
+	if role == "" {
+		return nil, fmt.Errorf("user %s has no console role in the %s claim", username, p.config.RolesClaim)
+	}
+
+	return &Principal{Username: username, Role: role}, nil
+}
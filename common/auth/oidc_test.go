@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://auth.example.com/realms/lamassu"
+	testClientID = "vdms"
+	testNonce    = "nonce"
+)
+
+func signTestToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			signature, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], nil)
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		}
+	case *ecdsa.PrivateKey:
+		r, s, signErr := ecdsa.Sign(rand.Reader, key, digest[:])
+		err = signErr
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := &OIDCProvider{
+		config:     OIDCConfig{ClientID: testClientID},
+		discovery:  oidcDiscovery{Issuer: testIssuer},
+		httpClient: &http.Client{},
+		keys: map[string]crypto.PublicKey{
+			"rsa": &rsaKey.PublicKey,
+			"ec":  &ecKey.PublicKey,
+		},
+	}
+
+	claims := func(override map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   testIssuer,
+			"aud":   testClientID,
+			"nonce": testNonce,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range override {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	valid := signTestToken(t, "RS256", "rsa", rsaKey, claims(nil))
+	parts := strings.Split(valid, ".")
+	otherClaims, _ := json.Marshal(claims(map[string]interface{}{"aud": "other"}))
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(otherClaims) + "." + parts[2]
+	unsigned := parts[0] + "." + parts[1] + "."
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa"}`))
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{
+			name:  "RS256",
+			token: valid,
+		},
+		{
+			name:  "PS256",
+			token: signTestToken(t, "PS256", "rsa", rsaKey, claims(nil)),
+		},
+		{
+			name:  "ES256",
+			token: signTestToken(t, "ES256", "ec", ecKey, claims(nil)),
+		},
+		{
+			name:  "audience list",
+			token: signTestToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": []string{"other", testClientID}})),
+		},
+		{
+			name:  "expired within leeway",
+			token: signTestToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": time.Now().Add(-30 * time.Second).Unix()})),
+		},
+		{
+			name:    "wrong issuer",
+			token:   signTestToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+			wantErr: "issued by",
+		},
+		{
+			name:    "missing issuer",
+			token:   signTestToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"iss": nil})),
+			wantErr: "issued by",
+		},
+		{
+			name:    "wrong audience",
+			token:   signTestToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": "other"})),
+			wantErr: "not issued for this client",
+		},
+		{
+			name:    "audience list without client",
+			token:   signTestToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": []string{"other"}})),
+			wantErr: "not issued for this client",
+		},
+		{
+			name:    "missing audience",
+			token:   signTestToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": nil})),
+			wantErr: "not issued for this client",
+		},
+		{
+			name:    "nonce mismatch",
+			token:   signTestToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"nonce": "other"})),
+			wantErr: "nonce mismatch",
+		},
+		{
+			name:    "expired",
+			token:   signTestToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": time.Now().Add(-2 * time.Minute).Unix()})),
+			wantErr: "expired",
+		},
+		{
+			name:    "missing expiry",
+			token:   signTestToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": nil})),
+			wantErr: "expired",
+		},
+		{
+			name:    "alg none",
+			token:   noneHeader + "." + parts[1] + ".",
+			wantErr: "unsupported ID token algorithm none",
+		},
+		{
+			name:    "alg HS256",
+			token:   signTestToken(t, "HS256", "rsa", rsaKey, claims(nil)),
+			wantErr: "unsupported ID token algorithm HS256",
+		},
+		{
+			name:    "EC algorithm with RSA key",
+			token:   signTestToken(t, "ES256", "rsa", rsaKey, claims(nil)),
+			wantErr: "does not match an RSA key",
+		},
+		{
+			name:    "RSA algorithm with EC key",
+			token:   signTestToken(t, "RS256", "ec", ecKey, claims(nil)),
+			wantErr: "invalid RS256 signature",
+		},
+		{
+			name:    "tampered claims",
+			token:   tampered,
+			wantErr: "verification error",
+		},
+		{
+			name:    "missing signature",
+			token:   unsigned,
+			wantErr: "verification error",
+		},
+		{
+			name:    "unknown key",
+			token:   signTestToken(t, "RS256", "other", rsaKey, claims(nil)),
+			wantErr: "error reading issuer keys",
+		},
+		{
+			name:    "malformed",
+			token:   "not-a-token",
+			wantErr: "malformed ID token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := provider.verifyIDToken(context.Background(), tt.token, testNonce)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("verifyIDToken() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verifyIDToken() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
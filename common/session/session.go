@@ -0,0 +1,117 @@
+// Package session records the exchanges of the simulators for regression
+// testing. Sessions are stored as JSON Lines, one Record per line, so the vDMS
+// and the virtual device can append to their own files and the results can be
+// concatenated before replaying.
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type RecordKind string
+
+const (
+	RecordKindEnroll      RecordKind = "VDMS_ENROLL"
+	RecordKindEST         RecordKind = "EST"
+	RecordKindDMSManager  RecordKind = "DMS_MANAGER"
+	RecordKindMQTTPublish RecordKind = "MQTT_PUBLISH"
+)
+
+// Record is a single exchange captured while recording a session.
+type Record struct {
+	Kind       RecordKind      `json:"kind"`
+	Operation  string          `json:"operation"`
+	Timestamp  time.Time       `json:"timestamp"`
+	DurationMs int64           `json:"duration_ms"`
+	Request    json.RawMessage `json:"request,omitempty"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Response   json.RawMessage `json:"response,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+type Recorder struct {
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+// Record appends a record to the session file. It is safe to call on a nil
+// recorder, in which case recording is disabled and nothing is written.
+func (r *Recorder) Record(record Record) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.encoder.Encode(record)
+	if err != nil {
+		log.Println("error writing session record:", err)
+	}
+}
+
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.file.Close()
+}
+
+// Read returns the records of a session file sorted by their timestamp, which
+// interleaves the records of concatenated files.
+func Read(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []Record{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("error parsing record at line %d: %v", line, err)
+		}
+		records = append(records, record)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Timestamp.Before(records[j].Timestamp) })
+	return records, nil
+}
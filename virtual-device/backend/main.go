@@ -1,54 +1,236 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lamassuiot/lamassu-simulation-tools/common/auth"
+	"github.com/lamassuiot/lamassu-simulation-tools/common/session"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/config"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/keyprovider"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/keystore"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/loadtest"
 	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
 	"github.com/lamassuiot/lamassu-vdevice/pkg/mqtt"
 	"github.com/lamassuiot/lamassu-vdevice/pkg/service"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/telemetry"
 	"github.com/lamassuiot/lamassu-vdevice/pkg/transport"
+	"golang.org/x/exp/slices"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		if len(os.Args) != 3 {
+			fmt.Println("usage: hash-password <password>")
+			os.Exit(1)
+		}
+		fmt.Println(auth.HashPassword(os.Args[2]))
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		os.Exit(loadtest.RunCommand(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "factory-reset" {
+		os.Exit(factoryResetCommand(os.Args[2:]))
+	}
+
+	profilePath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML configuration profile")
+	flag.Parse()
+
+	cfg, err := config.Load(*profilePath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	keyProviders, err := openKeyProviders(cfg)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer keyProviders.Close()
+
+	var identities *keystore.Keystore
+	if cfg.Keystore.Path != "" {
+		identities, err = keystore.Open(keystore.Config{
+			Path:         cfg.Keystore.Path,
+			Passphrase:   cfg.Keystore.Passphrase,
+			KeyFile:      cfg.Keystore.KeyFile,
+			KeyProviders: keyProviders,
+		})
+		if err != nil {
+			fmt.Println("error opening the keystore:", err)
+			os.Exit(1)
+		}
+	}
+
+	authenticator, err := auth.NewAuthenticator(auth.Config{
+		Mode:           cfg.Auth.Mode,
+		AllowAnonymous: cfg.Auth.AllowAnonymous,
+		UsersFile:      cfg.Auth.UsersFile,
+		SessionTTL:     cfg.Auth.SessionTTL,
+		AllowedOrigins: cfg.AllowedOrigins,
+		OIDC: auth.OIDCConfig{
+			Issuer:             cfg.OIDC.Issuer,
+			ClientID:           cfg.OIDC.ClientID,
+			ClientSecret:       cfg.OIDC.ClientSecret,
+			RedirectURL:        cfg.OIDC.RedirectURL,
+			RolesClaim:         cfg.OIDC.RolesClaim,
+			RoleMapping:        cfg.OIDC.RoleMapping,
+			InsecureSkipVerify: cfg.OIDC.InsecureSkipVerify,
+		},
+		Title:        "Virtual Device",
+		CookiePrefix: "vdevice",
+	})
+	if err != nil {
+		fmt.Println("error configuring authentication:", err)
+		os.Exit(1)
+	}
+	if authenticator.Mode() == auth.AuthModeNone {
+		log.Println("console authentication disabled, every console user acts as an admin")
+	}
+
 	logsChannel := make(chan mqtt.MQTTLog)
 
-	awsMqttClient := mqtt.NewAWSIoTCoreMQTTClient(
-		"a3hczhtwc7h4es.iot.eu-west-1.amazonaws.com",
-		"/home/ikerlan/lamassu/v2.lamassu-virtual-demos/virtual-device/backend/aws-iotcore-ca.crt",
-		logsChannel,
-	)
+	var recorder *session.Recorder
+	if cfg.RecordSessionFile != "" {
+		recorder, err = session.NewRecorder(cfg.RecordSessionFile)
+		if err != nil {
+			fmt.Println("error opening session recording file:", err)
+			os.Exit(1)
+		}
+	}
 
-	azureMqttClient := mqtt.NewAzureIotHubMQTTClient(
-		"lamassu-hub.azure-devices.net",
-		"/home/ikerlan/lamassu/v2.lamassu-virtual-demos/virtual-device/backend/azure-iothub-ca.crt",
-		"global.azure-devices-provisioning.net",
-		"0ne005927A2",
-		logsChannel,
-	)
+	// Every slot connection gets its own MQTT client.
+	newMqttClient := func(cloudProvider model.CloudProviderType) (mqtt.MqttDeviceService, error) {
+		var client mqtt.MqttDeviceService
+		switch cloudProvider {
+		case model.CloudProviderTypeAWS:
+			if cfg.AWS.IotEndpoint == "" {
+				return nil, errors.New("no AWS IoT Core endpoint configured")
+			}
+			client = mqtt.NewAWSIoTCoreMQTTClient(
+				cfg.AWS.IotEndpoint,
+				cfg.AWS.IotCA,
+				cfg.AWS.TelemetryTopic,
+				logsChannel,
+			)
+		case model.CouldProviderTypeAzure:
+			if cfg.Azure.IotHubEndpoint == "" {
+				return nil, errors.New("no Azure IoT Hub endpoint configured")
+			}
+			client = mqtt.NewAzureIotHubMQTTClient(
+				cfg.Azure.IotHubEndpoint,
+				cfg.Azure.IotHubCA,
+				cfg.Azure.DPSEndpoint,
+				cfg.Azure.ScopeID,
+				logsChannel,
+			)
+		case model.CloudProviderTypeGeneric:
+			if cfg.MQTT.Host == "" {
+				return nil, errors.New("no MQTT broker configured")
+			}
+			client = mqtt.NewGenericBrokerMQTTClient(mqtt.GenericBrokerConfig{
+				Host:               cfg.MQTT.Host,
+				Port:               cfg.MQTT.Port,
+				TLS:                cfg.MQTT.TLS,
+				CA:                 cfg.MQTT.CA,
+				InsecureSkipVerify: cfg.MQTT.InsecureSkipVerify,
+				ClientCertificate:  cfg.MQTT.ClientCertificate,
+				ClientID:           cfg.MQTT.ClientID,
+				Username:           cfg.MQTT.Username,
+				Password:           cfg.MQTT.Password,
+				QoS:                byte(cfg.MQTT.QoS),
+				Retain:             cfg.MQTT.Retain,
+				KeepAlive:          cfg.MQTT.KeepAlive,
+				WillTopic:          cfg.MQTT.Will.Topic,
+				WillPayload:        cfg.MQTT.Will.Payload,
+				WillQoS:            byte(cfg.MQTT.Will.QoS),
+				WillRetain:         cfg.MQTT.Will.Retain,
+				Topics: map[mqtt.TopicKind]string{
+					mqtt.TopicTelemetry: cfg.MQTT.Topics.Telemetry,
+					mqtt.TopicCommands:  cfg.MQTT.Topics.Commands,
+				},
+			}, logsChannel)
+		default:
+			return nil, fmt.Errorf("unknown cloud provider %q", cloudProvider)
+		}
 
-	mqttInstances := map[model.CloudProviderType]mqtt.MqttDeviceService{}
-	mqttInstances[model.CloudProviderTypeAWS] = awsMqttClient
-	mqttInstances[model.CouldProviderTypeAzure] = azureMqttClient
+		if recorder != nil {
+			client = mqtt.NewRecordingMqttDeviceService(client, string(cloudProvider), recorder)
+		}
+		return client, nil
+	}
 
-	deviceState, chanDeviceUpdate := service.New("http://dev-lamassu.zpd.ikerlan.es:7002", "https://dev-lamassu.zpd.ikerlan.es", mqttInstances)
+	fleetDevices := service.FleetFromTemplate(cfg.Fleet.Size)
+	if cfg.Fleet.File != "" {
+		fleetDevices, err = service.LoadFleetCSV(cfg.Fleet.File)
+		if err != nil {
+			fmt.Printf("error reading fleet file %s: %v\n", cfg.Fleet.File, err)
+			os.Exit(1)
+		}
+	}
 
-	wsHandler := transport.NewWebsocketHandler(deviceState, chanDeviceUpdate)
+	deviceDefaults := service.DeviceDefaults{
+		Model:                   cfg.Device.Model,
+		Slots:                   cfg.Device.Slots,
+		TelemetryRateSeconds:    cfg.Telemetry.RateSeconds,
+		TelemetryProperties:     cfg.Telemetry.Properties,
+		SlotKeyAlgorithms:       map[string]model.KeyAlgorithm{},
+		KeyProvider:             cfg.Device.KeyProvider,
+		SlotKeyProviders:        cfg.Device.SlotKeyProviders,
+		SlotCloudProviders:      map[string]model.CloudProviderType{},
+		QueuedEnrollmentTimeout: cfg.Device.QueuedEnrollmentTimeout,
+		Renewal: service.RenewalPolicy{
+			AutoReenroll:    cfg.Renewal.AutoReenroll,
+			RetryBackoff:    cfg.Renewal.RetryBackoff,
+			MaxRetryBackoff: cfg.Renewal.MaxRetryBackoff,
+			CheckInterval:   cfg.Renewal.CheckInterval,
+		},
+	}
+	// Validated along the configuration.
+	deviceDefaults.TelemetryEncoding, _ = telemetry.ParseEncoding(cfg.Telemetry.Encoding)
+	deviceDefaults.KeyAlgorithm, _ = model.ParseKeyAlgorithm(cfg.Device.KeyAlgorithm)
+	for slot, algorithm := range cfg.Device.SlotKeyAlgorithms {
+		deviceDefaults.SlotKeyAlgorithms[slot], _ = model.ParseKeyAlgorithm(algorithm)
+	}
+	for slot, provider := range cfg.Device.SlotCloudProviders {
+		deviceDefaults.SlotCloudProviders[slot], _ = model.ParseCloudProviderType(provider)
+	}
+	deviceDefaults.Renewal.LifetimeFraction, deviceDefaults.Renewal.BeforeExpiry, _ = cfg.Renewal.ParseThreshold()
+	fleet, err := service.NewFleet(cfg.VDMSAddress, cfg.LamassuGateway, deviceDefaults, fleetDevices, cfg.Fleet.EnrollmentConcurrency, identities, keyProviders, newMqttClient)
+	if err != nil {
+		fmt.Println("error creating the fleet:", err)
+		os.Exit(1)
+	}
+	if cfg.Connections.AutoConnect {
+		fmt.Printf("connecting %d slots to their cloud provider\n", fleet.AutoConnect())
+	}
+
+	wsHandler := transport.NewWebsocketHandler(fleet, authenticator, cfg.Redacted())
 
 	spa := spaHandler{staticPath: "build", indexPath: "index.html"}
 	router := mux.NewRouter()
 
+	authenticator.RegisterRoutes(router)
+	transport.NewFleetAPI(fleet).RegisterRoutes(router.PathPrefix("/api/v1").Subrouter(), authenticator)
 	router.PathPrefix("/ws").HandlerFunc(wsHandler.MainRoute)
-	router.PathPrefix("/").Handler(spa)
+	router.PathPrefix("/").Handler(authenticator.RequireConsole(spa))
 
 	srv := &http.Server{
 		Handler: router,
-		Addr:    ":7001",
+		Addr:    cfg.ListenAddress,
 	}
 
 	go func() {
@@ -62,7 +244,62 @@ func main() {
 		}
 	}()
 
-	log.Fatal(srv.ListenAndServe())
+	serveErrors := make(chan error, 1)
+	go func() {
+		serveErrors <- srv.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case sig := <-signals:
+		log.Printf("received %s, shutting down\n", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = srv.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			log.Println("error shutting down the HTTP server:", err)
+		}
+	case err = <-serveErrors:
+		log.Println("HTTP server stopped:", err)
+	}
+
+	// The session file is flushed here rather than deferred so the last
+	// records survive every exit path of the server.
+	recorder.Close()
+}
+
+// openKeyProviders opens the hardware key providers the slots use, the
+// software one is always there.
+func openKeyProviders(cfg config.Config) (keyprovider.Registry, error) {
+	providers := []keyprovider.Provider{}
+	for _, name := range cfg.KeyProviders() {
+		var provider keyprovider.Provider
+		var err error
+		switch name {
+		case keyprovider.PKCS11:
+			provider, err = keyprovider.NewPKCS11(keyprovider.PKCS11Config{
+				Module:     cfg.PKCS11.Module,
+				TokenLabel: cfg.PKCS11.TokenLabel,
+				PIN:        cfg.PKCS11.PIN,
+			})
+		case keyprovider.TPM:
+			provider, err = keyprovider.NewTPM(keyprovider.TPMConfig{
+				Address:         cfg.TPM.Address,
+				PlatformAddress: cfg.TPM.PlatformAddress,
+				Device:          cfg.TPM.Device,
+			})
+		default:
+			continue
+		}
+		if err != nil {
+			keyprovider.NewRegistry(providers...).Close()
+			return nil, fmt.Errorf("error opening the %s key provider: %v", name, err)
+		}
+		fmt.Printf("%s key provider ready\n", name)
+		providers = append(providers, provider)
+	}
+	return keyprovider.NewRegistry(providers...), nil
 }
 
 type spaHandler struct {
@@ -100,3 +337,32 @@ func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.FileServer(http.Dir(h.staticPath)).ServeHTTP(w, r)
 
 }
+
+// factoryResetCommand removes the persisted identities, the devices get a new
+// serial number and keys on the next start.
+func factoryResetCommand(args []string) int {
+	flags := flag.NewFlagSet("factory-reset", flag.ExitOnError)
+	profilePath := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML configuration profile")
+	flags.Parse(args)
+
+	cfg, err := config.Load(*profilePath)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if cfg.Keystore.Path == "" {
+		fmt.Println("no keystore configured, there is nothing to reset")
+		return 0
+	}
+
+	err = keystore.Reset(cfg.Keystore.Path)
+	if err != nil {
+		fmt.Println("error resetting the keystore:", err)
+		return 1
+	}
+	fmt.Println("device identities removed from", cfg.Keystore.Path)
+	if slices.Contains(cfg.KeyProviders(), keyprovider.PKCS11) {
+		fmt.Println("keys generated in the PKCS#11 token are not removed, delete them with the token tools")
+	}
+	return 0
+}
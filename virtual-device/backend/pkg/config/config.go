@@ -0,0 +1,573 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/keyprovider"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/mqtt"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/telemetry"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the effective configuration of the virtual device. Values are
+// taken from the defaults, then the YAML profile and finally the environment,
+// so a variable always wins over the profile.
+type Config struct {
+	ListenAddress     string   `yaml:"listen_address" json:"listen_address" split_words:"true"`
+	VDMSAddress       string   `yaml:"vdms_address" json:"vdms_address" envconfig:"VDMS_ADDRESS"`
+	LamassuGateway    string   `yaml:"lamassu_gateway" json:"lamassu_gateway" split_words:"true"`
+	RecordSessionFile string   `yaml:"record_session_file" json:"record_session_file" split_words:"true"`
+	AllowedOrigins    []string `yaml:"allowed_origins" json:"allowed_origins" split_words:"true"`
+
+	AWS         AWSConfig         `yaml:"aws" json:"aws" envconfig:"AWS"`
+	Azure       AzureConfig       `yaml:"azure" json:"azure" envconfig:"AZURE"`
+	MQTT        MQTTConfig        `yaml:"mqtt" json:"mqtt" envconfig:"MQTT"`
+	Device      DeviceConfig      `yaml:"device" json:"device" envconfig:"DEVICE"`
+	Telemetry   TelemetryConfig   `yaml:"telemetry" json:"telemetry" envconfig:"TELEMETRY"`
+	Renewal     RenewalConfig     `yaml:"renewal" json:"renewal" envconfig:"RENEWAL"`
+	Connections ConnectionsConfig `yaml:"connections" json:"connections" envconfig:"CONNECTIONS"`
+	Fleet       FleetConfig       `yaml:"fleet" json:"fleet" envconfig:"FLEET"`
+	Keystore    KeystoreConfig    `yaml:"keystore" json:"keystore" envconfig:"KEYSTORE"`
+	PKCS11      PKCS11Config      `yaml:"pkcs11" json:"pkcs11" envconfig:"PKCS11"`
+	TPM         TPMConfig         `yaml:"tpm" json:"tpm" envconfig:"TPM"`
+	Auth        AuthConfig        `yaml:"auth" json:"auth" envconfig:"AUTH"`
+	OIDC        OIDCConfig        `yaml:"oidc" json:"oidc" envconfig:"OIDC"`
+}
+
+type AWSConfig struct {
+	IotEndpoint string `yaml:"iot_endpoint" json:"iot_endpoint" split_words:"true"`
+	IotCA       string `yaml:"iot_ca" json:"iot_ca" split_words:"true"`
+	// TelemetryTopic is a template like the topics of the mqtt section.
+	TelemetryTopic string `yaml:"telemetry_topic" json:"telemetry_topic" split_words:"true"`
+}
+
+type AzureConfig struct {
+	IotHubEndpoint string `yaml:"iot_hub_endpoint" json:"iot_hub_endpoint" split_words:"true"`
+	IotHubCA       string `yaml:"iot_hub_ca" json:"iot_hub_ca" split_words:"true"`
+	DPSEndpoint    string `yaml:"dps_endpoint" json:"dps_endpoint" split_words:"true"`
+	ScopeID        string `yaml:"scope_id" json:"scope_id" split_words:"true"`
+}
+
+// MQTTConfig is the broker of the GENERIC cloud provider, any MQTT 3.1.1
+// broker. ClientID, Username and the topics are templates expanding
+// {device_id}, the id the slot connects with, and {common_name}, the subject
+// of its certificate.
+type MQTTConfig struct {
+	Host string `yaml:"host" json:"host" split_words:"true"`
+	// Port defaults to 8883 with TLS and to 1883 without.
+	Port int  `yaml:"port" json:"port" split_words:"true"`
+	TLS  bool `yaml:"tls" json:"tls" envconfig:"TLS"`
+	// CA verifies the broker, the system roots are used when empty.
+	CA                 string `yaml:"ca" json:"ca" envconfig:"CA"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify" split_words:"true"`
+	// ClientCertificate authenticates with the slot certificate, alone or
+	// along Username and Password.
+	ClientCertificate bool             `yaml:"client_certificate" json:"client_certificate" split_words:"true"`
+	ClientID          string           `yaml:"client_id" json:"client_id" split_words:"true"`
+	Username          string           `yaml:"username" json:"username" split_words:"true"`
+	Password          string           `yaml:"password" json:"password" split_words:"true"`
+	QoS               int              `yaml:"qos" json:"qos" envconfig:"QOS"`
+	Retain            bool             `yaml:"retain" json:"retain" split_words:"true"`
+	KeepAlive         time.Duration    `yaml:"keep_alive" json:"keep_alive" split_words:"true"`
+	Will              MQTTWillConfig   `yaml:"will" json:"will" envconfig:"WILL"`
+	Topics            MQTTTopicsConfig `yaml:"topics" json:"topics" envconfig:"TOPICS"`
+}
+
+// MQTTWillConfig is the last will, published by the broker when a device goes
+// away without disconnecting. An empty topic leaves it out.
+type MQTTWillConfig struct {
+	Topic   string `yaml:"topic" json:"topic" split_words:"true"`
+	Payload string `yaml:"payload" json:"payload" split_words:"true"`
+	QoS     int    `yaml:"qos" json:"qos" envconfig:"QOS"`
+	Retain  bool   `yaml:"retain" json:"retain" split_words:"true"`
+}
+
+// MQTTTopicsConfig are the topics of the devices on the broker. Messages on
+// the commands topic such as {"require_reenrollment": true} are acted upon.
+type MQTTTopicsConfig struct {
+	Telemetry string `yaml:"telemetry" json:"telemetry" split_words:"true"`
+	Commands  string `yaml:"commands" json:"commands" split_words:"true"`
+}
+
+type DeviceConfig struct {
+	Model string `yaml:"model" json:"model" split_words:"true"`
+	// Slots are created empty on every new device identity.
+	Slots []string `yaml:"slots" json:"slots" split_words:"true"`
+	// KeyAlgorithm is the key algorithm of the slots, e.g. ECDSA_P256.
+	// SlotKeyAlgorithms overrides it by slot id.
+	KeyAlgorithm      string            `yaml:"key_algorithm" json:"key_algorithm" split_words:"true"`
+	SlotKeyAlgorithms map[string]string `yaml:"slot_key_algorithms" json:"slot_key_algorithms" split_words:"true"`
+	// KeyProvider keeps the slot keys: software, pkcs11 or tpm.
+	// SlotKeyProviders overrides it by slot id.
+	KeyProvider      string            `yaml:"key_provider" json:"key_provider" split_words:"true"`
+	SlotKeyProviders map[string]string `yaml:"slot_key_providers" json:"slot_key_providers" split_words:"true"`
+	// SlotCloudProviders binds slots to a cloud provider, AWS, AZURE or
+	// GENERIC, the others are bound on their first connection.
+	SlotCloudProviders map[string]string `yaml:"slot_cloud_providers" json:"slot_cloud_providers" split_words:"true"`
+	// QueuedEnrollmentTimeout bounds how long an enrollment the vDMS queued,
+	// because the Lamassu gateway was down, is polled before it fails.
+	QueuedEnrollmentTimeout time.Duration `yaml:"queued_enrollment_timeout" json:"queued_enrollment_timeout" split_words:"true"`
+}
+
+// TelemetryConfig drives the readings the connected slots publish. Encoding
+// is json, cbor or senml, Properties are sent along every reading.
+type TelemetryConfig struct {
+	RateSeconds int               `yaml:"rate_seconds" json:"rate_seconds" split_words:"true"`
+	Encoding    string            `yaml:"encoding" json:"encoding" split_words:"true"`
+	Properties  map[string]string `yaml:"properties" json:"properties" split_words:"true"`
+}
+
+// RenewalConfig drives the renewal of the slot certificates. Threshold is
+// either the elapsed share of the certificate lifetime, e.g. "80%", or the
+// time left before it expires, e.g. "72h".
+type RenewalConfig struct {
+	Threshold       string        `yaml:"threshold" json:"threshold" split_words:"true"`
+	AutoReenroll    bool          `yaml:"auto_reenroll" json:"auto_reenroll" split_words:"true"`
+	CheckInterval   time.Duration `yaml:"check_interval" json:"check_interval" split_words:"true"`
+	RetryBackoff    time.Duration `yaml:"retry_backoff" json:"retry_backoff" split_words:"true"`
+	MaxRetryBackoff time.Duration `yaml:"max_retry_backoff" json:"max_retry_backoff" split_words:"true"`
+}
+
+// ParseThreshold returns the threshold as a share of the lifetime, or as the
+// time before expiry when it is not a percentage.
+func (r RenewalConfig) ParseThreshold() (float64, time.Duration, error) {
+	threshold := strings.TrimSpace(r.Threshold)
+	if strings.HasSuffix(threshold, "%") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(threshold, "%")), 64)
+		if err != nil || value <= 0 || value >= 100 {
+			return 0, 0, fmt.Errorf("%q is not a percentage between 0 and 100", r.Threshold)
+		}
+		return value / 100, 0, nil
+	}
+
+	beforeExpiry, err := time.ParseDuration(threshold)
+	if err != nil || beforeExpiry <= 0 {
+		return 0, 0, fmt.Errorf("%q is neither a percentage of the lifetime nor a positive duration", r.Threshold)
+	}
+	return 0, beforeExpiry, nil
+}
+
+// ConnectionsConfig drives the cloud connections of the slots. With
+// AutoConnect the enrolled slots bound to a cloud provider connect at startup.
+type ConnectionsConfig struct {
+	AutoConnect bool `yaml:"auto_connect" json:"auto_connect" split_words:"true"`
+}
+
+// FleetConfig simulates many devices in one process. Devices are read from
+// File when set, otherwise Size devices are built from the device section.
+type FleetConfig struct {
+	Size                  int    `yaml:"size" json:"size" split_words:"true"`
+	File                  string `yaml:"file" json:"file" split_words:"true"`
+	EnrollmentConcurrency int    `yaml:"enrollment_concurrency" json:"enrollment_concurrency" split_words:"true"`
+}
+
+// KeystoreConfig persists the device identities in the Path directory. Keys
+// are encrypted with the passphrase or the key file, one of them is required.
+type KeystoreConfig struct {
+	Path       string `yaml:"path" json:"path" split_words:"true"`
+	Passphrase string `yaml:"passphrase" json:"passphrase" split_words:"true"`
+	KeyFile    string `yaml:"key_file" json:"key_file" split_words:"true"`
+}
+
+// PKCS11Config selects the token of the pkcs11 key provider, e.g. a SoftHSM
+// token. The provider needs a build with the pkcs11 tag.
+type PKCS11Config struct {
+	Module     string `yaml:"module" json:"module" split_words:"true"`
+	TokenLabel string `yaml:"token_label" json:"token_label" split_words:"true"`
+	PIN        string `yaml:"pin" json:"pin" envconfig:"PIN"`
+}
+
+// TPMConfig selects the TPM of the tpm key provider: the command port of a
+// simulator, swtpm or ms-tpm-20-ref, or a TPM device such as /dev/tpmrm0.
+type TPMConfig struct {
+	Address         string `yaml:"address" json:"address" split_words:"true"`
+	PlatformAddress string `yaml:"platform_address" json:"platform_address" split_words:"true"`
+	Device          string `yaml:"device" json:"device" split_words:"true"`
+}
+
+type AuthConfig struct {
+	Mode string `yaml:"mode" json:"mode" split_words:"true"`
+	// AllowAnonymous has to be set for the NONE mode, which makes every
+	// console user an admin.
+	AllowAnonymous bool          `yaml:"allow_anonymous" json:"allow_anonymous" split_words:"true"`
+	UsersFile      string        `yaml:"users_file" json:"users_file" split_words:"true"`
+	SessionTTL     time.Duration `yaml:"session_ttl" json:"session_ttl" split_words:"true"`
+}
+
+type OIDCConfig struct {
+	Issuer             string            `yaml:"issuer" json:"issuer" split_words:"true"`
+	ClientID           string            `yaml:"client_id" json:"client_id" split_words:"true"`
+	ClientSecret       string            `yaml:"client_secret" json:"client_secret" split_words:"true"`
+	RedirectURL        string            `yaml:"redirect_url" json:"redirect_url" split_words:"true"`
+	RolesClaim         string            `yaml:"roles_claim" json:"roles_claim" split_words:"true"`
+	RoleMapping        map[string]string `yaml:"role_mapping" json:"role_mapping" split_words:"true"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify" json:"insecure_skip_verify" split_words:"true"`
+}
+
+// ValidationError lists every problem found, so all of them can be fixed in
+// one go.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+func Default() Config {
+	return Config{
+		ListenAddress: ":7001",
+		AWS: AWSConfig{
+			TelemetryTopic: "devices/{device_id}/telemetry",
+		},
+		Azure: AzureConfig{
+			DPSEndpoint: "global.azure-devices-provisioning.net",
+		},
+		MQTT: MQTTConfig{
+			TLS:               true,
+			ClientCertificate: true,
+			ClientID:          "{device_id}",
+			QoS:               1,
+			KeepAlive:         30 * time.Second,
+			Will: MQTTWillConfig{
+				Topic:   "devices/{device_id}/status",
+				Payload: "offline",
+				QoS:     1,
+				Retain:  true,
+			},
+			Topics: MQTTTopicsConfig{
+				Telemetry: "devices/{device_id}/telemetry",
+				Commands:  "devices/{device_id}/commands",
+			},
+		},
+		Device: DeviceConfig{
+			Model:                   "Raspberry Pi 4",
+			Slots:                   []string{"default"},
+			KeyAlgorithm:            string(model.DefaultKeyAlgorithm),
+			KeyProvider:             keyprovider.Software,
+			QueuedEnrollmentTimeout: 30 * time.Minute,
+		},
+		Telemetry: TelemetryConfig{
+			RateSeconds: 5,
+			Encoding:    string(telemetry.EncodingJSON),
+		},
+		Renewal: RenewalConfig{
+			Threshold:       "80%",
+			AutoReenroll:    true,
+			CheckInterval:   10 * time.Second,
+			RetryBackoff:    30 * time.Second,
+			MaxRetryBackoff: 30 * time.Minute,
+		},
+		Connections: ConnectionsConfig{
+			AutoConnect: true,
+		},
+		Fleet: FleetConfig{
+			Size:                  1,
+			EnrollmentConcurrency: 10,
+		},
+		Auth: AuthConfig{
+			SessionTTL: 8 * time.Hour,
+		},
+		OIDC: OIDCConfig{
+			RolesClaim: "realm_access.roles",
+		},
+	}
+}
+
+// Load builds the configuration from the optional YAML profile and the
+// environment, and validates it.
+func Load(profilePath string) (Config, error) {
+	config := Default()
+
+	if profilePath != "" {
+		err := loadProfile(profilePath, &config)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	err := envconfig.Process("", &config)
+	if err != nil {
+		return Config{}, fmt.Errorf("error parsing environment variables: %v", err)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+func loadProfile(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading profile: %v", err)
+	}
+
+	// Unknown keys are rejected, a typo would otherwise be silently ignored.
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(config)
+	if err != nil {
+		return fmt.Errorf("error parsing profile %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c Config) Validate() error {
+	problems := []string{}
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+		problem("listen_address (LISTEN_ADDRESS) %q is not a host:port address: %v", c.ListenAddress, err)
+	}
+
+	validateURL := func(name string, env string, value string) {
+		if value == "" {
+			problem("%s (%s) is required", name, env)
+			return
+		}
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("%s (%s) %q is not an http or https URL", name, env, value)
+		}
+	}
+	validateURL("vdms_address", "VDMS_ADDRESS", c.VDMSAddress)
+	validateURL("lamassu_gateway", "LAMASSU_GATEWAY", c.LamassuGateway)
+
+	// The CA bundles are only needed once an endpoint is configured.
+	validateFile := func(name string, env string, value string) {
+		if value == "" {
+			problem("%s (%s) is required", name, env)
+			return
+		}
+		if _, err := os.Stat(value); err != nil {
+			problem("%s (%s) %q cannot be read: %v", name, env, value, err)
+		}
+	}
+	if c.AWS.IotEndpoint != "" {
+		validateFile("aws.iot_ca", "AWS_IOT_CA", c.AWS.IotCA)
+		if err := mqtt.ValidateTemplate(c.AWS.TelemetryTopic); err != nil {
+			problem("aws.telemetry_topic (AWS_TELEMETRY_TOPIC): %v", err)
+		}
+	}
+	if c.Azure.IotHubEndpoint != "" {
+		validateFile("azure.iot_hub_ca", "AZURE_IOT_HUB_CA", c.Azure.IotHubCA)
+		if c.Azure.ScopeID == "" {
+			problem("azure.scope_id (AZURE_SCOPE_ID) is required with an IoT Hub endpoint")
+		}
+	}
+
+	if c.MQTT.Host != "" {
+		if c.MQTT.Port < 0 || c.MQTT.Port > 65535 {
+			problem("mqtt.port (MQTT_PORT) %d is not a port number", c.MQTT.Port)
+		}
+		if c.MQTT.CA != "" {
+			validateFile("mqtt.ca", "MQTT_CA", c.MQTT.CA)
+		}
+		if c.MQTT.ClientCertificate && !c.MQTT.TLS {
+			problem("mqtt.client_certificate (MQTT_CLIENT_CERTIFICATE) needs mqtt.tls (MQTT_TLS)")
+		}
+		if c.MQTT.Password != "" && c.MQTT.Username == "" {
+			problem("mqtt.password (MQTT_PASSWORD) needs mqtt.username (MQTT_USERNAME)")
+		}
+		if strings.TrimSpace(c.MQTT.ClientID) == "" {
+			problem("mqtt.client_id (MQTT_CLIENT_ID) must not be empty")
+		}
+		if c.MQTT.QoS < 0 || c.MQTT.QoS > 2 {
+			problem("mqtt.qos (MQTT_QOS) must be 0, 1 or 2, got %d", c.MQTT.QoS)
+		}
+		if c.MQTT.Will.QoS < 0 || c.MQTT.Will.QoS > 2 {
+			problem("mqtt.will.qos (MQTT_WILL_QOS) must be 0, 1 or 2, got %d", c.MQTT.Will.QoS)
+		}
+		if c.MQTT.KeepAlive < 0 {
+			problem("mqtt.keep_alive (MQTT_KEEP_ALIVE) must not be negative")
+		}
+		templates := []struct{ name, env, value string }{
+			{"mqtt.client_id", "MQTT_CLIENT_ID", c.MQTT.ClientID},
+			{"mqtt.username", "MQTT_USERNAME", c.MQTT.Username},
+			{"mqtt.will.topic", "MQTT_WILL_TOPIC", c.MQTT.Will.Topic},
+			{"mqtt.topics.telemetry", "MQTT_TOPICS_TELEMETRY", c.MQTT.Topics.Telemetry},
+			{"mqtt.topics.commands", "MQTT_TOPICS_COMMANDS", c.MQTT.Topics.Commands},
+		}
+		for _, template := range templates {
+			if err := mqtt.ValidateTemplate(template.value); err != nil {
+				problem("%s (%s): %v", template.name, template.env, err)
+			}
+		}
+	}
+
+	if strings.TrimSpace(c.Device.Model) == "" {
+		problem("device.model (DEVICE_MODEL) must not be empty")
+	}
+	if len(c.Device.Slots) == 0 {
+		problem("device.slots (DEVICE_SLOTS) must list at least one slot")
+	}
+	seenSlots := map[string]bool{}
+	for _, slot := range c.Device.Slots {
+		if strings.TrimSpace(slot) == "" {
+			problem("device.slots (DEVICE_SLOTS) contains an empty slot id")
+			continue
+		}
+		if seenSlots[slot] {
+			problem("device.slots (DEVICE_SLOTS) lists slot %q twice", slot)
+		}
+		seenSlots[slot] = true
+	}
+	if _, err := model.ParseKeyAlgorithm(c.Device.KeyAlgorithm); err != nil {
+		problem("device.key_algorithm (DEVICE_KEY_ALGORITHM): %v", err)
+	}
+	for slot, algorithm := range c.Device.SlotKeyAlgorithms {
+		if _, err := model.ParseKeyAlgorithm(algorithm); err != nil {
+			problem("device.slot_key_algorithms (DEVICE_SLOT_KEY_ALGORITHMS) of slot %q: %v", slot, err)
+		}
+	}
+	for _, provider := range c.KeyProviders() {
+		if !slices.Contains(keyprovider.Names, provider) {
+			problem("device.key_provider (DEVICE_KEY_PROVIDER) and device.slot_key_providers (DEVICE_SLOT_KEY_PROVIDERS) accept %v, got %q", keyprovider.Names, provider)
+		}
+		if provider == keyprovider.PKCS11 {
+			if c.PKCS11.Module == "" {
+				problem("pkcs11.module (PKCS11_MODULE) is required by the pkcs11 key provider")
+			} else if _, err := os.Stat(c.PKCS11.Module); err != nil {
+				problem("pkcs11.module (PKCS11_MODULE) %q cannot be read: %v", c.PKCS11.Module, err)
+			}
+			if c.PKCS11.TokenLabel == "" {
+				problem("pkcs11.token_label (PKCS11_TOKEN_LABEL) is required by the pkcs11 key provider")
+			}
+		}
+		if provider == keyprovider.TPM {
+			if (c.TPM.Address == "") == (c.TPM.Device == "") {
+				problem("either tpm.address (TPM_ADDRESS) or tpm.device (TPM_DEVICE) is required by the tpm key provider")
+			}
+			if c.TPM.PlatformAddress != "" && c.TPM.Address == "" {
+				problem("tpm.platform_address (TPM_PLATFORM_ADDRESS) needs tpm.address (TPM_ADDRESS)")
+			}
+		}
+	}
+
+	if c.Device.QueuedEnrollmentTimeout <= 0 {
+		problem("device.queued_enrollment_timeout (DEVICE_QUEUED_ENROLLMENT_TIMEOUT) must be positive")
+	}
+
+	for slot, name := range c.Device.SlotCloudProviders {
+		provider, err := model.ParseCloudProviderType(name)
+		if err != nil {
+			problem("device.slot_cloud_providers (DEVICE_SLOT_CLOUD_PROVIDERS) of slot %q: %v", slot, err)
+			continue
+		}
+		if provider == model.CloudProviderTypeAWS && c.AWS.IotEndpoint == "" {
+			problem("aws.iot_endpoint (AWS_IOT_ENDPOINT) is required by slot %q bound to AWS", slot)
+		}
+		if provider == model.CouldProviderTypeAzure && c.Azure.IotHubEndpoint == "" {
+			problem("azure.iot_hub_endpoint (AZURE_IOT_HUB_ENDPOINT) is required by slot %q bound to AZURE", slot)
+		}
+		if provider == model.CloudProviderTypeGeneric && c.MQTT.Host == "" {
+			problem("mqtt.host (MQTT_HOST) is required by slot %q bound to GENERIC", slot)
+		}
+	}
+
+	// The telemetry job runs on a seconds cron field.
+	if c.Telemetry.RateSeconds < 1 || c.Telemetry.RateSeconds > 59 {
+		problem("telemetry.rate_seconds (TELEMETRY_RATE_SECONDS) must be between 1 and 59, got %d", c.Telemetry.RateSeconds)
+	}
+	if _, err := telemetry.ParseEncoding(c.Telemetry.Encoding); err != nil {
+		problem("telemetry.encoding (TELEMETRY_ENCODING): %v", err)
+	}
+
+	if _, _, err := c.Renewal.ParseThreshold(); err != nil {
+		problem("renewal.threshold (RENEWAL_THRESHOLD): %v", err)
+	}
+	if c.Renewal.CheckInterval < time.Second {
+		problem("renewal.check_interval (RENEWAL_CHECK_INTERVAL) must be at least 1s, got %s", c.Renewal.CheckInterval)
+	}
+	if c.Renewal.RetryBackoff <= 0 {
+		problem("renewal.retry_backoff (RENEWAL_RETRY_BACKOFF) must be positive")
+	}
+	if c.Renewal.MaxRetryBackoff < c.Renewal.RetryBackoff {
+		problem("renewal.max_retry_backoff (RENEWAL_MAX_RETRY_BACKOFF) must not be shorter than renewal.retry_backoff (RENEWAL_RETRY_BACKOFF)")
+	}
+
+	if c.Fleet.File != "" {
+		if _, err := os.Stat(c.Fleet.File); err != nil {
+			problem("fleet.file (FLEET_FILE) %q cannot be read: %v", c.Fleet.File, err)
+		}
+	} else if c.Fleet.Size < 1 {
+		problem("fleet.size (FLEET_SIZE) must be at least 1, got %d", c.Fleet.Size)
+	}
+	if c.Fleet.EnrollmentConcurrency < 1 {
+		problem("fleet.enrollment_concurrency (FLEET_ENROLLMENT_CONCURRENCY) must be at least 1, got %d", c.Fleet.EnrollmentConcurrency)
+	}
+
+	if c.Keystore.Path != "" {
+		if c.Keystore.Passphrase == "" && c.Keystore.KeyFile == "" {
+			problem("keystore.passphrase (KEYSTORE_PASSPHRASE) or keystore.key_file (KEYSTORE_KEY_FILE) is required with a keystore path")
+		}
+		if c.Keystore.Passphrase != "" && c.Keystore.KeyFile != "" {
+			problem("keystore.passphrase (KEYSTORE_PASSPHRASE) and keystore.key_file (KEYSTORE_KEY_FILE) cannot be used together")
+		}
+		if c.Keystore.KeyFile != "" {
+			if _, err := os.Stat(c.Keystore.KeyFile); err != nil {
+				problem("keystore.key_file (KEYSTORE_KEY_FILE) %q cannot be read: %v", c.Keystore.KeyFile, err)
+			}
+		}
+	}
+
+	if c.Auth.SessionTTL <= 0 {
+		problem("auth.session_ttl (AUTH_SESSION_TTL) must be positive")
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// KeyProviders lists the key providers used by the slots, sorted.
+func (c Config) KeyProviders() []string {
+	providers := []string{}
+	add := func(provider string) {
+		if provider == "" {
+			provider = keyprovider.Software
+		}
+		if !slices.Contains(providers, provider) {
+			providers = append(providers, provider)
+		}
+	}
+	add(c.Device.KeyProvider)
+	for _, provider := range c.Device.SlotKeyProviders {
+		add(provider)
+	}
+	sort.Strings(providers)
+	return providers
+}
+
+// Redacted returns a copy without secrets, safe to show in the console.
+func (c Config) Redacted() Config {
+	if c.OIDC.ClientSecret != "" {
+		c.OIDC.ClientSecret = "********"
+	}
+	if c.Keystore.Passphrase != "" {
+		c.Keystore.Passphrase = "********"
+	}
+	if c.PKCS11.PIN != "" {
+		c.PKCS11.PIN = "********"
+	}
+	if c.MQTT.Password != "" {
+		c.MQTT.Password = "********"
+	}
+	return c
+}
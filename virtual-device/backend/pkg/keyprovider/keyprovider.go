@@ -0,0 +1,92 @@
+// Package keyprovider generates the slot keys and keeps them where a real
+// device would: in memory, in a PKCS#11 token or in a TPM 2.0. Keys of the
+// hardware providers never leave the token, they are used through
+// crypto.Signer for the certificate requests and the TLS handshakes.
+package keyprovider
+
+import (
+	"crypto"
+	"fmt"
+	"sort"
+
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+)
+
+const (
+	Software = "software"
+	PKCS11   = "pkcs11"
+	TPM      = "tpm"
+)
+
+// Names lists the providers the configuration may refer to.
+var Names = []string{Software, PKCS11, TPM}
+
+type Provider interface {
+	Name() string
+	// GenerateKey creates a key inside the provider. The label names the
+	// key for the operators, e.g. in the object list of a token.
+	GenerateKey(label string, algorithm model.KeyAlgorithm) (crypto.Signer, error)
+	// KeyReference is what LoadKey needs to find the key after a restart.
+	// It holds the key itself for software keys, so it is kept sealed.
+	KeyReference(key crypto.Signer) ([]byte, error)
+	LoadKey(reference []byte) (crypto.Signer, error)
+	// DeleteKey removes a key that has been replaced.
+	DeleteKey(key crypto.Signer) error
+	Close() error
+}
+
+// PKCS11Config selects the token the keys are generated in, e.g. a SoftHSM
+// token for testing.
+type PKCS11Config struct {
+	Module     string
+	TokenLabel string
+	PIN        string
+}
+
+// TPMConfig selects the TPM. Address is the command port of a simulator,
+// swtpm or ms-tpm-20-ref; PlatformAddress its platform port, only needed when
+// the simulator has to be powered on. Device is the path of a TPM device.
+type TPMConfig struct {
+	Address         string
+	PlatformAddress string
+	Device          string
+}
+
+// Registry holds the providers by name. The software provider is always
+// available, a nil Registry only has that one.
+type Registry map[string]Provider
+
+func NewRegistry(providers ...Provider) Registry {
+	registry := Registry{Software: NewSoftware()}
+	for _, provider := range providers {
+		registry[provider.Name()] = provider
+	}
+	return registry
+}
+
+// Get returns the provider, the software one when the name is empty.
+func (r Registry) Get(name string) (Provider, error) {
+	if name == "" || (name == Software && r[Software] == nil) {
+		return NewSoftware(), nil
+	}
+	provider, ok := r[name]
+	if !ok {
+		return nil, fmt.Errorf("key provider %s is not configured", name)
+	}
+	return provider, nil
+}
+
+func (r Registry) Close() {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := r[name].Close()
+		if err != nil {
+			fmt.Printf("error closing key provider %s: %v\n", name, err)
+		}
+	}
+}
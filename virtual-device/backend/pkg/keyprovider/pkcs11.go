@@ -0,0 +1,395 @@
+//go:build pkcs11
+
+package keyprovider
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+	"github.com/miekg/pkcs11"
+)
+
+// EdDSA mechanisms of PKCS#11 3.0, newer than the constants of the binding.
+const (
+	ckmECEdwardsKeyPairGen = 0x00001055
+	ckmEdDSA               = 0x00001057
+)
+
+var (
+	oidP256    = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidP384    = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// digestInfoPrefixes are the DER headers CKM_RSA_PKCS expects before the
+// digest, the token does not hash for us.
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pkcs11Provider uses a single logged in session, sessions are not safe for
+// concurrent use so the calls are serialized.
+type pkcs11Provider struct {
+	lock    sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+}
+
+type pkcs11KeyReference struct {
+	ID        []byte             `json:"id"`
+	Label     string             `json:"label"`
+	Algorithm model.KeyAlgorithm `json:"algorithm"`
+}
+
+type pkcs11Key struct {
+	provider  *pkcs11Provider
+	id        []byte
+	label     string
+	algorithm model.KeyAlgorithm
+	publicKey crypto.PublicKey
+}
+
+func NewPKCS11(config PKCS11Config) (Provider, error) {
+	ctx := pkcs11.New(config.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("error loading PKCS#11 module %s", config.Module)
+	}
+	err := ctx.Initialize()
+	if err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("error initializing PKCS#11 module: %v", err)
+	}
+
+	provider := &pkcs11Provider{ctx: ctx}
+	err = provider.openSession(config)
+	if err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	return provider, nil
+}
+
+func (p *pkcs11Provider) openSession(config PKCS11Config) error {
+	slots, err := p.ctx.GetSlotList(true)
+	if err != nil {
+		return fmt.Errorf("error listing PKCS#11 slots: %v", err)
+	}
+
+	for _, slot := range slots {
+		info, err := p.ctx.GetTokenInfo(slot)
+		if err != nil || info.Label != config.TokenLabel {
+			continue
+		}
+
+		p.session, err = p.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			return fmt.Errorf("error opening PKCS#11 session: %v", err)
+		}
+		err = p.ctx.Login(p.session, pkcs11.CKU_USER, config.PIN)
+		if err != nil {
+			p.ctx.CloseSession(p.session)
+			return fmt.Errorf("error logging in to PKCS#11 token %s: %v", config.TokenLabel, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("PKCS#11 token %s not found", config.TokenLabel)
+}
+
+func (p *pkcs11Provider) Name() string {
+	return PKCS11
+}
+
+func (p *pkcs11Provider) GenerateKey(label string, algorithm model.KeyAlgorithm) (crypto.Signer, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	publicTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	privateTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+
+	var mechanism uint
+	switch algorithm {
+	case model.KeyAlgorithmRSA2048, model.KeyAlgorithmRSA3072, model.KeyAlgorithmRSA4096:
+		bits := map[model.KeyAlgorithm]int{
+			model.KeyAlgorithmRSA2048: 2048,
+			model.KeyAlgorithmRSA3072: 3072,
+			model.KeyAlgorithmRSA4096: 4096,
+		}[algorithm]
+		mechanism = pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN
+		publicTemplate = append(publicTemplate,
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, bits),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+		)
+	case model.KeyAlgorithmECDSAP256, model.KeyAlgorithmECDSAP384, model.KeyAlgorithmEd25519:
+		oid := map[model.KeyAlgorithm]asn1.ObjectIdentifier{
+			model.KeyAlgorithmECDSAP256: oidP256,
+			model.KeyAlgorithmECDSAP384: oidP384,
+			model.KeyAlgorithmEd25519:   oidEd25519,
+		}[algorithm]
+		params, err := asn1.Marshal(oid)
+		if err != nil {
+			return nil, err
+		}
+		mechanism = pkcs11.CKM_EC_KEY_PAIR_GEN
+		if algorithm == model.KeyAlgorithmEd25519 {
+			mechanism = ckmECEdwardsKeyPairGen
+		}
+		publicTemplate = append(publicTemplate, pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params))
+	default:
+		return nil, fmt.Errorf("unknown key algorithm %q", algorithm)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	public, _, err := p.ctx.GenerateKeyPair(p.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, publicTemplate, privateTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("error generating %s key in the PKCS#11 token: %v", algorithm, err)
+	}
+	publicKey, err := p.readPublicKey(public, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11Key{provider: p, id: id, label: label, algorithm: algorithm, publicKey: publicKey}, nil
+}
+
+func (p *pkcs11Provider) readPublicKey(object pkcs11.ObjectHandle, algorithm model.KeyAlgorithm) (crypto.PublicKey, error) {
+	switch algorithm {
+	case model.KeyAlgorithmRSA2048, model.KeyAlgorithmRSA3072, model.KeyAlgorithmRSA4096:
+		attributes, err := p.ctx.GetAttributeValue(p.session, object, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading PKCS#11 public key: %v", err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attributes[0].Value),
+			E: int(new(big.Int).SetBytes(attributes[1].Value).Int64()),
+		}, nil
+	}
+
+	attributes, err := p.ctx.GetAttributeValue(p.session, object, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading PKCS#11 public key: %v", err)
+	}
+	// The point is wrapped in a DER octet string.
+	var point []byte
+	_, err = asn1.Unmarshal(attributes[0].Value, &point)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PKCS#11 EC point: %v", err)
+	}
+
+	switch algorithm {
+	case model.KeyAlgorithmEd25519:
+		if len(point) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid PKCS#11 Ed25519 public key")
+		}
+		return ed25519.PublicKey(point), nil
+	case model.KeyAlgorithmECDSAP256, model.KeyAlgorithmECDSAP384:
+		curve := elliptic.P256()
+		if algorithm == model.KeyAlgorithmECDSAP384 {
+			curve = elliptic.P384()
+		}
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, errors.New("invalid PKCS#11 EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unknown key algorithm %q", algorithm)
+}
+
+// findObject looks the key up by the CKA_ID generated along it.
+func (p *pkcs11Provider) findObject(class uint, id []byte) (pkcs11.ObjectHandle, error) {
+	err := p.ctx.FindObjectsInit(p.session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	})
+	if err != nil {
+		return 0, err
+	}
+	objects, _, err := p.ctx.FindObjects(p.session, 1)
+	finalErr := p.ctx.FindObjectsFinal(p.session)
+	if err != nil {
+		return 0, err
+	}
+	if finalErr != nil {
+		return 0, finalErr
+	}
+	if len(objects) == 0 {
+		return 0, errors.New("PKCS#11 key not found")
+	}
+	return objects[0], nil
+}
+
+func (p *pkcs11Provider) KeyReference(key crypto.Signer) ([]byte, error) {
+	k, ok := key.(*pkcs11Key)
+	if !ok {
+		return nil, errors.New("not a PKCS#11 key")
+	}
+	return json.Marshal(pkcs11KeyReference{ID: k.id, Label: k.label, Algorithm: k.algorithm})
+}
+
+func (p *pkcs11Provider) LoadKey(reference []byte) (crypto.Signer, error) {
+	var ref pkcs11KeyReference
+	err := json.Unmarshal(reference, &ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PKCS#11 key reference: %v", err)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	public, err := p.findObject(pkcs11.CKO_PUBLIC_KEY, ref.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error finding PKCS#11 key %s: %v", ref.Label, err)
+	}
+	publicKey, err := p.readPublicKey(public, ref.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11Key{provider: p, id: ref.ID, label: ref.Label, algorithm: ref.Algorithm, publicKey: publicKey}, nil
+}
+
+func (p *pkcs11Provider) DeleteKey(key crypto.Signer) error {
+	k, ok := key.(*pkcs11Key)
+	if !ok {
+		return errors.New("not a PKCS#11 key")
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY} {
+		object, err := p.findObject(class, k.id)
+		if err != nil {
+			continue
+		}
+		err = p.ctx.DestroyObject(p.session, object)
+		if err != nil {
+			return fmt.Errorf("error deleting PKCS#11 key %s: %v", k.label, err)
+		}
+	}
+	return nil
+}
+
+func (p *pkcs11Provider) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.ctx.Logout(p.session)
+	p.ctx.CloseSession(p.session)
+	err := p.ctx.Finalize()
+	p.ctx.Destroy()
+	return err
+}
+
+func (k *pkcs11Key) Public() crypto.PublicKey {
+	return k.publicKey
+}
+
+func (k *pkcs11Key) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism *pkcs11.Mechanism
+	data := digest
+
+	switch k.publicKey.(type) {
+	case *rsa.PublicKey:
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			params, err := pssParams(pssOpts)
+			if err != nil {
+				return nil, err
+			}
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params)
+		} else {
+			prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+			if !ok {
+				return nil, fmt.Errorf("the PKCS#11 provider does not sign %v digests", opts.HashFunc())
+			}
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+			data = append(append([]byte{}, prefix...), digest...)
+		}
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	case ed25519.PublicKey:
+		// Ed25519 signs the message itself.
+		mechanism = pkcs11.NewMechanism(ckmEdDSA, nil)
+	}
+
+	p := k.provider
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	private, err := p.findObject(pkcs11.CKO_PRIVATE_KEY, k.id)
+	if err != nil {
+		return nil, fmt.Errorf("error finding PKCS#11 key %s: %v", k.label, err)
+	}
+	err = p.ctx.SignInit(p.session, []*pkcs11.Mechanism{mechanism}, private)
+	if err != nil {
+		return nil, fmt.Errorf("error signing with PKCS#11 key %s: %v", k.label, err)
+	}
+	signature, err := p.ctx.Sign(p.session, data)
+	if err != nil {
+		return nil, fmt.Errorf("error signing with PKCS#11 key %s: %v", k.label, err)
+	}
+
+	if _, ok := k.publicKey.(*ecdsa.PublicKey); ok {
+		// CKM_ECDSA returns r and s concatenated, Go expects them in DER.
+		half := len(signature) / 2
+		return asn1.Marshal(struct {
+			R, S *big.Int
+		}{new(big.Int).SetBytes(signature[:half]), new(big.Int).SetBytes(signature[half:])})
+	}
+	return signature, nil
+}
+
+func pssParams(opts *rsa.PSSOptions) ([]byte, error) {
+	mechanisms := map[crypto.Hash][2]uint{
+		crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+		crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+		crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+	}
+	hash := opts.HashFunc()
+	mechanism, ok := mechanisms[hash]
+	if !ok {
+		return nil, fmt.Errorf("the PKCS#11 provider does not sign %v digests with PSS", hash)
+	}
+	saltLength := opts.SaltLength
+	if saltLength == rsa.PSSSaltLengthEqualsHash || saltLength == rsa.PSSSaltLengthAuto {
+		saltLength = hash.Size()
+	}
+	return pkcs11.NewPSSParams(mechanism[0], mechanism[1], uint(saltLength)), nil
+}
@@ -0,0 +1,11 @@
+//go:build !pkcs11
+
+package keyprovider
+
+import "errors"
+
+// NewPKCS11 needs cgo to load the module, the provider is only built with
+// the pkcs11 tag.
+func NewPKCS11(config PKCS11Config) (Provider, error) {
+	return nil, errors.New("PKCS#11 support is not built in, build with -tags pkcs11")
+}
@@ -0,0 +1,49 @@
+package keyprovider
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+)
+
+// softwareProvider keeps the keys in the process memory, they are persisted
+// by the keystore like any other secret.
+type softwareProvider struct{}
+
+func NewSoftware() Provider {
+	return softwareProvider{}
+}
+
+func (softwareProvider) Name() string {
+	return Software
+}
+
+func (softwareProvider) GenerateKey(label string, algorithm model.KeyAlgorithm) (crypto.Signer, error) {
+	return algorithm.GenerateKey()
+}
+
+func (softwareProvider) KeyReference(key crypto.Signer) ([]byte, error) {
+	return x509.MarshalPKCS8PrivateKey(key)
+}
+
+func (softwareProvider) LoadKey(reference []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(reference)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported key type")
+	}
+	return signer, nil
+}
+
+func (softwareProvider) DeleteKey(key crypto.Signer) error {
+	return nil
+}
+
+func (softwareProvider) Close() error {
+	return nil
+}
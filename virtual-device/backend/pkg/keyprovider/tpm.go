@@ -0,0 +1,338 @@
+package keyprovider
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+)
+
+// Commands of the TCP protocol of the TPM simulators.
+const (
+	simulatorSendCommand = 8
+	simulatorPowerOn     = 1
+	simulatorNVOn        = 11
+)
+
+// srkTemplate is the ECC storage root key of the TCG provisioning guidance.
+// It is derived from the owner seed, so the same key is recreated on every
+// start and the key blobs stored by the keystore keep loading.
+var srkTemplate = tpm2.Public{
+	Type:       tpm2.AlgECC,
+	NameAlg:    tpm2.AlgSHA256,
+	Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth | tpm2.FlagRestricted | tpm2.FlagDecrypt | tpm2.FlagNoDA,
+	ECCParameters: &tpm2.ECCParams{
+		Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+		CurveID:   tpm2.CurveNISTP256,
+	},
+}
+
+// tpmProvider creates the keys under the storage root key. The TPM only
+// holds a few objects at once, so each key is loaded for a signature and
+// flushed right after, which lets a whole fleet share one TPM.
+type tpmProvider struct {
+	lock sync.Mutex
+	rw   io.ReadWriteCloser
+	srk  tpmutil.Handle
+}
+
+type tpmKeyReference struct {
+	Public  []byte `json:"public"`
+	Private []byte `json:"private"`
+}
+
+type tpmKey struct {
+	provider  *tpmProvider
+	public    []byte
+	private   []byte
+	publicKey crypto.PublicKey
+}
+
+func NewTPM(config TPMConfig) (Provider, error) {
+	var rw io.ReadWriteCloser
+	var err error
+	switch {
+	case config.Address != "":
+		if config.PlatformAddress != "" {
+			err = powerOnSimulator(config.PlatformAddress)
+			if err != nil {
+				return nil, fmt.Errorf("error powering on the TPM simulator: %v", err)
+			}
+		}
+		rw, err = dialSimulator(config.Address)
+	case config.Device != "":
+		rw, err = tpm2.OpenTPM(config.Device)
+	default:
+		return nil, errors.New("no TPM address or device")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening the TPM: %v", err)
+	}
+
+	err = tpm2.Startup(rw, tpm2.StartupClear)
+	if tpmErr, ok := err.(tpm2.Error); err != nil && !(ok && tpmErr.Code == tpm2.RCInitialize) {
+		rw.Close()
+		return nil, fmt.Errorf("error starting the TPM: %v", err)
+	}
+
+	srk, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", srkTemplate)
+	if err != nil {
+		rw.Close()
+		return nil, fmt.Errorf("error creating the TPM storage root key: %v", err)
+	}
+
+	return &tpmProvider{rw: rw, srk: srk}, nil
+}
+
+func (p *tpmProvider) Name() string {
+	return TPM
+}
+
+// keyTemplate leaves the signature scheme open, RSA keys sign PKCS#1 v1.5
+// for the requests and PSS for TLS 1.3.
+func keyTemplate(algorithm model.KeyAlgorithm) (tpm2.Public, error) {
+	template := tpm2.Public{
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth,
+	}
+	switch algorithm {
+	case model.KeyAlgorithmRSA2048, model.KeyAlgorithmRSA3072, model.KeyAlgorithmRSA4096:
+		bits := map[model.KeyAlgorithm]uint16{
+			model.KeyAlgorithmRSA2048: 2048,
+			model.KeyAlgorithmRSA3072: 3072,
+			model.KeyAlgorithmRSA4096: 4096,
+		}[algorithm]
+		template.Type = tpm2.AlgRSA
+		template.RSAParameters = &tpm2.RSAParams{KeyBits: bits}
+	case model.KeyAlgorithmECDSAP256:
+		template.Type = tpm2.AlgECC
+		template.ECCParameters = &tpm2.ECCParams{CurveID: tpm2.CurveNISTP256}
+	case model.KeyAlgorithmECDSAP384:
+		template.Type = tpm2.AlgECC
+		template.ECCParameters = &tpm2.ECCParams{CurveID: tpm2.CurveNISTP384}
+	default:
+		return tpm2.Public{}, fmt.Errorf("the TPM does not support %s keys", algorithm)
+	}
+	return template, nil
+}
+
+func (p *tpmProvider) GenerateKey(label string, algorithm model.KeyAlgorithm) (crypto.Signer, error) {
+	template, err := keyTemplate(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	private, public, _, _, _, err := tpm2.CreateKey(p.rw, p.srk, tpm2.PCRSelection{}, "", "", template)
+	p.lock.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("error creating TPM key: %v", err)
+	}
+	return p.newKey(public, private)
+}
+
+func (p *tpmProvider) newKey(public, private []byte) (*tpmKey, error) {
+	decoded, err := tpm2.DecodePublic(public)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding TPM public key: %v", err)
+	}
+	publicKey, err := decoded.Key()
+	if err != nil {
+		return nil, fmt.Errorf("error decoding TPM public key: %v", err)
+	}
+	return &tpmKey{provider: p, public: public, private: private, publicKey: publicKey}, nil
+}
+
+// KeyReference returns the key blobs, the private one is wrapped by the
+// storage root key and useless outside of this TPM.
+func (p *tpmProvider) KeyReference(key crypto.Signer) ([]byte, error) {
+	k, ok := key.(*tpmKey)
+	if !ok {
+		return nil, errors.New("not a TPM key")
+	}
+	return json.Marshal(tpmKeyReference{Public: k.public, Private: k.private})
+}
+
+func (p *tpmProvider) LoadKey(reference []byte) (crypto.Signer, error) {
+	var ref tpmKeyReference
+	err := json.Unmarshal(reference, &ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TPM key reference: %v", err)
+	}
+	return p.newKey(ref.Public, ref.Private)
+}
+
+// DeleteKey has nothing to do, the TPM keeps no copy of the key.
+func (p *tpmProvider) DeleteKey(key crypto.Signer) error {
+	return nil
+}
+
+func (p *tpmProvider) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	tpm2.FlushContext(p.rw, p.srk)
+	return p.rw.Close()
+}
+
+func (k *tpmKey) Public() crypto.PublicKey {
+	return k.publicKey
+}
+
+func (k *tpmKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, err := tpmHash(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := &tpm2.SigScheme{Hash: hash}
+	switch k.publicKey.(type) {
+	case *rsa.PublicKey:
+		scheme.Alg = tpm2.AlgRSASSA
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			scheme.Alg = tpm2.AlgRSAPSS
+		}
+	default:
+		scheme.Alg = tpm2.AlgECDSA
+	}
+
+	p := k.provider
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	handle, _, err := tpm2.Load(p.rw, p.srk, "", k.public, k.private)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TPM key: %v", err)
+	}
+	defer tpm2.FlushContext(p.rw, handle)
+
+	signature, err := tpm2.Sign(p.rw, handle, "", digest, nil, scheme)
+	if err != nil {
+		return nil, fmt.Errorf("error signing with TPM key: %v", err)
+	}
+
+	if signature.RSA != nil {
+		return signature.RSA.Signature, nil
+	}
+	if signature.ECC != nil {
+		return asn1.Marshal(struct {
+			R, S *big.Int
+		}{signature.ECC.R, signature.ECC.S})
+	}
+	return nil, errors.New("unexpected TPM signature")
+}
+
+func tpmHash(hash crypto.Hash) (tpm2.Algorithm, error) {
+	switch hash {
+	case crypto.SHA1:
+		return tpm2.AlgSHA1, nil
+	case crypto.SHA256:
+		return tpm2.AlgSHA256, nil
+	case crypto.SHA384:
+		return tpm2.AlgSHA384, nil
+	case crypto.SHA512:
+		return tpm2.AlgSHA512, nil
+	}
+	return 0, fmt.Errorf("the TPM does not sign %v digests", hash)
+}
+
+// simulatorConn frames the TPM commands as the simulators expect them over
+// TCP. go-tpm writes a command and reads its response in one call each.
+type simulatorConn struct {
+	conn     net.Conn
+	response []byte
+}
+
+func dialSimulator(address string) (io.ReadWriteCloser, error) {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &simulatorConn{conn: conn}, nil
+}
+
+func (s *simulatorConn) Write(command []byte) (int, error) {
+	header := make([]byte, 9)
+	binary.BigEndian.PutUint32(header[0:4], simulatorSendCommand)
+	header[4] = 0 // locality
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(command)))
+	_, err := s.conn.Write(append(header, command...))
+	if err != nil {
+		return 0, err
+	}
+
+	var size uint32
+	err = binary.Read(s.conn, binary.BigEndian, &size)
+	if err != nil {
+		return 0, err
+	}
+	s.response = make([]byte, size)
+	_, err = io.ReadFull(s.conn, s.response)
+	if err != nil {
+		return 0, err
+	}
+	err = readAck(s.conn)
+	if err != nil {
+		return 0, err
+	}
+	return len(command), nil
+}
+
+func (s *simulatorConn) Read(buffer []byte) (int, error) {
+	if s.response == nil {
+		return 0, errors.New("no TPM response pending")
+	}
+	n := copy(buffer, s.response)
+	s.response = nil
+	return n, nil
+}
+
+func (s *simulatorConn) Close() error {
+	return s.conn.Close()
+}
+
+// powerOnSimulator sends the power on and NV on signals, a fresh
+// ms-tpm-20-ref simulator answers no command before them.
+func powerOnSimulator(address string) error {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, signal := range []uint32{simulatorPowerOn, simulatorNVOn} {
+		err = binary.Write(conn, binary.BigEndian, signal)
+		if err != nil {
+			return err
+		}
+		err = readAck(conn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readAck(conn net.Conn) error {
+	var ack uint32
+	err := binary.Read(conn, binary.BigEndian, &ack)
+	if err != nil {
+		return err
+	}
+	if ack != 0 {
+		return fmt.Errorf("TPM simulator answered %d", ack)
+	}
+	return nil
+}
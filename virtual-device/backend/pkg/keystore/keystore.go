@@ -0,0 +1,373 @@
+// Package keystore persists the identity of the virtual devices, so a restart
+// keeps their serial number, slots, keys and certificates. Private keys, and
+// the other secrets, are sealed with AES-256-GCM under a key derived from a
+// passphrase or read from a key file; certificates are kept in clear.
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/lamassuiot/lamassu-vdevice/pkg/keyprovider"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	keystoreVersion  = 1
+	metadataFileName = "keystore.json"
+
+	kdfPBKDF2  = "pbkdf2-sha256"
+	kdfKeyFile = "key-file"
+
+	kdfIterations = 210000
+	dataKeySize   = 32
+
+	// checkPlaintext is sealed in the metadata to detect a wrong passphrase
+	// or key file before any device file is read.
+	checkPlaintext = "lamassu-vdevice-keystore"
+)
+
+var ErrWrongKey = errors.New("the keystore cannot be opened with the given passphrase or key file")
+
+type Config struct {
+	// Path is the directory holding one file per device.
+	Path       string
+	Passphrase string
+	KeyFile    string
+	// KeyProviders load the slot keys. Keys kept by a PKCS#11 token or a TPM
+	// are stored as a reference, only software keys are in the files.
+	KeyProviders keyprovider.Registry
+}
+
+type sealedValue struct {
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+type metadata struct {
+	Version    int         `json:"version"`
+	KDF        string      `json:"kdf"`
+	Iterations int         `json:"iterations,omitempty"`
+	Salt       string      `json:"salt,omitempty"`
+	Check      sealedValue `json:"check"`
+}
+
+// Keystore is a directory of device identities sharing one data key.
+type Keystore struct {
+	path         string
+	aead         cipher.AEAD
+	keyProviders keyprovider.Registry
+}
+
+// Open opens the keystore, creating it on first use. The key material is
+// checked right away, a wrong passphrase is reported here.
+func Open(config Config) (*Keystore, error) {
+	if config.Path == "" {
+		return nil, errors.New("no keystore path")
+	}
+	if (config.Passphrase == "") == (config.KeyFile == "") {
+		return nil, errors.New("the keystore needs either a passphrase or a key file")
+	}
+
+	err := os.MkdirAll(config.Path, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating keystore directory: %v", err)
+	}
+
+	metadataPath := filepath.Join(config.Path, metadataFileName)
+	data, err := os.ReadFile(metadataPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return create(config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading keystore: %v", err)
+	}
+
+	var meta metadata
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing keystore metadata: %v", err)
+	}
+	if meta.Version != keystoreVersion {
+		return nil, fmt.Errorf("unsupported keystore version %d", meta.Version)
+	}
+
+	var dataKey []byte
+	switch meta.KDF {
+	case kdfPBKDF2:
+		if config.Passphrase == "" {
+			return nil, errors.New("the keystore was created with a passphrase")
+		}
+		salt, err := base64.StdEncoding.DecodeString(meta.Salt)
+		if err != nil || meta.Iterations < 1 {
+			return nil, errors.New("invalid keystore key derivation parameters")
+		}
+		dataKey = pbkdf2.Key([]byte(config.Passphrase), salt, meta.Iterations, dataKeySize, sha256.New)
+	case kdfKeyFile:
+		if config.KeyFile == "" {
+			return nil, errors.New("the keystore was created with a key file")
+		}
+		dataKey, err = readKeyFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported keystore key derivation %s", meta.KDF)
+	}
+
+	ks, err := newKeystore(config.Path, dataKey, config.KeyProviders)
+	if err != nil {
+		return nil, err
+	}
+	check, err := ks.open(meta.Check, metadataFileName)
+	if err != nil || string(check) != checkPlaintext {
+		return nil, ErrWrongKey
+	}
+	return ks, nil
+}
+
+func create(config Config) (*Keystore, error) {
+	meta := metadata{Version: keystoreVersion}
+
+	var dataKey []byte
+	var err error
+	if config.Passphrase != "" {
+		salt := make([]byte, 16)
+		_, err = rand.Read(salt)
+		if err != nil {
+			return nil, err
+		}
+		meta.KDF = kdfPBKDF2
+		meta.Iterations = kdfIterations
+		meta.Salt = base64.StdEncoding.EncodeToString(salt)
+		dataKey = pbkdf2.Key([]byte(config.Passphrase), salt, kdfIterations, dataKeySize, sha256.New)
+	} else {
+		meta.KDF = kdfKeyFile
+		dataKey, err = readKeyFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ks, err := newKeystore(config.Path, dataKey, config.KeyProviders)
+	if err != nil {
+		return nil, err
+	}
+	meta.Check, err = ks.seal([]byte(checkPlaintext), metadataFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(filepath.Join(config.Path, metadataFileName), data)
+	if err != nil {
+		return nil, fmt.Errorf("error writing keystore metadata: %v", err)
+	}
+	return ks, nil
+}
+
+// readKeyFile reads a 32 byte key, raw or encoded in hex or base64.
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keystore key file: %v", err)
+	}
+	if len(data) == dataKeySize {
+		return data, nil
+	}
+
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == dataKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == dataKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("the keystore key file must hold %d bytes, raw, hex or base64 encoded", dataKeySize)
+}
+
+func newKeystore(path string, dataKey []byte, keyProviders keyprovider.Registry) (*Keystore, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Keystore{path: path, aead: aead, keyProviders: keyProviders}, nil
+}
+
+// seal encrypts a secret. The context is authenticated along with it, so a
+// sealed value cannot be moved to another device or slot.
+func (ks *Keystore) seal(plaintext []byte, context string) (sealedValue, error) {
+	nonce := make([]byte, ks.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return sealedValue{}, err
+	}
+	return sealedValue{
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(ks.aead.Seal(nil, nonce, plaintext, []byte(context))),
+	}, nil
+}
+
+func (ks *Keystore) open(sealed sealedValue, context string) ([]byte, error) {
+	nonce, err := base64.StdEncoding.DecodeString(sealed.Nonce)
+	if err != nil || len(nonce) != ks.aead.NonceSize() {
+		return nil, errors.New("invalid sealed value nonce")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(sealed.Ciphertext)
+	if err != nil {
+		return nil, errors.New("invalid sealed value")
+	}
+	return ks.aead.Open(nil, nonce, ciphertext, []byte(context))
+}
+
+// Device returns the store of a single device. The id must be stable across
+// restarts, the fleet ids are.
+func (ks *Keystore) Device(id string) *DeviceKeystore {
+	return &DeviceKeystore{keystore: ks, id: id}
+}
+
+// Reset removes every identity and the keystore metadata, so the next start
+// creates fresh devices and may use another passphrase. It does not need the
+// key material.
+func Reset(path string) error {
+	entries, err := os.ReadDir(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		err = os.Remove(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeviceKeystore persists the identity of one device. Saves are skipped when
+// the identity did not change, telemetry updates are not worth a write.
+type DeviceKeystore struct {
+	keystore *Keystore
+	id       string
+
+	lock      sync.Mutex
+	lastSaved [sha256.Size]byte
+}
+
+func (d *DeviceKeystore) filePath() string {
+	return filepath.Join(d.keystore.path, d.id+".json")
+}
+
+// Load returns the persisted identity, or nil when there is none.
+func (d *DeviceKeystore) Load() (*model.DeviceState, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	data, err := os.ReadFile(d.filePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading identity of %s: %v", d.id, err)
+	}
+
+	var record deviceRecord
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing identity of %s: %v", d.id, err)
+	}
+	device, err := d.decode(record)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding identity of %s: %v", d.id, err)
+	}
+
+	d.lastSaved = fingerprint(*device)
+	return device, nil
+}
+
+// Save persists the identity of the device.
+func (d *DeviceKeystore) Save(device model.DeviceState) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	current := fingerprint(device)
+	if current == d.lastSaved {
+		return nil
+	}
+
+	record, err := d.encode(device)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(d.filePath(), data)
+	if err != nil {
+		return fmt.Errorf("error writing identity of %s: %v", d.id, err)
+	}
+
+	d.lastSaved = current
+	return nil
+}
+
+// Delete forgets the persisted identity.
+func (d *DeviceKeystore) Delete() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.lastSaved = [sha256.Size]byte{}
+	err := os.Remove(d.filePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// writeFileAtomic replaces the file in one step, a crash leaves either the
+// old or the new identity, never half of it.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,267 @@
+package keystore
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+)
+
+// deviceRecord is the file format of a device identity.
+type deviceRecord struct {
+	Version         int                `json:"version"`
+	Status          model.DeviceStatus `json:"status"`
+	SerialNumber    string             `json:"serial_number"`
+	Model           string             `json:"model"`
+	ClaimCode       string             `json:"claim_code"`
+	EnrollmentToken *sealedValue       `json:"enrollment_token,omitempty"`
+	Slots           []slotRecord       `json:"slots"`
+}
+
+type slotRecord struct {
+	ID                 string             `json:"id"`
+	Status             model.SlotStatus   `json:"status"`
+	SerialNumber       string             `json:"serial_number,omitempty"`
+	IssuingCA          string             `json:"issuing_ca,omitempty"`
+	ExpirationDate     *time.Time         `json:"expiration_date,omitempty"`
+	Certificate        string             `json:"certificate,omitempty"`
+	CAChain            string             `json:"ca_chain,omitempty"`
+	CertificateRequest string             `json:"certificate_request,omitempty"`
+	Receipt            string             `json:"receipt,omitempty"`
+	KeyAlgorithm       model.KeyAlgorithm `json:"key_algorithm,omitempty"`
+	KeyProvider        string             `json:"key_provider,omitempty"`
+	// CloudProvider is the binding of the slot, its connection is not kept.
+	CloudProvider model.CloudProviderType `json:"cloud_provider,omitempty"`
+	// PrivateKey is the sealed key reference of the provider, the PKCS#8 key
+	// for software keys.
+	PrivateKey *sealedValue `json:"private_key,omitempty"`
+}
+
+func (d *DeviceKeystore) sealContext(parts ...string) string {
+	context := d.id
+	for _, part := range parts {
+		context += "/" + part
+	}
+	return context
+}
+
+func (d *DeviceKeystore) encode(device model.DeviceState) (deviceRecord, error) {
+	record := deviceRecord{
+		Version:      keystoreVersion,
+		Status:       device.Status,
+		SerialNumber: device.SerialNumber,
+		Model:        device.Model,
+		ClaimCode:    device.ClaimCode,
+		Slots:        []slotRecord{},
+	}
+
+	if device.EnrollmentToken != "" {
+		sealed, err := d.keystore.seal([]byte(device.EnrollmentToken), d.sealContext("enrollment_token"))
+		if err != nil {
+			return deviceRecord{}, err
+		}
+		record.EnrollmentToken = &sealed
+	}
+
+	for _, slot := range device.Slots {
+		slotRecord := slotRecord{
+			ID:           slot.ID,
+			Status:       slot.Status,
+			SerialNumber: slot.SerialNumber,
+			IssuingCA:    slot.IssuingCA,
+			KeyAlgorithm: slot.KeyAlgorithm,
+			KeyProvider:  slot.KeyProvider,
+
+			CloudProvider: slot.CloudProvider,
+		}
+		if !slot.ExpirationDate.IsZero() {
+			expirationDate := slot.ExpirationDate
+			slotRecord.ExpirationDate = &expirationDate
+		}
+		if slot.Certificate != nil {
+			slotRecord.Certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: slot.Certificate.Raw}))
+		}
+		for _, crt := range slot.CAChain {
+			slotRecord.CAChain += string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw}))
+		}
+		if slot.CertificateRequest != nil {
+			slotRecord.CertificateRequest = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: slot.CertificateRequest.Raw}))
+		}
+		if slot.Receipt != nil {
+			slotRecord.Receipt = base64.StdEncoding.EncodeToString(slot.Receipt)
+		}
+		if slot.PrivateKey != nil {
+			provider, err := d.keystore.keyProviders.Get(slot.KeyProvider)
+			if err != nil {
+				return deviceRecord{}, fmt.Errorf("error encoding key of slot %s: %v", slot.ID, err)
+			}
+			reference, err := provider.KeyReference(slot.PrivateKey)
+			if err != nil {
+				return deviceRecord{}, fmt.Errorf("error encoding key of slot %s: %v", slot.ID, err)
+			}
+			sealed, err := d.keystore.seal(reference, d.sealContext("slots", slot.ID))
+			if err != nil {
+				return deviceRecord{}, err
+			}
+			slotRecord.PrivateKey = &sealed
+		}
+		record.Slots = append(record.Slots, slotRecord)
+	}
+
+	return record, nil
+}
+
+func (d *DeviceKeystore) decode(record deviceRecord) (*model.DeviceState, error) {
+	if record.Version != keystoreVersion {
+		return nil, fmt.Errorf("unsupported version %d", record.Version)
+	}
+
+	device := &model.DeviceState{
+		Status:       record.Status,
+		SerialNumber: record.SerialNumber,
+		Model:        record.Model,
+		ClaimCode:    record.ClaimCode,
+		Slots:        []model.Slot{},
+	}
+
+	if record.EnrollmentToken != nil {
+		token, err := d.keystore.open(*record.EnrollmentToken, d.sealContext("enrollment_token"))
+		if err != nil {
+			return nil, ErrWrongKey
+		}
+		device.EnrollmentToken = string(token)
+	}
+
+	for _, slotRecord := range record.Slots {
+		slot := model.Slot{
+			ID:           slotRecord.ID,
+			Status:       slotRecord.Status,
+			SerialNumber: slotRecord.SerialNumber,
+			IssuingCA:    slotRecord.IssuingCA,
+			KeyAlgorithm: slotRecord.KeyAlgorithm,
+			KeyProvider:  slotRecord.KeyProvider,
+
+			CloudProvider: slotRecord.CloudProvider,
+		}
+		if slotRecord.ExpirationDate != nil {
+			slot.ExpirationDate = *slotRecord.ExpirationDate
+		}
+
+		if slotRecord.Certificate != "" {
+			certificates, err := parseCertificates(slotRecord.Certificate)
+			if err != nil || len(certificates) != 1 {
+				return nil, fmt.Errorf("invalid certificate in slot %s", slot.ID)
+			}
+			slot.Certificate = certificates[0]
+		}
+		if slotRecord.CAChain != "" {
+			chain, err := parseCertificates(slotRecord.CAChain)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CA chain in slot %s: %v", slot.ID, err)
+			}
+			slot.CAChain = chain
+		}
+		if slotRecord.CertificateRequest != "" {
+			block, _ := pem.Decode([]byte(slotRecord.CertificateRequest))
+			if block == nil {
+				return nil, fmt.Errorf("invalid certificate request in slot %s", slot.ID)
+			}
+			csr, err := x509.ParseCertificateRequest(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid certificate request in slot %s: %v", slot.ID, err)
+			}
+			slot.CertificateRequest = csr
+		}
+		if slotRecord.Receipt != "" {
+			receipt, err := base64.StdEncoding.DecodeString(slotRecord.Receipt)
+			if err != nil {
+				return nil, fmt.Errorf("invalid receipt in slot %s: %v", slot.ID, err)
+			}
+			slot.Receipt = receipt
+		}
+		if slotRecord.PrivateKey != nil {
+			reference, err := d.keystore.open(*slotRecord.PrivateKey, d.sealContext("slots", slot.ID))
+			if err != nil {
+				return nil, ErrWrongKey
+			}
+			provider, err := d.keystore.keyProviders.Get(slot.KeyProvider)
+			if err != nil {
+				return nil, fmt.Errorf("error loading key of slot %s: %v", slot.ID, err)
+			}
+			signer, err := provider.LoadKey(reference)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key in slot %s: %v", slot.ID, err)
+			}
+			slot.PrivateKey = signer
+			// Identities saved before the algorithm was recorded.
+			if slot.KeyAlgorithm == "" {
+				slot.KeyAlgorithm, _ = model.KeyAlgorithmOf(signer.Public())
+			}
+		}
+
+		device.Slots = append(device.Slots, slot)
+	}
+
+	return device, nil
+}
+
+func parseCertificates(data string) ([]*x509.Certificate, error) {
+	certificates := []*x509.Certificate{}
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, crt)
+	}
+	if len(certificates) == 0 {
+		return nil, errors.New("no PEM certificate")
+	}
+	return certificates, nil
+}
+
+// fingerprint digests the persisted part of the identity, the telemetry and
+// the connection state are left out.
+func fingerprint(device model.DeviceState) [sha256.Size]byte {
+	h := sha256.New()
+	write := func(values ...string) {
+		for _, value := range values {
+			fmt.Fprintf(h, "%d:%s", len(value), value)
+		}
+	}
+	write(string(device.Status), device.SerialNumber, device.Model, device.ClaimCode, device.EnrollmentToken)
+
+	for _, slot := range device.Slots {
+		write(slot.ID, string(slot.Status), slot.SerialNumber, slot.IssuingCA, slot.ExpirationDate.String(), string(slot.Receipt), string(slot.KeyAlgorithm), slot.KeyProvider, string(slot.CloudProvider))
+		if slot.Certificate != nil {
+			write(string(slot.Certificate.Raw))
+		}
+		for _, crt := range slot.CAChain {
+			write(string(crt.Raw))
+		}
+		if slot.CertificateRequest != nil {
+			write(string(slot.CertificateRequest.Raw))
+		}
+		// Keys of the hardware providers cannot be exported, the public key
+		// tells them apart just as well.
+		if slot.PrivateKey != nil {
+			der, _ := x509.MarshalPKIXPublicKey(slot.PrivateKey.Public())
+			write(string(der))
+		}
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
@@ -0,0 +1,215 @@
+package loadtest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/lamassuiot/lamassu-vdevice/pkg/config"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/mqtt"
+)
+
+// RunCommand implements the loadtest command. Endpoints are taken from the
+// device configuration, the workload from the flags or a profile file.
+func RunCommand(args []string) int {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "path to the YAML configuration profile of the device")
+	profilePath := flags.String("profile", "", "YAML load test profile, replaces the workload flags")
+	targetName := flags.String("target", "vdms", "system under test: vdms or est")
+	estURL := flags.String("est-url", "", "base URL of the EST server, without /.well-known/est")
+	estLabel := flags.String("est-label", "", "additional path segment of the EST server")
+	estCertificate := flags.String("est-certificate", "", "PEM client certificate for EST, the DMS one for Lamassu")
+	estKey := flags.String("est-key", "", "PEM private key of the EST client certificate")
+	estCA := flags.String("est-ca", "", "PEM CAs the EST server is verified against, unverified when empty")
+	enrollmentToken := flags.String("enrollment-token", "", "enrollment token sent to the vDMS")
+	mqttProvider := flags.String("mqtt-provider", "azure", "cloud provider of mqtt-connect: azure or aws")
+	mix := flags.String("mix", "enroll", "operations and their weights, e.g. enroll=3,reenroll=1,mqtt-connect=1")
+	startRate := flags.Float64("start-rate", 0, "arrival rate at the start of the ramp-up and the end of the ramp-down, per second")
+	rate := flags.Float64("rate", 1, "arrival rate of the steady phase, per second")
+	rampUp := flags.Duration("ramp-up", 0, "duration of the ramp-up phase")
+	steady := flags.Duration("steady", time.Minute, "duration of the steady phase")
+	rampDown := flags.Duration("ramp-down", 0, "duration of the ramp-down phase")
+	concurrency := flags.Int("concurrency", 10, "maximum number of operations in flight")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout of each operation")
+	slot := flags.String("slot", "default", "device slot the certificates are requested for")
+	keyAlgorithm := flags.String("key-algorithm", string(model.DefaultKeyAlgorithm), "algorithm of the device keys: RSA_2048, RSA_3072, RSA_4096, ECDSA_P256, ECDSA_P384 or ED25519")
+	label := flags.String("label", "", "label of the run shown in the reports, e.g. the Lamassu release")
+	jsonPath := flags.String("json", "loadtest-report.json", "path of the JSON report, none when empty")
+	htmlPath := flags.String("html", "loadtest-report.html", "path of the HTML report, none when empty")
+	flags.Parse(args)
+
+	var profile Profile
+	if *profilePath != "" {
+		var err error
+		profile, err = LoadProfile(*profilePath)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	} else {
+		operationMix, err := ParseMix(*mix)
+		if err != nil {
+			fmt.Println("invalid -mix:", err)
+			return 1
+		}
+		profile = Profile{
+			Phases:      RampProfile(*startRate, *rate, *rampUp, *steady, *rampDown),
+			Mix:         operationMix,
+			Concurrency: *concurrency,
+			Timeout:     *timeout,
+		}
+	}
+	if profile.Slot == "" {
+		profile.Slot = *slot
+	}
+	if profile.KeyAlgorithm == "" {
+		profile.KeyAlgorithm = model.KeyAlgorithm(*keyAlgorithm)
+	}
+	// Profiles may spell the algorithm in lower case or with dashes.
+	if algorithm, err := model.ParseKeyAlgorithm(string(profile.KeyAlgorithm)); err == nil {
+		profile.KeyAlgorithm = algorithm
+	}
+	err := profile.Validate()
+	if err != nil {
+		fmt.Println("invalid load test:", err)
+		return 1
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	mqttClients, err := mqttClientFactory(cfg, *mqttProvider)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	var target Target
+	switch *targetName {
+	case "vdms":
+		target = NewVDMSTarget(cfg.VDMSAddress, *enrollmentToken, mqttClients)
+	case "est":
+		estConfig, err := loadEstConfig(*estURL, *estLabel, *estCertificate, *estKey, *estCA)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		target, err = NewESTTarget(estConfig, mqttClients)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	default:
+		fmt.Printf("unknown target %q, expected vdms or est\n", *targetName)
+		return 1
+	}
+
+	fmt.Printf("load test of %s for %s, %d phases, concurrency %d\n", target.Name(), profile.Duration(), len(profile.Phases), profile.Concurrency)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report := NewRunner(profile, target).Run(ctx)
+	report.Label = *label
+	report.Target = target.Name()
+	report.Profile = profile
+
+	for _, operation := range report.Operations {
+		fmt.Printf("%s: %d succeeded, %d failed, %d skipped, %.2f/s, p50 %.1f ms, p95 %.1f ms, p99 %.1f ms\n",
+			operation.Operation, operation.Succeeded, operation.Failed, operation.Skipped, operation.ThroughputPerSecond,
+			operation.Latency.P50Ms, operation.Latency.P95Ms, operation.Latency.P99Ms)
+		for _, count := range operation.Errors {
+			fmt.Printf("  %d x %s, e.g. %s\n", count.Count, count.Cause, count.Example)
+		}
+	}
+
+	if *jsonPath != "" {
+		err = report.WriteJSON(*jsonPath)
+		if err != nil {
+			fmt.Println("error writing JSON report:", err)
+			return 1
+		}
+		fmt.Println("JSON report written to", *jsonPath)
+	}
+	if *htmlPath != "" {
+		err = report.WriteHTML(*htmlPath)
+		if err != nil {
+			fmt.Println("error writing HTML report:", err)
+			return 1
+		}
+		fmt.Println("HTML report written to", *htmlPath)
+	}
+	return 0
+}
+
+// mqttClientFactory builds the clients of mqtt-connect. Their logs are
+// dropped, they would flood the output.
+func mqttClientFactory(cfg config.Config, provider string) (MqttClientFactory, error) {
+	logsChannel := make(chan mqtt.MQTTLog)
+	go func() {
+		for range logsChannel {
+		}
+	}()
+
+	switch provider {
+	case "azure":
+		return func() mqtt.MqttDeviceService {
+			return mqtt.NewAzureIotHubMQTTClient(cfg.Azure.IotHubEndpoint, cfg.Azure.IotHubCA, cfg.Azure.DPSEndpoint, cfg.Azure.ScopeID, logsChannel)
+		}, nil
+	case "aws":
+		return func() mqtt.MqttDeviceService {
+			return mqtt.NewAWSIoTCoreMQTTClient(cfg.AWS.IotEndpoint, cfg.AWS.IotCA, cfg.AWS.TelemetryTopic, logsChannel)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown MQTT provider %q, expected azure or aws", provider)
+}
+
+func loadEstConfig(estURL, label, certificatePath, keyPath, caPath string) (EstConfig, error) {
+	if estURL == "" {
+		return EstConfig{}, fmt.Errorf("-est-url is required with the est target")
+	}
+	estConfig := EstConfig{URL: estURL, Label: label}
+
+	if certificatePath != "" || keyPath != "" {
+		keyPair, err := tls.LoadX509KeyPair(certificatePath, keyPath)
+		if err != nil {
+			return EstConfig{}, fmt.Errorf("error loading EST client certificate: %v", err)
+		}
+		for _, der := range keyPair.Certificate {
+			crt, err := x509.ParseCertificate(der)
+			if err != nil {
+				return EstConfig{}, fmt.Errorf("error parsing EST client certificate: %v", err)
+			}
+			estConfig.ClientCertificates = append(estConfig.ClientCertificates, crt)
+		}
+		estConfig.ClientKey = keyPair.PrivateKey
+	}
+
+	if caPath != "" {
+		data, err := os.ReadFile(caPath)
+		if err != nil {
+			return EstConfig{}, fmt.Errorf("error reading EST CAs: %v", err)
+		}
+		estConfig.Anchors = x509.NewCertPool()
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			crt, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return EstConfig{}, fmt.Errorf("error parsing EST CAs: %v", err)
+			}
+			estConfig.Anchors.AddCert(crt)
+		}
+	}
+
+	return estConfig, nil
+}
@@ -0,0 +1,354 @@
+package loadtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+	"gopkg.in/yaml.v3"
+)
+
+type Operation string
+
+const (
+	OperationEnroll      Operation = "enroll"
+	OperationReenroll    Operation = "reenroll"
+	OperationMqttConnect Operation = "mqtt-connect"
+)
+
+var operations = []Operation{OperationEnroll, OperationReenroll, OperationMqttConnect}
+
+func ParseOperation(value string) (Operation, error) {
+	for _, operation := range operations {
+		if string(operation) == value {
+			return operation, nil
+		}
+	}
+	return "", fmt.Errorf("unknown operation %q, expected one of enroll, reenroll or mqtt-connect", value)
+}
+
+// Phase is a stretch of the test where the arrival rate, in operations per
+// second, moves linearly from FromRate to ToRate. A constant rate is a phase
+// with both rates equal.
+type Phase struct {
+	Name     string        `yaml:"name" json:"name"`
+	Duration time.Duration `yaml:"duration" json:"duration"`
+	FromRate float64       `yaml:"from_rate" json:"from_rate"`
+	ToRate   float64       `yaml:"to_rate" json:"to_rate"`
+}
+
+// MarshalJSON writes the duration as text, as in the YAML profile.
+func (p Phase) MarshalJSON() ([]byte, error) {
+	type phase Phase
+	return json.Marshal(struct {
+		phase
+		Duration string `json:"duration"`
+	}{phase(p), p.Duration.String()})
+}
+
+func (p Phase) rateAt(elapsed time.Duration) float64 {
+	if p.Duration <= 0 {
+		return p.ToRate
+	}
+	return p.FromRate + (p.ToRate-p.FromRate)*float64(elapsed)/float64(p.Duration)
+}
+
+// RampProfile builds the usual ramp-up, steady and ramp-down phases. Phases
+// with no duration are left out.
+func RampProfile(startRate, rate float64, rampUp, steady, rampDown time.Duration) []Phase {
+	phases := []Phase{}
+	if rampUp > 0 {
+		phases = append(phases, Phase{Name: "ramp-up", Duration: rampUp, FromRate: startRate, ToRate: rate})
+	}
+	if steady > 0 {
+		phases = append(phases, Phase{Name: "steady", Duration: steady, FromRate: rate, ToRate: rate})
+	}
+	if rampDown > 0 {
+		phases = append(phases, Phase{Name: "ramp-down", Duration: rampDown, FromRate: rate, ToRate: startRate})
+	}
+	return phases
+}
+
+// Mix is the relative weight of each operation in the workload.
+type Mix map[Operation]int
+
+// ParseMix reads a mix such as "enroll=3,reenroll=1".
+func ParseMix(value string) (Mix, error) {
+	mix := Mix{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, weight := entry, "1"
+		if i := strings.Index(entry, "="); i != -1 {
+			name, weight = entry[:i], entry[i+1:]
+		}
+		operation, err := ParseOperation(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		mix[operation], err = strconv.Atoi(strings.TrimSpace(weight))
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight for %s: %v", operation, err)
+		}
+	}
+	return mix, mix.validate()
+}
+
+func (m Mix) validate() error {
+	total := 0
+	for operation, weight := range m {
+		if _, err := ParseOperation(string(operation)); err != nil {
+			return err
+		}
+		if weight < 0 {
+			return fmt.Errorf("the weight of %s must not be negative", operation)
+		}
+		total += weight
+	}
+	if total == 0 {
+		return errors.New("the operation mix is empty")
+	}
+	return nil
+}
+
+// Profile describes a load test. It can be written as YAML so that the same
+// test is run against every Lamassu release being compared.
+type Profile struct {
+	Phases      []Phase       `yaml:"phases" json:"phases"`
+	Mix         Mix           `yaml:"mix" json:"mix"`
+	Concurrency int           `yaml:"concurrency" json:"concurrency"`
+	Timeout     time.Duration `yaml:"timeout" json:"timeout"`
+	Slot        string        `yaml:"slot" json:"slot"`
+	// KeyAlgorithm is the algorithm of the device keys, e.g. ECDSA_P256.
+	KeyAlgorithm model.KeyAlgorithm `yaml:"key_algorithm" json:"key_algorithm"`
+}
+
+func (p Profile) MarshalJSON() ([]byte, error) {
+	type profile Profile
+	return json.Marshal(struct {
+		profile
+		Timeout string `json:"timeout"`
+	}{profile(p), p.Timeout.String()})
+}
+
+func LoadProfile(path string) (Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Profile{}, fmt.Errorf("error reading load test profile: %v", err)
+	}
+
+	var profile Profile
+	err = yaml.Unmarshal(data, &profile)
+	if err != nil {
+		return Profile{}, fmt.Errorf("error parsing load test profile %s: %v", path, err)
+	}
+	return profile, nil
+}
+
+func (p Profile) Validate() error {
+	if len(p.Phases) == 0 {
+		return errors.New("the profile has no phase")
+	}
+	for i, phase := range p.Phases {
+		if phase.Duration <= 0 {
+			return fmt.Errorf("phase %d (%s) must have a positive duration", i+1, phase.Name)
+		}
+		if phase.FromRate < 0 || phase.ToRate < 0 {
+			return fmt.Errorf("phase %d (%s) must not have a negative rate", i+1, phase.Name)
+		}
+	}
+	if p.Concurrency < 1 {
+		return errors.New("the concurrency must be at least 1")
+	}
+	if p.Timeout <= 0 {
+		return errors.New("the operation timeout must be positive")
+	}
+	if _, err := model.ParseKeyAlgorithm(string(p.KeyAlgorithm)); err != nil {
+		return err
+	}
+	return p.Mix.validate()
+}
+
+func (p Profile) Duration() time.Duration {
+	var total time.Duration
+	for _, phase := range p.Phases {
+		total += phase.Duration
+	}
+	return total
+}
+
+// phaseAt returns the phase running after elapsed and the rate it asks for.
+// ok is false once every phase is over.
+func (p Profile) phaseAt(elapsed time.Duration) (phase Phase, rate float64, ok bool) {
+	for _, phase := range p.Phases {
+		if elapsed < phase.Duration {
+			return phase, phase.rateAt(elapsed), true
+		}
+		elapsed -= phase.Duration
+	}
+	return Phase{}, 0, false
+}
+
+// arrivalTick is the resolution of the arrival scheduler.
+const arrivalTick = 10 * time.Millisecond
+
+// progressPeriod is how often the progress is printed.
+const progressPeriod = 5 * time.Second
+
+// Runner drives the workload: operations arrive at the rate of the profile
+// regardless of how fast the target answers (an open model), and arrivals
+// that find every worker busy are skipped rather than queued, so a slow
+// target shows up as skipped operations instead of a slower arrival rate.
+type Runner struct {
+	profile  Profile
+	target   Target
+	recorder *Recorder
+
+	// picked counts the operations picked so far, to follow the mix.
+	picked map[Operation]int
+}
+
+func NewRunner(profile Profile, target Target) *Runner {
+	return &Runner{
+		profile:  profile,
+		target:   target,
+		recorder: NewRecorder(),
+		picked:   map[Operation]int{},
+	}
+}
+
+// nextOperation follows the mix deterministically, picking the operation
+// furthest behind its share, so two runs of a profile send the same workload.
+func (r *Runner) nextOperation() Operation {
+	var next Operation
+	best := -1.0
+	ordered := make([]Operation, 0, len(r.profile.Mix))
+	for operation := range r.profile.Mix {
+		ordered = append(ordered, operation)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i] < ordered[j] })
+
+	for _, operation := range ordered {
+		weight := r.profile.Mix[operation]
+		if weight == 0 {
+			continue
+		}
+		deficit := float64(weight) / float64(r.picked[operation]+1)
+		if deficit > best {
+			best = deficit
+			next = operation
+		}
+	}
+	r.picked[next]++
+	return next
+}
+
+// Run runs every phase of the profile and waits for the operations in flight.
+// Cancelling the context stops the arrivals early.
+func (r *Runner) Run(ctx context.Context) *Report {
+	workers := make(chan struct{}, r.profile.Concurrency)
+	var inFlight sync.WaitGroup
+
+	start := time.Now()
+	r.recorder.Start(start)
+
+	ticker := time.NewTicker(arrivalTick)
+	defer ticker.Stop()
+
+	lastTick := start
+	lastProgress := start
+	owed := 0.0
+
+arrivals:
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println("load test interrupted, waiting for the operations in flight")
+			break arrivals
+		case now := <-ticker.C:
+			phase, rate, ok := r.profile.phaseAt(now.Sub(start))
+			if !ok {
+				break arrivals
+			}
+
+			owed += rate * now.Sub(lastTick).Seconds()
+			lastTick = now
+			for ; owed >= 1; owed-- {
+				operation := r.nextOperation()
+				select {
+				case workers <- struct{}{}:
+				default:
+					r.recorder.Skipped(operation, now)
+					continue
+				}
+
+				r.recorder.Arrived(operation, now)
+				inFlight.Add(1)
+				go func() {
+					defer func() {
+						<-workers
+						inFlight.Done()
+					}()
+					r.execute(operation)
+				}()
+			}
+
+			if now.Sub(lastProgress) >= progressPeriod {
+				lastProgress = now
+				fmt.Printf("%s %s rate=%.1f/s in_flight=%d %s\n", now.Sub(start).Truncate(time.Second), phase.Name, rate, len(workers), r.recorder.progress())
+			}
+		}
+	}
+
+	inFlight.Wait()
+	return r.recorder.Report(time.Now())
+}
+
+// execute runs one operation. Keys are generated and prerequisite enrollments
+// done before the clock starts, only the operation itself is measured.
+func (r *Runner) execute(operation Operation) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.profile.Timeout)
+	defer cancel()
+
+	identity, err := newIdentity(r.profile.Slot, r.profile.KeyAlgorithm)
+	if err != nil {
+		r.recorder.Failed(operation, time.Now(), &setupError{err})
+		return
+	}
+
+	if operation != OperationEnroll {
+		err = r.target.Enroll(ctx, identity)
+		if err != nil {
+			r.recorder.Failed(operation, time.Now(), &setupError{err})
+			return
+		}
+	}
+
+	started := time.Now()
+	switch operation {
+	case OperationEnroll:
+		err = r.target.Enroll(ctx, identity)
+	case OperationReenroll:
+		err = r.target.Reenroll(ctx, identity)
+	case OperationMqttConnect:
+		err = r.target.MqttConnect(ctx, identity)
+	}
+	finished := time.Now()
+
+	if err != nil {
+		r.recorder.Failed(operation, finished, err)
+		return
+	}
+	r.recorder.Succeeded(operation, finished, finished.Sub(started))
+}
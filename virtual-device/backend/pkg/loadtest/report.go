@@ -0,0 +1,405 @@
+package loadtest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/est"
+)
+
+// Causes the errors are grouped by.
+const (
+	CauseTimeout    = "timeout"
+	CauseCanceled   = "canceled"
+	CauseConnection = "connection"
+	CauseTLS        = "tls"
+	CauseSetup      = "setup"
+	CauseOther      = "other"
+)
+
+// ErrorCause classifies an error so failures can be broken down. HTTP errors
+// are grouped by status code, "http 503" for instance.
+func ErrorCause(err error) string {
+	var setup *setupError
+	if errors.As(err, &setup) {
+		return CauseSetup + ": " + ErrorCause(setup.err)
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return fmt.Sprintf("http %d", statusErr.StatusCode)
+	}
+	var estErr est.Error
+	if errors.As(err, &estErr) {
+		return fmt.Sprintf("http %d", estErr.StatusCode())
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return CauseTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return CauseCanceled
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return CauseTimeout
+	}
+
+	var recordHeaderErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &recordHeaderErr) || errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &certificateInvalidErr) || errors.As(err, &hostnameErr) ||
+		strings.Contains(err.Error(), "tls: ") {
+		return CauseTLS
+	}
+
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	if errors.As(err, &opErr) || errors.As(err, &dnsErr) {
+		return CauseConnection
+	}
+
+	return CauseOther
+}
+
+type LatencySummary struct {
+	MinMs  float64 `json:"min_ms"`
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P95Ms  float64 `json:"p95_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+	MaxMs  float64 `json:"max_ms"`
+}
+
+type ErrorCount struct {
+	Cause string `json:"cause"`
+	Count int    `json:"count"`
+	// Example is the first error seen with this cause.
+	Example string `json:"example"`
+}
+
+type OperationReport struct {
+	Operation Operation `json:"operation"`
+	// Started operations, skipped arrivals are not included.
+	Started   int `json:"started"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	// Skipped arrivals found every worker busy.
+	Skipped             int     `json:"skipped"`
+	ThroughputPerSecond float64 `json:"throughput_per_second"`
+	// Latency of the successful operations.
+	Latency LatencySummary `json:"latency"`
+	Errors  []ErrorCount   `json:"errors"`
+}
+
+// TimelinePoint counts what happened during one second of the test.
+type TimelinePoint struct {
+	Second    int `json:"second"`
+	Started   int `json:"started"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Skipped   int `json:"skipped"`
+}
+
+type Report struct {
+	Label           string            `json:"label,omitempty"`
+	Target          string            `json:"target"`
+	StartedAt       time.Time         `json:"started_at"`
+	FinishedAt      time.Time         `json:"finished_at"`
+	DurationSeconds float64           `json:"duration_seconds"`
+	Profile         Profile           `json:"profile"`
+	Operations      []OperationReport `json:"operations"`
+	Timeline        []TimelinePoint   `json:"timeline"`
+}
+
+type operationStats struct {
+	started   int
+	succeeded int
+	failed    int
+	skipped   int
+	latencies []time.Duration
+	errors    map[string]*ErrorCount
+}
+
+// Recorder collects the outcome of every operation of a run.
+type Recorder struct {
+	lock       sync.Mutex
+	startedAt  time.Time
+	operations map[Operation]*operationStats
+	timeline   []TimelinePoint
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{operations: map[Operation]*operationStats{}}
+}
+
+func (r *Recorder) Start(at time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.startedAt = at
+}
+
+func (r *Recorder) stats(operation Operation) *operationStats {
+	stats, ok := r.operations[operation]
+	if !ok {
+		stats = &operationStats{errors: map[string]*ErrorCount{}}
+		r.operations[operation] = stats
+	}
+	return stats
+}
+
+func (r *Recorder) point(at time.Time) *TimelinePoint {
+	second := int(at.Sub(r.startedAt) / time.Second)
+	if second < 0 {
+		second = 0
+	}
+	for len(r.timeline) <= second {
+		r.timeline = append(r.timeline, TimelinePoint{Second: len(r.timeline)})
+	}
+	return &r.timeline[second]
+}
+
+func (r *Recorder) Arrived(operation Operation, at time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.stats(operation).started++
+	r.point(at).Started++
+}
+
+func (r *Recorder) Skipped(operation Operation, at time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.stats(operation).skipped++
+	r.point(at).Skipped++
+}
+
+func (r *Recorder) Succeeded(operation Operation, at time.Time, latency time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	stats := r.stats(operation)
+	stats.succeeded++
+	stats.latencies = append(stats.latencies, latency)
+	r.point(at).Succeeded++
+}
+
+func (r *Recorder) Failed(operation Operation, at time.Time, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	stats := r.stats(operation)
+	stats.failed++
+	cause := ErrorCause(err)
+	if count, ok := stats.errors[cause]; ok {
+		count.Count++
+	} else {
+		stats.errors[cause] = &ErrorCount{Cause: cause, Count: 1, Example: err.Error()}
+	}
+	r.point(at).Failed++
+}
+
+func (r *Recorder) progress() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	parts := []string{}
+	for _, operation := range operations {
+		stats, ok := r.operations[operation]
+		if !ok {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s ok=%d failed=%d skipped=%d", operation, stats.succeeded, stats.failed, stats.skipped))
+	}
+	return strings.Join(parts, " ")
+}
+
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*100) / 100
+}
+
+// percentile uses the nearest rank method on sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func summarize(latencies []time.Duration) LatencySummary {
+	if len(latencies) == 0 {
+		return LatencySummary{}
+	}
+
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, latency := range sorted {
+		total += latency
+	}
+
+	return LatencySummary{
+		MinMs:  milliseconds(sorted[0]),
+		MeanMs: milliseconds(total / time.Duration(len(sorted))),
+		P50Ms:  milliseconds(percentile(sorted, 50)),
+		P95Ms:  milliseconds(percentile(sorted, 95)),
+		P99Ms:  milliseconds(percentile(sorted, 99)),
+		MaxMs:  milliseconds(sorted[len(sorted)-1]),
+	}
+}
+
+func (r *Recorder) Report(finishedAt time.Time) *Report {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	duration := finishedAt.Sub(r.startedAt).Seconds()
+	report := &Report{
+		StartedAt:       r.startedAt,
+		FinishedAt:      finishedAt,
+		DurationSeconds: math.Round(duration*100) / 100,
+		Operations:      []OperationReport{},
+		Timeline:        append([]TimelinePoint{}, r.timeline...),
+	}
+
+	for _, operation := range operations {
+		stats, ok := r.operations[operation]
+		if !ok {
+			continue
+		}
+
+		errorCounts := []ErrorCount{}
+		for _, count := range stats.errors {
+			errorCounts = append(errorCounts, *count)
+		}
+		sort.Slice(errorCounts, func(i, j int) bool {
+			if errorCounts[i].Count != errorCounts[j].Count {
+				return errorCounts[i].Count > errorCounts[j].Count
+			}
+			return errorCounts[i].Cause < errorCounts[j].Cause
+		})
+
+		throughput := 0.0
+		if duration > 0 {
+			throughput = math.Round(float64(stats.succeeded)/duration*100) / 100
+		}
+
+		report.Operations = append(report.Operations, OperationReport{
+			Operation:           operation,
+			Started:             stats.started,
+			Succeeded:           stats.succeeded,
+			Failed:              stats.failed,
+			Skipped:             stats.skipped,
+			ThroughputPerSecond: throughput,
+			Latency:             summarize(stats.latencies),
+			Errors:              errorCounts,
+		})
+	}
+
+	return report
+}
+
+func (r *Report) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+//go:embed report.html
+var reportTemplateSource string
+
+var reportTemplate = template.Must(template.New("report").Parse(reportTemplateSource))
+
+// chart sizes of the HTML report, in SVG user units.
+const (
+	chartWidth  = 900
+	chartHeight = 240
+)
+
+type chartSeries struct {
+	Name   string
+	Color  string
+	Points string
+}
+
+type chart struct {
+	Width    int
+	Height   int
+	MaxValue int
+	Seconds  int
+	Series   []chartSeries
+}
+
+// throughputChart draws the timeline as SVG polylines, so the report needs
+// no script or external resource.
+func (r *Report) throughputChart() chart {
+	c := chart{Width: chartWidth, Height: chartHeight, MaxValue: 1, Seconds: len(r.Timeline)}
+	for _, point := range r.Timeline {
+		for _, value := range []int{point.Started, point.Succeeded, point.Failed, point.Skipped} {
+			if value > c.MaxValue {
+				c.MaxValue = value
+			}
+		}
+	}
+
+	series := []struct {
+		name  string
+		color string
+		value func(TimelinePoint) int
+	}{
+		{"started", "#1976d2", func(p TimelinePoint) int { return p.Started }},
+		{"succeeded", "#2e7d32", func(p TimelinePoint) int { return p.Succeeded }},
+		{"failed", "#c62828", func(p TimelinePoint) int { return p.Failed }},
+		{"skipped", "#ef6c00", func(p TimelinePoint) int { return p.Skipped }},
+	}
+
+	xStep := float64(chartWidth)
+	if len(r.Timeline) > 1 {
+		xStep = float64(chartWidth) / float64(len(r.Timeline)-1)
+	}
+	for _, s := range series {
+		points := make([]string, 0, len(r.Timeline))
+		for i, point := range r.Timeline {
+			x := float64(i) * xStep
+			y := float64(chartHeight) - float64(s.value(point))/float64(c.MaxValue)*float64(chartHeight)
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+		}
+		c.Series = append(c.Series, chartSeries{Name: s.name, Color: s.color, Points: strings.Join(points, " ")})
+	}
+	return c
+}
+
+// WriteHTML writes a self-contained report, a single file that can be kept
+// next to the JSON one and opened anywhere.
+func (r *Report) WriteHTML(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return reportTemplate.Execute(file, struct {
+		*Report
+		Chart chart
+	}{r, r.throughputChart()})
+}
@@ -0,0 +1,376 @@
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/est"
+	"github.com/jakehl/goid"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/mqtt"
+)
+
+// Identity is a throwaway device identity, each operation gets its own.
+type Identity struct {
+	SerialNumber string
+	Slot         string
+	PrivateKey   crypto.Signer
+	Request      *x509.CertificateRequest
+	Certificate  *x509.Certificate
+}
+
+func newIdentity(slot string, keyAlgorithm model.KeyAlgorithm) (*Identity, error) {
+	key, err := keyAlgorithm.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("error generating key: %v", err)
+	}
+
+	serialNumber := "loadtest-" + goid.NewV4UUID().String()
+	commonName := serialNumber
+	if slot != "default" {
+		commonName = slot + ":" + serialNumber
+	}
+
+	template := x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{"Lamassu"},
+		},
+		SignatureAlgorithm: keyAlgorithm.SignatureAlgorithm(),
+	}
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating certificate request: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate request: %v", err)
+	}
+
+	return &Identity{
+		SerialNumber: serialNumber,
+		Slot:         slot,
+		PrivateKey:   key,
+		Request:      csr,
+	}, nil
+}
+
+// Target is the system under test. Reenroll and MqttConnect are given an
+// identity already enrolled.
+type Target interface {
+	Name() string
+	Enroll(ctx context.Context, identity *Identity) error
+	Reenroll(ctx context.Context, identity *Identity) error
+	MqttConnect(ctx context.Context, identity *Identity) error
+}
+
+// MqttClientFactory returns a new client of the cloud provider the
+// mqtt-connect operation connects to.
+type MqttClientFactory func() mqtt.MqttDeviceService
+
+// StatusError is an unexpected HTTP status answered by the target.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d: %s", e.StatusCode, e.Body)
+}
+
+// setupError wraps the failures of what precedes the measured operation, so
+// they are not mistaken for failures of the operation itself.
+type setupError struct {
+	err error
+}
+
+func (e *setupError) Error() string {
+	return "setup: " + e.err.Error()
+}
+
+func (e *setupError) Unwrap() error {
+	return e.err
+}
+
+// connectMqtt is shared by the targets, the MQTT broker does not depend on
+// how the certificate was obtained.
+func connectMqtt(ctx context.Context, factory MqttClientFactory, identity *Identity) error {
+	if factory == nil {
+		return errors.New("no MQTT provider configured")
+	}
+
+	client := factory()
+	connected := make(chan error, 1)
+	go func() {
+		connected <- client.Connect(identity.Certificate, identity.PrivateKey, identity.SerialNumber)
+	}()
+
+	select {
+	case err := <-connected:
+		if err != nil {
+			return err
+		}
+		client.Disconnect()
+		return nil
+	case <-ctx.Done():
+		// The client cannot be interrupted, it is left to give up on its own.
+		go func() {
+			if <-connected == nil {
+				client.Disconnect()
+			}
+		}()
+		return ctx.Err()
+	}
+}
+
+// vdmsTarget enrolls through the virtual DMS, the way virtual devices do.
+type vdmsTarget struct {
+	dmsUrl          string
+	enrollmentToken string
+	mqttClients     MqttClientFactory
+	httpClient      *http.Client
+}
+
+func NewVDMSTarget(dmsUrl string, enrollmentToken string, mqttClients MqttClientFactory) Target {
+	return &vdmsTarget{
+		dmsUrl:          strings.TrimSuffix(dmsUrl, "/"),
+		enrollmentToken: enrollmentToken,
+		mqttClients:     mqttClients,
+		httpClient:      &http.Client{},
+	}
+}
+
+func (t *vdmsTarget) Name() string {
+	return "vdms " + t.dmsUrl
+}
+
+type vdmsEnrollResponse struct {
+	Certificate string `json:"certificate"`
+}
+
+func (t *vdmsTarget) Enroll(ctx context.Context, identity *Identity) error {
+	body, _ := json.Marshal(map[string]string{
+		"serial_number":       identity.SerialNumber,
+		"model":               "loadtest",
+		"slot":                identity.Slot,
+		"certificate_request": encodePEM("CERTIFICATE REQUEST", identity.Request.Raw),
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.dmsUrl+"/enroll", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.enrollmentToken != "" {
+		req.Header.Set("X-Enrollment-Token", t.enrollmentToken)
+	}
+
+	crt, err := t.exchange(ctx, t.httpClient, req)
+	if err != nil {
+		return err
+	}
+	identity.Certificate = crt
+	return nil
+}
+
+func (t *vdmsTarget) Reenroll(ctx context.Context, identity *Identity) error {
+	body, _ := json.Marshal(map[string]string{
+		"serial_number":       identity.SerialNumber,
+		"model":               "loadtest",
+		"slot":                identity.Slot,
+		"certificate":         encodePEM("CERTIFICATE", identity.Certificate.Raw),
+		"certificate_request": encodePEM("CERTIFICATE REQUEST", identity.Request.Raw),
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.dmsUrl+"/reenroll", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// As the device does, the current certificate is also presented as TLS
+	// client certificate for DMSs listening over HTTPS.
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				Certificates: []tls.Certificate{
+					{
+						Certificate: [][]byte{identity.Certificate.Raw},
+						PrivateKey:  identity.PrivateKey,
+						Leaf:        identity.Certificate,
+					},
+				},
+			},
+		},
+	}
+
+	crt, err := t.exchange(ctx, httpClient, req)
+	if err != nil {
+		return err
+	}
+	identity.Certificate = crt
+	return nil
+}
+
+func (t *vdmsTarget) MqttConnect(ctx context.Context, identity *Identity) error {
+	return connectMqtt(ctx, t.mqttClients, identity)
+}
+
+// exchange sends an enrollment request and follows the vDMS while it answers
+// 202 Accepted. The time spent queued counts in the latency, it is what a
+// device waits for.
+func (t *vdmsTarget) exchange(ctx context.Context, httpClient *http.Client, req *http.Request) (*x509.Certificate, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for resp.StatusCode == http.StatusAccepted {
+		location := resp.Header.Get("Location")
+		retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil || retryAfter < 1 {
+			retryAfter = 1
+		}
+		resp.Body.Close()
+
+		if location == "" {
+			return nil, errors.New("enrollment accepted without a location to poll")
+		}
+
+		select {
+		case <-time.After(time.Duration(retryAfter) * time.Second):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		poll, err := http.NewRequestWithContext(ctx, http.MethodGet, t.dmsUrl+location, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = httpClient.Do(poll)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(respBody))}
+	}
+
+	var enrollResp vdmsEnrollResponse
+	err = json.Unmarshal(respBody, &enrollResp)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding response: %v", err)
+	}
+	return decodeCertificate(enrollResp.Certificate)
+}
+
+// estTarget enrolls directly against an EST server, leaving the vDMS out of
+// the measure.
+type estTarget struct {
+	client      est.Client
+	mqttClients MqttClientFactory
+}
+
+// EstConfig locates the EST server. URL is the base of the EST endpoints
+// without the /.well-known/est part, and Label the optional additional path
+// segment. The client certificate authenticates the enrollments, Lamassu
+// expects the one of a DMS.
+type EstConfig struct {
+	URL                string
+	Label              string
+	ClientCertificates []*x509.Certificate
+	ClientKey          interface{}
+	Anchors            *x509.CertPool
+}
+
+func NewESTTarget(config EstConfig, mqttClients MqttClientFactory) (Target, error) {
+	estUrl, err := url.Parse(config.URL)
+	if err != nil || estUrl.Host == "" {
+		return nil, fmt.Errorf("invalid EST URL %q", config.URL)
+	}
+
+	client := est.Client{
+		Host:                  estUrl.Host + strings.TrimSuffix(estUrl.Path, "/"),
+		AdditionalPathSegment: config.Label,
+		Certificates:          config.ClientCertificates,
+		PrivateKey:            config.ClientKey,
+		ExplicitAnchor:        config.Anchors,
+		InsecureSkipVerify:    config.Anchors == nil,
+	}
+	return &estTarget{client: client, mqttClients: mqttClients}, nil
+}
+
+func (t *estTarget) Name() string {
+	name := "est https://" + t.client.Host
+	if t.client.AdditionalPathSegment != "" {
+		name += " (" + t.client.AdditionalPathSegment + ")"
+	}
+	return name
+}
+
+func (t *estTarget) Enroll(ctx context.Context, identity *Identity) error {
+	crt, err := t.client.Enroll(ctx, identity.Request)
+	if err != nil {
+		return err
+	}
+	identity.Certificate = crt
+	return nil
+}
+
+// Reenroll authenticates with the device certificate, as RFC 7030 asks for
+// simplereenroll.
+func (t *estTarget) Reenroll(ctx context.Context, identity *Identity) error {
+	client := t.client
+	client.Certificates = []*x509.Certificate{identity.Certificate}
+	client.PrivateKey = identity.PrivateKey
+
+	crt, err := client.Reenroll(ctx, identity.Request)
+	if err != nil {
+		return err
+	}
+	identity.Certificate = crt
+	return nil
+}
+
+func (t *estTarget) MqttConnect(ctx context.Context, identity *Identity) error {
+	return connectMqtt(ctx, t.mqttClients, identity)
+}
+
+func encodePEM(blockType string, der []byte) string {
+	return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}))
+}
+
+func decodeCertificate(b64Certificate string) (*x509.Certificate, error) {
+	decoded, err := base64.StdEncoding.DecodeString(b64Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding certificate: %v", err)
+	}
+	block, _ := pem.Decode(decoded)
+	if block == nil {
+		return nil, errors.New("error decoding certificate: invalid PEM block")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
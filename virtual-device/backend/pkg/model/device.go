@@ -1,8 +1,10 @@
 package model
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -18,14 +20,38 @@ const (
 )
 
 type Slot struct {
-	ID                 string
-	Certificate        *x509.Certificate
+	ID          string
+	Certificate *x509.Certificate
+	// CAChain holds the CA certificates sent along the certificate, if any.
+	CAChain            []*x509.Certificate
 	CertificateRequest *x509.CertificateRequest
-	PrivateKey         *rsa.PrivateKey
-	SerialNumber       string
-	Status             SlotStatus
-	IssuingCA          string
-	ExpirationDate     time.Time
+	PrivateKey         crypto.Signer
+	// KeyAlgorithm is the algorithm of the key generated on the next
+	// enrollment, and of PrivateKey once there is one.
+	KeyAlgorithm KeyAlgorithm
+	// KeyProvider names where the key is generated and kept, "software",
+	// "pkcs11" or "tpm", see the keyprovider package.
+	KeyProvider    string
+	SerialNumber   string
+	Status         SlotStatus
+	IssuingCA      string
+	ExpirationDate time.Time
+	// Receipt is the DER encoded enrollment receipt signed by the DMS for
+	// the current certificate.
+	Receipt []byte
+	// NextRenewal is when the slot is re-enrolled automatically, zero when
+	// it is not. RenewalAttempts counts the failed automatic re-enrollments
+	// of the current certificate, RenewalError is the last failure.
+	NextRenewal     time.Time
+	RenewalAttempts int
+	RenewalError    string
+	// EnrollmentError is the cause of the last failed enrollment.
+	EnrollmentError string
+	// CloudProvider is the provider the slot connects to, empty until it is
+	// bound. ConnectionError is the last connection failure.
+	CloudProvider    CloudProviderType
+	ConnectionStatus ConnectionStatus
+	ConnectionError  string
 }
 
 type DeviceStatus string
@@ -43,6 +69,14 @@ type DeviceState struct {
 	TelemetryDataRateSeconds int
 	Slots                    []Slot
 	MqttConnected            bool
+	ClaimCode                string
+	EnrollmentToken          string
+	// TelemetrySequence numbers the published telemetry messages, the
+	// counters tell how their publications went since the device started.
+	TelemetrySequence        uint64
+	TelemetryPublished       int
+	TelemetryPublishFailures int
+	TelemetryPublishError    string
 }
 
 type TelemetryData struct {
@@ -56,4 +90,35 @@ type CloudProviderType string
 const (
 	CloudProviderTypeAWS   CloudProviderType = "AWS"
 	CouldProviderTypeAzure CloudProviderType = "AZURE"
+	// CloudProviderTypeGeneric is any MQTT 3.1.1 broker.
+	CloudProviderTypeGeneric CloudProviderType = "GENERIC"
+)
+
+var CloudProviderTypes = []CloudProviderType{
+	CloudProviderTypeAWS,
+	CouldProviderTypeAzure,
+	CloudProviderTypeGeneric,
+}
+
+// ParseCloudProviderType accepts the names of CloudProviderTypes in any case.
+func ParseCloudProviderType(name string) (CloudProviderType, error) {
+	provider := CloudProviderType(strings.ToUpper(strings.TrimSpace(name)))
+	for _, known := range CloudProviderTypes {
+		if provider == known {
+			return known, nil
+		}
+	}
+	return "", fmt.Errorf("unknown cloud provider %q, expected one of %v", name, CloudProviderTypes)
+}
+
+type ConnectionStatus string
+
+const (
+	ConnectionStatusDisconnected ConnectionStatus = "DISCONNECTED"
+	ConnectionStatusConnecting   ConnectionStatus = "CONNECTING"
+	ConnectionStatusConnected    ConnectionStatus = "CONNECTED"
+	// ConnectionStatusReconnecting is a lost connection the client is
+	// bringing back on its own.
+	ConnectionStatusReconnecting ConnectionStatus = "RECONNECTING"
+	ConnectionStatusFailed       ConnectionStatus = "FAILED"
 )
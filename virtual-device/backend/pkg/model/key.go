@@ -0,0 +1,112 @@
+package model
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// KeyAlgorithm is the algorithm of the key generated when a slot enrolls.
+// Ed25519 is only accepted by some CAs and brokers, check yours first.
+type KeyAlgorithm string
+
+const (
+	KeyAlgorithmRSA2048   KeyAlgorithm = "RSA_2048"
+	KeyAlgorithmRSA3072   KeyAlgorithm = "RSA_3072"
+	KeyAlgorithmRSA4096   KeyAlgorithm = "RSA_4096"
+	KeyAlgorithmECDSAP256 KeyAlgorithm = "ECDSA_P256"
+	KeyAlgorithmECDSAP384 KeyAlgorithm = "ECDSA_P384"
+	KeyAlgorithmEd25519   KeyAlgorithm = "ED25519"
+
+	DefaultKeyAlgorithm = KeyAlgorithmRSA2048
+)
+
+var KeyAlgorithms = []KeyAlgorithm{
+	KeyAlgorithmRSA2048,
+	KeyAlgorithmRSA3072,
+	KeyAlgorithmRSA4096,
+	KeyAlgorithmECDSAP256,
+	KeyAlgorithmECDSAP384,
+	KeyAlgorithmEd25519,
+}
+
+// ParseKeyAlgorithm accepts the names of KeyAlgorithms in any case, with
+// dashes or underscores, e.g. ecdsa-p256.
+func ParseKeyAlgorithm(name string) (KeyAlgorithm, error) {
+	algorithm := KeyAlgorithm(strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(name), "-", "_")))
+	for _, known := range KeyAlgorithms {
+		if algorithm == known {
+			return algorithm, nil
+		}
+	}
+	return "", fmt.Errorf("unknown key algorithm %q, expected one of %v", name, KeyAlgorithms)
+}
+
+// GenerateKey generates a software key of the algorithm.
+func (a KeyAlgorithm) GenerateKey() (crypto.Signer, error) {
+	switch a {
+	case KeyAlgorithmRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyAlgorithmRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyAlgorithmRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyAlgorithmECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyAlgorithmECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyAlgorithmEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unknown key algorithm %q", a)
+}
+
+// SignatureAlgorithm is the algorithm the certificate requests are signed
+// with.
+func (a KeyAlgorithm) SignatureAlgorithm() x509.SignatureAlgorithm {
+	switch a {
+	case KeyAlgorithmRSA2048, KeyAlgorithmRSA3072, KeyAlgorithmRSA4096:
+		return x509.SHA256WithRSA
+	case KeyAlgorithmECDSAP256:
+		return x509.ECDSAWithSHA256
+	case KeyAlgorithmECDSAP384:
+		return x509.ECDSAWithSHA384
+	case KeyAlgorithmEd25519:
+		return x509.PureEd25519
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
+// KeyAlgorithmOf tells the algorithm of a public key.
+func KeyAlgorithmOf(publicKey crypto.PublicKey) (KeyAlgorithm, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		switch key.N.BitLen() {
+		case 2048:
+			return KeyAlgorithmRSA2048, nil
+		case 3072:
+			return KeyAlgorithmRSA3072, nil
+		case 4096:
+			return KeyAlgorithmRSA4096, nil
+		}
+		return "", fmt.Errorf("unsupported RSA key size %d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return KeyAlgorithmECDSAP256, nil
+		case elliptic.P384():
+			return KeyAlgorithmECDSAP384, nil
+		}
+		return "", fmt.Errorf("unsupported ECDSA curve %s", key.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return KeyAlgorithmEd25519, nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", publicKey)
+}
@@ -22,36 +22,75 @@ func (t *TelemetryData) Serialize() SerializedTelemetryData {
 }
 
 type SerializedSlot struct {
-	ID             string     `json:"id"`
-	Certificate    string     `json:"certificate"`
-	PrivateKey     string     `json:"private_key"`
-	SerialNumber   string     `json:"serial_number"`
-	Status         SlotStatus `json:"status"`
-	IssuingCA      string     `json:"issuing_ca"`
-	ExpirationDate string     `json:"expiration_date"`
+	ID               string            `json:"id"`
+	Certificate      string            `json:"certificate"`
+	PrivateKey       string            `json:"private_key"`
+	KeyAlgorithm     string            `json:"key_algorithm"`
+	KeyProvider      string            `json:"key_provider"`
+	SerialNumber     string            `json:"serial_number"`
+	Status           SlotStatus        `json:"status"`
+	IssuingCA        string            `json:"issuing_ca"`
+	ExpirationDate   string            `json:"expiration_date"`
+	Receipt          string            `json:"receipt,omitempty"`
+	NextRenewal      string            `json:"next_renewal,omitempty"`
+	RenewalError     string            `json:"renewal_error,omitempty"`
+	EnrollmentError  string            `json:"enrollment_error,omitempty"`
+	CloudProvider    CloudProviderType `json:"cloud_provider"`
+	ConnectionStatus ConnectionStatus  `json:"connection_status"`
+	ConnectionError  string            `json:"connection_error,omitempty"`
 }
 
 func (s Slot) Serialize() SerializedSlot {
 	b64PemKeyString := ""
 	if s.PrivateKey != nil {
-		pemKeyString := pem.EncodeToMemory(
-			&pem.Block{
-				Type:  "RSA PRIVATE KEY",
-				Bytes: x509.MarshalPKCS1PrivateKey(s.PrivateKey),
-			},
-		)
-		b64PemKeyString = base64.StdEncoding.EncodeToString(pemKeyString)
+		// Keys held outside of the process cannot be exported.
+		der, err := x509.MarshalPKCS8PrivateKey(s.PrivateKey)
+		if err == nil {
+			pemKeyString := pem.EncodeToMemory(
+				&pem.Block{
+					Type:  "PRIVATE KEY",
+					Bytes: der,
+				},
+			)
+			b64PemKeyString = base64.StdEncoding.EncodeToString(pemKeyString)
+		}
+	}
+
+	b64Receipt := ""
+	if s.Receipt != nil {
+		b64Receipt = base64.StdEncoding.EncodeToString(s.Receipt)
+	}
+
+	nextRenewal := ""
+	if !s.NextRenewal.IsZero() {
+		nextRenewal = strconv.Itoa(int(s.NextRenewal.Unix()))
 	}
 
 	return SerializedSlot{
-		ID:             s.ID,
-		Certificate:    "certi",
-		PrivateKey:     b64PemKeyString,
-		Status:         s.Status,
-		SerialNumber:   s.SerialNumber,
-		IssuingCA:      s.IssuingCA,
-		ExpirationDate: strconv.Itoa(int(s.ExpirationDate.Unix())),
+		ID:               s.ID,
+		Certificate:      "certi",
+		PrivateKey:       b64PemKeyString,
+		KeyAlgorithm:     string(s.KeyAlgorithm),
+		KeyProvider:      s.KeyProvider,
+		Status:           s.Status,
+		SerialNumber:     s.SerialNumber,
+		IssuingCA:        s.IssuingCA,
+		ExpirationDate:   strconv.Itoa(int(s.ExpirationDate.Unix())),
+		Receipt:          b64Receipt,
+		NextRenewal:      nextRenewal,
+		RenewalError:     s.RenewalError,
+		EnrollmentError:  s.EnrollmentError,
+		CloudProvider:    s.CloudProvider,
+		ConnectionStatus: s.connectionStatus(),
+		ConnectionError:  s.ConnectionError,
+	}
+}
+
+func (s Slot) connectionStatus() ConnectionStatus {
+	if s.ConnectionStatus == "" {
+		return ConnectionStatusDisconnected
 	}
+	return s.ConnectionStatus
 }
 
 type SerializedDeviceState struct {
@@ -63,6 +102,12 @@ type SerializedDeviceState struct {
 	Slots                    []SerializedSlot        `json:"slots"`
 	MqttClient               string                  `json:"mqtt_provider"`
 	MqttConnected            bool                    `json:"mqtt_connected"`
+	ClaimCode                string                  `json:"claim_code"`
+	HasEnrollmentToken       bool                    `json:"has_enrollment_token"`
+	TelemetrySequence        uint64                  `json:"telemetry_sequence"`
+	TelemetryPublished       int                     `json:"telemetry_published"`
+	TelemetryPublishFailures int                     `json:"telemetry_publish_failures"`
+	TelemetryPublishError    string                  `json:"telemetry_publish_error,omitempty"`
 }
 
 func (d DeviceState) Serialize() SerializedDeviceState {
@@ -80,5 +125,11 @@ func (d DeviceState) Serialize() SerializedDeviceState {
 		Slots:                    serializedSlots,
 		MqttClient:               "mqtt",
 		MqttConnected:            d.MqttConnected,
+		ClaimCode:                d.ClaimCode,
+		HasEnrollmentToken:       d.EnrollmentToken != "",
+		TelemetrySequence:        d.TelemetrySequence,
+		TelemetryPublished:       d.TelemetryPublished,
+		TelemetryPublishFailures: d.TelemetryPublishFailures,
+		TelemetryPublishError:    d.TelemetryPublishError,
 	}
 }
@@ -1,10 +1,9 @@
 package mqtt
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"time"
@@ -15,19 +14,27 @@ import (
 type awsIotCoreMQTT struct {
 	awsIotCoreEndpoint string
 	awsIotCoreCA       string
-	logsChannel        chan MQTTLog
-	mqttClient         *MQTT.Client
+	telemetryTopic     string
+	// deviceTelemetryTopic is telemetryTopic expanded for the connected
+	// device.
+	deviceTelemetryTopic string
+	logsChannel          chan MQTTLog
+	mqttClient           *MQTT.Client
+	connectionHandler    ConnectionHandler
 }
 
-func NewAWSIoTCoreMQTTClient(endpoint, awsIotCoreCA string, logsChannel chan MQTTLog) MqttDeviceService {
+// NewAWSIoTCoreMQTTClient publishes the telemetry on telemetryTopic, a
+// template expanded by ExpandTemplate.
+func NewAWSIoTCoreMQTTClient(endpoint, awsIotCoreCA, telemetryTopic string, logsChannel chan MQTTLog) MqttDeviceService {
 	return &awsIotCoreMQTT{
 		awsIotCoreEndpoint: endpoint,
 		awsIotCoreCA:       awsIotCoreCA,
+		telemetryTopic:     telemetryTopic,
 		logsChannel:        logsChannel,
 	}
 }
 
-func (c *awsIotCoreMQTT) Connect(certificate *x509.Certificate, key *rsa.PrivateKey, deviceID string) error {
+func (c *awsIotCoreMQTT) Connect(certificate *x509.Certificate, key crypto.Signer, deviceID string) error {
 	certpool := x509.NewCertPool()
 	pemCerts, err := ioutil.ReadFile(c.awsIotCoreCA)
 	if err != nil {
@@ -36,15 +43,7 @@ func (c *awsIotCoreMQTT) Connect(certificate *x509.Certificate, key *rsa.Private
 
 	certpool.AppendCertsFromPEM(pemCerts)
 
-	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
-	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-
-	// pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.certificate.Raw})
-	// pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(c.key)})
-	tlsCert, err := tls.X509KeyPair(pemCert, pemKey)
-	if err != nil {
-		return err
-	}
+	tlsCert := clientCertificate(certificate, key)
 
 	tlsconfig := &tls.Config{
 		RootCAs:            certpool,
@@ -58,6 +57,7 @@ func (c *awsIotCoreMQTT) Connect(certificate *x509.Certificate, key *rsa.Private
 	opts.SetTLSConfig(tlsconfig)
 	opts.SetDefaultPublishHandler(c.DefaultMessageHandler)
 	opts.SetConnectionLostHandler(c.onConnectionLostHandler)
+	opts.SetOnConnectHandler(c.onConnectHandler)
 
 	mqttClient := MQTT.NewClient(opts)
 	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeInfo, Title: "Connecting to AWS IoT Core ..."}
@@ -81,11 +81,27 @@ func (c *awsIotCoreMQTT) Connect(certificate *x509.Certificate, key *rsa.Private
 	}
 
 	c.mqttClient = &mqttClient
+	c.deviceTelemetryTopic = ExpandTemplate(c.telemetryTopic, certificate, deviceID)
 	return nil
 }
 
+func (c *awsIotCoreMQTT) SetConnectionHandler(handler ConnectionHandler) {
+	c.connectionHandler = handler
+}
+
 func (c *awsIotCoreMQTT) onConnectionLostHandler(cl MQTT.Client, reason error) {
 	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: "Connection Lost: " + reason.Error()}
+	if c.connectionHandler != nil {
+		c.connectionHandler(false, reason)
+	}
+}
+
+// onConnectHandler runs on the first connection and on every automatic
+// reconnection.
+func (c *awsIotCoreMQTT) onConnectHandler(cl MQTT.Client) {
+	if c.connectionHandler != nil {
+		c.connectionHandler(true, nil)
+	}
 }
 
 func (c *awsIotCoreMQTT) DefaultMessageHandler(client MQTT.Client, msg MQTT.Message) {
@@ -93,17 +109,17 @@ func (c *awsIotCoreMQTT) DefaultMessageHandler(client MQTT.Client, msg MQTT.Mess
 }
 
 func (c *awsIotCoreMQTT) Publish(topic string, payload []byte) error {
-	if condition := (*c.mqttClient).IsConnected(); !condition {
-		fmt.Println("Not connected. Not publishing message: " + string(payload))
-		return nil
+	if !c.IsConnected() {
+		c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: "<< " + topic, Message: ErrNotConnected.Error()}
+		return ErrNotConnected
 	}
 
 	resp := (*c.mqttClient).Publish(topic, 0, false, payload)
-	if resp.WaitTimeout(time.Second*5) && resp.Error() != nil {
-		c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: "<< " + topic, Message: string(payload)}
-		return resp.Error()
+	if err := waitForToken(resp); err != nil {
+		c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: "<< " + topic, Message: logPayload(payload)}
+		return err
 	}
-	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeInfo, Title: "<< " + topic, Message: string(payload)}
+	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeInfo, Title: "<< " + topic, Message: logPayload(payload)}
 	return nil
 }
 
@@ -116,20 +132,29 @@ func (c *awsIotCoreMQTT) Subscribe(topic string, callback func(topic string, pay
 		callback(topic, payload)
 	}
 	resp := (*c.mqttClient).Subscribe(topic, 0, loggerFunc)
-	if resp.WaitTimeout(time.Second*5) && resp.Error() != nil {
+	if err := waitForToken(resp); err != nil {
 		c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: "[Subscribe] " + topic}
-		return resp.Error()
+		return err
 	}
 	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeInfo, Title: "[Subscribe] " + topic}
 	return nil
 }
 
+func (c *awsIotCoreMQTT) Topic(kind TopicKind) string {
+	if kind == TopicTelemetry {
+		return c.deviceTelemetryTopic
+	}
+	return ""
+}
+
 func (c *awsIotCoreMQTT) Disconnect() error {
 	fmt.Println("disconnecting")
-	(*c.mqttClient).Disconnect(uint(time.Second))
+	if c.mqttClient != nil {
+		(*c.mqttClient).Disconnect(uint(time.Second))
+	}
 	return nil
 }
 
 func (c *awsIotCoreMQTT) IsConnected() bool {
-	return (*c.mqttClient).IsConnected()
+	return c.mqttClient != nil && (*c.mqttClient).IsConnected()
 }
@@ -1,7 +1,7 @@
 package mqtt
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
@@ -20,6 +20,8 @@ type azureIotHubMQTT struct {
 	azureScopeID        string
 	logsChannel         chan MQTTLog
 	mqttClient          *MQTT.Client
+	deviceID            string
+	connectionHandler   ConnectionHandler
 }
 
 func NewAzureIotHubMQTTClient(azureIotHubEndpoint, azureIotHubCA string, azureDpsEndpoint string, azureScopeID string, logsChannel chan MQTTLog) MqttDeviceService {
@@ -32,7 +34,7 @@ func NewAzureIotHubMQTTClient(azureIotHubEndpoint, azureIotHubCA string, azureDp
 	}
 }
 
-func (c *azureIotHubMQTT) Connect(certificate *x509.Certificate, key *rsa.PrivateKey, deviceID string) error {
+func (c *azureIotHubMQTT) Connect(certificate *x509.Certificate, key crypto.Signer, deviceID string) error {
 	certpool := x509.NewCertPool()
 	pemCerts, err := ioutil.ReadFile(c.azureIotHubCA)
 	if err != nil {
@@ -42,15 +44,9 @@ func (c *azureIotHubMQTT) Connect(certificate *x509.Certificate, key *rsa.Privat
 	certpool.AppendCertsFromPEM(pemCerts)
 
 	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
-	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-
 	fmt.Println(string(pemCert))
-	fmt.Println(string(pemKey))
 
-	tlsCert, err := tls.X509KeyPair(pemCert, pemKey)
-	if err != nil {
-		return err
-	}
+	tlsCert := clientCertificate(certificate, key)
 
 	tlsconfig := &tls.Config{
 		RootCAs:            certpool,
@@ -106,7 +102,10 @@ func (c *azureIotHubMQTT) Connect(certificate *x509.Certificate, key *rsa.Privat
 	hubOpts.SetClientID(deviceID)
 	hubOpts.SetTLSConfig(tlsconfig)
 	hubOpts.SetDefaultPublishHandler(c.DefaultMessageHandler)
+	hubOpts.SetConnectionLostHandler(c.onConnectionLostHandler)
+	hubOpts.SetOnConnectHandler(c.onConnectHandler)
 
+	c.deviceID = deviceID
 	hubUsername := fmt.Sprintf("%s/%s/api-version=2016-11-14", c.azureIotHubEndpoint, deviceID)
 	hubOpts.SetUsername(hubUsername)
 
@@ -127,17 +126,41 @@ func (c *azureIotHubMQTT) Connect(certificate *x509.Certificate, key *rsa.Privat
 	return nil
 }
 
+func (c *azureIotHubMQTT) SetConnectionHandler(handler ConnectionHandler) {
+	c.connectionHandler = handler
+}
+
+// The handlers are only set on the IoT Hub connection, the DPS one is closed
+// once the device is registered.
+func (c *azureIotHubMQTT) onConnectionLostHandler(cl MQTT.Client, reason error) {
+	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: "Connection Lost: " + reason.Error()}
+	if c.connectionHandler != nil {
+		c.connectionHandler(false, reason)
+	}
+}
+
+func (c *azureIotHubMQTT) onConnectHandler(cl MQTT.Client) {
+	if c.connectionHandler != nil {
+		c.connectionHandler(true, nil)
+	}
+}
+
 func (c *azureIotHubMQTT) DefaultMessageHandler(client MQTT.Client, msg MQTT.Message) {
 	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeInfo, Title: ">> Incoming messgae - using default message handler for topic: " + msg.Topic(), Message: string(msg.Payload())}
 }
 
 func (c *azureIotHubMQTT) Publish(topic string, payload []byte) error {
+	if !c.IsConnected() {
+		c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: "<< " + topic, Message: ErrNotConnected.Error()}
+		return ErrNotConnected
+	}
+
 	resp := (*c.mqttClient).Publish(topic, 0, false, payload)
-	if resp.WaitTimeout(time.Second*5) && resp.Error() != nil {
-		c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: "<< " + topic, Message: string(payload)}
-		return resp.Error()
+	if err := waitForToken(resp); err != nil {
+		c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: "<< " + topic, Message: logPayload(payload)}
+		return err
 	}
-	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeInfo, Title: "<< " + topic, Message: string(payload)}
+	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeInfo, Title: "<< " + topic, Message: logPayload(payload)}
 	return nil
 }
 
@@ -149,19 +172,30 @@ func (c *azureIotHubMQTT) Subscribe(topic string, callback func(topic string, pa
 		callback(topic, payload)
 	}
 	resp := (*c.mqttClient).Subscribe(topic, 0, loggerFunc)
-	if resp.WaitTimeout(time.Second*5) && resp.Error() != nil {
+	if err := waitForToken(resp); err != nil {
 		c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: ">> " + topic}
-		return resp.Error()
+		return err
 	}
 	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeInfo, Title: ">> " + topic}
 	return nil
 }
 
+// Topic returns the device-to-cloud events topic for the telemetry, the
+// message properties are appended to it.
+func (c *azureIotHubMQTT) Topic(kind TopicKind) string {
+	if kind == TopicTelemetry && c.deviceID != "" {
+		return "devices/" + c.deviceID + "/messages/events/"
+	}
+	return ""
+}
+
 func (c *azureIotHubMQTT) Disconnect() error {
-	(*c.mqttClient).Disconnect(uint(time.Second))
+	if c.mqttClient != nil {
+		(*c.mqttClient).Disconnect(uint(time.Second))
+	}
 	return nil
 }
 
 func (c *azureIotHubMQTT) IsConnected() bool {
-	return (*c.mqttClient).IsConnected()
+	return c.mqttClient != nil && (*c.mqttClient).IsConnected()
 }
@@ -0,0 +1,223 @@
+package mqtt
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// GenericBrokerConfig describes an MQTT 3.1.1 broker such as Mosquitto, EMQX
+// or HiveMQ. ClientID, Username and the topics are templates, see
+// ExpandTemplate.
+type GenericBrokerConfig struct {
+	Host string
+	// Port defaults to 8883 with TLS and to 1883 without.
+	Port int
+	TLS  bool
+	// CA verifies the broker certificate, the system roots are used when it
+	// is empty.
+	CA                 string
+	InsecureSkipVerify bool
+	// ClientCertificate presents the slot certificate in the TLS handshake.
+	// Without it and without Username the connection is anonymous.
+	ClientCertificate bool
+	ClientID          string
+	Username          string
+	Password          string
+	QoS               byte
+	Retain            bool
+	KeepAlive         time.Duration
+	// The last will is published by the broker when the device goes away
+	// without disconnecting, an empty WillTopic leaves it out.
+	WillTopic   string
+	WillPayload string
+	WillQoS     byte
+	WillRetain  bool
+	Topics      map[TopicKind]string
+}
+
+type genericBrokerMQTT struct {
+	config            GenericBrokerConfig
+	logsChannel       chan MQTTLog
+	mqttClient        *MQTT.Client
+	connectionHandler ConnectionHandler
+	topics            map[TopicKind]string
+}
+
+var templatePlaceholder = regexp.MustCompile(`\{([a-z_]*)\}`)
+
+// templateVariables are the placeholders of the templates: the id the device
+// connects with and the subject of its certificate.
+var templateVariables = []string{"device_id", "common_name"}
+
+// ValidateTemplate rejects unknown placeholders, which would otherwise end up
+// verbatim in the topics.
+func ValidateTemplate(template string) error {
+	for _, match := range templatePlaceholder.FindAllStringSubmatch(template, -1) {
+		known := false
+		for _, variable := range templateVariables {
+			known = known || match[1] == variable
+		}
+		if !known {
+			return fmt.Errorf("unknown placeholder %s, expected one of {%s}", match[0], strings.Join(templateVariables, "}, {"))
+		}
+	}
+	return nil
+}
+
+// ExpandTemplate replaces {device_id} and {common_name} in the template.
+func ExpandTemplate(template string, certificate *x509.Certificate, deviceID string) string {
+	return strings.NewReplacer(
+		"{device_id}", deviceID,
+		"{common_name}", certificate.Subject.CommonName,
+	).Replace(template)
+}
+
+func NewGenericBrokerMQTTClient(config GenericBrokerConfig, logsChannel chan MQTTLog) MqttDeviceService {
+	if config.Port == 0 {
+		config.Port = 1883
+		if config.TLS {
+			config.Port = 8883
+		}
+	}
+	return &genericBrokerMQTT{
+		config:      config,
+		logsChannel: logsChannel,
+	}
+}
+
+func (c *genericBrokerMQTT) Connect(certificate *x509.Certificate, key crypto.Signer, deviceID string) error {
+	opts := MQTT.NewClientOptions()
+	scheme := "tcp"
+	if c.config.TLS {
+		tlsconfig := &tls.Config{
+			ServerName:         c.config.Host,
+			InsecureSkipVerify: c.config.InsecureSkipVerify,
+		}
+		if c.config.CA != "" {
+			pemCerts, err := os.ReadFile(c.config.CA)
+			if err != nil {
+				return err
+			}
+			certpool := x509.NewCertPool()
+			if !certpool.AppendCertsFromPEM(pemCerts) {
+				return errors.New("no certificate found in the broker CA file " + c.config.CA)
+			}
+			tlsconfig.RootCAs = certpool
+		}
+		if c.config.ClientCertificate {
+			tlsconfig.Certificates = []tls.Certificate{clientCertificate(certificate, key)}
+		}
+		opts.SetTLSConfig(tlsconfig)
+		scheme = "tls"
+	}
+
+	opts.AddBroker(scheme + "://" + net.JoinHostPort(c.config.Host, strconv.Itoa(c.config.Port)))
+	opts.SetClientID(ExpandTemplate(c.config.ClientID, certificate, deviceID))
+	if c.config.Username != "" {
+		opts.SetUsername(ExpandTemplate(c.config.Username, certificate, deviceID))
+		opts.SetPassword(c.config.Password)
+	}
+	if c.config.KeepAlive > 0 {
+		opts.SetKeepAlive(c.config.KeepAlive)
+	}
+	if c.config.WillTopic != "" {
+		opts.SetWill(ExpandTemplate(c.config.WillTopic, certificate, deviceID), c.config.WillPayload, c.config.WillQoS, c.config.WillRetain)
+	}
+	opts.SetDefaultPublishHandler(c.DefaultMessageHandler)
+	opts.SetConnectionLostHandler(c.onConnectionLostHandler)
+	opts.SetOnConnectHandler(c.onConnectHandler)
+
+	c.topics = map[TopicKind]string{}
+	for kind, template := range c.config.Topics {
+		c.topics[kind] = ExpandTemplate(template, certificate, deviceID)
+	}
+
+	mqttClient := MQTT.NewClient(opts)
+	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeInfo, Title: fmt.Sprintf("Connecting to MQTT broker %s:%d ...", c.config.Host, c.config.Port)}
+
+	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
+		c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: "Error connecting to MQTT broker: " + token.Error().Error()}
+		return token.Error()
+	}
+
+	c.mqttClient = &mqttClient
+	return nil
+}
+
+func (c *genericBrokerMQTT) SetConnectionHandler(handler ConnectionHandler) {
+	c.connectionHandler = handler
+}
+
+func (c *genericBrokerMQTT) onConnectionLostHandler(cl MQTT.Client, reason error) {
+	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: "Connection Lost: " + reason.Error()}
+	if c.connectionHandler != nil {
+		c.connectionHandler(false, reason)
+	}
+}
+
+func (c *genericBrokerMQTT) onConnectHandler(cl MQTT.Client) {
+	if c.connectionHandler != nil {
+		c.connectionHandler(true, nil)
+	}
+}
+
+func (c *genericBrokerMQTT) DefaultMessageHandler(client MQTT.Client, msg MQTT.Message) {
+	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeInfo, Title: ">> Incoming message - using default message handler for topic: " + msg.Topic(), Message: string(msg.Payload())}
+}
+
+func (c *genericBrokerMQTT) Publish(topic string, payload []byte) error {
+	if !c.IsConnected() {
+		c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: "<< " + topic, Message: ErrNotConnected.Error()}
+		return ErrNotConnected
+	}
+
+	resp := (*c.mqttClient).Publish(topic, c.config.QoS, c.config.Retain, payload)
+	if err := waitForToken(resp); err != nil {
+		c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: "<< " + topic, Message: logPayload(payload)}
+		return err
+	}
+	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeInfo, Title: "<< " + topic, Message: logPayload(payload)}
+	return nil
+}
+
+func (c *genericBrokerMQTT) Subscribe(topic string, callback func(topic string, payload []byte)) error {
+	loggerFunc := func(client MQTT.Client, msg MQTT.Message) {
+		payload := msg.Payload()
+		topic := msg.Topic()
+		c.logsChannel <- MQTTLog{Type: MQTTTLogTypeInfo, Title: ">> " + topic, Message: string(payload)}
+		callback(topic, payload)
+	}
+	resp := (*c.mqttClient).Subscribe(topic, c.config.QoS, loggerFunc)
+	if err := waitForToken(resp); err != nil {
+		c.logsChannel <- MQTTLog{Type: MQTTTLogTypeError, Title: "[Subscribe] " + topic}
+		return err
+	}
+	c.logsChannel <- MQTTLog{Type: MQTTTLogTypeInfo, Title: "[Subscribe] " + topic}
+	return nil
+}
+
+func (c *genericBrokerMQTT) Topic(kind TopicKind) string {
+	return c.topics[kind]
+}
+
+func (c *genericBrokerMQTT) Disconnect() error {
+	if c.mqttClient != nil {
+		(*c.mqttClient).Disconnect(uint(time.Second / time.Millisecond))
+	}
+	return nil
+}
+
+func (c *genericBrokerMQTT) IsConnected() bool {
+	return c.mqttClient != nil && (*c.mqttClient).IsConnected()
+}
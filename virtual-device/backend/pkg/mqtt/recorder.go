@@ -0,0 +1,84 @@
+package mqtt
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"time"
+
+	"github.com/lamassuiot/lamassu-simulation-tools/common/session"
+)
+
+type recordingMqttDeviceService struct {
+	inner    MqttDeviceService
+	provider string
+	recorder *session.Recorder
+}
+
+// NewRecordingMqttDeviceService wraps a provider so that every publish is
+// appended to the session, in the layout of the vDMS records so both files
+// can be replayed together. Subscriptions and connections are not recorded.
+func NewRecordingMqttDeviceService(inner MqttDeviceService, provider string, recorder *session.Recorder) MqttDeviceService {
+	return &recordingMqttDeviceService{
+		inner:    inner,
+		provider: provider,
+		recorder: recorder,
+	}
+}
+
+func (c *recordingMqttDeviceService) Connect(certificate *x509.Certificate, key crypto.Signer, deviceID string) error {
+	return c.inner.Connect(certificate, key, deviceID)
+}
+
+func (c *recordingMqttDeviceService) SetConnectionHandler(handler ConnectionHandler) {
+	c.inner.SetConnectionHandler(handler)
+}
+
+func (c *recordingMqttDeviceService) IsConnected() bool {
+	return c.inner.IsConnected()
+}
+
+func (c *recordingMqttDeviceService) Publish(topic string, payload []byte) error {
+	start := time.Now()
+	err := c.inner.Publish(topic, payload)
+
+	// The payload is binary with CBOR telemetry, the encoder writes the bytes
+	// as base64 so they replay as published.
+	request, _ := json.Marshal(struct {
+		Provider        string `json:"provider"`
+		Topic           string `json:"topic"`
+		Payload         []byte `json:"payload"`
+		PayloadEncoding string `json:"payload_encoding"`
+	}{
+		Provider:        c.provider,
+		Topic:           topic,
+		Payload:         payload,
+		PayloadEncoding: "base64",
+	})
+
+	record := session.Record{
+		Kind:       session.RecordKindMQTTPublish,
+		Operation:  topic,
+		Timestamp:  start,
+		DurationMs: time.Since(start).Milliseconds(),
+		Request:    request,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	c.recorder.Record(record)
+
+	return err
+}
+
+func (c *recordingMqttDeviceService) Subscribe(topic string, callback func(topic string, payload []byte)) error {
+	return c.inner.Subscribe(topic, callback)
+}
+
+func (c *recordingMqttDeviceService) Topic(kind TopicKind) string {
+	return c.inner.Topic(kind)
+}
+
+func (c *recordingMqttDeviceService) Disconnect() error {
+	return c.inner.Disconnect()
+}
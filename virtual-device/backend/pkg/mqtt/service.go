@@ -1,8 +1,16 @@
 package mqtt
 
 import (
-	"crypto/rsa"
+	"crypto"
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
 type MQTTTLogType string
@@ -20,12 +28,67 @@ type MQTTLog struct {
 	Timestamp int          `json:"timestamp"`
 }
 
+// TopicKind names the topics a device uses beside the ones of its provider
+// protocol, such as the Azure twin or the AWS shadow.
+type TopicKind string
+
+const (
+	TopicTelemetry TopicKind = "telemetry"
+	// TopicCommands carries the requests sent to the device, e.g.
+	// {"require_reenrollment": true}.
+	TopicCommands TopicKind = "commands"
+)
+
+// ConnectionHandler is told when an established connection is lost, with the
+// reason, and when the client has connected again on its own.
+type ConnectionHandler func(connected bool, err error)
+
 type MqttDeviceService interface {
-	Connect(certificate *x509.Certificate, key *rsa.PrivateKey, deviceID string) error
+	Connect(certificate *x509.Certificate, key crypto.Signer, deviceID string) error
 	IsConnected() bool
+	// SetConnectionHandler is called before Connect.
+	SetConnectionHandler(handler ConnectionHandler)
 
 	Publish(topic string, payload []byte) error
 	Subscribe(topic string, callback func(topic string, payload []byte)) error
+	// Topic returns the topic of the connected device, empty when the
+	// provider has none of the kind.
+	Topic(kind TopicKind) string
 
 	Disconnect() error
 }
+
+// operationTimeout bounds the wait for the broker to acknowledge a publish or
+// a subscription.
+const operationTimeout = 5 * time.Second
+
+// ErrNotConnected is returned by Publish while the client is not connected.
+var ErrNotConnected = errors.New("not connected to the MQTT broker")
+
+// waitForToken waits for the broker to complete the operation, not hearing
+// back in time is an error too.
+func waitForToken(token MQTT.Token) error {
+	if !token.WaitTimeout(operationTimeout) {
+		return fmt.Errorf("no response from the MQTT broker after %s", operationTimeout)
+	}
+	return token.Error()
+}
+
+// logPayload returns the payload as shown in the MQTT logs. Binary payloads,
+// such as CBOR telemetry, are shown in hex.
+func logPayload(payload []byte) string {
+	if utf8.Valid(payload) {
+		return string(payload)
+	}
+	return hex.EncodeToString(payload)
+}
+
+// clientCertificate presents the slot certificate in the TLS handshake. The
+// key signs the handshake in place, it does not need to be exportable.
+func clientCertificate(certificate *x509.Certificate, key crypto.Signer) tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{certificate.Raw},
+		PrivateKey:  key,
+		Leaf:        certificate,
+	}
+}
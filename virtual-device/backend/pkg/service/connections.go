@@ -0,0 +1,259 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/mqtt"
+	"golang.org/x/exp/slices"
+)
+
+// MqttClientFactory returns a new client of the cloud provider, every slot
+// connection holds its own.
+type MqttClientFactory func(cloudProvider model.CloudProviderType) (mqtt.MqttDeviceService, error)
+
+// ConnectCloudProvider binds the slot to the cloud provider and connects it
+// with the slot certificate. An empty provider connects the slot to the one it
+// is bound to. The connection the slot already had is closed first.
+func (d *DeviceServiceImpl) ConnectCloudProvider(cloudProvider model.CloudProviderType, slotID string) error {
+	device := d.deviceStore.GetDeviceState()
+	idx := slices.IndexFunc(device.Slots, func(s model.Slot) bool { return s.ID == slotID })
+	if idx == -1 {
+		return fmt.Errorf("slot with id %s not found", slotID)
+	}
+
+	slot := device.Slots[idx]
+	if cloudProvider == "" {
+		cloudProvider = slot.CloudProvider
+	}
+	if cloudProvider == "" {
+		return fmt.Errorf("slot %s is not bound to a cloud provider", slotID)
+	}
+	if slot.Certificate == nil || slot.PrivateKey == nil {
+		return fmt.Errorf("slot %s is not enrolled", slotID)
+	}
+
+	d.closeConnection(slotID)
+
+	mqttClient, err := d.newMqttClient(cloudProvider)
+	if err != nil {
+		d.updateConnection(slotID, func(slot *model.Slot) {
+			slot.CloudProvider = cloudProvider
+			slot.ConnectionStatus = model.ConnectionStatusFailed
+			slot.ConnectionError = err.Error()
+		})
+		return fmt.Errorf("error connecting slot %s to %s: %v", slotID, cloudProvider, err)
+	}
+
+	d.updateConnection(slotID, func(slot *model.Slot) {
+		slot.CloudProvider = cloudProvider
+		slot.ConnectionStatus = model.ConnectionStatusConnecting
+		slot.ConnectionError = ""
+	})
+
+	// The client is registered before connecting, its handler ignores the
+	// events of clients replaced in the meantime.
+	mqttClient.SetConnectionHandler(func(connected bool, err error) {
+		d.connectionChanged(slotID, mqttClient, connected, err)
+	})
+	d.connectionsLock.Lock()
+	d.connections[slotID] = mqttClient
+	d.connectionsLock.Unlock()
+
+	clientID := slot.Certificate.Subject.CommonName
+	if clientID == "" {
+		clientID = device.SerialNumber
+	}
+
+	err = mqttClient.Connect(slot.Certificate, slot.PrivateKey, clientID)
+	if err != nil {
+		d.connectionsLock.Lock()
+		if d.connections[slotID] == mqttClient {
+			delete(d.connections, slotID)
+		}
+		d.connectionsLock.Unlock()
+
+		d.updateConnection(slotID, func(slot *model.Slot) {
+			slot.ConnectionStatus = model.ConnectionStatusFailed
+			slot.ConnectionError = err.Error()
+		})
+		return fmt.Errorf("error connecting slot %s to %s: %v", slotID, cloudProvider, err)
+	}
+
+	d.updateConnection(slotID, func(slot *model.Slot) {
+		slot.ConnectionStatus = model.ConnectionStatusConnected
+	})
+	fmt.Printf("slot %s of %s connected to %s as %s\n", slotID, device.SerialNumber, cloudProvider, clientID)
+
+	d.subscribeCloudProvider(cloudProvider, mqttClient, slotID, clientID)
+	return nil
+}
+
+// DisconnectCloudProvider closes the connection of the slot, which stays
+// bound to its cloud provider.
+func (d *DeviceServiceImpl) DisconnectCloudProvider(slotID string) error {
+	d.connectionsLock.Lock()
+	mqttClient := d.connections[slotID]
+	delete(d.connections, slotID)
+	d.connectionsLock.Unlock()
+
+	if mqttClient == nil {
+		return fmt.Errorf("slot %s is not connected", slotID)
+	}
+
+	err := mqttClient.Disconnect()
+	d.updateConnection(slotID, func(slot *model.Slot) {
+		slot.ConnectionStatus = model.ConnectionStatusDisconnected
+		slot.ConnectionError = ""
+	})
+	if err != nil {
+		return fmt.Errorf("error disconnecting slot %s: %v", slotID, err)
+	}
+	return nil
+}
+
+func (d *DeviceServiceImpl) connection(slotID string) mqtt.MqttDeviceService {
+	d.connectionsLock.Lock()
+	defer d.connectionsLock.Unlock()
+	return d.connections[slotID]
+}
+
+// closeConnection drops the connection of the slot, if any, leaving its
+// status to the caller.
+func (d *DeviceServiceImpl) closeConnection(slotID string) {
+	d.connectionsLock.Lock()
+	mqttClient := d.connections[slotID]
+	delete(d.connections, slotID)
+	d.connectionsLock.Unlock()
+
+	if mqttClient != nil {
+		err := mqttClient.Disconnect()
+		if err != nil {
+			fmt.Printf("error disconnecting slot %s: %v\n", slotID, err)
+		}
+	}
+}
+
+func (d *DeviceServiceImpl) disconnectAll() {
+	d.connectionsLock.Lock()
+	slotIDs := []string{}
+	for slotID := range d.connections {
+		slotIDs = append(slotIDs, slotID)
+	}
+	d.connectionsLock.Unlock()
+
+	for _, slotID := range slotIDs {
+		d.DisconnectCloudProvider(slotID)
+	}
+}
+
+// connectionChanged follows a connection lost and brought back by its client.
+func (d *DeviceServiceImpl) connectionChanged(slotID string, mqttClient mqtt.MqttDeviceService, connected bool, err error) {
+	if d.connection(slotID) != mqttClient {
+		return
+	}
+
+	d.updateConnection(slotID, func(slot *model.Slot) {
+		if connected {
+			slot.ConnectionStatus = model.ConnectionStatusConnected
+			slot.ConnectionError = ""
+			return
+		}
+		slot.ConnectionStatus = model.ConnectionStatusReconnecting
+		if err != nil {
+			slot.ConnectionError = err.Error()
+		}
+	})
+}
+
+// updateConnection applies the change to the slot and keeps MqttConnected
+// telling whether any slot is connected.
+func (d *DeviceServiceImpl) updateConnection(slotID string, change func(slot *model.Slot)) {
+	d.deviceStore.UpdateDeviceState(func(device *model.DeviceState) {
+		idx := slices.IndexFunc(device.Slots, func(s model.Slot) bool { return s.ID == slotID })
+		if idx == -1 {
+			return
+		}
+		change(&device.Slots[idx])
+
+		device.MqttConnected = false
+		for _, slot := range device.Slots {
+			if slot.ConnectionStatus == model.ConnectionStatusConnected {
+				device.MqttConnected = true
+			}
+		}
+	})
+}
+
+// subscribeCloudProvider listens to the re-enrollment requests of the cloud
+// provider: the desired properties of the Azure device twin, the AWS thing
+// shadow and the commands topic of a generic broker.
+func (d *DeviceServiceImpl) subscribeCloudProvider(cloudProvider model.CloudProviderType, mqttClient mqtt.MqttDeviceService, slotID, clientID string) {
+	reenrollRequested := func(topic string, payload []byte) {
+		var req struct {
+			Reenroll bool   `json:"require_reenrollment"`
+			Version  string `json:"version"`
+		}
+		json.Unmarshal(payload, &req)
+		if req.Reenroll {
+			d.Reenroll(slotID)
+		}
+	}
+
+	switch cloudProvider {
+	case model.CouldProviderTypeAzure:
+		err := mqttClient.Subscribe("$iothub/twin/PATCH/properties/desired/#", reenrollRequested)
+		if err != nil {
+			fmt.Println("could not subscribe to azure twin topic", err)
+		}
+
+	case model.CloudProviderTypeGeneric:
+		if topic := mqttClient.Topic(mqtt.TopicCommands); topic != "" {
+			err := mqttClient.Subscribe(topic, reenrollRequested)
+			if err != nil {
+				fmt.Println("could not subscribe to commands topic", err)
+			}
+		}
+
+	case model.CloudProviderTypeAWS:
+		mqttClient.Subscribe(fmt.Sprintf("$aws/things/%s", clientID), func(topic string, payload []byte) {
+			fmt.Printf("====================================ACCEPTED==========================================\n")
+			fmt.Printf("TOPIC: %s\n", topic)
+			fmt.Printf("MSG: %s\n", payload)
+			fmt.Printf("==============================================================================\n\n")
+		})
+
+		// significa que no hay shadow y hay que crearlo
+		mqttClient.Subscribe(fmt.Sprintf("$aws/things/%s/shadow/get/rejected", clientID), func(topic string, payload []byte) {
+			fmt.Printf("====================================REJECTED==========================================\n")
+			fmt.Printf("TOPIC: %s\n", topic)
+			fmt.Printf("MSG: %s\n", payload)
+			fmt.Printf("Publishing on update topic to create device shadow\n")
+			fmt.Printf("==============================================================================\n\n")
+
+			deviceState := `{
+				"state": {
+					"reported" : {
+						"need_rotation" : false
+					}
+				}
+			}`
+			mqttClient.Publish(fmt.Sprintf("$aws/things/%s/shadow/update", clientID), []byte(deviceState))
+			fmt.Printf("==============================================================================\n")
+		})
+
+		mqttClient.Subscribe(fmt.Sprintf("$aws/things/%s/shadow/update/delta", clientID), func(topic string, payload []byte) {
+			fmt.Printf("====================================DELTA==========================================\n")
+			fmt.Printf("TOPIC: %s\n", topic)
+			fmt.Printf("MSG: %s\n", payload)
+			fmt.Printf("Here goes the reenrollment process.")
+			fmt.Printf("==============================================================================\n\n")
+		})
+		time.Sleep(time.Second * 2)
+
+		mqttClient.Publish(fmt.Sprintf("$aws/things/%s/shadow/get", clientID), []byte{})
+		time.Sleep(time.Second * 2)
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
-	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
@@ -12,89 +12,280 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
 	mathRand "math/rand"
 	"net/http"
-	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jakehl/goid"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/keyprovider"
 	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
 	"github.com/lamassuiot/lamassu-vdevice/pkg/mqtt"
 	"github.com/lamassuiot/lamassu-vdevice/pkg/service/store"
-	estClient "github.com/lamassuiot/lamassuiot/pkg/est/client"
-	"github.com/lamassuiot/lamassuiot/pkg/utils"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/telemetry"
 	"github.com/robfig/cron/v3"
 	"golang.org/x/exp/slices"
 )
 
+const defaultEnrollmentRetryAfter = 10 // in seconds
+const defaultQueuedEnrollmentTimeout = 30 * time.Minute
+
 type DeviceServiceImpl struct {
 	deviceStore *store.DeviceStateStore
 
 	cronInstance        *cron.Cron
 	telemetryDataCronID *cron.EntryID
+	// telemetryOffset spreads the telemetry of fleet devices sharing the
+	// scheduler over the interval, in seconds.
+	telemetryOffset int
 
 	dmsUrl            string
 	lamassuGatewayURL string
+	defaults          DeviceDefaults
+	// identityStore persists the identity across restarts, nil keeps it in
+	// memory only.
+	identityStore IdentityStore
+	// keyProviders generate and keep the slot keys, see
+	// DeviceDefaults.KeyProvider.
+	keyProviders keyprovider.Registry
+
+	// newMqttClient creates the client of every slot connection, the open
+	// ones are kept by slot id.
+	newMqttClient   MqttClientFactory
+	connectionsLock sync.Mutex
+	connections     map[string]mqtt.MqttDeviceService
+}
 
-	mqttProviderInstances map[model.CloudProviderType]mqtt.MqttDeviceService
+// IdentityStore persists the identity of a device, see the keystore package.
+type IdentityStore interface {
+	store.Persister
+	// Load returns the persisted identity, nil when there is none.
+	Load() (*model.DeviceState, error)
+	Delete() error
 }
 
 type DeviceService interface {
 	ResetDeviceState()
+	FactoryReset()
 
 	GenerateNewSlot()
+	SetSlotKeyAlgorithm(slotID string, algorithm model.KeyAlgorithm) error
 
+	SetEnrollmentToken(token string)
 	Enroll(slotID string) error
 	Reenroll(slotID string) error
 
 	ConnectCloudProvider(cloudProvider model.CloudProviderType, slotID string) error
-	DisconnectCloudProvider()
+	DisconnectCloudProvider(slotID string) error
 
 	GetSensorData()
 	UpdateGetSensorDataInterval(interval int) // in seconds
 }
 
+// DeviceDefaults describe the device created for every new identity.
+type DeviceDefaults struct {
+	// SerialNumber is only used for the first identity, a random one is
+	// generated when empty.
+	SerialNumber         string
+	Model                string
+	Slots                []string
+	TelemetryRateSeconds int
+	// TelemetryEncoding is the payload encoding of the published readings,
+	// JSON when empty. TelemetryProperties are sent along every reading.
+	TelemetryEncoding   telemetry.Encoding
+	TelemetryProperties map[string]string
+	// KeyAlgorithm is the key algorithm of the slots, SlotKeyAlgorithms
+	// overrides it by slot id.
+	KeyAlgorithm      model.KeyAlgorithm
+	SlotKeyAlgorithms map[string]model.KeyAlgorithm
+	// KeyProvider is the key provider of the slots, SlotKeyProviders
+	// overrides it by slot id.
+	KeyProvider      string
+	SlotKeyProviders map[string]string
+	// SlotCloudProviders binds slots to a cloud provider, the others are
+	// bound on their first connection.
+	SlotCloudProviders map[string]model.CloudProviderType
+	// QueuedEnrollmentTimeout bounds the polling of an enrollment the vDMS
+	// queued, 30 minutes when zero.
+	QueuedEnrollmentTimeout time.Duration
+	Renewal                 RenewalPolicy
+}
+
+func (d DeviceDefaults) queuedEnrollmentTimeout() time.Duration {
+	if d.QueuedEnrollmentTimeout > 0 {
+		return d.QueuedEnrollmentTimeout
+	}
+	return defaultQueuedEnrollmentTimeout
+}
+
+func (d DeviceDefaults) slotKeyAlgorithm(slotID string) model.KeyAlgorithm {
+	if algorithm, ok := d.SlotKeyAlgorithms[slotID]; ok {
+		return algorithm
+	}
+	if d.KeyAlgorithm != "" {
+		return d.KeyAlgorithm
+	}
+	return model.DefaultKeyAlgorithm
+}
+
+func (d DeviceDefaults) slotKeyProvider(slotID string) string {
+	if provider, ok := d.SlotKeyProviders[slotID]; ok {
+		return provider
+	}
+	if d.KeyProvider != "" {
+		return d.KeyProvider
+	}
+	return keyprovider.Software
+}
+
 // returns a new instance of DeviceServiceImpl and a channel to receive updates of the device state
-func New(dmsUrl, lamassuGatewayURL string, mqttProviderInstances map[model.CloudProviderType]mqtt.MqttDeviceService) (DeviceService, chan model.DeviceState) {
+func New(dmsUrl, lamassuGatewayURL string, defaults DeviceDefaults, newMqttClient MqttClientFactory) (DeviceService, chan model.DeviceState) {
 	c := cron.New(cron.WithSeconds())
 	c.Start()
 
 	deviceStateStore, updateDeviceStateChannel := store.New()
 
-	svc := DeviceServiceImpl{
-		deviceStore:           deviceStateStore,
-		cronInstance:          c,
-		dmsUrl:                dmsUrl,
-		lamassuGatewayURL:     lamassuGatewayURL,
-		mqttProviderInstances: mqttProviderInstances,
+	fmt.Println("Initializing device state")
+	svc, _ := newDeviceService(deviceStateStore, c, 0, dmsUrl, lamassuGatewayURL, defaults, nil, nil, newMqttClient)
+
+	return svc, updateDeviceStateChannel
+}
+
+// newDeviceService restores the persisted identity when there is one, the
+// device starts with a fresh identity otherwise.
+func newDeviceService(deviceStore *store.DeviceStateStore, cronInstance *cron.Cron, telemetryOffset int, dmsUrl, lamassuGatewayURL string, defaults DeviceDefaults, identityStore IdentityStore, keyProviders keyprovider.Registry, newMqttClient MqttClientFactory) (*DeviceServiceImpl, error) {
+	svc := &DeviceServiceImpl{
+		deviceStore:       deviceStore,
+		cronInstance:      cronInstance,
+		telemetryOffset:   telemetryOffset,
+		dmsUrl:            dmsUrl,
+		lamassuGatewayURL: lamassuGatewayURL,
+		defaults:          defaults,
+		identityStore:     identityStore,
+		keyProviders:      keyProviders,
+		newMqttClient:     newMqttClient,
+		connections:       map[string]mqtt.MqttDeviceService{},
 	}
 
-	fmt.Println("Initializing device state")
-	svc.ResetDeviceState()
+	if identityStore != nil {
+		deviceStore.SetPersister(identityStore)
+
+		persisted, err := identityStore.Load()
+		if err != nil {
+			return nil, err
+		}
+		if persisted != nil {
+			if defaults.SerialNumber != "" && persisted.SerialNumber != defaults.SerialNumber {
+				fmt.Printf("keeping persisted serial number %s instead of %s, factory reset the device to change it\n", persisted.SerialNumber, defaults.SerialNumber)
+			}
+			svc.restoreDeviceState(persisted)
+			return svc, nil
+		}
+	}
+
+	svc.resetDeviceState(svc.factorySerialNumber())
+	return svc, nil
+}
+
+// factorySerialNumber is the serial number the device is given, or a random
+// one when it has none.
+func (d *DeviceServiceImpl) factorySerialNumber() string {
+	if d.defaults.SerialNumber != "" {
+		return d.defaults.SerialNumber
+	}
+	return goid.NewV4UUID().String()
+}
+
+// restoreDeviceState resumes a persisted identity. Operations cut by the
+// restart are rolled back: an enrollment without certificate starts over and
+// a re-enrollment keeps the current certificate.
+func (d *DeviceServiceImpl) restoreDeviceState(device *model.DeviceState) {
+	for i, slot := range device.Slots {
+		switch slot.Status {
+		case model.SlotStatusPendingProvisioning:
+			slot.Status = model.SlotStatusNeedsProvisioning
+			slot.PrivateKey = nil
+			slot.CertificateRequest = nil
+		case model.SlotStatusReenrollmentUnderway:
+			slot.Status = model.SlotStatusProvisioned
+		}
+		if slot.KeyAlgorithm == "" {
+			slot.KeyAlgorithm = d.defaults.slotKeyAlgorithm(slot.ID)
+		}
+		if slot.KeyProvider == "" {
+			slot.KeyProvider = d.defaults.slotKeyProvider(slot.ID)
+		}
+		if slot.CloudProvider == "" {
+			slot.CloudProvider = d.defaults.SlotCloudProviders[slot.ID]
+		}
+		slot.ConnectionStatus = model.ConnectionStatusDisconnected
+		slot.ConnectionError = ""
+		device.Slots[i] = slot
+	}
+	device.TelemetryDataRateSeconds = d.defaults.TelemetryRateSeconds
+	device.MqttConnected = false
+
+	fmt.Printf("restored identity %s with %d slots\n", device.SerialNumber, len(device.Slots))
+	d.deviceStore.SetDeviceState(device)
 
-	return &svc, updateDeviceStateChannel
+	d.UpdateGetSensorDataInterval(device.TelemetryDataRateSeconds)
 }
 
 func (d *DeviceServiceImpl) ResetDeviceState() {
-	defaultSlots := []model.Slot{
-		{
-			ID:           "default",
+	// The connections belong to the identity being replaced.
+	d.disconnectAll()
+	d.resetDeviceState(goid.NewV4UUID().String())
+}
+
+// FactoryReset wipes the identity, keys and certificates included, from
+// memory and from the keystore, and gives the device back its initial serial
+// number.
+func (d *DeviceServiceImpl) FactoryReset() {
+	d.disconnectAll()
+
+	for _, slot := range d.deviceStore.GetDeviceState().Slots {
+		d.deleteSlotKey(slot)
+	}
+
+	if d.identityStore != nil {
+		err := d.identityStore.Delete()
+		if err != nil {
+			fmt.Println("error deleting persisted identity:", err)
+		}
+	}
+
+	d.resetDeviceState(d.factorySerialNumber())
+}
+
+func (d *DeviceServiceImpl) resetDeviceState(serialNumber string) {
+	defaultSlots := []model.Slot{}
+	for _, slotID := range d.defaults.Slots {
+		defaultSlots = append(defaultSlots, model.Slot{
+			ID:           slotID,
 			Status:       model.SlotStatusNeedsProvisioning,
 			Certificate:  nil,
 			PrivateKey:   nil,
+			KeyAlgorithm: d.defaults.slotKeyAlgorithm(slotID),
+			KeyProvider:  d.defaults.slotKeyProvider(slotID),
 			SerialNumber: "",
-		},
+
+			CloudProvider:    d.defaults.SlotCloudProviders[slotID],
+			ConnectionStatus: model.ConnectionStatusDisconnected,
+		})
 	}
 
 	newDeviceState := model.DeviceState{
 		Status:                   model.DeviceStatusEmpty,
-		SerialNumber:             goid.NewV4UUID().String(),
-		Model:                    "Raspberry Pi 4",
-		TelemetryDataRateSeconds: 5,
+		SerialNumber:             serialNumber,
+		Model:                    d.defaults.Model,
+		TelemetryDataRateSeconds: d.defaults.TelemetryRateSeconds,
 		TelemetryData:            model.TelemetryData{},
 		Slots:                    defaultSlots,
 		MqttConnected:            false,
+		ClaimCode:                newClaimCode(),
 	}
 
 	d.deviceStore.SetDeviceState(&newDeviceState)
@@ -103,40 +294,101 @@ func (d *DeviceServiceImpl) ResetDeviceState() {
 }
 
 func (d *DeviceServiceImpl) GenerateNewSlot() {
-	device := d.deviceStore.GetDeviceState()
+	d.deviceStore.UpdateDeviceState(func(device *model.DeviceState) {
+		slotID := strconv.Itoa(len(device.Slots))
+		device.Slots = append(device.Slots, model.Slot{
+			ID:           slotID,
+			Status:       model.SlotStatusNeedsProvisioning,
+			Certificate:  nil,
+			PrivateKey:   nil,
+			KeyAlgorithm: d.defaults.slotKeyAlgorithm(slotID),
+			KeyProvider:  d.defaults.slotKeyProvider(slotID),
+			SerialNumber: "",
+			IssuingCA:    "",
 
-	device.Slots = append(device.Slots, model.Slot{
-		ID:           strconv.Itoa(len(device.Slots)),
-		Status:       model.SlotStatusNeedsProvisioning,
-		Certificate:  nil,
-		PrivateKey:   nil,
-		SerialNumber: "",
-		IssuingCA:    "",
+			CloudProvider:    d.defaults.SlotCloudProviders[slotID],
+			ConnectionStatus: model.ConnectionStatusDisconnected,
+		})
 	})
+}
 
-	d.deviceStore.SetDeviceState(device)
+// SetSlotKeyAlgorithm chooses the key algorithm of the next enrollment of the
+// slot. Re-enrollments keep the current key.
+func (d *DeviceServiceImpl) SetSlotKeyAlgorithm(slotID string, algorithm model.KeyAlgorithm) error {
+	_, err := model.ParseKeyAlgorithm(string(algorithm))
+	if err != nil {
+		return err
+	}
+
+	found := d.updateSlot(slotID, func(slot *model.Slot) {
+		if slot.Status == model.SlotStatusPendingProvisioning || slot.Status == model.SlotStatusReenrollmentUnderway {
+			err = fmt.Errorf("slot %s is enrolling, its key algorithm cannot be changed", slotID)
+			return
+		}
+		slot.KeyAlgorithm = algorithm
+	})
+	if !found {
+		return fmt.Errorf("slot with id %s not found", slotID)
+	}
+	return err
+}
+
+// SetEnrollmentToken stores a one-time token issued by the DMS. While set, it is
+// sent instead of the claim code so the enrollment is approved right away.
+func (d *DeviceServiceImpl) SetEnrollmentToken(token string) {
+	d.deviceStore.UpdateDeviceState(func(device *model.DeviceState) {
+		device.EnrollmentToken = token
+	})
 }
 
 func (d *DeviceServiceImpl) Enroll(slotID string) error {
-	idx := slices.IndexFunc(d.deviceStore.GetDeviceState().Slots, func(s model.Slot) bool { return s.ID == slotID })
+	device := d.deviceStore.GetDeviceState()
+	idx := slices.IndexFunc(device.Slots, func(s model.Slot) bool { return s.ID == slotID })
 	if idx == -1 {
 		fmt.Println("device not found")
 		return fmt.Errorf("slot with id %s not found", slotID)
 	}
 
 	fmt.Println(idx)
-	keyBytes, _ := rsa.GenerateKey(rand.Reader, 2048)
-	device := d.deviceStore.GetDeviceState()
 	slot := device.Slots[idx]
 
-	slot.PrivateKey = keyBytes
-	slot.Certificate = nil
-	slot.Status = model.SlotStatusPendingProvisioning
+	if slot.KeyAlgorithm == "" {
+		slot.KeyAlgorithm = d.defaults.slotKeyAlgorithm(slot.ID)
+	}
+	if slot.KeyProvider == "" {
+		slot.KeyProvider = d.defaults.slotKeyProvider(slot.ID)
+	}
+	provider, err := d.keyProviders.Get(slot.KeyProvider)
+	if err != nil {
+		return err
+	}
+	key, err := provider.GenerateKey(device.SerialNumber+"/"+slot.ID, slot.KeyAlgorithm)
+	if err != nil {
+		return fmt.Errorf("error generating %s key with the %s key provider: %v", slot.KeyAlgorithm, slot.KeyProvider, err)
+	}
 
-	device.Slots[idx] = slot
-	d.deviceStore.SetDeviceState(device)
+	// The current key and certificate are kept until the new certificate is
+	// stored. A failed enrollment leaves the slot as it was, with the error,
+	// and deletes the new key.
+	previousStatus := slot.Status
+	fail := func(err error) error {
+		deleteErr := provider.DeleteKey(key)
+		if deleteErr != nil {
+			fmt.Printf("error deleting key of slot %s: %v\n", slot.ID, deleteErr)
+		}
+		d.updateSlot(slot.ID, func(s *model.Slot) {
+			s.Status = previousStatus
+			s.EnrollmentError = err.Error()
+		})
+		return err
+	}
 
-	commonName := d.deviceStore.GetDeviceState().SerialNumber
+	d.updateSlot(slot.ID, func(s *model.Slot) {
+		s.EnrollmentError = ""
+		s.Status = model.SlotStatusPendingProvisioning
+	})
+
+	commonName := device.SerialNumber
 	if slot.ID != "default" {
 		commonName = slot.ID + ":" + commonName
 	}
@@ -152,46 +404,67 @@ func (d *DeviceServiceImpl) Enroll(slotID string) error {
 
 	template := x509.CertificateRequest{
 		Subject:            subj,
-		SignatureAlgorithm: x509.SHA256WithRSA,
+		SignatureAlgorithm: slot.KeyAlgorithm.SignatureAlgorithm(),
 	}
 
-	csrBytes, _ := x509.CreateCertificateRequest(rand.Reader, &template, keyBytes)
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+	if err != nil {
+		return fail(fmt.Errorf("error creating certificate request: %v", err))
+	}
 	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})
 	pemString := base64.StdEncoding.EncodeToString(pemBytes)
 
 	csr, err := x509.ParseCertificateRequest(csrBytes)
 	if err != nil {
 		fmt.Println(err)
-		return fmt.Errorf("error parsing certificate request: %v", err)
+		return fail(fmt.Errorf("error parsing certificate request: %v", err))
 	}
 
-	slot.CertificateRequest = csr
-
 	values := map[string]string{
-		"serial_number":       d.deviceStore.GetDeviceState().SerialNumber,
-		"model":               d.deviceStore.GetDeviceState().Model,
+		"serial_number":       device.SerialNumber,
+		"model":               device.Model,
 		"slot":                slot.ID,
 		"certificate_request": pemString,
 	}
 	json_data, _ := json.Marshal(values)
 	fmt.Println(string(json_data))
 
-	resp, err := http.Post(d.dmsUrl+"/enroll", "application/json", bytes.NewReader(json_data))
+	req, err := http.NewRequest(http.MethodPost, d.dmsUrl+"/enroll", bytes.NewReader(json_data))
+	if err != nil {
+		return fail(fmt.Errorf("error creating enrollment request: %v", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := device.EnrollmentToken; token != "" {
+		req.Header.Set("X-Enrollment-Token", token)
+	} else {
+		req.Header.Set("X-Claim-Code", device.ClaimCode)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		fmt.Println(err)
-		return fmt.Errorf("error sending enrollment request: %v", err)
+		return fail(fmt.Errorf("error sending enrollment request: %v", err))
 	}
 
 	fmt.Println(resp.StatusCode)
 
+	ctx, cancel := context.WithTimeout(context.Background(), d.defaults.queuedEnrollmentTimeout())
+	defer cancel()
+	resp, err = d.waitForEnrollment(ctx, http.DefaultClient, resp)
+	if err != nil {
+		return fail(err)
+	}
+
 	type EnrollMessageOut struct {
 		IssuingCA   string `json:"issuing_ca"`
 		Certificate string `json:"certificate"`
+		Receipt     string `json:"receipt"`
 	}
 
 	enrollRespBytes, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
 	if err != nil {
-		return fmt.Errorf("error reading enrollment response: %v", err)
+		return fail(fmt.Errorf("error reading enrollment response: %v", err))
 	}
 
 	var enrollResp EnrollMessageOut
@@ -199,27 +472,117 @@ func (d *DeviceServiceImpl) Enroll(slotID string) error {
 
 	decodedCert, err := base64.StdEncoding.DecodeString(string(enrollResp.Certificate))
 	if err != nil {
-		return fmt.Errorf("error decoding certificate: %v", err)
+		return fail(fmt.Errorf("error decoding certificate: %v", err))
 	}
 
-	certBlock, _ := pem.Decode(decodedCert)
-	certificate, err := x509.ParseCertificate(certBlock.Bytes)
+	certificate, caChain, err := parseCertificateBundle(decodedCert)
 	if err != nil {
-		return fmt.Errorf("error parsing certificate: %v", err)
+		return fail(err)
 	}
 
-	slot.Certificate = certificate
-	slot.SerialNumber = utils.InsertNth(utils.ToHexInt(certificate.SerialNumber), 2)
-	slot.IssuingCA = enrollResp.IssuingCA
-	slot.ExpirationDate = certificate.NotAfter
-	slot.Status = model.SlotStatusProvisioned
-
-	device.Slots[idx] = slot
-	d.deviceStore.SetDeviceState(device)
+	receipt := decodeReceipt(enrollResp.Receipt)
+	d.deviceStore.UpdateDeviceState(func(device *model.DeviceState) {
+		idx := slices.IndexFunc(device.Slots, func(s model.Slot) bool { return s.ID == slot.ID })
+		if idx != -1 {
+			s := &device.Slots[idx]
+			s.KeyAlgorithm = slot.KeyAlgorithm
+			s.KeyProvider = slot.KeyProvider
+			s.PrivateKey = key
+			s.CertificateRequest = csr
+			s.Certificate = certificate
+			s.CAChain = caChain
+			s.SerialNumber = formatSerialNumber(certificate.SerialNumber)
+			s.IssuingCA = enrollResp.IssuingCA
+			s.ExpirationDate = certificate.NotAfter
+			s.Receipt = receipt
+			s.Status = model.SlotStatusProvisioned
+			s.NextRenewal = time.Time{}
+			s.RenewalAttempts = 0
+			s.RenewalError = ""
+		}
+		// Enrollment tokens are single use.
+		device.EnrollmentToken = ""
+	})
+	d.deleteSlotKey(slot)
 
 	return nil
 }
 
+// updateSlot applies the change to the slot, it returns false when the device
+// has no such slot.
+func (d *DeviceServiceImpl) updateSlot(slotID string, change func(slot *model.Slot)) bool {
+	found := false
+	d.deviceStore.UpdateDeviceState(func(device *model.DeviceState) {
+		idx := slices.IndexFunc(device.Slots, func(s model.Slot) bool { return s.ID == slotID })
+		if idx == -1 {
+			return
+		}
+		found = true
+		change(&device.Slots[idx])
+	})
+	return found
+}
+
+// deleteSlotKey removes the key of the slot from its provider, keys in a
+// token would pile up otherwise.
+func (d *DeviceServiceImpl) deleteSlotKey(slot model.Slot) {
+	if slot.PrivateKey == nil {
+		return
+	}
+	provider, err := d.keyProviders.Get(slot.KeyProvider)
+	if err != nil {
+		fmt.Printf("error deleting key of slot %s: %v\n", slot.ID, err)
+		return
+	}
+	err = provider.DeleteKey(slot.PrivateKey)
+	if err != nil {
+		fmt.Printf("error deleting key of slot %s: %v\n", slot.ID, err)
+	}
+}
+
+// waitForEnrollment polls the vDMS, with the client the enrollment was sent
+// with, while it answers 202 Accepted, which it does when the enrollment has
+// been queued because the Lamassu gateway is not reachable. Polling stops once
+// the context is done. The final response is returned with its body unread.
+func (d *DeviceServiceImpl) waitForEnrollment(ctx context.Context, httpClient *http.Client, resp *http.Response) (*http.Response, error) {
+	for resp.StatusCode == http.StatusAccepted {
+		location := resp.Header.Get("Location")
+		retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil || retryAfter < 1 {
+			retryAfter = defaultEnrollmentRetryAfter
+		}
+		resp.Body.Close()
+
+		if location == "" {
+			return nil, fmt.Errorf("enrollment accepted without a location to poll")
+		}
+
+		fmt.Printf("enrollment queued by the DMS, polling %s in %d seconds\n", location, retryAfter)
+		select {
+		case <-time.After(time.Duration(retryAfter) * time.Second):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("enrollment still queued by the DMS: %v", ctx.Err())
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.dmsUrl+location, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating enrollment status request: %v", err)
+		}
+		resp, err = httpClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error polling enrollment status: %v", err)
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("enrollment rejected with status code %d: %s", resp.StatusCode, string(body))
+	}
+
+	return resp, nil
+}
+
 func (d *DeviceServiceImpl) Reenroll(slotID string) error {
 	device := d.deviceStore.GetDeviceState()
 	idx := slices.IndexFunc(device.Slots, func(s model.Slot) bool { return s.ID == slotID })
@@ -228,112 +591,150 @@ func (d *DeviceServiceImpl) Reenroll(slotID string) error {
 	}
 
 	slot := device.Slots[idx]
+	if slot.Certificate == nil || slot.CertificateRequest == nil {
+		return fmt.Errorf("slot %s is not enrolled", slotID)
+	}
+
+	// A failed re-enrollment leaves the slot as it was, with the error.
+	previousStatus := slot.Status
+	fail := func(err error) error {
+		d.updateSlot(slot.ID, func(s *model.Slot) {
+			s.Status = previousStatus
+			s.RenewalError = err.Error()
+		})
+		return err
+	}
+
 	slot.Status = model.SlotStatusReenrollmentUnderway
-	device.Slots[idx] = slot
-	d.deviceStore.SetDeviceState(device)
+	d.updateSlot(slot.ID, func(s *model.Slot) { s.Status = slot.Status })
 
-	devManagerUrl, err := url.Parse(d.lamassuGatewayURL)
-	if err != nil {
-		return fmt.Errorf("error parsing lamassu gateway url: %v", err)
+	crtPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: slot.Certificate.Raw})
+	csrPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: slot.CertificateRequest.Raw})
+
+	values := map[string]string{
+		"serial_number":       device.SerialNumber,
+		"model":               device.Model,
+		"slot":                slot.ID,
+		"certificate":         base64.StdEncoding.EncodeToString(crtPem),
+		"certificate_request": base64.StdEncoding.EncodeToString(csrPem),
 	}
+	json_data, _ := json.Marshal(values)
 
-	devManagerUrl.Path = "api/devmanager"
-	client, err := estClient.NewESTClient(nil, devManagerUrl, slot.Certificate, slot.PrivateKey, nil, true)
-	if err != nil {
-		return fmt.Errorf("error creating EST client: %v", err)
+	// The current certificate is also presented as TLS client certificate,
+	// which the DMS uses when it listens over HTTPS.
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				Certificates: []tls.Certificate{
+					{
+						Certificate: [][]byte{slot.Certificate.Raw},
+						PrivateKey:  slot.PrivateKey,
+						Leaf:        slot.Certificate,
+					},
+				},
+			},
+		},
 	}
 
-	ctx := context.Background()
-	crt, err := client.Reenroll(ctx, slot.CertificateRequest)
+	resp, err := httpClient.Post(d.dmsUrl+"/reenroll", "application/json", bytes.NewReader(json_data))
 	if err != nil {
-		return fmt.Errorf("error reenrolling: %v", err)
+		return fail(fmt.Errorf("error sending reenrollment request: %v", err))
 	}
 
-	slot.Certificate = crt
-	slot.SerialNumber = utils.InsertNth(utils.ToHexInt(crt.SerialNumber), 2)
-	slot.ExpirationDate = crt.NotAfter
-	slot.Status = model.SlotStatusProvisioned
-	device.Slots[idx] = slot
-	d.deviceStore.SetDeviceState(device)
-
-	return nil
-}
+	ctx, cancel := context.WithTimeout(context.Background(), d.defaults.queuedEnrollmentTimeout())
+	defer cancel()
+	resp, err = d.waitForEnrollment(ctx, httpClient, resp)
+	if err != nil {
+		return fail(fmt.Errorf("error reenrolling: %v", err))
+	}
 
-func (d *DeviceServiceImpl) ConnectCloudProvider(cloudProvider model.CloudProviderType, slotID string) error {
-	device := d.deviceStore.GetDeviceState()
-	idx := slices.IndexFunc(device.Slots, func(s model.Slot) bool { return s.ID == slotID })
-	if idx == -1 {
-		return fmt.Errorf("slot with id %s not found", slotID)
+	reenrollRespBytes, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fail(fmt.Errorf("error reading reenrollment response: %v", err))
 	}
 
-	slot := device.Slots[idx]
+	var reenrollResp struct {
+		IssuingCA   string `json:"issuing_ca"`
+		Certificate string `json:"certificate"`
+		Receipt     string `json:"receipt"`
+	}
+	json.Unmarshal(reenrollRespBytes, &reenrollResp)
 
-	mqttClient := d.mqttProviderInstances[model.CouldProviderTypeAzure]
-	err := mqttClient.Connect(slot.Certificate, slot.PrivateKey, device.SerialNumber)
+	decodedCert, err := base64.StdEncoding.DecodeString(reenrollResp.Certificate)
 	if err != nil {
-		return fmt.Errorf("error connecting to cloud provider: %v", err)
+		return fail(fmt.Errorf("error decoding certificate: %v", err))
 	}
 
-	switch cloudProvider {
-	case model.CouldProviderTypeAzure:
-		err := mqttClient.Subscribe("$iothub/twin/PATCH/properties/desired/#", func(topic string, payload []byte) {
-			var req struct {
-				Reenroll bool   `json:"require_reenrollment"`
-				Version  string `json:"version"`
-			}
-			json.Unmarshal(payload, &req)
-			if req.Reenroll {
-				d.Reenroll(slot.ID)
-			}
-		})
+	crt, caChain, err := parseCertificateBundle(decodedCert)
+	if err != nil {
+		return fail(err)
+	}
 
-		fmt.Println("could not subscribe to azure twin topic", err)
+	receipt := decodeReceipt(reenrollResp.Receipt)
+	d.updateSlot(slot.ID, func(s *model.Slot) {
+		s.Certificate = crt
+		s.CAChain = caChain
+		s.SerialNumber = formatSerialNumber(crt.SerialNumber)
+		s.ExpirationDate = crt.NotAfter
+		s.Receipt = receipt
+		s.Status = model.SlotStatusProvisioned
+		s.NextRenewal = time.Time{}
+		s.RenewalAttempts = 0
+		s.RenewalError = ""
+	})
 
-	case model.CloudProviderTypeAWS:
-		mqttClient.Subscribe(fmt.Sprintf("$aws/things/%s", device.SerialNumber), func(topic string, payload []byte) {
-			fmt.Printf("====================================ACCEPTED==========================================\n")
-			fmt.Printf("TOPIC: %s\n", topic)
-			fmt.Printf("MSG: %s\n", payload)
-			fmt.Printf("==============================================================================\n\n")
-		})
+	// An open connection still presents the previous certificate.
+	if d.connection(slot.ID) != nil {
+		go func() {
+			err := d.ConnectCloudProvider("", slot.ID)
+			if err != nil {
+				fmt.Printf("error reconnecting slot %s with its new certificate: %v\n", slot.ID, err)
+			}
+		}()
+	}
 
-		// significa que no hay shadow y hay que crearlo
-		mqttClient.Subscribe(fmt.Sprintf("$aws/things/%s/shadow/get/rejected", device.SerialNumber), func(topic string, payload []byte) {
-			fmt.Printf("====================================REJECTED==========================================\n")
-			fmt.Printf("TOPIC: %s\n", topic)
-			fmt.Printf("MSG: %s\n", payload)
-			fmt.Printf("Publishing on update topic to create device shadow\n")
-			fmt.Printf("==============================================================================\n\n")
-
-			deviceState := `{
-				"state": {
-					"reported" : {
-						"need_rotation" : false
-					}
-				}
-			}`
-			mqttClient.Publish(fmt.Sprintf("$aws/things/%s/shadow/update", device.SerialNumber), []byte(deviceState))
-			fmt.Printf("==============================================================================\n")
-		})
+	return nil
+}
 
-		mqttClient.Subscribe(fmt.Sprintf("$aws/things/%s/shadow/update/delta", device.SerialNumber), func(topic string, payload []byte) {
-			fmt.Printf("====================================DELTA==========================================\n")
-			fmt.Printf("TOPIC: %s\n", topic)
-			fmt.Printf("MSG: %s\n", payload)
-			fmt.Printf("Here goes the reenrollment process.")
-			fmt.Printf("==============================================================================\n\n")
-		})
-		time.Sleep(time.Second * 2)
+// parseCertificateBundle parses the PEM certificate returned by the DMS. Any
+// certificate after the first one is part of its CA chain.
+func parseCertificateBundle(pemBytes []byte) (*x509.Certificate, []*x509.Certificate, error) {
+	certBlock, rest := pem.Decode(pemBytes)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("error decoding certificate: invalid PEM block")
+	}
 
-		mqttClient.Publish(fmt.Sprintf("$aws/things/%s/shadow/get", device.SerialNumber), []byte{})
-		time.Sleep(time.Second * 2)
+	crt, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing certificate: %v", err)
 	}
 
-	return nil
+	caChain := []*x509.Certificate{}
+	for block, rest := pem.Decode(rest); block != nil; block, rest = pem.Decode(rest) {
+		caCrt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing CA certificate: %v", err)
+		}
+		caChain = append(caChain, caCrt)
+	}
+	return crt, caChain, nil
 }
 
-func (d *DeviceServiceImpl) DisconnectCloudProvider() {
+// decodeReceipt returns the DER enrollment receipt sent along the certificate.
+// DMSs that do not issue receipts leave it out.
+func decodeReceipt(b64Receipt string) []byte {
+	if b64Receipt == "" {
+		return nil
+	}
 
+	receipt, err := base64.StdEncoding.DecodeString(b64Receipt)
+	if err != nil {
+		fmt.Println("error decoding enrollment receipt:", err)
+		return nil
+	}
+	return receipt
 }
 
 func (d *DeviceServiceImpl) GetSensorData() {
@@ -344,19 +745,35 @@ func (d *DeviceServiceImpl) GetSensorData() {
 		Humidity:     mathRand.Intn(50),
 		BatteryLevel: mathRand.Intn(101),
 	}
-
-	d.deviceStore.SetDeviceState(device)
-
+	// The readings are published without holding the store, only the
+	// telemetry fields are written back.
+	published := device.TelemetryPublished
+	failures := device.TelemetryPublishFailures
+	d.publishTelemetry(device)
+
+	d.deviceStore.UpdateDeviceState(func(current *model.DeviceState) {
+		current.TelemetryData = device.TelemetryData
+		current.TelemetrySequence = device.TelemetrySequence
+		current.TelemetryPublished += device.TelemetryPublished - published
+		current.TelemetryPublishFailures += device.TelemetryPublishFailures - failures
+		if device.TelemetryPublished != published || device.TelemetryPublishFailures != failures {
+			current.TelemetryPublishError = device.TelemetryPublishError
+		}
+	})
 }
 
 func (d *DeviceServiceImpl) UpdateGetSensorDataInterval(interval int) {
 	fmt.Println("UpdateGetSensorDataInterval")
+	if interval < 1 {
+		fmt.Println("invalid telemetry data rate", interval)
+		return
+	}
 
 	if d.telemetryDataCronID != nil {
 		d.cronInstance.Remove(*d.telemetryDataCronID)
 	}
 
-	newTelemetryDataCronID, err := d.cronInstance.AddFunc(fmt.Sprintf("0/%d * * * * *", interval), d.GetSensorData)
+	newTelemetryDataCronID, err := d.cronInstance.AddFunc(fmt.Sprintf("%d/%d * * * * *", d.telemetryOffset%interval, interval), d.GetSensorData)
 	if err != nil {
 		fmt.Println("error adding cron job for telemetry data", err)
 		return
@@ -364,3 +781,38 @@ func (d *DeviceServiceImpl) UpdateGetSensorDataInterval(interval int) {
 
 	d.telemetryDataCronID = &newTelemetryDataCronID
 }
+
+// newClaimCode returns a code such as "K7QM-3XPA" to be shown on the device.
+// Characters that are easily confused (0, O, 1, I) are left out.
+func newClaimCode() string {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	code := ""
+	for i, v := range b {
+		if i == 4 {
+			code += "-"
+		}
+		code += string(alphabet[int(v)%len(alphabet)])
+	}
+	return code
+}
+
+// formatSerialNumber formats certificate serial numbers the way Lamassu
+// displays them, hex bytes separated by dashes.
+func formatSerialNumber(serialNumber *big.Int) string {
+	hex := fmt.Sprintf("%x", serialNumber)
+	if len(hex)%2 != 0 {
+		hex = "0" + hex
+	}
+
+	var b strings.Builder
+	for i, r := range hex {
+		if i > 0 && i%2 == 0 {
+			b.WriteRune('-')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
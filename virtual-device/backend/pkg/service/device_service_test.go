@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWaitForEnrollment(t *testing.T) {
+	tests := []struct {
+		name    string
+		polls   int
+		timeout time.Duration
+		wantErr bool
+	}{
+		{
+			name:    "completed after a poll",
+			polls:   1,
+			timeout: time.Minute,
+		},
+		{
+			name:    "still queued when the timeout expires",
+			polls:   100,
+			timeout: 100 * time.Millisecond,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			polled := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/enroll/queued" {
+					t.Errorf("polled %s, want /enroll/queued", r.URL.Path)
+				}
+				polled++
+				if polled < tt.polls {
+					acceptEnrollment(w)
+					return
+				}
+				w.Write([]byte(`{}`))
+			}))
+			defer srv.Close()
+
+			d := &DeviceServiceImpl{dmsUrl: srv.URL}
+			recorder := httptest.NewRecorder()
+			acceptEnrollment(recorder)
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			resp, err := d.waitForEnrollment(ctx, srv.Client(), recorder.Result())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("waitForEnrollment() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("waitForEnrollment() status = %d, want %d", resp.StatusCode, http.StatusOK)
+				}
+			}
+		})
+	}
+}
+
+func acceptEnrollment(w http.ResponseWriter) {
+	w.Header().Set("Location", "/enroll/queued")
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,661 @@
+package service
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/lamassu-vdevice/pkg/keyprovider"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/keystore"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/service/store"
+	"github.com/robfig/cron/v3"
+)
+
+// FleetDeviceSpec describes one device of the fleet. Empty fields are taken
+// from the template.
+type FleetDeviceSpec struct {
+	SerialNumber string
+	Model        string
+	Slots        []string
+}
+
+type FleetStats struct {
+	Devices              int                        `json:"devices"`
+	DevicesByStatus      map[model.DeviceStatus]int `json:"devices_by_status"`
+	Slots                int                        `json:"slots"`
+	SlotsByStatus        map[model.SlotStatus]int   `json:"slots_by_status"`
+	MqttConnected        int                        `json:"mqtt_connected"`
+	EnrollmentsQueued    int                        `json:"enrollments_queued"`
+	EnrollmentsInFlight  int                        `json:"enrollments_in_flight"`
+	EnrollmentsSucceeded int                        `json:"enrollments_succeeded"`
+	EnrollmentsFailed    int                        `json:"enrollments_failed"`
+	// The telemetry counters add up those of the devices.
+	TelemetryPublished       int `json:"telemetry_published"`
+	TelemetryPublishFailures int `json:"telemetry_publish_failures"`
+}
+
+type FleetSlotSummary struct {
+	ID              string             `json:"id"`
+	Status          model.SlotStatus   `json:"status"`
+	SerialNumber    string             `json:"serial_number"`
+	KeyAlgorithm    model.KeyAlgorithm `json:"key_algorithm"`
+	KeyProvider     string             `json:"key_provider"`
+	ExpirationDate  int64              `json:"expiration_date,omitempty"`
+	NextRenewal     int64              `json:"next_renewal,omitempty"`
+	RenewalError    string             `json:"renewal_error,omitempty"`
+	EnrollmentError string             `json:"enrollment_error,omitempty"`
+
+	CloudProvider    model.CloudProviderType `json:"cloud_provider,omitempty"`
+	ConnectionStatus model.ConnectionStatus  `json:"connection_status"`
+}
+
+// SlotTransition is a change of the status of a slot.
+type SlotTransition struct {
+	DeviceID     string           `json:"device_id"`
+	SerialNumber string           `json:"serial_number"`
+	SlotID       string           `json:"slot_id"`
+	From         model.SlotStatus `json:"from"`
+	To           model.SlotStatus `json:"to"`
+	// Error is the cause of a failed enrollment or re-enrollment.
+	Error string `json:"error,omitempty"`
+}
+
+// FleetDeviceSummary is the listing view of a device, without key material.
+type FleetDeviceSummary struct {
+	ID            string             `json:"id"`
+	SerialNumber  string             `json:"serial_number"`
+	Model         string             `json:"model"`
+	Status        model.DeviceStatus `json:"status"`
+	MqttConnected bool               `json:"mqtt_connected"`
+	Slots         []FleetSlotSummary `json:"slots"`
+	LastError     string             `json:"last_error,omitempty"`
+}
+
+type fleetDevice struct {
+	id        string
+	service   *DeviceServiceImpl
+	state     model.DeviceState
+	lastError string
+	// renewing holds the slots with an automatic re-enrollment queued or
+	// running.
+	renewing map[string]bool
+}
+
+// Fleet drives many simulated devices in one process. Devices share a single
+// scheduler and enrollments go through a limiter so Lamassu is loaded at a
+// controlled rate.
+type Fleet struct {
+	lock     sync.Mutex
+	devices  []*fleetDevice
+	byID     map[string]*fleetDevice
+	cron     *cron.Cron
+	limiter  chan struct{}
+	listener func(id string, device model.DeviceState)
+	// transitionListener is told about every slot status change.
+	transitionListener func(transition SlotTransition)
+
+	enrollmentsQueued    int
+	enrollmentsInFlight  int
+	enrollmentsSucceeded int
+	enrollmentsFailed    int
+}
+
+// NewFleet spawns one device per spec. enrollmentConcurrency bounds the
+// enrollments, re-enrollments and MQTT connections running at once. With a
+// keystore, devices resume the identity they had before the restart. The slot
+// keys are generated by keyProviders, a nil registry only has software keys.
+func NewFleet(dmsUrl, lamassuGatewayURL string, template DeviceDefaults, specs []FleetDeviceSpec, enrollmentConcurrency int, identities *keystore.Keystore, keyProviders keyprovider.Registry, newMqttClient MqttClientFactory) (*Fleet, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("the fleet has no devices")
+	}
+	if enrollmentConcurrency < 1 {
+		enrollmentConcurrency = 1
+	}
+
+	c := cron.New(cron.WithSeconds())
+	c.Start()
+
+	fleet := &Fleet{
+		devices: make([]*fleetDevice, 0, len(specs)),
+		byID:    map[string]*fleetDevice{},
+		cron:    c,
+		limiter: make(chan struct{}, enrollmentConcurrency),
+	}
+
+	fmt.Printf("Initializing fleet of %d devices\n", len(specs))
+	for i, spec := range specs {
+		defaults := template
+		defaults.SerialNumber = spec.SerialNumber
+		if spec.Model != "" {
+			defaults.Model = spec.Model
+		}
+		if len(spec.Slots) > 0 {
+			defaults.Slots = spec.Slots
+		}
+
+		device := &fleetDevice{id: fmt.Sprintf("device-%d", i+1), renewing: map[string]bool{}}
+		fleet.devices = append(fleet.devices, device)
+		fleet.byID[device.id] = device
+
+		deviceStore := store.NewWithListener(func(state model.DeviceState) {
+			fleet.deviceUpdated(device, state)
+		})
+		var identityStore IdentityStore
+		if identities != nil {
+			identityStore = identities.Device(device.id)
+		}
+
+		var err error
+		device.service, err = newDeviceService(deviceStore, c, i, dmsUrl, lamassuGatewayURL, defaults, identityStore, keyProviders, newMqttClient)
+		if err != nil {
+			c.Stop()
+			return nil, fmt.Errorf("%s: %v", device.id, err)
+		}
+	}
+
+	if interval := template.Renewal.CheckInterval; interval > 0 {
+		_, err := c.AddFunc(fmt.Sprintf("@every %s", interval), fleet.checkRenewals)
+		if err != nil {
+			c.Stop()
+			return nil, fmt.Errorf("error scheduling the certificate lifecycle monitor: %v", err)
+		}
+	}
+
+	return fleet, nil
+}
+
+// FleetFromTemplate returns the specs of count devices built from the template
+// alone, with random serial numbers.
+func FleetFromTemplate(count int) []FleetDeviceSpec {
+	return make([]FleetDeviceSpec, count)
+}
+
+// LoadFleetCSV reads the devices of a fleet from a CSV file with a header
+// row. The serial_number column is required, model and slots are optional.
+// Slots are separated by semicolons.
+func LoadFleetCSV(path string) ([]FleetDeviceSpec, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %v", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["serial_number"]; !ok {
+		return nil, errors.New("missing serial_number column")
+	}
+
+	column := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	specs := []FleetDeviceSpec{}
+	seen := map[string]int{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		spec := FleetDeviceSpec{
+			SerialNumber: column(record, "serial_number"),
+			Model:        column(record, "model"),
+		}
+		if spec.SerialNumber == "" {
+			return nil, fmt.Errorf("line %d: empty serial number", line)
+		}
+		if previous, ok := seen[spec.SerialNumber]; ok {
+			return nil, fmt.Errorf("line %d: serial number %s already used on line %d", line, spec.SerialNumber, previous)
+		}
+		seen[spec.SerialNumber] = line
+
+		for _, slot := range strings.Split(column(record, "slots"), ";") {
+			if slot = strings.TrimSpace(slot); slot != "" {
+				spec.Slots = append(spec.Slots, slot)
+			}
+		}
+		specs = append(specs, spec)
+	}
+
+	if len(specs) == 0 {
+		return nil, errors.New("no devices listed")
+	}
+	return specs, nil
+}
+
+// OnDeviceUpdate registers the function called with every device update. It
+// runs on the updating goroutine and must not block.
+func (f *Fleet) OnDeviceUpdate(listener func(id string, device model.DeviceState)) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.listener = listener
+}
+
+// OnSlotTransition registers the function called with every slot status
+// change. It runs on the updating goroutine and must not block.
+func (f *Fleet) OnSlotTransition(listener func(transition SlotTransition)) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.transitionListener = listener
+}
+
+func (f *Fleet) deviceUpdated(device *fleetDevice, state model.DeviceState) {
+	// The slots are copied, the device keeps mutating its own slice.
+	state.Slots = append([]model.Slot{}, state.Slots...)
+
+	f.lock.Lock()
+	previous := device.state
+	device.state = state
+	listener := f.listener
+	transitionListener := f.transitionListener
+	f.lock.Unlock()
+
+	if listener != nil {
+		listener(device.id, state)
+	}
+	if transitionListener != nil && previous.SerialNumber == state.SerialNumber {
+		for _, transition := range slotTransitions(device.id, previous, state) {
+			transitionListener(transition)
+		}
+	}
+}
+
+// slotTransitions compares the slots of two states of a device. New slots
+// are not transitions.
+func slotTransitions(id string, previous, current model.DeviceState) []SlotTransition {
+	previousStatus := map[string]model.SlotStatus{}
+	for _, slot := range previous.Slots {
+		previousStatus[slot.ID] = slot.Status
+	}
+
+	transitions := []SlotTransition{}
+	for _, slot := range current.Slots {
+		from, ok := previousStatus[slot.ID]
+		if !ok || from == slot.Status {
+			continue
+		}
+		transition := SlotTransition{
+			DeviceID:     id,
+			SerialNumber: current.SerialNumber,
+			SlotID:       slot.ID,
+			From:         from,
+			To:           slot.Status,
+		}
+		if from == model.SlotStatusReenrollmentUnderway && slot.Status != model.SlotStatusProvisioned {
+			transition.Error = slot.RenewalError
+		}
+		if from == model.SlotStatusPendingProvisioning && slot.Status != model.SlotStatusProvisioned {
+			transition.Error = slot.EnrollmentError
+		}
+		transitions = append(transitions, transition)
+	}
+	return transitions
+}
+
+func (f *Fleet) Size() int {
+	return len(f.devices)
+}
+
+// DefaultDeviceID is the device shown when a console connects.
+func (f *Fleet) DefaultDeviceID() string {
+	return f.devices[0].id
+}
+
+// Resolve finds a device by its fleet id or its current serial number.
+func (f *Fleet) Resolve(idOrSerialNumber string) (string, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.byID[idOrSerialNumber]; ok {
+		return idOrSerialNumber, true
+	}
+	for _, device := range f.devices {
+		if device.state.SerialNumber == idOrSerialNumber {
+			return device.id, true
+		}
+	}
+	return "", false
+}
+
+// Device returns the service driving the given device.
+func (f *Fleet) Device(id string) (DeviceService, bool) {
+	device, ok := f.byID[id]
+	if !ok {
+		return nil, false
+	}
+	return device.service, true
+}
+
+func (f *Fleet) DeviceState(id string) (model.DeviceState, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	device, ok := f.byID[id]
+	if !ok {
+		return model.DeviceState{}, false
+	}
+	return device.state, true
+}
+
+func (f *Fleet) Stats() FleetStats {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	stats := FleetStats{
+		Devices:              len(f.devices),
+		DevicesByStatus:      map[model.DeviceStatus]int{},
+		SlotsByStatus:        map[model.SlotStatus]int{},
+		EnrollmentsQueued:    f.enrollmentsQueued,
+		EnrollmentsInFlight:  f.enrollmentsInFlight,
+		EnrollmentsSucceeded: f.enrollmentsSucceeded,
+		EnrollmentsFailed:    f.enrollmentsFailed,
+	}
+	for _, device := range f.devices {
+		stats.DevicesByStatus[device.state.Status]++
+		if device.state.MqttConnected {
+			stats.MqttConnected++
+		}
+		stats.TelemetryPublished += device.state.TelemetryPublished
+		stats.TelemetryPublishFailures += device.state.TelemetryPublishFailures
+		for _, slot := range device.state.Slots {
+			stats.Slots++
+			stats.SlotsByStatus[slot.Status]++
+		}
+	}
+	return stats
+}
+
+// Devices lists the devices in fleet order. An empty status matches every
+// device, otherwise devices are kept when any of their slots has the status.
+func (f *Fleet) Devices(offset, limit int, slotStatus model.SlotStatus) []FleetDeviceSummary {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	summaries := []FleetDeviceSummary{}
+	skipped := 0
+	for _, device := range f.devices {
+		if limit > 0 && len(summaries) >= limit {
+			break
+		}
+		if slotStatus != "" && !hasSlotStatus(device.state, slotStatus) {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		summaries = append(summaries, device.summary())
+	}
+	return summaries
+}
+
+func hasSlotStatus(device model.DeviceState, status model.SlotStatus) bool {
+	for _, slot := range device.Slots {
+		if slot.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *fleetDevice) summary() FleetDeviceSummary {
+	slots := []FleetSlotSummary{}
+	for _, slot := range d.state.Slots {
+		summary := FleetSlotSummary{
+			ID:              slot.ID,
+			Status:          slot.Status,
+			SerialNumber:    slot.SerialNumber,
+			KeyAlgorithm:    slot.KeyAlgorithm,
+			KeyProvider:     slot.KeyProvider,
+			RenewalError:    slot.RenewalError,
+			EnrollmentError: slot.EnrollmentError,
+
+			CloudProvider:    slot.CloudProvider,
+			ConnectionStatus: model.ConnectionStatusDisconnected,
+		}
+		if slot.ConnectionStatus != "" {
+			summary.ConnectionStatus = slot.ConnectionStatus
+		}
+		if !slot.ExpirationDate.IsZero() {
+			summary.ExpirationDate = slot.ExpirationDate.Unix()
+		}
+		if !slot.NextRenewal.IsZero() {
+			summary.NextRenewal = slot.NextRenewal.Unix()
+		}
+		slots = append(slots, summary)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].ID < slots[j].ID })
+
+	return FleetDeviceSummary{
+		ID:            d.id,
+		SerialNumber:  d.state.SerialNumber,
+		Model:         d.state.Model,
+		Status:        d.state.Status,
+		MqttConnected: d.state.MqttConnected,
+		Slots:         slots,
+		LastError:     d.lastError,
+	}
+}
+
+// throttled runs an operation once the limiter lets it through and keeps the
+// enrollment counters.
+func (f *Fleet) throttled(device *fleetDevice, operation func() error) error {
+	f.lock.Lock()
+	f.enrollmentsQueued++
+	f.lock.Unlock()
+
+	f.limiter <- struct{}{}
+	defer func() { <-f.limiter }()
+
+	f.lock.Lock()
+	f.enrollmentsQueued--
+	f.enrollmentsInFlight++
+	f.lock.Unlock()
+
+	err := operation()
+
+	f.lock.Lock()
+	f.enrollmentsInFlight--
+	if err != nil {
+		f.enrollmentsFailed++
+		device.lastError = err.Error()
+	} else {
+		f.enrollmentsSucceeded++
+		device.lastError = ""
+	}
+	f.lock.Unlock()
+
+	return err
+}
+
+func (f *Fleet) device(id string) (*fleetDevice, error) {
+	device, ok := f.byID[id]
+	if !ok {
+		return nil, fmt.Errorf("device %s not found", id)
+	}
+	return device, nil
+}
+
+// Enroll enrolls a slot of a device through the limiter. It blocks until the
+// enrollment is over.
+func (f *Fleet) Enroll(id string, slotID string) error {
+	device, err := f.device(id)
+	if err != nil {
+		return err
+	}
+	return f.throttled(device, func() error { return device.service.Enroll(slotID) })
+}
+
+func (f *Fleet) Reenroll(id string, slotID string) error {
+	device, err := f.device(id)
+	if err != nil {
+		return err
+	}
+	return f.throttled(device, func() error { return device.service.Reenroll(slotID) })
+}
+
+func (f *Fleet) ConnectCloudProvider(id string, cloudProvider model.CloudProviderType, slotID string) error {
+	device, err := f.device(id)
+	if err != nil {
+		return err
+	}
+	return f.throttled(device, func() error { return device.service.ConnectCloudProvider(cloudProvider, slotID) })
+}
+
+// devicesWithSlot returns the devices with the slot in one of the given
+// statuses.
+func (f *Fleet) devicesWithSlot(slotID string, statuses ...model.SlotStatus) []*fleetDevice {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	devices := []*fleetDevice{}
+	for _, device := range f.devices {
+		for _, slot := range device.state.Slots {
+			if slot.ID != slotID {
+				continue
+			}
+			for _, status := range statuses {
+				if slot.Status == status {
+					devices = append(devices, device)
+				}
+			}
+		}
+	}
+	return devices
+}
+
+// EnrollAll starts the enrollment of the slot on every device that still
+// needs it and returns how many were scheduled. Enrollments run in the
+// background at the configured concurrency.
+func (f *Fleet) EnrollAll(slotID string) int {
+	devices := f.devicesWithSlot(slotID, model.SlotStatusNeedsProvisioning)
+	for _, device := range devices {
+		go f.Enroll(device.id, slotID)
+	}
+	return len(devices)
+}
+
+func (f *Fleet) ReenrollAll(slotID string) int {
+	devices := f.devicesWithSlot(slotID, model.SlotStatusProvisioned, model.SlotStatusNeedsReenrollment, model.SlotStatusExpired)
+	for _, device := range devices {
+		go f.Reenroll(device.id, slotID)
+	}
+	return len(devices)
+}
+
+// ConnectAll connects the slot of every device holding a valid certificate,
+// an empty cloud provider keeps the one each slot is bound to.
+func (f *Fleet) ConnectAll(cloudProvider model.CloudProviderType, slotID string) int {
+	devices := f.devicesWithSlot(slotID, model.SlotStatusProvisioned, model.SlotStatusNeedsReenrollment)
+	for _, device := range devices {
+		go f.ConnectCloudProvider(device.id, cloudProvider, slotID)
+	}
+	return len(devices)
+}
+
+// DisconnectCloudProvider closes a slot connection. Disconnecting is not
+// throttled, it puts no load on Lamassu.
+func (f *Fleet) DisconnectCloudProvider(id string, slotID string) error {
+	device, err := f.device(id)
+	if err != nil {
+		return err
+	}
+	return device.service.DisconnectCloudProvider(slotID)
+}
+
+// DisconnectAll closes the connection of the slot on every device and returns
+// how many were closed.
+func (f *Fleet) DisconnectAll(slotID string) int {
+	disconnected := 0
+	for _, device := range f.devices {
+		if device.service.DisconnectCloudProvider(slotID) == nil {
+			disconnected++
+		}
+	}
+	return disconnected
+}
+
+// AutoConnect connects every slot bound to a cloud provider that holds a
+// valid certificate, which is how the devices come back after a restart. It
+// returns how many connections were scheduled.
+func (f *Fleet) AutoConnect() int {
+	f.lock.Lock()
+	type slotConnection struct{ id, slotID string }
+	connections := []slotConnection{}
+	for _, device := range f.devices {
+		for _, slot := range device.state.Slots {
+			if slot.CloudProvider == "" {
+				continue
+			}
+			if slot.Status == model.SlotStatusProvisioned || slot.Status == model.SlotStatusNeedsReenrollment {
+				connections = append(connections, slotConnection{device.id, slot.ID})
+			}
+		}
+	}
+	f.lock.Unlock()
+
+	for _, connection := range connections {
+		go f.ConnectCloudProvider(connection.id, "", connection.slotID)
+	}
+	return len(connections)
+}
+
+// checkRenewals runs the certificate lifecycle of every device and queues the
+// automatic re-enrollments that are due. They go through the limiter like the
+// ones started from the console.
+func (f *Fleet) checkRenewals() {
+	now := time.Now()
+	for _, device := range f.devices {
+		for _, slotID := range device.service.checkSlotLifecycle(now) {
+			f.lock.Lock()
+			renewing := device.renewing[slotID]
+			device.renewing[slotID] = true
+			f.lock.Unlock()
+
+			if !renewing {
+				go f.renew(device, slotID)
+			}
+		}
+	}
+}
+
+func (f *Fleet) renew(device *fleetDevice, slotID string) {
+	defer func() {
+		f.lock.Lock()
+		delete(device.renewing, slotID)
+		f.lock.Unlock()
+	}()
+
+	fmt.Printf("%s: re-enrolling slot %s automatically\n", device.id, slotID)
+	err := f.throttled(device, func() error { return device.service.Reenroll(slotID) })
+	if err != nil {
+		device.service.renewalFailed(slotID, time.Now())
+	}
+}
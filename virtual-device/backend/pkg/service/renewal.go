@@ -0,0 +1,126 @@
+package service
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+)
+
+// RenewalPolicy decides when the slot certificates are renewed. A slot needs
+// re-enrollment once LifetimeFraction of its certificate lifetime has
+// elapsed or, when LifetimeFraction is zero, BeforeExpiry before NotAfter.
+type RenewalPolicy struct {
+	LifetimeFraction float64
+	BeforeExpiry     time.Duration
+	// AutoReenroll re-enrolls the slots needing it, otherwise they are only
+	// flagged. Failed attempts are retried after RetryBackoff, doubled on
+	// every failure up to MaxRetryBackoff.
+	AutoReenroll    bool
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// CheckInterval is how often the slots are checked, zero disables the
+	// lifecycle monitor.
+	CheckInterval time.Duration
+}
+
+// RenewalTime is when a slot holding the certificate needs re-enrollment.
+func (p RenewalPolicy) RenewalTime(crt *x509.Certificate) time.Time {
+	if p.LifetimeFraction > 0 {
+		lifetime := crt.NotAfter.Sub(crt.NotBefore)
+		return crt.NotBefore.Add(time.Duration(float64(lifetime) * p.LifetimeFraction))
+	}
+	return crt.NotAfter.Add(-p.BeforeExpiry)
+}
+
+// retryDelay is the wait before the next attempt after the given number of
+// failed ones.
+func (p RenewalPolicy) retryDelay(attempts int) time.Duration {
+	delay := p.RetryBackoff
+	for i := 1; i < attempts && delay < p.MaxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if p.MaxRetryBackoff > 0 && delay > p.MaxRetryBackoff {
+		delay = p.MaxRetryBackoff
+	}
+	return delay
+}
+
+// checkSlotLifecycle moves the enrolled slots along the lifecycle of their
+// certificate: NEEDS_REENROLLMENT past the renewal time and EXPIRED past
+// NotAfter. It returns the slots due for an automatic re-enrollment.
+func (d *DeviceServiceImpl) checkSlotLifecycle(now time.Time) []string {
+	policy := d.defaults.Renewal
+	device := d.deviceStore.GetDeviceState()
+
+	due := []string{}
+	changed := map[string]model.Slot{}
+	for _, slot := range device.Slots {
+		if slot.Certificate == nil {
+			continue
+		}
+		switch slot.Status {
+		case model.SlotStatusProvisioned, model.SlotStatusNeedsReenrollment, model.SlotStatusExpired:
+		default:
+			// Enrolling, the outcome decides the status.
+			continue
+		}
+
+		renewalTime := policy.RenewalTime(slot.Certificate)
+		status := model.SlotStatusProvisioned
+		if !now.Before(slot.Certificate.NotAfter) {
+			status = model.SlotStatusExpired
+		} else if !now.Before(renewalTime) {
+			status = model.SlotStatusNeedsReenrollment
+		}
+
+		nextRenewal := time.Time{}
+		if policy.AutoReenroll {
+			nextRenewal = renewalTime
+			// Failed attempts keep the time of their retry.
+			if slot.RenewalAttempts > 0 {
+				nextRenewal = slot.NextRenewal
+			}
+		}
+
+		if status != slot.Status || !nextRenewal.Equal(slot.NextRenewal) {
+			if status != slot.Status {
+				fmt.Printf("slot %s of %s: %s -> %s\n", slot.ID, device.SerialNumber, slot.Status, status)
+			}
+			slot.Status = status
+			slot.NextRenewal = nextRenewal
+			changed[slot.ID] = slot
+		}
+
+		if policy.AutoReenroll && status != model.SlotStatusProvisioned && !now.Before(nextRenewal) {
+			due = append(due, slot.ID)
+		}
+	}
+
+	if len(changed) > 0 {
+		d.deviceStore.UpdateDeviceState(func(device *model.DeviceState) {
+			for i, slot := range device.Slots {
+				update, ok := changed[slot.ID]
+				// A slot enrolled in the meantime keeps its new certificate.
+				if !ok || slot.Certificate != update.Certificate {
+					continue
+				}
+				device.Slots[i].Status = update.Status
+				device.Slots[i].NextRenewal = update.NextRenewal
+			}
+		})
+	}
+	return due
+}
+
+// renewalFailed schedules the next attempt of a failed automatic
+// re-enrollment.
+func (d *DeviceServiceImpl) renewalFailed(slotID string, now time.Time) {
+	serialNumber := d.deviceStore.GetDeviceState().SerialNumber
+	d.updateSlot(slotID, func(slot *model.Slot) {
+		slot.RenewalAttempts++
+		slot.NextRenewal = now.Add(d.defaults.Renewal.retryDelay(slot.RenewalAttempts))
+		fmt.Printf("automatic re-enrollment %d of slot %s of %s failed, retrying at %s\n", slot.RenewalAttempts, slot.ID, serialNumber, slot.NextRenewal.Format(time.RFC3339))
+	})
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestRenewalPolicyRenewalTime(t *testing.T) {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	crt := &x509.Certificate{
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(100 * time.Hour),
+	}
+
+	tests := []struct {
+		name   string
+		policy RenewalPolicy
+		want   time.Time
+	}{
+		{
+			name:   "lifetime fraction",
+			policy: RenewalPolicy{LifetimeFraction: 0.8},
+			want:   notBefore.Add(80 * time.Hour),
+		},
+		{
+			name:   "lifetime fraction takes precedence",
+			policy: RenewalPolicy{LifetimeFraction: 0.5, BeforeExpiry: time.Hour},
+			want:   notBefore.Add(50 * time.Hour),
+		},
+		{
+			name:   "before expiry",
+			policy: RenewalPolicy{BeforeExpiry: 10 * time.Hour},
+			want:   notBefore.Add(90 * time.Hour),
+		},
+		{
+			name:   "before expiry longer than the lifetime",
+			policy: RenewalPolicy{BeforeExpiry: 200 * time.Hour},
+			want:   notBefore.Add(-100 * time.Hour),
+		},
+		{
+			name:   "no policy",
+			policy: RenewalPolicy{},
+			want:   crt.NotAfter,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.RenewalTime(crt); !got.Equal(tt.want) {
+				t.Errorf("RenewalTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenewalPolicyRetryDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RenewalPolicy
+		attempts int
+		want     time.Duration
+	}{
+		{
+			name:     "first attempt",
+			policy:   RenewalPolicy{RetryBackoff: time.Minute, MaxRetryBackoff: time.Hour},
+			attempts: 1,
+			want:     time.Minute,
+		},
+		{
+			name:     "doubled on every failure",
+			policy:   RenewalPolicy{RetryBackoff: time.Minute, MaxRetryBackoff: time.Hour},
+			attempts: 4,
+			want:     8 * time.Minute,
+		},
+		{
+			name:     "capped",
+			policy:   RenewalPolicy{RetryBackoff: time.Minute, MaxRetryBackoff: 10 * time.Minute},
+			attempts: 5,
+			want:     10 * time.Minute,
+		},
+		{
+			name:     "capped after many failures",
+			policy:   RenewalPolicy{RetryBackoff: time.Minute, MaxRetryBackoff: time.Hour},
+			attempts: 1000,
+			want:     time.Hour,
+		},
+		{
+			name:     "backoff above the cap",
+			policy:   RenewalPolicy{RetryBackoff: 2 * time.Hour, MaxRetryBackoff: time.Hour},
+			attempts: 1,
+			want:     time.Hour,
+		},
+		{
+			name:     "no attempts",
+			policy:   RenewalPolicy{RetryBackoff: time.Minute, MaxRetryBackoff: time.Hour},
+			attempts: 0,
+			want:     time.Minute,
+		},
+		{
+			name:     "no backoff",
+			policy:   RenewalPolicy{MaxRetryBackoff: time.Hour},
+			attempts: 3,
+			want:     0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.retryDelay(tt.attempts); got != tt.want {
+				t.Errorf("retryDelay(%d) = %v, want %v", tt.attempts, got, tt.want)
+			}
+		})
+	}
+}
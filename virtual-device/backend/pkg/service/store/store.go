@@ -1,12 +1,27 @@
 package store
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
 )
 
+// Persister saves the device identity on every change, so that it survives a
+// restart.
+type Persister interface {
+	Save(device model.DeviceState) error
+}
+
+// DeviceStateStore holds the state of a device shared by the HTTP handlers,
+// the cron jobs and the MQTT callbacks. Readers get a copy, changes go through
+// SetDeviceState or UpdateDeviceState.
 type DeviceStateStore struct {
+	lock                     sync.Mutex
 	device                   *model.DeviceState
 	updateDeviceStateChannel chan model.DeviceState
+	listener                 func(model.DeviceState)
+	persister                Persister
 }
 
 func New() (*DeviceStateStore, chan model.DeviceState) {
@@ -17,11 +32,75 @@ func New() (*DeviceStateStore, chan model.DeviceState) {
 	}, deviceStateChannel
 }
 
+// NewWithListener returns a store that calls listener on every update instead
+// of publishing it on a channel. The listener runs on the updating goroutine
+// and must not block.
+func NewWithListener(listener func(model.DeviceState)) *DeviceStateStore {
+	return &DeviceStateStore{
+		listener: listener,
+	}
+}
+
+func (d *DeviceStateStore) SetPersister(persister Persister) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.persister = persister
+}
+
+// GetDeviceState returns a copy of the state, changing it does not change the
+// store.
 func (d *DeviceStateStore) GetDeviceState() *model.DeviceState {
-	return d.device
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return copyDeviceState(d.device)
 }
 
 func (d *DeviceStateStore) SetDeviceState(device *model.DeviceState) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.set(copyDeviceState(device))
+}
+
+// UpdateDeviceState applies the change to the current state, no other update
+// runs in between. It must not call the store.
+func (d *DeviceStateStore) UpdateDeviceState(update func(device *model.DeviceState)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	device := copyDeviceState(d.device)
+	if device == nil {
+		device = &model.DeviceState{}
+	}
+	update(device)
+	d.set(device)
+}
+
+func (d *DeviceStateStore) set(device *model.DeviceState) {
 	d.device = device
-	go func() { d.updateDeviceStateChannel <- *device }()
+	if d.persister != nil {
+		err := d.persister.Save(*device)
+		if err != nil {
+			fmt.Println("error persisting device identity:", err)
+		}
+	}
+	if d.listener != nil {
+		d.listener(*copyDeviceState(device))
+		return
+	}
+	update := *copyDeviceState(device)
+	go func() { d.updateDeviceStateChannel <- update }()
+}
+
+func copyDeviceState(device *model.DeviceState) *model.DeviceState {
+	if device == nil {
+		return nil
+	}
+	deviceCopy := *device
+	if device.Slots != nil {
+		deviceCopy.Slots = append([]model.Slot{}, device.Slots...)
+	}
+	return &deviceCopy
 }
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/mqtt"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/telemetry"
+)
+
+// publishTelemetry sends the reading over every slot connection, on the
+// telemetry topic of its provider. Every reading takes the next sequence
+// number, so the readings taken while disconnected show up as gaps.
+func (d *DeviceServiceImpl) publishTelemetry(device *model.DeviceState) {
+	device.TelemetrySequence++
+
+	encoding := d.defaults.TelemetryEncoding
+	if encoding == "" {
+		encoding = telemetry.EncodingJSON
+	}
+
+	for _, slot := range device.Slots {
+		mqttClient := d.connection(slot.ID)
+		if mqttClient == nil {
+			continue
+		}
+		topic := mqttClient.Topic(mqtt.TopicTelemetry)
+		if topic == "" {
+			continue
+		}
+
+		var err error
+		switch slot.ConnectionStatus {
+		case model.ConnectionStatusConnected:
+			err = d.publishReading(device, slot, mqttClient, topic, encoding)
+		case model.ConnectionStatusReconnecting:
+			err = fmt.Errorf("slot %s is reconnecting", slot.ID)
+		default:
+			// Still connecting.
+			continue
+		}
+
+		if err != nil {
+			device.TelemetryPublishFailures++
+			device.TelemetryPublishError = err.Error()
+			continue
+		}
+		device.TelemetryPublished++
+		device.TelemetryPublishError = ""
+	}
+}
+
+func (d *DeviceServiceImpl) publishReading(device *model.DeviceState, slot model.Slot, mqttClient mqtt.MqttDeviceService, topic string, encoding telemetry.Encoding) error {
+	payload, err := encoding.Encode(telemetry.Message{
+		DeviceID:     device.SerialNumber,
+		SlotID:       slot.ID,
+		Sequence:     device.TelemetrySequence,
+		Timestamp:    time.Now(),
+		Temperature:  device.TelemetryData.Temperature,
+		Humidity:     device.TelemetryData.Humidity,
+		BatteryLevel: device.TelemetryData.BatteryLevel,
+		Properties:   d.defaults.TelemetryProperties,
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding telemetry: %v", err)
+	}
+
+	// IoT Hub reads the message properties from the topic.
+	if slot.CloudProvider == model.CouldProviderTypeAzure {
+		topic += telemetry.PropertyBag(encoding, d.defaults.TelemetryProperties)
+	}
+
+	err = mqttClient.Publish(topic, payload)
+	if err != nil {
+		return fmt.Errorf("error publishing telemetry of slot %s: %v", slot.ID, err)
+	}
+	return nil
+}
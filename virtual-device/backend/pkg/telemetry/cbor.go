@@ -0,0 +1,125 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// CBOR major types.
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborTag      = 6
+	cborSimple   = 7
+)
+
+// cborTagEpoch marks an epoch-based date/time.
+const cborTagEpoch = 1
+
+// epochTime is encoded as tag 1 over the seconds since the epoch.
+type epochTime time.Time
+
+// encodeCBOR encodes the few types of the telemetry documents. Map keys are
+// sorted as RFC 8949 deterministic encoding asks, shorter keys first.
+func encodeCBOR(value interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := writeCBOR(&b, value)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func writeCBOR(b *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		b.WriteByte(cborSimple<<5 | 22)
+	case bool:
+		if v {
+			b.WriteByte(cborSimple<<5 | 21)
+		} else {
+			b.WriteByte(cborSimple<<5 | 20)
+		}
+	case int:
+		writeCBORInt(b, int64(v))
+	case int64:
+		writeCBORInt(b, v)
+	case uint64:
+		writeCBORHead(b, cborUnsigned, v)
+	case float64:
+		b.WriteByte(cborSimple<<5 | 27)
+		binary.Write(b, binary.BigEndian, math.Float64bits(v))
+	case string:
+		writeCBORHead(b, cborText, uint64(len(v)))
+		b.WriteString(v)
+	case epochTime:
+		writeCBORHead(b, cborTag, cborTagEpoch)
+		return writeCBOR(b, float64(time.Time(v).UnixNano())/1e9)
+	case []interface{}:
+		writeCBORHead(b, cborArray, uint64(len(v)))
+		for _, item := range v {
+			err := writeCBOR(b, item)
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+
+		writeCBORHead(b, cborMap, uint64(len(v)))
+		for _, key := range keys {
+			writeCBOR(b, key)
+			err := writeCBOR(b, v[key])
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot encode %T as CBOR", value)
+	}
+	return nil
+}
+
+func writeCBORInt(b *bytes.Buffer, v int64) {
+	if v < 0 {
+		writeCBORHead(b, cborNegative, uint64(-1-v))
+		return
+	}
+	writeCBORHead(b, cborUnsigned, uint64(v))
+}
+
+// writeCBORHead writes the major type and its argument in the shortest form.
+func writeCBORHead(b *bytes.Buffer, major byte, argument uint64) {
+	switch {
+	case argument < 24:
+		b.WriteByte(major<<5 | byte(argument))
+	case argument <= math.MaxUint8:
+		b.WriteByte(major<<5 | 24)
+		b.WriteByte(byte(argument))
+	case argument <= math.MaxUint16:
+		b.WriteByte(major<<5 | 25)
+		binary.Write(b, binary.BigEndian, uint16(argument))
+	case argument <= math.MaxUint32:
+		b.WriteByte(major<<5 | 26)
+		binary.Write(b, binary.BigEndian, uint32(argument))
+	default:
+		b.WriteByte(major<<5 | 27)
+		binary.Write(b, binary.BigEndian, argument)
+	}
+}
@@ -0,0 +1,105 @@
+package telemetry
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEncodeCBOR(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []byte
+	}{
+		{
+			name:  "small int",
+			value: 23,
+			want:  []byte{0x17},
+		},
+		{
+			name:  "one byte int",
+			value: 24,
+			want:  []byte{0x18, 0x18},
+		},
+		{
+			name:  "two byte int",
+			value: int64(1000),
+			want:  []byte{0x19, 0x03, 0xe8},
+		},
+		{
+			name:  "four byte int",
+			value: 1000000,
+			want:  []byte{0x1a, 0x00, 0x0f, 0x42, 0x40},
+		},
+		{
+			name:  "eight byte uint",
+			value: uint64(1) << 32,
+			want:  []byte{0x1b, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			name:  "negative int",
+			value: -1,
+			want:  []byte{0x20},
+		},
+		{
+			name:  "one byte negative int",
+			value: -100,
+			want:  []byte{0x38, 0x63},
+		},
+		{
+			name:  "two byte negative int",
+			value: int64(-1000),
+			want:  []byte{0x39, 0x03, 0xe7},
+		},
+		{
+			name:  "float",
+			value: 1.5,
+			want:  []byte{0xfb, 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			name:  "negative float",
+			value: -4.1,
+			want:  []byte{0xfb, 0xc0, 0x10, 0x66, 0x66, 0x66, 0x66, 0x66, 0x66},
+		},
+		{
+			name:  "epoch time",
+			value: epochTime(time.Unix(1363896240, 500000000)),
+			want:  []byte{0xc1, 0xfb, 0x41, 0xd4, 0x52, 0xd9, 0xec, 0x20, 0x00, 0x00},
+		},
+		{
+			name:  "null and booleans",
+			value: []interface{}{nil, true, false},
+			want:  []byte{0x83, 0xf6, 0xf5, 0xf4},
+		},
+		{
+			name:  "text",
+			value: "IETF",
+			want:  []byte{0x64, 0x49, 0x45, 0x54, 0x46},
+		},
+		{
+			name:  "map keys shorter first",
+			value: map[string]interface{}{"aa": 2, "b": 1, "a": 3},
+			want:  []byte{0xa3, 0x61, 0x61, 0x03, 0x61, 0x62, 0x01, 0x62, 0x61, 0x61, 0x02},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeCBOR(tt.value)
+			if err != nil {
+				t.Fatalf("encodeCBOR() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("encodeCBOR() = % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeCBORUnsupportedType(t *testing.T) {
+	_, err := encodeCBOR(map[string]interface{}{"value": float32(1)})
+	if err == nil {
+		t.Error("encodeCBOR() of a float32 succeeded")
+	}
+}
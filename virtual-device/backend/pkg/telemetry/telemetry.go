@@ -0,0 +1,155 @@
+// Package telemetry encodes the simulated sensor readings published by the
+// devices.
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Encoding string
+
+const (
+	EncodingJSON Encoding = "json"
+	// EncodingCBOR is the JSON document encoded as CBOR (RFC 8949), the
+	// timestamp tagged as an epoch-based date.
+	EncodingCBOR Encoding = "cbor"
+	// EncodingSenML is a SenML pack (RFC 8428) in its JSON representation.
+	EncodingSenML Encoding = "senml"
+)
+
+var Encodings = []Encoding{EncodingJSON, EncodingCBOR, EncodingSenML}
+
+func ParseEncoding(name string) (Encoding, error) {
+	encoding := Encoding(strings.ToLower(strings.TrimSpace(name)))
+	for _, known := range Encodings {
+		if encoding == known {
+			return known, nil
+		}
+	}
+	return "", fmt.Errorf("unknown telemetry encoding %q, expected one of %v", name, Encodings)
+}
+
+// ContentType is the media type of the payloads.
+func (e Encoding) ContentType() string {
+	switch e {
+	case EncodingCBOR:
+		return "application/cbor"
+	case EncodingSenML:
+		return "application/senml+json"
+	}
+	return "application/json"
+}
+
+// Message is one reading of the device sensors. Sequence numbers the messages
+// of a device so receivers can spot the lost ones.
+type Message struct {
+	DeviceID     string
+	SlotID       string
+	Sequence     uint64
+	Timestamp    time.Time
+	Temperature  int
+	Humidity     int
+	BatteryLevel int
+	// Properties are sent along every message, e.g. the site of the device.
+	Properties map[string]string
+}
+
+// Encode returns the payload of the message.
+func (e Encoding) Encode(m Message) ([]byte, error) {
+	switch e {
+	case EncodingJSON:
+		return json.Marshal(m.document(m.Timestamp.UTC().Format(time.RFC3339Nano)))
+	case EncodingCBOR:
+		return encodeCBOR(m.document(epochTime(m.Timestamp)))
+	case EncodingSenML:
+		return json.Marshal(m.senml())
+	}
+	return nil, fmt.Errorf("unknown telemetry encoding %q", e)
+}
+
+func (m Message) document(timestamp interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for key, value := range m.Properties {
+		properties[key] = value
+	}
+
+	return map[string]interface{}{
+		"device_id":  m.DeviceID,
+		"slot_id":    m.SlotID,
+		"sequence":   m.Sequence,
+		"timestamp":  timestamp,
+		"properties": properties,
+		"telemetry": map[string]interface{}{
+			"temperature":   m.Temperature,
+			"humidity":      m.Humidity,
+			"battery_level": m.BatteryLevel,
+		},
+	}
+}
+
+// senmlRecord holds the fields of RFC 8428 used by the devices.
+type senmlRecord struct {
+	BaseName    string   `json:"bn,omitempty"`
+	BaseTime    float64  `json:"bt,omitempty"`
+	Name        string   `json:"n"`
+	Unit        string   `json:"u,omitempty"`
+	Value       *float64 `json:"v,omitempty"`
+	StringValue *string  `json:"vs,omitempty"`
+}
+
+// senml names the records after the base name urn:dev:id:<device id>:, the
+// properties are string records under "property/".
+func (m Message) senml() []senmlRecord {
+	number := func(value float64) *float64 { return &value }
+	text := func(value string) *string { return &value }
+
+	records := []senmlRecord{
+		{Name: "temperature", Unit: "Cel", Value: number(float64(m.Temperature))},
+		{Name: "humidity", Unit: "%RH", Value: number(float64(m.Humidity))},
+		{Name: "battery_level", Unit: "%EL", Value: number(float64(m.BatteryLevel))},
+		{Name: "sequence", Value: number(float64(m.Sequence))},
+		{Name: "slot_id", StringValue: text(m.SlotID)},
+	}
+	for _, key := range sortedKeys(m.Properties) {
+		records = append(records, senmlRecord{Name: "property/" + key, StringValue: text(m.Properties[key])})
+	}
+
+	records[0].BaseName = "urn:dev:id:" + m.DeviceID + ":"
+	records[0].BaseTime = float64(m.Timestamp.UnixNano()) / 1e9
+	return records
+}
+
+// PropertyBag appends the properties to an Azure IoT Hub event topic, along
+// the content type and encoding system properties.
+func PropertyBag(encoding Encoding, properties map[string]string) string {
+	values := []string{
+		"$.ct=" + escapeProperty(encoding.ContentType()),
+	}
+	if encoding != EncodingCBOR {
+		values = append(values, "$.ce=utf-8")
+	}
+	for _, key := range sortedKeys(properties) {
+		values = append(values, escapeProperty(key)+"="+escapeProperty(properties[key]))
+	}
+	return strings.Join(values, "&")
+}
+
+// escapeProperty percent-encodes the spaces too, IoT Hub does not read them
+// as "+".
+func escapeProperty(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
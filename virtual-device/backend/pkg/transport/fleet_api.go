@@ -0,0 +1,226 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lamassuiot/lamassu-simulation-tools/common/auth"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/service"
+)
+
+// FleetAPI exposes the fleet aggregates and lets a single device be inspected
+// or driven. Fleet wide operations run in the background, the aggregates show
+// their progress.
+type FleetAPI struct {
+	fleet *service.Fleet
+}
+
+type fleetSlotRequest struct {
+	SlotID string `json:"slot_id"`
+	// Provider is the cloud provider of the connect routes, the slots keep
+	// the one they are bound to when empty.
+	Provider string `json:"provider"`
+}
+
+type fleetOperationResponse struct {
+	Scheduled int `json:"scheduled"`
+}
+
+func NewFleetAPI(fleet *service.Fleet) *FleetAPI {
+	return &FleetAPI{fleet: fleet}
+}
+
+func (api *FleetAPI) RegisterRoutes(router *mux.Router, authenticator *auth.Authenticator) {
+	router.HandleFunc("/fleet", authenticator.Require(auth.RoleViewer, api.statsRoute)).Methods("GET")
+	router.HandleFunc("/fleet/devices", authenticator.Require(auth.RoleViewer, api.devicesRoute)).Methods("GET")
+	router.HandleFunc("/fleet/devices/{id}", authenticator.Require(auth.RoleViewer, api.deviceRoute)).Methods("GET")
+	router.HandleFunc("/fleet/devices/{id}/enroll", authenticator.Require(auth.RoleApprover, api.deviceEnrollRoute)).Methods("POST")
+	router.HandleFunc("/fleet/devices/{id}/reenroll", authenticator.Require(auth.RoleApprover, api.deviceReenrollRoute)).Methods("POST")
+	router.HandleFunc("/fleet/devices/{id}/mqtt/connect", authenticator.Require(auth.RoleApprover, api.deviceConnectRoute)).Methods("POST")
+	router.HandleFunc("/fleet/devices/{id}/mqtt/disconnect", authenticator.Require(auth.RoleApprover, api.deviceDisconnectRoute)).Methods("POST")
+	router.HandleFunc("/fleet/devices/{id}/factory-reset", authenticator.Require(auth.RoleAdmin, api.deviceFactoryResetRoute)).Methods("POST")
+	router.HandleFunc("/fleet/enroll", authenticator.Require(auth.RoleApprover, api.enrollRoute)).Methods("POST")
+	router.HandleFunc("/fleet/reenroll", authenticator.Require(auth.RoleApprover, api.reenrollRoute)).Methods("POST")
+	router.HandleFunc("/fleet/mqtt/connect", authenticator.Require(auth.RoleApprover, api.connectRoute)).Methods("POST")
+	router.HandleFunc("/fleet/mqtt/disconnect", authenticator.Require(auth.RoleApprover, api.disconnectRoute)).Methods("POST")
+}
+
+func writeAPIJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeAPIError(w http.ResponseWriter, statusCode int, message string) {
+	writeAPIJSON(w, statusCode, map[string]string{"error": message})
+}
+
+func readSlotRequest(w http.ResponseWriter, r *http.Request) (fleetSlotRequest, bool) {
+	var request fleetSlotRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Error parsing request body: %v", err))
+		return request, false
+	}
+	if request.SlotID == "" {
+		writeAPIError(w, http.StatusBadRequest, "slot_id is required")
+		return request, false
+	}
+	if _, err := parseCloudProvider(request.Provider); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return request, false
+	}
+	return request, true
+}
+
+func (request fleetSlotRequest) cloudProvider() model.CloudProviderType {
+	provider, _ := parseCloudProvider(request.Provider)
+	return provider
+}
+
+// resolveDevice accepts the fleet id or the serial number of the device.
+func (api *FleetAPI) resolveDevice(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id, ok := api.fleet.Resolve(mux.Vars(r)["id"])
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Device not found")
+		return "", false
+	}
+	return id, true
+}
+
+func (api *FleetAPI) statsRoute(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, http.StatusOK, api.fleet.Stats())
+}
+
+func (api *FleetAPI) devicesRoute(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	offset, limit := 0, 100
+	var err error
+	if value := query.Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			writeAPIError(w, http.StatusBadRequest, "offset must be a positive number")
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			writeAPIError(w, http.StatusBadRequest, "limit must be a number greater than 0")
+			return
+		}
+	}
+
+	writeAPIJSON(w, http.StatusOK, api.fleet.Devices(offset, limit, model.SlotStatus(query.Get("slot_status"))))
+}
+
+func (api *FleetAPI) deviceRoute(w http.ResponseWriter, r *http.Request) {
+	id, ok := api.resolveDevice(w, r)
+	if !ok {
+		return
+	}
+
+	device, _ := api.fleet.DeviceState(id)
+	writeAPIJSON(w, http.StatusOK, device.Serialize())
+}
+
+// deviceOperationRoute runs an operation on a single device and waits for it,
+// so the caller gets its outcome.
+func (api *FleetAPI) deviceOperationRoute(w http.ResponseWriter, r *http.Request, operation func(id string, request fleetSlotRequest) error) {
+	id, ok := api.resolveDevice(w, r)
+	if !ok {
+		return
+	}
+	request, ok := readSlotRequest(w, r)
+	if !ok {
+		return
+	}
+
+	auth.AuditLog(auth.PrincipalFromContext(r.Context()), r.Method+" "+r.URL.Path, request.SlotID)
+	err := operation(id, request)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	device, _ := api.fleet.DeviceState(id)
+	writeAPIJSON(w, http.StatusOK, device.Serialize())
+}
+
+func (api *FleetAPI) deviceEnrollRoute(w http.ResponseWriter, r *http.Request) {
+	api.deviceOperationRoute(w, r, func(id string, request fleetSlotRequest) error {
+		return api.fleet.Enroll(id, request.SlotID)
+	})
+}
+
+func (api *FleetAPI) deviceReenrollRoute(w http.ResponseWriter, r *http.Request) {
+	api.deviceOperationRoute(w, r, func(id string, request fleetSlotRequest) error {
+		return api.fleet.Reenroll(id, request.SlotID)
+	})
+}
+
+func (api *FleetAPI) deviceConnectRoute(w http.ResponseWriter, r *http.Request) {
+	api.deviceOperationRoute(w, r, func(id string, request fleetSlotRequest) error {
+		return api.fleet.ConnectCloudProvider(id, request.cloudProvider(), request.SlotID)
+	})
+}
+
+func (api *FleetAPI) deviceDisconnectRoute(w http.ResponseWriter, r *http.Request) {
+	api.deviceOperationRoute(w, r, func(id string, request fleetSlotRequest) error {
+		return api.fleet.DisconnectCloudProvider(id, request.SlotID)
+	})
+}
+
+func (api *FleetAPI) deviceFactoryResetRoute(w http.ResponseWriter, r *http.Request) {
+	id, ok := api.resolveDevice(w, r)
+	if !ok {
+		return
+	}
+
+	auth.AuditLog(auth.PrincipalFromContext(r.Context()), r.Method+" "+r.URL.Path, "")
+	deviceService, _ := api.fleet.Device(id)
+	deviceService.FactoryReset()
+
+	device, _ := api.fleet.DeviceState(id)
+	writeAPIJSON(w, http.StatusOK, device.Serialize())
+}
+
+func (api *FleetAPI) fleetOperationRoute(w http.ResponseWriter, r *http.Request, operation func(request fleetSlotRequest) int) {
+	request, ok := readSlotRequest(w, r)
+	if !ok {
+		return
+	}
+
+	auth.AuditLog(auth.PrincipalFromContext(r.Context()), r.Method+" "+r.URL.Path, request.SlotID)
+	writeAPIJSON(w, http.StatusAccepted, fleetOperationResponse{Scheduled: operation(request)})
+}
+
+func (api *FleetAPI) enrollRoute(w http.ResponseWriter, r *http.Request) {
+	api.fleetOperationRoute(w, r, func(request fleetSlotRequest) int {
+		return api.fleet.EnrollAll(request.SlotID)
+	})
+}
+
+func (api *FleetAPI) reenrollRoute(w http.ResponseWriter, r *http.Request) {
+	api.fleetOperationRoute(w, r, func(request fleetSlotRequest) int {
+		return api.fleet.ReenrollAll(request.SlotID)
+	})
+}
+
+func (api *FleetAPI) connectRoute(w http.ResponseWriter, r *http.Request) {
+	api.fleetOperationRoute(w, r, func(request fleetSlotRequest) int {
+		return api.fleet.ConnectAll(request.cloudProvider(), request.SlotID)
+	})
+}
+
+// disconnectRoute answers once the connections are closed, Scheduled is how
+// many were.
+func (api *FleetAPI) disconnectRoute(w http.ResponseWriter, r *http.Request) {
+	api.fleetOperationRoute(w, r, func(request fleetSlotRequest) int {
+		return api.fleet.DisconnectAll(request.SlotID)
+	})
+}
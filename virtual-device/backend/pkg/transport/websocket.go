@@ -5,17 +5,29 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/lamassuiot/lamassu-simulation-tools/common/auth"
+	"github.com/lamassuiot/lamassu-vdevice/pkg/config"
 	"github.com/lamassuiot/lamassu-vdevice/pkg/model"
 	"github.com/lamassuiot/lamassu-vdevice/pkg/service"
 )
 
 type WebsocketHandler struct {
 	activeWebSocketConnection *websocket.Conn
-	deviceService             service.DeviceService
+	fleet                     *service.Fleet
 	webSocketPublisherChan    chan []byte
+	auth                      *auth.Authenticator
+	upgrader                  websocket.Upgrader
+	config                    config.Config
+
+	// selectedDeviceID is the fleet device shown in the console, commands
+	// are sent to it.
+	selectedDeviceLock sync.Mutex
+	selectedDeviceID   string
 }
 
 type WebSocketMessage struct {
@@ -24,28 +36,71 @@ type WebSocketMessage struct {
 	Timestamp time.Time   `json:"timestamp"`
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+// commandRoles is the least role allowed to send each console command. Wiping
+// the device identity or its slots is kept for admins.
+var commandRoles = map[string]auth.Role{
+	"CHANGE_TELEMETRY_DATA_RATE": auth.RoleApprover,
+	"ENROLL":                     auth.RoleApprover,
+	"SET_SLOT_KEY_ALGORITHM":     auth.RoleApprover,
+	"SET_ENROLLMENT_TOKEN":       auth.RoleApprover,
+	"REENROLL":                   auth.RoleApprover,
+	"MQTT_CONNECT":               auth.RoleApprover,
+	"MQTT_DISCONNECT":            auth.RoleApprover,
+	"GEN_NEW_ID":                 auth.RoleAdmin,
+	"GEN_NEW_SLOT":               auth.RoleAdmin,
+	"FACTORY_RESET":              auth.RoleAdmin,
+	"FLEET_SELECT_DEVICE":        auth.RoleViewer,
+	"FLEET_ENROLL":               auth.RoleApprover,
+	"FLEET_REENROLL":             auth.RoleApprover,
+	"FLEET_MQTT_CONNECT":         auth.RoleApprover,
+	"FLEET_MQTT_DISCONNECT":      auth.RoleApprover,
 }
 
-func NewWebsocketHandler(svc service.DeviceService, updateDeviceStateChan chan model.DeviceState) *WebsocketHandler {
+// fleetUpdatePeriod is how often the fleet aggregates are checked for changes.
+const fleetUpdatePeriod = time.Second
+
+func commandRole(command string) auth.Role {
+	if role, ok := commandRoles[command]; ok {
+		return role
+	}
+	return auth.RoleAdmin
+}
+
+// NewWebsocketHandler serves the console. The given configuration is sent to
+// every console that connects, it must not hold secrets.
+func NewWebsocketHandler(fleet *service.Fleet, authenticator *auth.Authenticator, effectiveConfig config.Config) *WebsocketHandler {
 	fmt.Println("NewWebsocketHandler")
 	wsSvc := &WebsocketHandler{
 		activeWebSocketConnection: nil,
-		deviceService:             svc,
+		fleet:                     fleet,
 		webSocketPublisherChan:    make(chan []byte),
+		auth:                      authenticator,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: authenticator.CheckOrigin,
+		},
+		config:           effectiveConfig,
+		selectedDeviceID: fleet.DefaultDeviceID(),
 	}
 
-	//send device update messages to the websocket connection
-	go func() {
-		for updatedDevice := range updateDeviceStateChan {
-			wsSvc.SendWebSocketMessage(WebSocketMessage{
-				Type:      "DEVICE_STATE_UPDATE",
-				Message:   updatedDevice.Serialize(),
-				Timestamp: time.Now(),
-			})
+	//send the updates of the selected device to the websocket connection
+	fleet.OnDeviceUpdate(func(id string, updatedDevice model.DeviceState) {
+		if id != wsSvc.selectedDevice() {
+			return
 		}
-	}()
+		go wsSvc.sendDeviceState(updatedDevice)
+	})
+	fleet.OnSlotTransition(func(transition service.SlotTransition) {
+		if transition.DeviceID != wsSvc.selectedDevice() {
+			return
+		}
+		go wsSvc.SendWebSocketMessage(WebSocketMessage{
+			Type:      "SLOT_TRANSITION",
+			Message:   transition,
+			Timestamp: time.Now(),
+		})
+	})
+
+	go wsSvc.publishFleetUpdates()
 
 	go func() {
 		wsSvc.publishToWebsocket(wsSvc.webSocketPublisherChan)
@@ -54,13 +109,95 @@ func NewWebsocketHandler(svc service.DeviceService, updateDeviceStateChan chan m
 	return wsSvc
 }
 
-func (ws *WebsocketHandler) messageHandler(inMessage WebSocketMessage) {
+func (ws *WebsocketHandler) selectedDevice() string {
+	ws.selectedDeviceLock.Lock()
+	defer ws.selectedDeviceLock.Unlock()
+
+	return ws.selectedDeviceID
+}
+
+func (ws *WebsocketHandler) sendDeviceState(device model.DeviceState) {
+	ws.SendWebSocketMessage(WebSocketMessage{
+		Type:      "DEVICE_STATE_UPDATE",
+		Message:   device.Serialize(),
+		Timestamp: time.Now(),
+	})
+}
+
+func (ws *WebsocketHandler) sendSelectedDevice() {
+	id := ws.selectedDevice()
+	ws.SendWebSocketMessage(WebSocketMessage{
+		Type:      "FLEET_SELECTED_DEVICE",
+		Message:   map[string]string{"device_id": id},
+		Timestamp: time.Now(),
+	})
+	if device, ok := ws.fleet.DeviceState(id); ok {
+		ws.sendDeviceState(device)
+	}
+}
+
+func (ws *WebsocketHandler) sendError(err error) {
+	ws.SendWebSocketMessage(WebSocketMessage{
+		Type:      "ERROR",
+		Message:   err.Error(),
+		Timestamp: time.Now(),
+	})
+}
+
+// parseCloudProvider accepts an empty provider, the slot connects to the one
+// it is bound to.
+func parseCloudProvider(name string) (model.CloudProviderType, error) {
+	if name == "" {
+		return "", nil
+	}
+	return model.ParseCloudProviderType(name)
+}
+
+func (ws *WebsocketHandler) sendFleetUpdate(stats service.FleetStats) {
+	ws.SendWebSocketMessage(WebSocketMessage{
+		Type:      "FLEET_UPDATE",
+		Message:   stats,
+		Timestamp: time.Now(),
+	})
+}
+
+// publishFleetUpdates sends the fleet aggregates whenever they change. They
+// are polled rather than pushed, a large fleet changes far more often than
+// the console needs to know.
+func (ws *WebsocketHandler) publishFleetUpdates() {
+	var last service.FleetStats
+	for range time.Tick(fleetUpdatePeriod) {
+		stats := ws.fleet.Stats()
+		if reflect.DeepEqual(stats, last) {
+			continue
+		}
+		last = stats
+		ws.sendFleetUpdate(stats)
+	}
+}
+
+func (ws *WebsocketHandler) messageHandler(principal *auth.Principal, inMessage WebSocketMessage) {
 	bytesIn, err := json.Marshal(inMessage.Message)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
+	required := commandRole(inMessage.Type)
+	if !principal.Role.Allows(required) {
+		auth.AuditLog(principal, inMessage.Type, fmt.Sprintf("denied, requires the %s role", required))
+		ws.SendWebSocketMessage(WebSocketMessage{
+			Type:      "ERROR",
+			Message:   fmt.Sprintf("%s requires the %s role", inMessage.Type, required),
+			Timestamp: time.Now(),
+		})
+		return
+	}
+	auth.AuditLog(principal, inMessage.Type, string(bytesIn))
+
+	deviceID := ws.selectedDevice()
+	deviceService, _ := ws.fleet.Device(deviceID)
+
 	switch inMessage.Type {
 	case "CHANGE_TELEMETRY_DATA_RATE":
 		type SpecificMessage struct {
@@ -70,13 +207,16 @@ func (ws *WebsocketHandler) messageHandler(inMessage WebSocketMessage) {
 		var newRateMessage SpecificMessage
 		json.Unmarshal(bytesIn, &newRateMessage)
 
-		ws.deviceService.UpdateGetSensorDataInterval(newRateMessage.NewRate)
+		deviceService.UpdateGetSensorDataInterval(newRateMessage.NewRate)
 
 	case "GEN_NEW_ID":
-		ws.deviceService.ResetDeviceState()
+		deviceService.ResetDeviceState()
 
 	case "GEN_NEW_SLOT":
-		ws.deviceService.GenerateNewSlot()
+		deviceService.GenerateNewSlot()
+
+	case "FACTORY_RESET":
+		deviceService.FactoryReset()
 
 	case "ENROLL":
 		type SpecificMessage struct {
@@ -86,7 +226,31 @@ func (ws *WebsocketHandler) messageHandler(inMessage WebSocketMessage) {
 		var msg SpecificMessage
 		json.Unmarshal(bytesIn, &msg)
 
-		ws.deviceService.Enroll(msg.SlotID)
+		ws.fleet.Enroll(deviceID, msg.SlotID)
+
+	case "SET_SLOT_KEY_ALGORITHM":
+		type SpecificMessage struct {
+			SlotID       string `json:"slot_id"`
+			KeyAlgorithm string `json:"key_algorithm"`
+		}
+
+		var msg SpecificMessage
+		json.Unmarshal(bytesIn, &msg)
+
+		err = deviceService.SetSlotKeyAlgorithm(msg.SlotID, model.KeyAlgorithm(msg.KeyAlgorithm))
+		if err != nil {
+			log.Println(err)
+		}
+
+	case "SET_ENROLLMENT_TOKEN":
+		type SpecificMessage struct {
+			Token string `json:"token"`
+		}
+
+		var msg SpecificMessage
+		json.Unmarshal(bytesIn, &msg)
+
+		deviceService.SetEnrollmentToken(msg.Token)
 
 	case "REENROLL":
 		type SpecificMessage struct {
@@ -96,7 +260,7 @@ func (ws *WebsocketHandler) messageHandler(inMessage WebSocketMessage) {
 		var msg SpecificMessage
 		json.Unmarshal(bytesIn, &msg)
 
-		ws.deviceService.Reenroll(msg.SlotID)
+		ws.fleet.Reenroll(deviceID, msg.SlotID)
 
 	case "MQTT_CONNECT":
 		type SpecificMessage struct {
@@ -107,18 +271,125 @@ func (ws *WebsocketHandler) messageHandler(inMessage WebSocketMessage) {
 		var msg SpecificMessage
 		json.Unmarshal(bytesIn, &msg)
 
-		ws.deviceService.ConnectCloudProvider(model.CouldProviderTypeAzure, msg.SlotID)
+		provider, err := parseCloudProvider(msg.Provider)
+		if err != nil {
+			ws.sendError(err)
+			return
+		}
+		err = ws.fleet.ConnectCloudProvider(deviceID, provider, msg.SlotID)
+		if err != nil {
+			ws.sendError(err)
+		}
+
+	case "MQTT_DISCONNECT":
+		type SpecificMessage struct {
+			SlotID string `json:"slot_id"`
+		}
+
+		var msg SpecificMessage
+		json.Unmarshal(bytesIn, &msg)
+
+		err = ws.fleet.DisconnectCloudProvider(deviceID, msg.SlotID)
+		if err != nil {
+			ws.sendError(err)
+		}
+
+	case "FLEET_SELECT_DEVICE":
+		type SpecificMessage struct {
+			DeviceID string `json:"device_id"`
+		}
+
+		var msg SpecificMessage
+		json.Unmarshal(bytesIn, &msg)
+
+		// Devices can be picked by their fleet id or their serial number.
+		id, ok := ws.fleet.Resolve(msg.DeviceID)
+		if !ok {
+			ws.SendWebSocketMessage(WebSocketMessage{
+				Type:      "ERROR",
+				Message:   fmt.Sprintf("device %s not found", msg.DeviceID),
+				Timestamp: time.Now(),
+			})
+			return
+		}
+
+		ws.selectedDeviceLock.Lock()
+		ws.selectedDeviceID = id
+		ws.selectedDeviceLock.Unlock()
+
+		ws.sendSelectedDevice()
+
+	case "FLEET_ENROLL":
+		type SpecificMessage struct {
+			SlotID string `json:"slot_id"`
+		}
+
+		var msg SpecificMessage
+		json.Unmarshal(bytesIn, &msg)
+
+		ws.fleet.EnrollAll(msg.SlotID)
+
+	case "FLEET_REENROLL":
+		type SpecificMessage struct {
+			SlotID string `json:"slot_id"`
+		}
+
+		var msg SpecificMessage
+		json.Unmarshal(bytesIn, &msg)
+
+		ws.fleet.ReenrollAll(msg.SlotID)
+
+	case "FLEET_MQTT_CONNECT":
+		type SpecificMessage struct {
+			SlotID   string `json:"slot_id"`
+			Provider string `json:"provider"`
+		}
+
+		var msg SpecificMessage
+		json.Unmarshal(bytesIn, &msg)
+
+		provider, err := parseCloudProvider(msg.Provider)
+		if err != nil {
+			ws.sendError(err)
+			return
+		}
+		ws.fleet.ConnectAll(provider, msg.SlotID)
+
+	case "FLEET_MQTT_DISCONNECT":
+		type SpecificMessage struct {
+			SlotID string `json:"slot_id"`
+		}
+
+		var msg SpecificMessage
+		json.Unmarshal(bytesIn, &msg)
+
+		ws.fleet.DisconnectAll(msg.SlotID)
 	}
 }
 
 func (ws *WebsocketHandler) MainRoute(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
+	// The session is checked before the upgrade so the console gets a plain
+	// 401 and can send the user to the login page.
+	principal := ws.auth.Authenticate(r)
+	if principal == nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	c, err := ws.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Print("upgrade:", err)
 		return
 	}
 
 	ws.activeWebSocketConnection = c
+	ws.SendWebSocketMessage(WebSocketMessage{
+		Type:      "CONFIG",
+		Message:   ws.config,
+		Timestamp: time.Now(),
+	})
+	ws.sendFleetUpdate(ws.fleet.Stats())
+	ws.sendSelectedDevice()
 
 	for {
 		_, message, err := c.ReadMessage()
@@ -131,7 +402,7 @@ func (ws *WebsocketHandler) MainRoute(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("<< Incoming message: " + string(message))
 		err = json.Unmarshal(message, &inMessage)
 		if err == nil {
-			ws.messageHandler(inMessage)
+			ws.messageHandler(principal, inMessage)
 			continue
 		}
 		fmt.Println("err parsing message:", err)
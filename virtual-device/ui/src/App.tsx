@@ -1,6 +1,6 @@
 /* eslint-disable */
 import React, { useState, useEffect } from "react"
-import { Box, Button, ButtonGroup, createTheme, GlobalStyles, Grid, IconButton, keyframes, Paper, Slider, ThemeProvider, Typography } from "@mui/material"
+import { Box, Button, ButtonGroup, createTheme, GlobalStyles, Grid, IconButton, keyframes, MenuItem, Paper, Select, Slider, ThemeProvider, Typography } from "@mui/material"
 import CachedIcon from "@mui/icons-material/Cached"
 import CheckIcon from "@mui/icons-material/Check"
 import PriorityHighIcon from "@mui/icons-material/PriorityHigh"
@@ -31,8 +31,22 @@ const App = () => {
     const [selectedIntegration, setSelectedIntegration] = useState("aws")
     const supportedIntegrations = [
         "aws",
-        "azure"
+        "azure",
+        "generic"
     ]
+    const supportedKeyAlgorithms = [
+        "RSA_2048",
+        "RSA_3072",
+        "RSA_4096",
+        "ECDSA_P256",
+        "ECDSA_P384",
+        "ED25519"
+    ]
+    const keyProviderNames: { [provider: string]: string } = {
+        software: "Software",
+        pkcs11: "PKCS#11 token",
+        tpm: "TPM 2.0"
+    }
 
     const [selectedSlotID, setSelectedSlotID] = useState("default")
 
@@ -59,6 +73,9 @@ const App = () => {
     })
 
     const filteredSlots = deviceState.slots.filter(s => s.id === selectedSlotID)
+    const selectedSlot = filteredSlots.length > 0 ? filteredSlots[0] : undefined
+    // Slots being connected or reconnecting can be disconnected as well.
+    const slotConnected = selectedSlot !== undefined && ["CONNECTING", "CONNECTED", "RECONNECTING"].includes(selectedSlot.connectionStatus)
 
     let statusColor = "#ED6059"
     if (filteredSlots.length === 1) {
@@ -214,6 +231,21 @@ const App = () => {
                                             Generate Serial Number
                                         </Button>
                                     </Grid>
+                                    <Grid item xs="auto" marginLeft="20px">
+                                        <Button variant="outlined" color="error" sx={{ height: "50px", fontSize: "30px" }} onClick={() => {
+                                            dispatch({
+                                                type: ActionType.WS_SEND_MESSAGE,
+                                                value: {
+                                                    type: "FACTORY_RESET",
+                                                    message: {
+                                                    },
+                                                    time: Date.now()
+                                                }
+                                            })
+                                        }}>
+                                            Factory Reset
+                                        </Button>
+                                    </Grid>
 
                                     <Grid item xs container justifyContent="flex-end" spacing={2}>
                                         <Grid item marginRight="30px">
@@ -248,7 +280,7 @@ const App = () => {
                                             </Button>
                                         </Grid>
                                         <Grid item>
-                                            <Button sx={{ height: "50px", fontSize: "30px" }} variant="outlined" disabled={!(filteredSlots.length === 1 && (filteredSlots[0].status === "PROVISIONED" || filteredSlots[0].status === "NEEDS_REENROLLMENT"))} startIcon={<LockResetOutlinedIcon />} onClick={() => {
+                                            <Button sx={{ height: "50px", fontSize: "30px" }} variant="outlined" disabled={!(filteredSlots.length === 1 && (filteredSlots[0].status === "PROVISIONED" || filteredSlots[0].status === "NEEDS_REENROLLMENT" || filteredSlots[0].status === "EXPIRED"))} startIcon={<LockResetOutlinedIcon />} onClick={() => {
                                                 dispatch({
                                                     type: ActionType.WS_SEND_MESSAGE,
                                                     value: {
@@ -274,6 +306,10 @@ const App = () => {
                                             <Box bgcolor="#1F2933" component={Paper} padding="25px">
                                                 <Typography color="#B2B3B7" fontSize="25px" fontWeight="400">Device Serial Number</Typography>
                                                 <Typography color="#DEE2E7" fontSize="28px" fontWeight="400" display="inline-block">{deviceState.serialNumber}</Typography>
+                                                <Typography color="#B2B3B7" fontSize="20px" fontWeight="400" marginTop="15px">Claim Code</Typography>
+                                                <Typography color="#DEE2E7" fontSize="28px" fontWeight="400" fontFamily="monospace">
+                                                    {deviceState.hasEnrollmentToken ? "Enrollment token set" : deviceState.claimCode}
+                                                </Typography>
                                             </Box>
                                         </Grid>
                                         <Grid item xs={12}>
@@ -362,6 +398,54 @@ const App = () => {
                                                                 <Typography color="#B2B3B7" fontSize="25px" fontWeight="400">Expiration Date</Typography>
                                                                 <Typography color="#DEE2E7" fontSize="28px" fontWeight="400">{expirationDate}</Typography>
                                                             </Grid>
+                                                            {
+                                                                filteredSlots[0].nextRenewal && (
+                                                                    <Grid item xs={12}>
+                                                                        <Typography color="#B2B3B7" fontSize="25px" fontWeight="400">Next Renewal</Typography>
+                                                                        <Typography color="#DEE2E7" fontSize="28px" fontWeight="400">{moment(filteredSlots[0].nextRenewal).format("DD/MM/YYYY HH:mm:ss")}</Typography>
+                                                                    </Grid>
+                                                                )
+                                                            }
+                                                            {
+                                                                filteredSlots[0].renewalError !== "" && (
+                                                                    <Grid item xs={12}>
+                                                                        <Typography color="#B2B3B7" fontSize="25px" fontWeight="400">Last Renewal Error</Typography>
+                                                                        <Typography color="#ee3125" fontSize="20px" fontWeight="400">{filteredSlots[0].renewalError}</Typography>
+                                                                    </Grid>
+                                                                )
+                                                            }
+                                                            <Grid item xs={12}>
+                                                                <Typography color="#B2B3B7" fontSize="25px" fontWeight="400">Key Algorithm</Typography>
+                                                                <Select
+                                                                    variant="standard"
+                                                                    sx={{ color: "#DEE2E7", fontSize: "28px" }}
+                                                                    value={filteredSlots[0].keyAlgorithm || ""}
+                                                                    disabled={filteredSlots[0].status !== "NEEDS_PROVISIONING"}
+                                                                    onChange={(ev) => {
+                                                                        dispatch({
+                                                                            type: ActionType.WS_SEND_MESSAGE,
+                                                                            value: {
+                                                                                type: "SET_SLOT_KEY_ALGORITHM",
+                                                                                message: {
+                                                                                    slot_id: selectedSlotID,
+                                                                                    key_algorithm: ev.target.value
+                                                                                },
+                                                                                time: Date.now()
+                                                                            }
+                                                                        })
+                                                                    }}
+                                                                >
+                                                                    {
+                                                                        supportedKeyAlgorithms.map(algorithm => (
+                                                                            <MenuItem key={algorithm} value={algorithm}>{algorithm}</MenuItem>
+                                                                        ))
+                                                                    }
+                                                                </Select>
+                                                            </Grid>
+                                                            <Grid item xs={12}>
+                                                                <Typography color="#B2B3B7" fontSize="25px" fontWeight="400">Key Storage</Typography>
+                                                                <Typography color="#DEE2E7" fontSize="28px" fontWeight="400">{keyProviderNames[filteredSlots[0].keyProvider] || filteredSlots[0].keyProvider}</Typography>
+                                                            </Grid>
                                                         </>
                                                     )
 
@@ -389,16 +473,29 @@ const App = () => {
                                         </Grid>
                                         <Grid item xs="auto" container alignItems="center" spacing={1}>
                                             <Grid item>
-                                                <Typography>{deviceState.mqttConnected ? "CONNECTED" : "DISCONNECTED"}</Typography>
+                                                <Typography>{selectedSlot ? selectedSlot.connectionStatus : "DISCONNECTED"}{selectedSlot && selectedSlot.cloudProvider !== "" && ` (${selectedSlot.cloudProvider})`}</Typography>
+                                                {
+                                                    selectedSlot && selectedSlot.connectionError !== "" && (
+                                                        <Typography color="#ee3125" fontSize="12px">{selectedSlot.connectionError}</Typography>
+                                                    )
+                                                }
+                                                <Typography color="#B2B3B7" fontSize="12px">Telemetry: {deviceState.telemetryPublished} published, {deviceState.telemetryPublishFailures} failed</Typography>
+                                                {
+                                                    deviceState.telemetryPublishError !== "" && (
+                                                        <Typography color="#ee3125" fontSize="12px">{deviceState.telemetryPublishError}</Typography>
+                                                    )
+                                                }
                                             </Grid>
                                             <Grid item>
                                                 <Button sx={{ height: "50px", fontSize: "30px" }} variant="outlined" startIcon={<ReplayIcon />} onClick={() => {
-                                                    if (deviceState.mqttConnected) {
+                                                    if (slotConnected) {
                                                         dispatch({
                                                             type: ActionType.WS_SEND_MESSAGE,
                                                             value: {
                                                                 type: "MQTT_DISCONNECT",
-                                                                message: {},
+                                                                message: {
+                                                                    slot_id: selectedSlotID
+                                                                },
                                                                 time: Date.now()
                                                             }
                                                         })
@@ -417,7 +514,7 @@ const App = () => {
                                                     }
                                                 }}
                                                 >
-                                                    {deviceState.mqttConnected ? "Disconnect" : "Connect"}
+                                                    {slotConnected ? "Disconnect" : "Connect"}
                                                 </Button>
                                             </Grid>
                                         </Grid>
@@ -1,6 +1,6 @@
 /* eslint-disable */
 import React, { useState, useEffect } from "react"
-import { Box, Button, ButtonGroup, createTheme, Grid, IconButton, keyframes, Paper, Slider, ThemeProvider, Typography } from "@mui/material"
+import { Box, Button, ButtonGroup, createTheme, Grid, IconButton, keyframes, Paper, Slider, TextField, ThemeProvider, Typography } from "@mui/material"
 import CachedIcon from "@mui/icons-material/Cached"
 import DeleteOutlineOutlinedIcon from "@mui/icons-material/DeleteOutlineOutlined"
 import moment from "moment"
@@ -14,8 +14,25 @@ const InspectMode= () => {
     const dispatch = useDispatch()
 
     const websocketMessages = useAppSelector((state: any) => websocketSelector.getMessages(state))
+    const config = useAppSelector((state: any) => deviceManagerSelector.getConfig(state))
+    const fleet = useAppSelector((state: any) => deviceManagerSelector.getFleet(state))
+    const selectedDeviceId = useAppSelector((state: any) => deviceManagerSelector.getSelectedDeviceId(state))
     console.log(websocketMessages)
 
+    const [fleetDeviceId, setFleetDeviceId] = useState("")
+    const [fleetSlotId, setFleetSlotId] = useState("default")
+
+    const sendFleetCommand = (type: string, message: any) => {
+        dispatch({
+            type: ActionType.WS_SEND_MESSAGE,
+            value: {
+                type: type,
+                message: message,
+                time: Date.now()
+            }
+        })
+    }
+
     const [provisioningFlow, setProvisioningFlow] = useState("device")
     const supportedProvisioningFlows = [
         "device",
@@ -66,6 +83,59 @@ const InspectMode= () => {
                             }}
                         />
                     </Grid>
+                    {
+                        fleet && fleet.devices > 1 && (
+                            <Grid item xs={12} container spacing={1}>
+                                <Grid item xs={12}>
+                                    <Typography color="#B2B3B7" fontSize="25px" fontWeight="400">Fleet</Typography>
+                                </Grid>
+                                <Grid item xs={12}>
+                                    <Typography color="#B2B3B7" fontSize="12px">{fleet.devices} devices, showing {selectedDeviceId}</Typography>
+                                    <Typography color="#B2B3B7" fontSize="12px">
+                                        Slots: {Object.keys(fleet.slotsByStatus).map(status => `${status} ${fleet.slotsByStatus[status]}`).join(", ")}
+                                    </Typography>
+                                    <Typography color="#B2B3B7" fontSize="12px">MQTT connected: {fleet.mqttConnected}</Typography>
+                                    <Typography color="#B2B3B7" fontSize="12px">Telemetry: {fleet.telemetryPublished} published, {fleet.telemetryPublishFailures} failed</Typography>
+                                    <Typography color="#B2B3B7" fontSize="12px">
+                                        Enrollments: {fleet.enrollmentsQueued} queued, {fleet.enrollmentsInFlight} in flight, {fleet.enrollmentsSucceeded} succeeded, {fleet.enrollmentsFailed} failed
+                                    </Typography>
+                                </Grid>
+                                <Grid item xs={12} container spacing={1} alignItems="center">
+                                    <Grid item xs={8}>
+                                        <TextField size="small" fullWidth label="Device ID or serial number" value={fleetDeviceId} onChange={(ev) => setFleetDeviceId(ev.target.value)} />
+                                    </Grid>
+                                    <Grid item xs={4}>
+                                        <Button variant="outlined" disabled={fleetDeviceId === ""} onClick={() => {
+                                            sendFleetCommand("FLEET_SELECT_DEVICE", { device_id: fleetDeviceId })
+                                        }}>Show</Button>
+                                    </Grid>
+                                </Grid>
+                                <Grid item xs={12} container spacing={1} alignItems="center">
+                                    <Grid item xs={4}>
+                                        <TextField size="small" fullWidth label="Slot" value={fleetSlotId} onChange={(ev) => setFleetSlotId(ev.target.value)} />
+                                    </Grid>
+                                    <Grid item xs={8}>
+                                        <ButtonGroup size="small">
+                                            <Button onClick={() => sendFleetCommand("FLEET_ENROLL", { slot_id: fleetSlotId })}>Enroll all</Button>
+                                            <Button onClick={() => sendFleetCommand("FLEET_REENROLL", { slot_id: fleetSlotId })}>Reenroll all</Button>
+                                            <Button onClick={() => sendFleetCommand("FLEET_MQTT_CONNECT", { slot_id: fleetSlotId })}>Connect all</Button>
+                                            <Button onClick={() => sendFleetCommand("FLEET_MQTT_DISCONNECT", { slot_id: fleetSlotId })}>Disconnect all</Button>
+                                        </ButtonGroup>
+                                    </Grid>
+                                </Grid>
+                            </Grid>
+                        )
+                    }
+                    <Grid item xs={12} container spacing={1}>
+                        <Grid item xs={12}>
+                            <Typography color="#B2B3B7" fontSize="25px" fontWeight="400">Configuration</Typography>
+                        </Grid>
+                        <Grid item xs={12}>
+                            <Typography component="pre" color="#B2B3B7" fontSize="10px" whiteSpace="pre-wrap">
+                                {config ? JSON.stringify(config, null, 2) : "-"}
+                            </Typography>
+                        </Grid>
+                    </Grid>
                     <Grid item xs={12} container spacing={1}>
                         <Grid item xs={12}>
                             <Typography color="#B2B3B7" fontSize="25px" fontWeight="400">Web Socket Messages</Typography>
@@ -3,4 +3,8 @@ export enum ActionType {
     TELEMETRY_DATA = "TELEMETRY_DATA",
     DEVICE_UPDATED = "DEVICE_STATE_UPDATE",
     MQTT_LOG = "MQTT_LOG",
+    CONFIG = "CONFIG",
+    FLEET_UPDATE = "FLEET_UPDATE",
+    FLEET_SELECTED_DEVICE = "FLEET_SELECTED_DEVICE",
+    SLOT_TRANSITION = "SLOT_TRANSITION",
 }
@@ -14,8 +14,15 @@ export interface SlotState {
     serialNumber: string,
     certificate: string,
     privateKey: string,
+    keyAlgorithm: string,
+    keyProvider: string,
     issuingCA: string,
-    expirationDate: Date
+    expirationDate: Date,
+    nextRenewal: Date | undefined,
+    renewalError: string,
+    cloudProvider: string,
+    connectionStatus: string,
+    connectionError: string
 }
 
 export interface DeviceState {
@@ -24,6 +31,11 @@ export interface DeviceState {
     model: string,
     slots: Array<SlotState>
     mqttConnected: boolean,
+    claimCode: string,
+    hasEnrollmentToken: boolean,
+    telemetryPublished: number,
+    telemetryPublishFailures: number,
+    telemetryPublishError: string
 }
 
 export interface MQTTLog {
@@ -33,10 +45,27 @@ export interface MQTTLog {
     timestamp: Date
 }
 
+export interface FleetState {
+    devices: number,
+    devicesByStatus: { [status: string]: number },
+    slots: number,
+    slotsByStatus: { [status: string]: number },
+    mqttConnected: number,
+    enrollmentsQueued: number,
+    enrollmentsInFlight: number,
+    enrollmentsSucceeded: number,
+    enrollmentsFailed: number,
+    telemetryPublished: number,
+    telemetryPublishFailures: number
+}
+
 export interface DeviceManagerState {
     telemetryData: TelemetryDataState,
     device: DeviceState
     mqttLogs: Array<MQTTLog>
+    config: any
+    fleet: FleetState | null
+    selectedDeviceId: string
 }
 
 const initialState = {
@@ -49,9 +78,17 @@ const initialState = {
         status: "-",
         serialNumber: "-",
         model: "-",
-        slots: []
+        slots: [],
+        claimCode: "-",
+        hasEnrollmentToken: false,
+        telemetryPublished: 0,
+        telemetryPublishFailures: 0,
+        telemetryPublishError: ""
     },
-    mqttLogs: []
+    mqttLogs: [],
+    config: null,
+    fleet: null,
+    selectedDeviceId: "-"
 }
 
 export const deviceManagerReducer = (state = initialState, action: any) => {
@@ -65,6 +102,11 @@ export const deviceManagerReducer = (state = initialState, action: any) => {
                 serialNumber: action.value.message.serial_number,
                 model: action.value.message.model,
                 mqttConnected: action.value.message.mqtt_connected,
+                claimCode: action.value.message.claim_code,
+                hasEnrollmentToken: action.value.message.has_enrollment_token,
+                telemetryPublished: action.value.message.telemetry_published,
+                telemetryPublishFailures: action.value.message.telemetry_publish_failures,
+                telemetryPublishError: action.value.message.telemetry_publish_error || "",
                 slots: action.value.message.slots.map((slot: any) => {
                     return {
                         id: slot.id,
@@ -72,8 +114,15 @@ export const deviceManagerReducer = (state = initialState, action: any) => {
                         serialNumber: slot.serial_number,
                         certificate: slot.certificate,
                         privateKey: slot.private_key,
+                        keyAlgorithm: slot.key_algorithm,
+                        keyProvider: slot.key_provider,
                         issuingCA: slot.issuing_ca,
-                        expirationDate: moment.unix(slot.expiration_date)
+                        expirationDate: moment.unix(slot.expiration_date),
+                        nextRenewal: slot.next_renewal ? moment.unix(slot.next_renewal) : undefined,
+                        renewalError: slot.renewal_error || "",
+                        cloudProvider: slot.cloud_provider || "",
+                        connectionStatus: slot.connection_status,
+                        connectionError: slot.connection_error || ""
                     }
                 })
             },
@@ -90,6 +139,43 @@ export const deviceManagerReducer = (state = initialState, action: any) => {
             mqttLogs: [action.value.message, ...logs]
         })
     }
+    case actions.deviceManagerActions.ActionType.SLOT_TRANSITION: {
+        // Slot status changes are shown along the MQTT logs.
+        const transition = action.value.message
+        const logs = state.mqttLogs.slice(0, 20)
+        return Object.assign({}, state, {
+            mqttLogs: [{
+                type: transition.to === "EXPIRED" || transition.error ? "ERROR" : "INFO",
+                title: "Slot " + transition.slot_id + ": " + transition.from + " → " + transition.to,
+                message: transition.error || "",
+                timestamp: new Date(action.value.timestamp)
+            }, ...logs]
+        })
+    }
+    case actions.deviceManagerActions.ActionType.CONFIG:
+        return Object.assign({}, state, {
+            config: action.value.message
+        })
+    case actions.deviceManagerActions.ActionType.FLEET_UPDATE:
+        return Object.assign({}, state, {
+            fleet: {
+                devices: action.value.message.devices,
+                devicesByStatus: action.value.message.devices_by_status,
+                slots: action.value.message.slots,
+                slotsByStatus: action.value.message.slots_by_status,
+                mqttConnected: action.value.message.mqtt_connected,
+                enrollmentsQueued: action.value.message.enrollments_queued,
+                enrollmentsInFlight: action.value.message.enrollments_in_flight,
+                enrollmentsSucceeded: action.value.message.enrollments_succeeded,
+                enrollmentsFailed: action.value.message.enrollments_failed,
+                telemetryPublished: action.value.message.telemetry_published,
+                telemetryPublishFailures: action.value.message.telemetry_publish_failures
+            }
+        })
+    case actions.deviceManagerActions.ActionType.FLEET_SELECTED_DEVICE:
+        return Object.assign({}, state, {
+            selectedDeviceId: action.value.message.device_id
+        })
     default:
         break
     }
@@ -108,6 +194,21 @@ export const getDeviceState = (state: RootState): DeviceState => {
     return reducer.device
 }
 
+export const getConfig = (state: RootState): any => {
+    const reducer = getSelector(state)
+    return reducer.config
+}
+
+export const getFleet = (state: RootState): FleetState | null => {
+    const reducer = getSelector(state)
+    return reducer.fleet
+}
+
+export const getSelectedDeviceId = (state: RootState): string => {
+    const reducer = getSelector(state)
+    return reducer.selectedDeviceId
+}
+
 export const getMqttLogs = (state: RootState): Array<MQTTLog> => {
     const reducer = getSelector(state)
     return reducer.mqttLogs
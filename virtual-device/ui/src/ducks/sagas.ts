@@ -19,6 +19,18 @@ function * message (action: any) {
     case ActionType.MQTT_LOG:
         yield put({ type: ActionType.MQTT_LOG, value: msg })
         break
+    case ActionType.CONFIG:
+        yield put({ type: ActionType.CONFIG, value: msg })
+        break
+    case ActionType.FLEET_UPDATE:
+        yield put({ type: ActionType.FLEET_UPDATE, value: msg })
+        break
+    case ActionType.FLEET_SELECTED_DEVICE:
+        yield put({ type: ActionType.FLEET_SELECTED_DEVICE, value: msg })
+        break
+    case ActionType.SLOT_TRANSITION:
+        yield put({ type: ActionType.SLOT_TRANSITION, value: msg })
+        break
     }
 }
 function * mySaga () {
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type CfgAdminLogin struct {
+	OperatorUsername string `json:"operator_username"`
+	OperatorPassword string `json:"operator_password"`
+}
+type CfgAdoptDMS struct {
+	Name        string `json:"name"`
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"private_key"`
+}
+type CfgUpdateDMSStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+type CfgUpdateDMSAuthorizedCAs struct {
+	Name          string   `json:"name"`
+	AuthorizedCAs []string `json:"authorized_cas"`
+}
+
+func (c *CfgAdminLogin) validate() error {
+	if c.OperatorUsername == "" {
+		return missingField("operator_username")
+	}
+	return nil
+}
+
+func (c *CfgAdoptDMS) validate() error {
+	if c.Name == "" {
+		return missingField("name")
+	}
+	if c.PrivateKey == "" {
+		return missingField("private_key")
+	}
+	return nil
+}
+
+func (c *CfgUpdateDMSStatus) validate() error {
+	if c.Name == "" {
+		return missingField("name")
+	}
+	if c.Status == "" {
+		return missingField("status")
+	}
+	return nil
+}
+
+func (c *CfgUpdateDMSAuthorizedCAs) validate() error {
+	if c.Name == "" {
+		return missingField("name")
+	}
+	return nil
+}
+
+type LamassuDMSSerialized struct {
+	Name              string           `json:"name"`
+	Status            LamassuDMSStatus `json:"status"`
+	SerialNumber      string           `json:"serial_number"`
+	CommonName        string           `json:"common_name"`
+	KeyType           string           `json:"key_type"`
+	KeyBits           int              `json:"key_bits"`
+	AuthorizedCAs     []string         `json:"authorized_cas"`
+	CreationTimestamp int              `json:"creation_timestamp"`
+	HasCertificate    bool             `json:"has_certificate"`
+	Adopted           bool             `json:"adopted"`
+}
+
+func serializeLamassuDMS(dms LamassuDMS) LamassuDMSSerialized {
+	authorizedCAs := []string{}
+	if dms.AuthorizedCAs != nil {
+		authorizedCAs = dms.AuthorizedCAs
+	}
+
+	creationTimestamp := 0
+	if !dms.CreationTimestamp.IsZero() {
+		creationTimestamp = int(dms.CreationTimestamp.UnixMilli())
+	}
+
+	return LamassuDMSSerialized{
+		Name:              dms.Name,
+		Status:            dms.Status,
+		SerialNumber:      dms.SerialNumber,
+		CommonName:        dms.CommonName,
+		KeyType:           dms.KeyType,
+		KeyBits:           dms.KeyBits,
+		AuthorizedCAs:     authorizedCAs,
+		CreationTimestamp: creationTimestamp,
+		HasCertificate:    dms.Certificate != nil,
+		Adopted:           dms.Name == currentDMS().Name,
+	}
+}
+
+// adminLogin creates the operator clients without creating a DMS, so existing
+// DMSs can be listed and managed from the console.
+func adminLogin(raw json.RawMessage) error {
+	var cfg CfgAdminLogin
+	if err := decodeCommand(raw, &cfg); err != nil {
+		return err
+	}
+
+	err := SingeltonInstance.Lamassu.Login(cfg.OperatorUsername, cfg.OperatorPassword)
+	if err != nil {
+		return lamassuError("Error creating DMS Client", err)
+	}
+
+	return sendDMSList()
+}
+
+func listLamassuDMSs() ([]LamassuDMS, error) {
+	dmss, err := SingeltonInstance.Lamassu.ListDMSs(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(dmss, func(i, j int) bool { return dmss[i].Name < dmss[j].Name })
+	return dmss, nil
+}
+
+func sendDMSList() error {
+	dmss, err := listLamassuDMSs()
+	if err != nil {
+		return lamassuError("Error listing DMSs", err)
+	}
+
+	serialized := make([]LamassuDMSSerialized, 0)
+	for _, dms := range dmss {
+		serialized = append(serialized, serializeLamassuDMS(dms))
+	}
+
+	sendWebSocketMessage(
+		WebSocketMessage{
+			Type:      "DMS_LIST",
+			Message:   serialized,
+			Timestamp: time.Now(),
+		},
+	)
+	return nil
+}
+
+// adoptDMS makes the vDMS act as an existing DMS. The certificate is taken
+// from Lamassu unless one is given, the private key has to be imported as it
+// never leaves the DMS that created it.
+func adoptDMS(raw json.RawMessage) error {
+	var cfg CfgAdoptDMS
+	if err := decodeCommand(raw, &cfg); err != nil {
+		return err
+	}
+
+	dms, err := SingeltonInstance.Lamassu.GetDMS(context.Background(), cfg.Name)
+	if err != nil {
+		return lamassuError("Error adopting DMS", err)
+	}
+
+	key, err := decodeRSAPrivateKey(cfg.PrivateKey)
+	if err != nil {
+		return invalidField("private_key", err)
+	}
+
+	crt := dms.Certificate
+	if cfg.Certificate != "" {
+		crt, err = decodeB64PEMCertificate(cfg.Certificate)
+		if err != nil {
+			return invalidField("certificate", err)
+		}
+	}
+
+	state := DMSState{
+		Status:        DMSStatusAwaitingAuth,
+		Name:          dms.Name,
+		Certificate:   crt,
+		PrivateKey:    key,
+		AuthorizedCAs: dms.AuthorizedCAs,
+	}
+
+	if crt != nil {
+		publicKey, ok := crt.PublicKey.(*rsa.PublicKey)
+		if !ok || !publicKey.Equal(&key.PublicKey) {
+			return invalidField("private_key", fmt.Errorf("private key does not match the certificate of %s", dms.Name))
+		}
+	}
+
+	if dms.Status == LamassuDMSStatusApproved {
+		if crt == nil && SingeltonInstance.Lamassu.Capabilities().DMSApproval {
+			return newProtocolError(ProtocolErrorRejected, "Error adopting DMS", fmt.Errorf("DMS %s has no certificate", dms.Name))
+		}
+		state.Status = DMSStatusIdle
+		if len(dms.AuthorizedCAs) > 0 {
+			state.SelectedCAForEnrollment = dms.AuthorizedCAs[0]
+		}
+	}
+
+	updateDMS(func(current *DMSState) {
+		*current = state
+	})
+	err = scheduleDMSStatusCheck()
+	if err != nil {
+		return newProtocolError(ProtocolErrorInternal, "Error adopting DMS", err)
+	}
+
+	sendDMSUpdate()
+	return sendDMSList()
+}
+
+func updateDMSStatus(raw json.RawMessage) error {
+	var cfg CfgUpdateDMSStatus
+	if err := decodeCommand(raw, &cfg); err != nil {
+		return err
+	}
+
+	status, err := parseLamassuDMSStatus(cfg.Status)
+	if err != nil {
+		return invalidField("status", err)
+	}
+
+	_, err = SingeltonInstance.Lamassu.UpdateDMSStatus(context.Background(), cfg.Name, status)
+	if err != nil {
+		return lamassuError("Error updating DMS status", err)
+	}
+
+	return sendDMSList()
+}
+
+func updateDMSAuthorizedCAs(raw json.RawMessage) error {
+	var cfg CfgUpdateDMSAuthorizedCAs
+	if err := decodeCommand(raw, &cfg); err != nil {
+		return err
+	}
+
+	_, err := SingeltonInstance.Lamassu.UpdateDMSAuthorizedCAs(context.Background(), cfg.Name, cfg.AuthorizedCAs)
+	if err != nil {
+		return lamassuError("Error updating authorized CAs", err)
+	}
+
+	adopted := false
+	updateDMS(func(current *DMSState) {
+		if cfg.Name != current.Name {
+			return
+		}
+
+		adopted = true
+		current.AuthorizedCAs = cfg.AuthorizedCAs
+		selectedAuthorized := false
+		for _, ca := range cfg.AuthorizedCAs {
+			if ca == current.SelectedCAForEnrollment {
+				selectedAuthorized = true
+			}
+		}
+		if !selectedAuthorized {
+			current.SelectedCAForEnrollment = ""
+			if len(cfg.AuthorizedCAs) > 0 {
+				current.SelectedCAForEnrollment = cfg.AuthorizedCAs[0]
+			}
+		}
+	})
+	if adopted {
+		sendDMSUpdate()
+	}
+
+	return sendDMSList()
+}
+
+// decodeRSAPrivateKey accepts base64 encoded PKCS#1 or PKCS#8 PEM keys.
+func decodeRSAPrivateKey(b64Pem string) (*rsa.PrivateKey, error) {
+	decodedKey, err := base64.StdEncoding.DecodeString(b64Pem)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBlock, _ := pem.Decode(decodedKey)
+	if keyBlock == nil {
+		return nil, errors.New("invalid PEM block")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("only RSA keys are supported")
+	}
+	return rsaKey, nil
+}
+
+func decodeB64PEMCertificate(b64Pem string) (*x509.Certificate, error) {
+	decodedCrt, err := base64.StdEncoding.DecodeString(b64Pem)
+	if err != nil {
+		return nil, err
+	}
+
+	crtBlock, _ := pem.Decode(decodedCrt)
+	if crtBlock == nil {
+		return nil, errors.New("invalid PEM block")
+	}
+
+	return x509.ParseCertificate(crtBlock.Bytes)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lamassuiot/lamassu-simulation-tools/common/auth"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// APISettings updates the DMS settings, fields left out keep their value.
+// Names match the ones of the DMS state returned by the API.
+type APISettings struct {
+	SelectedCAForEnrollment      *string `json:"selected_ca_for_enrollment"`
+	AutomaticEnrollment          *bool   `json:"automatic_enrollment"`
+	AutomaticCertificateTransfer *bool   `json:"automatic_certificate_transfer"`
+	AutomaticReenrollment        *bool   `json:"automatic_reenrollment"`
+	RepeatEnrollmentPolicy       *string `json:"repeat_enrollment_policy"`
+	MaxActiveCertificatesPerSlot *int    `json:"max_active_certificates_per_slot"`
+	RevokeSupersededCertificates *bool   `json:"revoke_superseded_certificates"`
+}
+
+type APIRejectEnrollment struct {
+	Reason string `json:"reason"`
+}
+
+// registerAPIRoutes mounts the REST control API. It drives the vDMS through
+// the same commands as the console, so the console follows any change made
+// through the API. Requests are authenticated with an API token or a console
+// session.
+func registerAPIRoutes(router *mux.Router, authenticator *auth.Authenticator) {
+	router.HandleFunc("/openapi.json", openAPIRoute).Methods("GET")
+
+	router.HandleFunc("/dms", authenticator.RequireAPI(auth.RoleViewer, apiDMSRoute)).Methods("GET")
+	router.HandleFunc("/dms", authenticator.RequireAPI(auth.RoleAdmin, apiDMSRoute)).Methods("POST")
+	router.HandleFunc("/dms/settings", authenticator.RequireAPI(auth.RoleAdmin, apiDMSSettingsRoute)).Methods("PATCH")
+	router.HandleFunc("/enrollments/pending", authenticator.RequireAPI(auth.RoleViewer, apiPendingEnrollmentsRoute)).Methods("GET")
+	router.HandleFunc("/enrollments/{id}/approve", authenticator.RequireAPI(auth.RoleApprover, apiApproveEnrollmentRoute)).Methods("POST")
+	router.HandleFunc("/enrollments/{id}/reject", authenticator.RequireAPI(auth.RoleApprover, apiRejectEnrollmentRoute)).Methods("POST")
+	router.HandleFunc("/enrollments/backlog", authenticator.RequireAPI(auth.RoleViewer, apiEnrollmentBacklogRoute)).Methods("GET")
+	router.HandleFunc("/ledger", authenticator.RequireAPI(auth.RoleViewer, apiLedgerRoute)).Methods("GET")
+	router.HandleFunc("/ledger/{serial_number}", authenticator.RequireAPI(auth.RoleViewer, apiLedgerEntryRoute)).Methods("GET")
+	router.HandleFunc("/ledger/{serial_number}/receipt", authenticator.RequireAPI(auth.RoleViewer, apiLedgerReceiptRoute)).Methods("GET")
+	router.HandleFunc("/manifest", authenticator.RequireAPI(auth.RoleViewer, manifestRoute)).Methods("GET")
+	router.HandleFunc("/manifest", authenticator.RequireAPI(auth.RoleAdmin, manifestRoute)).Methods("POST", "PUT")
+	router.HandleFunc("/manifest/{serial_number}", authenticator.RequireAPI(auth.RoleAdmin, manifestDeviceRoute)).Methods("DELETE")
+	router.HandleFunc("/manifest/{serial_number}/reset", authenticator.RequireAPI(auth.RoleAdmin, manifestDeviceResetRoute)).Methods("POST")
+	router.HandleFunc("/tokens", authenticator.RequireAPI(auth.RoleViewer, tokensRoute)).Methods("GET")
+	router.HandleFunc("/tokens", authenticator.RequireAPI(auth.RoleAdmin, tokensRoute)).Methods("POST")
+	router.HandleFunc("/tokens/{id}", authenticator.RequireAPI(auth.RoleAdmin, tokenRoute)).Methods("DELETE")
+}
+
+// dispatchCommand runs a console command on behalf of the given user.
+func dispatchCommand(principal *auth.Principal, commandType string, payload interface{}) (interface{}, error) {
+	command := IncomingWebSocketMessage{Type: commandType}
+	if payload != nil {
+		message, err := json.Marshal(payload)
+		if err != nil {
+			return nil, newProtocolError(ProtocolErrorInternal, "Error encoding command", err)
+		}
+		command.Message = message
+	}
+	return handleCommand(principal, command)
+}
+
+func protocolErrorStatusCode(code ProtocolErrorCode) int {
+	switch code {
+	case ProtocolErrorInvalidMessage, ProtocolErrorMissingField, ProtocolErrorInvalidField:
+		return http.StatusBadRequest
+	case ProtocolErrorUnauthorized:
+		return http.StatusUnauthorized
+	case ProtocolErrorNotFound, ProtocolErrorUnknownCommand:
+		return http.StatusNotFound
+	case ProtocolErrorInvalidState:
+		return http.StatusConflict
+	case ProtocolErrorRejected:
+		return http.StatusUnprocessableEntity
+	case ProtocolErrorUpstream:
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+func writeAPIJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeAPIError(w http.ResponseWriter, statusCode int, err error) {
+	protocolError := toProtocolError(err)
+	if statusCode == 0 {
+		statusCode = protocolErrorStatusCode(protocolError.Code)
+	}
+	writeAPIJSON(w, statusCode, protocolError)
+}
+
+func readAPIBody(r *http.Request) (json.RawMessage, error) {
+	var body json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return nil, newProtocolError(ProtocolErrorInvalidMessage, "Error parsing request body", err)
+	}
+	return body, nil
+}
+
+func openAPIRoute(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+func apiDMSRoute(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		dms := currentDMS()
+		writeAPIJSON(w, http.StatusOK, dms.Serialize())
+		return
+	}
+
+	body, err := readAPIBody(r)
+	if err != nil {
+		writeAPIError(w, 0, err)
+		return
+	}
+
+	_, err = handleCommand(auth.PrincipalFromContext(r.Context()), IncomingWebSocketMessage{Type: "CFG", Message: body})
+	if err != nil {
+		writeAPIError(w, 0, err)
+		return
+	}
+
+	dms := currentDMS()
+	writeAPIJSON(w, http.StatusCreated, dms.Serialize())
+}
+
+func apiDMSSettingsRoute(w http.ResponseWriter, r *http.Request) {
+	var settings APISettings
+	body, err := readAPIBody(r)
+	if err == nil {
+		err = decodeCommand(body, &settings)
+	}
+	if err != nil {
+		writeAPIError(w, 0, err)
+		return
+	}
+
+	// Values are checked up front so an invalid one does not leave the
+	// settings half applied.
+	if settings.SelectedCAForEnrollment != nil && *settings.SelectedCAForEnrollment == "" {
+		writeAPIError(w, 0, invalidField("selected_ca_for_enrollment", errors.New("must not be empty")))
+		return
+	}
+	if settings.RepeatEnrollmentPolicy != nil {
+		if _, err := parseRepeatEnrollmentPolicy(*settings.RepeatEnrollmentPolicy); err != nil {
+			writeAPIError(w, 0, invalidField("repeat_enrollment_policy", err))
+			return
+		}
+	}
+
+	type command struct {
+		commandType string
+		payload     interface{}
+	}
+	commands := []command{}
+	if settings.SelectedCAForEnrollment != nil {
+		commands = append(commands, command{"CFG_SELECTED_CA_FOR_ENROLLMENT", CfgSelectedCAForEnrollment{SelectedCA: *settings.SelectedCAForEnrollment}})
+	}
+	if settings.AutomaticEnrollment != nil {
+		commands = append(commands, command{"CFG_AUTO_ENROLLMENT", CfgAutoEnrollment{AutoEnroll: *settings.AutomaticEnrollment}})
+	}
+	if settings.AutomaticCertificateTransfer != nil {
+		commands = append(commands, command{"CFG_AUTO_TRANSFER", CfgAutoTransfer{AutoTransfer: *settings.AutomaticCertificateTransfer}})
+	}
+	if settings.AutomaticReenrollment != nil {
+		commands = append(commands, command{"CFG_AUTO_REENROLLMENT", CfgAutoReenrollment{AutoReenroll: *settings.AutomaticReenrollment}})
+	}
+	if settings.RepeatEnrollmentPolicy != nil || settings.MaxActiveCertificatesPerSlot != nil || settings.RevokeSupersededCertificates != nil {
+		dms := currentDMS()
+		repeatEnrollment := CfgRepeatEnrollment{
+			Policy:                       string(dms.RepeatEnrollmentPolicy),
+			MaxActiveCertificatesPerSlot: dms.MaxActiveCertificatesPerSlot,
+			RevokeSuperseded:             dms.RevokeSupersededCertificates,
+		}
+		if settings.RepeatEnrollmentPolicy != nil {
+			repeatEnrollment.Policy = *settings.RepeatEnrollmentPolicy
+		}
+		if settings.MaxActiveCertificatesPerSlot != nil {
+			repeatEnrollment.MaxActiveCertificatesPerSlot = *settings.MaxActiveCertificatesPerSlot
+		}
+		if settings.RevokeSupersededCertificates != nil {
+			repeatEnrollment.RevokeSuperseded = *settings.RevokeSupersededCertificates
+		}
+		commands = append(commands, command{"CFG_REPEAT_ENROLLMENT", repeatEnrollment})
+	}
+
+	for _, c := range commands {
+		_, err := dispatchCommand(auth.PrincipalFromContext(r.Context()), c.commandType, c.payload)
+		if err != nil {
+			writeAPIError(w, 0, err)
+			return
+		}
+	}
+
+	dms := currentDMS()
+	writeAPIJSON(w, http.StatusOK, dms.Serialize())
+}
+
+func apiPendingEnrollmentsRoute(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, http.StatusOK, pendingEnrollments())
+}
+
+func apiApproveEnrollmentRoute(w http.ResponseWriter, r *http.Request) {
+	err := approvePendingEnrollment(auth.PrincipalFromContext(r.Context()), mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, 0, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiRejectEnrollmentRoute(w http.ResponseWriter, r *http.Request) {
+	// The body is optional, it only carries the reason shown to the device.
+	var reject APIRejectEnrollment
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&reject)
+		if err != nil {
+			writeAPIError(w, 0, newProtocolError(ProtocolErrorInvalidMessage, "Error parsing request body", err))
+			return
+		}
+	}
+
+	_, err := dispatchCommand(auth.PrincipalFromContext(r.Context()), "REJECT_ENROLLMENT", RejectEnrollment{ID: mux.Vars(r)["id"], Reason: reject.Reason})
+	if err != nil {
+		writeAPIError(w, 0, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiEnrollmentBacklogRoute(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, http.StatusOK, SingeltonInstance.EnrollmentBacklog.Serialize())
+}
+
+func apiLedgerRoute(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	status := r.URL.Query().Get("status")
+
+	ledger := []EnrolledIdentitySerialized{}
+	for _, identity := range serializeEnrolledIdentities() {
+		if deviceID != "" && identity.DeviceID != deviceID {
+			continue
+		}
+		if status != "" && string(identity.Status) != status {
+			continue
+		}
+		ledger = append(ledger, identity)
+	}
+
+	writeAPIJSON(w, http.StatusOK, ledger)
+}
+
+func apiLedgerEntryRoute(w http.ResponseWriter, r *http.Request) {
+	serialNumber := mux.Vars(r)["serial_number"]
+	for _, identity := range serializeEnrolledIdentities() {
+		if identity.SerialNumber == serialNumber {
+			writeAPIJSON(w, http.StatusOK, identity)
+			return
+		}
+	}
+
+	writeAPIError(w, 0, newProtocolError(ProtocolErrorNotFound, "Enrolled identity not found", nil))
+}
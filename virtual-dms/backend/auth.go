@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/lamassuiot/lamassu-simulation-tools/common/auth"
+)
+
+// writeAuthError reports authentication failures as protocol errors, like
+// every other API error.
+func writeAuthError(w http.ResponseWriter, statusCode int, message string) {
+	code := ProtocolErrorUnauthorized
+	switch statusCode {
+	case http.StatusForbidden:
+		code = ProtocolErrorForbidden
+	case http.StatusBadRequest:
+		code = ProtocolErrorInvalidMessage
+	case http.StatusNotFound:
+		code = ProtocolErrorNotFound
+	}
+	writeAPIError(w, statusCode, newProtocolError(code, message, nil))
+}
+
+func runHashPassword(args []string) int {
+	if len(args) != 1 {
+		fmt.Println("usage: hash-password <password>")
+		return 1
+	}
+	fmt.Println(auth.HashPassword(args[0]))
+	return 0
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type GatewayLinkState string
+
+const (
+	GatewayLinkStateUnknown GatewayLinkState = "UNKNOWN"
+	GatewayLinkStateUp      GatewayLinkState = "UP"
+	GatewayLinkStateDown    GatewayLinkState = "DOWN"
+)
+
+type QueuedEnrollmentStatus string
+
+const (
+	QueuedEnrollmentStatusQueued           QueuedEnrollmentStatus = "QUEUED"
+	QueuedEnrollmentStatusAwaitingTransfer QueuedEnrollmentStatus = "AWAITING_TRANSFER"
+	QueuedEnrollmentStatusCompleted        QueuedEnrollmentStatus = "COMPLETED"
+	QueuedEnrollmentStatusFailed           QueuedEnrollmentStatus = "FAILED"
+)
+
+const (
+	backlogInitialBackoff = 5 * time.Second
+	backlogMaxBackoff     = 5 * time.Minute
+	gatewayProbeTimeout   = 5 * time.Second
+)
+
+// QueuedEnrollment is an approved enrollment that could not reach the Lamassu
+// gateway. It is persisted as-is, so it only holds serializable fields.
+type QueuedEnrollment struct {
+	ID                            string                 `json:"id"`
+	Status                        QueuedEnrollmentStatus `json:"status"`
+	RequestingDate                time.Time              `json:"requesting_date"`
+	QueuedAt                      time.Time              `json:"queued_at"`
+	DeviceModel                   string                 `json:"device_model"`
+	DeviceID                      string                 `json:"device_id"`
+	DeviceSlot                    string                 `json:"device_slot"`
+	IssuingCA                     string                 `json:"issuing_ca"`
+	CertificateRequest            string                 `json:"certificate_request"`
+	Certificate                   string                 `json:"certificate,omitempty"`
+	AuthorizedCertificateTransfer bool                   `json:"authorized_certificate_transfer"`
+	Attempts                      int                    `json:"attempts"`
+	LastError                     string                 `json:"last_error,omitempty"`
+	NextRetryAt                   time.Time              `json:"next_retry_at"`
+	SupersedesSerialNumbers       []string               `json:"supersedes,omitempty"`
+	ApprovedBy                    string                 `json:"approved_by,omitempty"`
+	TransferApprovedBy            string                 `json:"transfer_approved_by,omitempty"`
+	RejectedBy                    string                 `json:"rejected_by,omitempty"`
+	FinishedAt                    *time.Time             `json:"finished_at,omitempty"`
+	PolledAt                      *time.Time             `json:"polled_at,omitempty"`
+}
+
+// finish moves the item to a final status, from then on it only waits for
+// the device to poll its result before being pruned.
+func (q *QueuedEnrollment) finish(status QueuedEnrollmentStatus) {
+	now := time.Now()
+	q.Status = status
+	q.FinishedAt = &now
+}
+
+func (q *QueuedEnrollment) finished() bool {
+	return q.Status == QueuedEnrollmentStatusCompleted || q.Status == QueuedEnrollmentStatusFailed
+}
+
+func (q *QueuedEnrollment) certificateRequest() (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(q.CertificateRequest))
+	if block == nil {
+		return nil, errors.New("invalid certificate request")
+	}
+	return x509.ParseCertificateRequest(block.Bytes)
+}
+
+func (q *QueuedEnrollment) certificate() (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(q.Certificate))
+	if block == nil {
+		return nil, errors.New("invalid certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func (q *QueuedEnrollment) ToEnrollmentInProcess() *EnrollmentInProcess {
+	enrollment := &EnrollmentInProcess{
+		ID:                            q.ID,
+		Status:                        EnrollingStatusStep1,
+		RequestingDate:                q.RequestingDate,
+		DeviceModel:                   q.DeviceModel,
+		IssuingCA:                     q.IssuingCA,
+		DeviceID:                      q.DeviceID,
+		DeviceSlot:                    q.DeviceSlot,
+		AuthorizedEnrollment:          true,
+		AuthorizedCertificateTransfer: q.AuthorizedCertificateTransfer,
+		SupersedesSerialNumbers:       q.SupersedesSerialNumbers,
+		ApprovedBy:                    q.ApprovedBy,
+		TransferApprovedBy:            q.TransferApprovedBy,
+	}
+
+	enrollment.CertificateSigningRequest, _ = q.certificateRequest()
+	if crt, err := q.certificate(); err == nil {
+		enrollment.Status = EnrollingStatusStep3
+		enrollment.Certificate = crt
+		enrollment.SerialNumber = formatSerialNumber(crt.SerialNumber)
+		enrollment.ExpirationDate = crt.NotAfter
+	}
+
+	return enrollment
+}
+
+type EnrollmentBacklogSerialized struct {
+	LinkState     GatewayLinkState   `json:"link_state"`
+	LastLinkCheck time.Time          `json:"last_link_check"`
+	NextRetryAt   *time.Time         `json:"next_retry_at,omitempty"`
+	Backlog       []QueuedEnrollment `json:"backlog"`
+}
+
+// EnrollmentBacklog stores enrollments approved while the Lamassu gateway was
+// unreachable and forwards them once the link is back.
+type EnrollmentBacklog struct {
+	lock          sync.Mutex
+	path          string
+	items         []*QueuedEnrollment
+	linkState     GatewayLinkState
+	lastLinkCheck time.Time
+	retrying      bool
+}
+
+func NewEnrollmentBacklog(path string) (*EnrollmentBacklog, error) {
+	backlog := &EnrollmentBacklog{
+		path:      path,
+		items:     []*QueuedEnrollment{},
+		linkState: GatewayLinkStateUnknown,
+	}
+
+	if path == "" {
+		return backlog, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return backlog, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, &backlog.items)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing enrollment backlog: %v", err)
+	}
+
+	return backlog, nil
+}
+
+// persist must be called while holding the lock.
+func (b *EnrollmentBacklog) persist() {
+	if b.path == "" {
+		return
+	}
+
+	content, err := json.MarshalIndent(b.items, "", "  ")
+	if err != nil {
+		log.Println("error serializing enrollment backlog:", err)
+		return
+	}
+
+	tmpPath := b.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, content, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, b.path)
+	}
+	if err != nil {
+		log.Println("error persisting enrollment backlog:", err)
+	}
+}
+
+func (b *EnrollmentBacklog) Enqueue(enrollment *EnrollmentInProcess, cause error) *QueuedEnrollment {
+	item := &QueuedEnrollment{
+		ID:                            newRandomID(),
+		Status:                        QueuedEnrollmentStatusQueued,
+		RequestingDate:                enrollment.RequestingDate,
+		QueuedAt:                      time.Now(),
+		DeviceModel:                   enrollment.DeviceModel,
+		DeviceID:                      enrollment.DeviceID,
+		DeviceSlot:                    enrollment.DeviceSlot,
+		IssuingCA:                     enrollment.IssuingCA,
+		CertificateRequest:            string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: enrollment.CertificateSigningRequest.Raw})),
+		AuthorizedCertificateTransfer: enrollment.AuthorizedCertificateTransfer,
+		LastError:                     cause.Error(),
+		NextRetryAt:                   time.Now().Add(backlogInitialBackoff),
+		SupersedesSerialNumbers:       enrollment.SupersedesSerialNumbers,
+		ApprovedBy:                    enrollment.ApprovedBy,
+		TransferApprovedBy:            enrollment.TransferApprovedBy,
+	}
+
+	b.lock.Lock()
+	b.items = append(b.items, item)
+	b.persist()
+	b.lock.Unlock()
+
+	sendEnrollmentBacklogUpdate()
+	return item
+}
+
+func (b *EnrollmentBacklog) Get(id string) (QueuedEnrollment, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, item := range b.items {
+		if item.ID == id {
+			return *item, true
+		}
+	}
+	return QueuedEnrollment{}, false
+}
+
+func (b *EnrollmentBacklog) AuthorizeTransfer(id string, approvedBy string) error {
+	b.lock.Lock()
+	var item *QueuedEnrollment
+	for _, i := range b.items {
+		if i.ID == id {
+			item = i
+		}
+	}
+	if item == nil {
+		b.lock.Unlock()
+		return fmt.Errorf("queued enrollment with id %s not found", id)
+	}
+
+	item.AuthorizedCertificateTransfer = true
+	item.TransferApprovedBy = approvedBy
+	completed := item.Status == QueuedEnrollmentStatusAwaitingTransfer
+	if completed {
+		item.finish(QueuedEnrollmentStatusCompleted)
+	}
+	b.persist()
+	snapshot := *item
+	b.lock.Unlock()
+
+	if completed {
+		completeQueuedEnrollment(&snapshot)
+	}
+	sendEnrollmentBacklogUpdate()
+	return nil
+}
+
+// RejectTransfer fails a queued enrollment whose certificate has not been
+// handed to the device yet.
+func (b *EnrollmentBacklog) RejectTransfer(id string, reason string, rejectedBy string) error {
+	b.lock.Lock()
+	var item *QueuedEnrollment
+	for _, i := range b.items {
+		if i.ID == id {
+			item = i
+		}
+	}
+	if item == nil {
+		b.lock.Unlock()
+		return fmt.Errorf("queued enrollment with id %s not found", id)
+	}
+	if item.Status != QueuedEnrollmentStatusQueued && item.Status != QueuedEnrollmentStatusAwaitingTransfer {
+		b.lock.Unlock()
+		return fmt.Errorf("queued enrollment with id %s is %s", id, item.Status)
+	}
+
+	item.finish(QueuedEnrollmentStatusFailed)
+	item.LastError = rejectionMessage(reason)
+	item.RejectedBy = rejectedBy
+	b.persist()
+	snapshot := *item
+	b.lock.Unlock()
+
+	SingeltonInstance.DeviceManifest.MarkFailed(snapshot.DeviceID, snapshot.DeviceSlot)
+	dispatchWebhookEvent(WebhookEventEnrollmentFailed, snapshot.ToEnrollmentInProcess(), snapshot.LastError)
+	sendEnrollmentBacklogUpdate()
+	return nil
+}
+
+// MarkPolled records that the device has fetched the final result of a
+// queued enrollment, so the next prune drops it.
+func (b *EnrollmentBacklog) MarkPolled(id string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, item := range b.items {
+		if item.ID == id && item.finished() && item.PolledAt == nil {
+			now := time.Now()
+			item.PolledAt = &now
+			b.persist()
+		}
+	}
+}
+
+// Prune drops the finished enrollments the device has already polled and
+// those nobody polled within the retention. It is run periodically by the
+// cron scheduler.
+func (b *EnrollmentBacklog) Prune(retention time.Duration) {
+	b.lock.Lock()
+	items := []*QueuedEnrollment{}
+	for _, item := range b.items {
+		if !item.finished() {
+			items = append(items, item)
+			continue
+		}
+
+		// Items persisted before finished_at existed count from the moment
+		// they were queued.
+		finishedAt := item.QueuedAt
+		if item.FinishedAt != nil {
+			finishedAt = *item.FinishedAt
+		}
+		if item.PolledAt == nil && time.Since(finishedAt) < retention {
+			items = append(items, item)
+		}
+	}
+	pruned := len(b.items) - len(items)
+	if pruned > 0 {
+		b.items = items
+		b.persist()
+	}
+	b.lock.Unlock()
+
+	if pruned > 0 {
+		sendEnrollmentBacklogUpdate()
+	}
+}
+
+func (b *EnrollmentBacklog) LinkState() GatewayLinkState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.linkState
+}
+
+func (b *EnrollmentBacklog) setLinkState(state GatewayLinkState) {
+	b.lock.Lock()
+	changed := b.linkState != state
+	b.linkState = state
+	b.lastLinkCheck = time.Now()
+	b.lock.Unlock()
+
+	if changed {
+		sendEnrollmentBacklogUpdate()
+	}
+}
+
+func (b *EnrollmentBacklog) Serialize() EnrollmentBacklogSerialized {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	serialized := EnrollmentBacklogSerialized{
+		LinkState:     b.linkState,
+		LastLinkCheck: b.lastLinkCheck,
+		Backlog:       []QueuedEnrollment{},
+	}
+
+	for _, item := range b.items {
+		serialized.Backlog = append(serialized.Backlog, *item)
+		if item.Status != QueuedEnrollmentStatusQueued {
+			continue
+		}
+		if serialized.NextRetryAt == nil || item.NextRetryAt.Before(*serialized.NextRetryAt) {
+			nextRetryAt := item.NextRetryAt
+			serialized.NextRetryAt = &nextRetryAt
+		}
+	}
+
+	sort.Slice(serialized.Backlog, func(i, j int) bool {
+		return serialized.Backlog[i].QueuedAt.After(serialized.Backlog[j].QueuedAt)
+	})
+	return serialized
+}
+
+// RetryDue forwards every queued enrollment whose backoff has elapsed. It is
+// run periodically by the cron scheduler, overlapping runs are skipped.
+func (b *EnrollmentBacklog) RetryDue() {
+	if dms := currentDMS(); dms.Certificate == nil || dms.PrivateKey == nil {
+		// The DMS identity is only kept in memory, queued items wait until the
+		// DMS is configured again after a restart.
+		return
+	}
+
+	b.lock.Lock()
+	if b.retrying {
+		b.lock.Unlock()
+		return
+	}
+	b.retrying = true
+	due := []*QueuedEnrollment{}
+	for _, item := range b.items {
+		if item.Status == QueuedEnrollmentStatusQueued && time.Now().After(item.NextRetryAt) {
+			due = append(due, item)
+		}
+	}
+	b.lock.Unlock()
+
+	defer func() {
+		b.lock.Lock()
+		b.retrying = false
+		b.lock.Unlock()
+	}()
+
+	for _, item := range due {
+		b.retry(item)
+	}
+}
+
+func (b *EnrollmentBacklog) retry(item *QueuedEnrollment) {
+	b.lock.Lock()
+	csr, err := item.certificateRequest()
+	issuingCA := item.IssuingCA
+	b.lock.Unlock()
+
+	var crt *x509.Certificate
+	if err == nil {
+		crt, err = SingeltonInstance.Lamassu.Enroll(context.Background(), dmsIdentity(), issuingCA, csr)
+	}
+	automaticTransfer := currentDMS().AutomaticCertificateTransfer
+	unreachable := err != nil && isGatewayUnreachable(err)
+
+	b.lock.Lock()
+	item.Attempts++
+	var completed *QueuedEnrollment
+	switch {
+	case err == nil:
+		item.LastError = ""
+		item.Certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw}))
+		item.Status = QueuedEnrollmentStatusAwaitingTransfer
+		if item.AuthorizedCertificateTransfer || automaticTransfer {
+			item.AuthorizedCertificateTransfer = true
+			item.finish(QueuedEnrollmentStatusCompleted)
+			snapshot := *item
+			completed = &snapshot
+		}
+
+	case unreachable:
+		item.LastError = err.Error()
+		backoff := backlogInitialBackoff << uint(item.Attempts)
+		if backoff > backlogMaxBackoff || backoff <= 0 {
+			backoff = backlogMaxBackoff
+		}
+		item.NextRetryAt = time.Now().Add(backoff)
+
+	default:
+		item.LastError = err.Error()
+		item.finish(QueuedEnrollmentStatusFailed)
+	}
+	b.persist()
+	snapshot := *item
+	b.lock.Unlock()
+
+	if err == nil {
+		b.setLinkState(GatewayLinkStateUp)
+		dispatchWebhookEvent(WebhookEventCertificateIssued, snapshot.ToEnrollmentInProcess(), "")
+		if completed == nil {
+			dispatchWebhookEvent(WebhookEventAwaitingApproval, snapshot.ToEnrollmentInProcess(), "")
+		}
+	} else if snapshot.Status == QueuedEnrollmentStatusFailed {
+		SingeltonInstance.DeviceManifest.MarkFailed(snapshot.DeviceID, snapshot.DeviceSlot)
+		dispatchWebhookEvent(WebhookEventEnrollmentFailed, snapshot.ToEnrollmentInProcess(), snapshot.LastError)
+	} else {
+		b.setLinkState(GatewayLinkStateDown)
+	}
+
+	if completed != nil {
+		completeQueuedEnrollment(completed)
+	}
+	sendEnrollmentBacklogUpdate()
+}
+
+// ProbeGateway updates the link state. Any HTTP response, whatever its status
+// code, means the gateway is reachable.
+func (b *EnrollmentBacklog) ProbeGateway() {
+	if probeGateway() {
+		b.setLinkState(GatewayLinkStateUp)
+	} else {
+		b.setLinkState(GatewayLinkStateDown)
+	}
+}
+
+func probeGateway() bool {
+	httpClient := &http.Client{
+		Timeout: gatewayProbeTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	gatewayUrl := SingeltonInstance.LamassuGatewayURL
+	resp, err := httpClient.Get(gatewayUrl.String())
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// isGatewayUnreachable tells connectivity problems, which are worth retrying,
+// apart from errors returned by a reachable Lamassu instance. Other errors are
+// told apart by the link state of the last periodic probe, the gateway is not
+// probed while a device waits.
+func isGatewayUnreachable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if upstreamStatusCode(err) != 0 {
+		return false
+	}
+
+	return SingeltonInstance.EnrollmentBacklog.LinkState() == GatewayLinkStateDown
+}
+
+func completeQueuedEnrollment(item *QueuedEnrollment) {
+	enrollment := item.ToEnrollmentInProcess()
+	enrollment.Status = EnrollingStatusStep4
+	if enrollment.Certificate == nil {
+		return
+	}
+
+	recordEnrolledIdentity(enrollment)
+}
+
+func sendEnrollmentBacklogUpdate() {
+	sendWebSocketMessage(
+		WebSocketMessage{
+			Type:      "ENROLLMENT_BACKLOG_UPDATE",
+			Message:   SingeltonInstance.EnrollmentBacklog.Serialize(),
+			Timestamp: time.Now(),
+		},
+	)
+}
+
+// writeEnrollmentAccepted answers with an EST style 202 so the device polls
+// for its certificate at the returned location.
+func writeEnrollmentAccepted(w http.ResponseWriter, item QueuedEnrollment) {
+	retryAfter := int(time.Until(item.NextRetryAt).Seconds()) + 1
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Location", "/enroll/"+item.ID)
+	w.WriteHeader(http.StatusAccepted)
+
+	type EnrollAcceptedMessageOut struct {
+		EnrollmentID string                 `json:"enrollment_id"`
+		Status       QueuedEnrollmentStatus `json:"status"`
+	}
+
+	outBytes, _ := json.Marshal(EnrollAcceptedMessageOut{
+		EnrollmentID: item.ID,
+		Status:       item.Status,
+	})
+	w.Write(outBytes)
+}
+
+func enrollStatusRoute(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	item, ok := SingeltonInstance.EnrollmentBacklog.Get(id)
+	if !ok {
+		http.Error(w, "Enrollment not found", http.StatusNotFound)
+		return
+	}
+
+	switch item.Status {
+	case QueuedEnrollmentStatusCompleted:
+		crt, err := item.certificate()
+		if err != nil {
+			http.Error(w, "Error decoding certificate", http.StatusInternalServerError)
+			return
+		}
+		writeEnrollResponse(w, crt)
+		SingeltonInstance.EnrollmentBacklog.MarkPolled(item.ID)
+
+	case QueuedEnrollmentStatusFailed:
+		http.Error(w, "Error enrolling device: "+item.LastError, http.StatusInternalServerError)
+		SingeltonInstance.EnrollmentBacklog.MarkPolled(item.ID)
+
+	default:
+		writeEnrollmentAccepted(w, item)
+	}
+}
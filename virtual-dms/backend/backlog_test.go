@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestIsGatewayUnreachable(t *testing.T) {
+	refused := &url.Error{
+		Op:  "Post",
+		URL: "https://lamassu.example.com/.well-known/est/simpleenroll",
+		Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+	}
+
+	tests := []struct {
+		name      string
+		err       error
+		linkState GatewayLinkState
+		want      bool
+	}{
+		{
+			name:      "network error",
+			err:       fmt.Errorf("failed to execute HTTP request: %w", refused),
+			linkState: GatewayLinkStateUp,
+			want:      true,
+		},
+		{
+			name:      "error status from Lamassu",
+			err:       &lamassuStatusError{statusCode: 500, body: "internal error"},
+			linkState: GatewayLinkStateDown,
+			want:      false,
+		},
+		{
+			name:      "other error with the gateway down",
+			err:       errors.New("unexpected EOF"),
+			linkState: GatewayLinkStateDown,
+			want:      true,
+		},
+		{
+			name:      "other error with the gateway up",
+			err:       errors.New("no certificate returned"),
+			linkState: GatewayLinkStateUp,
+			want:      false,
+		},
+		{
+			name:      "other error before the first probe",
+			err:       errors.New("no certificate returned"),
+			linkState: GatewayLinkStateUnknown,
+			want:      false,
+		},
+	}
+
+	previous := SingeltonInstance
+	defer func() { SingeltonInstance = previous }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SingeltonInstance = &Singelton{EnrollmentBacklog: &EnrollmentBacklog{linkState: tt.linkState}}
+			if got := isGatewayUnreachable(tt.err); got != tt.want {
+				t.Errorf("isGatewayUnreachable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type DMSIdentityMode string
+
+const (
+	// DMSIdentityModeMTLS authenticates the DMS with its certificate on the
+	// TLS connection to the Lamassu gateway.
+	DMSIdentityModeMTLS DMSIdentityMode = "MTLS"
+	// DMSIdentityModeForwardedHeader also sends the DMS certificate in the
+	// X-Forwarded-Client-Cert header, for gateways behind a TLS terminating
+	// proxy that does not pass the client certificate through.
+	DMSIdentityModeForwardedHeader DMSIdentityMode = "FORWARDED_HEADER"
+)
+
+const defaultForwardedClientCertHeader = "X-Forwarded-Client-Cert"
+
+func parseDMSIdentityMode(mode string) (DMSIdentityMode, error) {
+	switch DMSIdentityMode(strings.ToUpper(mode)) {
+	case DMSIdentityModeMTLS:
+		return DMSIdentityModeMTLS, nil
+	case DMSIdentityModeForwardedHeader:
+		return DMSIdentityModeForwardedHeader, nil
+	}
+	return "", fmt.Errorf("unknown DMS identity mode %s", mode)
+}
+
+// dmsIdentity returns the identity the DMS authenticates with, sending its
+// certificate as forwarded client certificate when the DMS is configured to
+// authenticate through a proxy.
+func dmsIdentity() DMSIdentity {
+	dms := currentDMS()
+	return DMSIdentity{
+		Name:        dms.Name,
+		Certificate: dms.Certificate,
+		PrivateKey:  dms.PrivateKey,
+		Forwarded:   SingeltonInstance.DMSIdentityMode == DMSIdentityModeForwardedHeader,
+	}
+}
+
+// parseTrustedProxies accepts CIDR blocks and single IP addresses.
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	trustedProxies := []*net.IPNet{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			trustedProxies = append(trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %s: %v", entry, err)
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+	return trustedProxies, nil
+}
+
+func isTrustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, trustedProxy := range SingeltonInstance.TrustedProxies {
+		if trustedProxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClientCertificate returns the client certificate forwarded by a
+// TLS terminating proxy, or nil if the request carries none. The header is
+// only honoured when the request comes straight from a trusted proxy.
+func forwardedClientCertificate(r *http.Request) (*x509.Certificate, error) {
+	value := r.Header.Get(SingeltonInstance.ForwardedClientCertHeader)
+	if value == "" {
+		return nil, nil
+	}
+
+	if !isTrustedProxy(r.RemoteAddr) {
+		return nil, fmt.Errorf("%s header set by untrusted peer %s", SingeltonInstance.ForwardedClientCertHeader, r.RemoteAddr)
+	}
+
+	return parseForwardedClientCert(value)
+}
+
+// parseForwardedClientCert understands the Envoy format, a comma separated list
+// of semicolon separated key=value pairs where Cert holds the URL encoded PEM,
+// and the bare URL encoded PEM that nginx sets from $ssl_client_escaped_cert.
+// With Envoy the first element belongs to the original client.
+func parseForwardedClientCert(value string) (*x509.Certificate, error) {
+	value = strings.TrimSpace(value)
+
+	certValue := ""
+	if unescaped, err := url.PathUnescape(value); err == nil && strings.HasPrefix(unescaped, "-----BEGIN") {
+		certValue = value
+	} else {
+		element := splitOutsideQuotes(value, ',')[0]
+		for _, pair := range splitOutsideQuotes(element, ';') {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "Cert") {
+				certValue = strings.Trim(strings.TrimSpace(kv[1]), "\"")
+			}
+		}
+	}
+
+	if certValue == "" {
+		return nil, errors.New("forwarded client certificate header has no certificate")
+	}
+
+	// PathUnescape keeps '+' as is, it is a valid base64 character in PEM.
+	unescaped, err := url.PathUnescape(certValue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid forwarded client certificate encoding: %v", err)
+	}
+
+	block, _ := pem.Decode([]byte(unescaped))
+	if block == nil {
+		return nil, errors.New("invalid forwarded client certificate PEM block")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// splitOutsideQuotes splits on sep, ignoring separators inside double quoted
+// values such as Subject="CN=device,O=Lamassu".
+func splitOutsideQuotes(value string, sep rune) []string {
+	parts := []string{}
+	quoted := false
+	start := 0
+	for i, c := range value {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
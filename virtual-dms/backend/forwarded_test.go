@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCertificatePEM(t *testing.T, commonName string) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestParseForwardedClientCert(t *testing.T) {
+	device := url.PathEscape(testCertificatePEM(t, "device"))
+	proxy := url.PathEscape(testCertificatePEM(t, "proxy"))
+
+	tests := []struct {
+		name    string
+		value   string
+		wantCN  string
+		wantErr string
+	}{
+		{
+			name:   "envoy",
+			value:  `Hash=1234;Cert="` + device + `";Subject="CN=device,O=Lamassu";URI=`,
+			wantCN: "device",
+		},
+		{
+			name:   "envoy unquoted cert",
+			value:  `By=spiffe://lamassu;Cert=` + device,
+			wantCN: "device",
+		},
+		{
+			name:   "envoy key is case insensitive",
+			value:  `cert="` + device + `"`,
+			wantCN: "device",
+		},
+		{
+			name:   "envoy first element is the original client",
+			value:  `Cert="` + device + `";Subject="CN=device",Cert="` + proxy + `";Subject="CN=proxy"`,
+			wantCN: "device",
+		},
+		{
+			name:   "nginx escaped cert",
+			value:  device,
+			wantCN: "device",
+		},
+		{
+			name:   "nginx escaped cert with surrounding spaces",
+			value:  "  " + device + " ",
+			wantCN: "device",
+		},
+		{
+			name:    "envoy without cert",
+			value:   `Hash=1234;Subject="CN=device"`,
+			wantErr: "has no certificate",
+		},
+		{
+			name:    "invalid escaping",
+			value:   `Cert="%zz"`,
+			wantErr: "invalid forwarded client certificate encoding",
+		},
+		{
+			name:    "not a PEM block",
+			value:   `Cert="` + url.PathEscape("not a certificate") + `"`,
+			wantErr: "invalid forwarded client certificate PEM block",
+		},
+		{
+			name:    "garbage PEM contents",
+			value:   url.PathEscape("-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"),
+			wantErr: "x509",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crt, err := parseForwardedClientCert(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseForwardedClientCert() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseForwardedClientCert() error = %v", err)
+			}
+			if crt.Subject.CommonName != tt.wantCN {
+				t.Errorf("parseForwardedClientCert() CN = %s, want %s", crt.Subject.CommonName, tt.wantCN)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "single addresses become host ranges",
+			entries: []string{"10.0.0.1", "::1"},
+			want:    []string{"10.0.0.1/32", "::1/128"},
+		},
+		{
+			name:    "ranges and blank entries",
+			entries: []string{" 10.0.0.0/8 ", "", "fd00::/8"},
+			want:    []string{"10.0.0.0/8", "fd00::/8"},
+		},
+		{
+			name:    "invalid address",
+			entries: []string{"proxy.local"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid range",
+			entries: []string{"10.0.0.0/33"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTrustedProxies(tt.entries)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseTrustedProxies() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTrustedProxies() error = %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseTrustedProxies() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].String() != tt.want[i] {
+					t.Errorf("parseTrustedProxies()[%d] = %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestForwardedClientCertificate(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := SingeltonInstance
+	SingeltonInstance = &Singelton{
+		TrustedProxies:            trustedProxies,
+		ForwardedClientCertHeader: "X-Client-Cert",
+	}
+	defer func() { SingeltonInstance = previous }()
+
+	device := url.PathEscape(testCertificatePEM(t, "device"))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		value      string
+		wantCert   bool
+		wantErr    bool
+	}{
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.1.2.3:41000",
+			header:     "X-Client-Cert",
+			value:      device,
+			wantCert:   true,
+		},
+		{
+			name:       "trusted IPv6 proxy",
+			remoteAddr: "[::1]:41000",
+			header:     "X-Client-Cert",
+			value:      `Cert="` + device + `"`,
+			wantCert:   true,
+		},
+		{
+			name:       "untrusted peer",
+			remoteAddr: "192.168.1.10:41000",
+			header:     "X-Client-Cert",
+			value:      device,
+			wantErr:    true,
+		},
+		{
+			name:       "unparseable peer address",
+			remoteAddr: "somewhere",
+			header:     "X-Client-Cert",
+			value:      device,
+			wantErr:    true,
+		},
+		{
+			name:       "other header is ignored",
+			remoteAddr: "192.168.1.10:41000",
+			header:     defaultForwardedClientCertHeader,
+			value:      device,
+		},
+		{
+			name:       "no header",
+			remoteAddr: "10.1.2.3:41000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/enroll", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+
+			crt, err := forwardedClientCertificate(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("forwardedClientCertificate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (crt != nil) != tt.wantCert {
+				t.Errorf("forwardedClientCertificate() certificate = %v, want one %v", crt, tt.wantCert)
+			}
+		})
+	}
+}
+
+func TestIsTrustedProxyWithoutProxies(t *testing.T) {
+	previous := SingeltonInstance
+	SingeltonInstance = &Singelton{TrustedProxies: []*net.IPNet{}}
+	defer func() { SingeltonInstance = previous }()
+
+	if isTrustedProxy("127.0.0.1:8080") {
+		t.Error("isTrustedProxy() trusted a peer with no trusted proxies configured")
+	}
+}
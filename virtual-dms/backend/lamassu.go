@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LamassuAPIVersion selects the Lamassu API the vDMS talks to.
+type LamassuAPIVersion string
+
+const (
+	LamassuAPIVersionV2 LamassuAPIVersion = "v2"
+	LamassuAPIVersionV3 LamassuAPIVersion = "v3"
+)
+
+func parseLamassuAPIVersion(version string) (LamassuAPIVersion, error) {
+	switch LamassuAPIVersion(strings.ToLower(version)) {
+	case "", LamassuAPIVersionV2:
+		return LamassuAPIVersionV2, nil
+	case LamassuAPIVersionV3:
+		return LamassuAPIVersionV3, nil
+	}
+	return "", fmt.Errorf("unknown Lamassu API version %s", version)
+}
+
+type LamassuDMSStatus string
+
+const (
+	LamassuDMSStatusPendingApproval LamassuDMSStatus = "PENDING_APPROVAL"
+	LamassuDMSStatusApproved        LamassuDMSStatus = "APPROVED"
+	LamassuDMSStatusRejected        LamassuDMSStatus = "REJECTED"
+	LamassuDMSStatusRevoked         LamassuDMSStatus = "REVOKED"
+	LamassuDMSStatusExpired         LamassuDMSStatus = "EXPIRED"
+)
+
+func parseLamassuDMSStatus(status string) (LamassuDMSStatus, error) {
+	switch LamassuDMSStatus(status) {
+	case LamassuDMSStatusPendingApproval, LamassuDMSStatusApproved, LamassuDMSStatusRejected, LamassuDMSStatusRevoked, LamassuDMSStatusExpired:
+		return LamassuDMSStatus(status), nil
+	}
+	return "", fmt.Errorf("invalid dms status %s", status)
+}
+
+// LamassuDMS is the part of a Lamassu DMS the simulator works with, whatever
+// the API version it was read from.
+type LamassuDMS struct {
+	Name              string
+	Status            LamassuDMSStatus
+	SerialNumber      string
+	CommonName        string
+	KeyType           string
+	KeyBits           int
+	AuthorizedCAs     []string
+	CreationTimestamp time.Time
+	Certificate       *x509.Certificate
+}
+
+// LamassuCapabilities lists the operations a Lamassu API version supports.
+type LamassuCapabilities struct {
+	DMSApproval  bool `json:"dms_approval"`
+	Reenroll     bool `json:"reenroll"`
+	ServerKeyGen bool `json:"server_keygen"`
+	Revocation   bool `json:"revocation"`
+}
+
+// DMSIdentity is what the vDMS authenticates with against the EST server.
+type DMSIdentity struct {
+	Name        string
+	Certificate *x509.Certificate
+	PrivateKey  *rsa.PrivateKey
+	// Forwarded sends the certificate in the forwarded client certificate
+	// header, as a TLS terminating proxy in front of the DMS would.
+	Forwarded bool
+}
+
+var (
+	errOperatorNotLoggedIn       = errors.New("no operator is logged in")
+	errNotSupported              = errors.New("operation not supported by the configured Lamassu API version")
+	errLamassuAPIVersionMismatch = errors.New("Lamassu API version mismatch")
+)
+
+// LamassuBackend hides the Lamassu API version behind the operations the
+// vDMS needs. Operator operations require Login to be called first, EST
+// operations authenticate with the given DMS identity.
+type LamassuBackend interface {
+	Version() LamassuAPIVersion
+	Capabilities() LamassuCapabilities
+	// Probe checks that the gateway serves the API version of the backend.
+	Probe(ctx context.Context) error
+	Login(username, password string) error
+
+	CreateDMS(ctx context.Context, name string) (*LamassuDMS, *rsa.PrivateKey, error)
+	GetDMS(ctx context.Context, name string) (*LamassuDMS, error)
+	ListDMSs(ctx context.Context) ([]LamassuDMS, error)
+	UpdateDMSStatus(ctx context.Context, name string, status LamassuDMSStatus) (*LamassuDMS, error)
+	UpdateDMSAuthorizedCAs(ctx context.Context, name string, authorizedCAs []string) (*LamassuDMS, error)
+	RevokeCertificate(ctx context.Context, caName, serialNumber, reason string) error
+
+	Enroll(ctx context.Context, identity DMSIdentity, caName string, csr *x509.CertificateRequest) (*x509.Certificate, error)
+	Reenroll(ctx context.Context, identity DMSIdentity, deviceCrt *x509.Certificate, csr *x509.CertificateRequest) (*x509.Certificate, error)
+	ServerKeyGen(ctx context.Context, identity DMSIdentity, caName string, csr *x509.CertificateRequest) (*x509.Certificate, interface{}, error)
+	CACerts(ctx context.Context, identity DMSIdentity, caName string) ([]*x509.Certificate, error)
+}
+
+// lamassuError reports Lamassu failures as upstream errors, except for the
+// ones caused by the state of the vDMS or the configured API version.
+func lamassuError(message string, err error) *ProtocolError {
+	if errors.Is(err, errOperatorNotLoggedIn) || errors.Is(err, errNotSupported) {
+		return newProtocolError(ProtocolErrorInvalidState, message, err)
+	}
+	return newProtocolError(ProtocolErrorUpstream, message, err)
+}
+
+func newLamassuBackend(version LamassuAPIVersion, gatewayUrl url.URL) LamassuBackend {
+	switch version {
+	case LamassuAPIVersionV3:
+		return newLamassuV3Backend(gatewayUrl)
+	default:
+		return newLamassuV2Backend(gatewayUrl)
+	}
+}
+
+// probeLamassuAPIVersion tells the API version served by the gateway from the
+// health endpoint of the DMS manager: v2 answers with a health flag while
+// newer versions report their build version.
+func probeLamassuAPIVersion(ctx context.Context, gatewayUrl url.URL) (LamassuAPIVersion, error) {
+	httpClient := &http.Client{
+		Timeout: gatewayProbeTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	gatewayUrl.Path = "api/dmsmanager/v1/health"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gatewayUrl.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("DMS manager health check responded with status code %d", resp.StatusCode)
+	}
+
+	var health struct {
+		Healthy *bool  `json:"healthy"`
+		Version string `json:"version"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&health)
+	if err != nil {
+		return "", fmt.Errorf("could not decode DMS manager health check: %v", err)
+	}
+
+	switch {
+	case health.Version != "":
+		return LamassuAPIVersionV3, nil
+	case health.Healthy != nil:
+		return LamassuAPIVersionV2, nil
+	}
+	return "", errors.New("could not tell the Lamassu API version from the DMS manager health check")
+}
+
+func probeLamassuBackend(ctx context.Context, backend LamassuBackend, gatewayUrl url.URL) error {
+	version, err := probeLamassuAPIVersion(ctx, gatewayUrl)
+	if err != nil {
+		return err
+	}
+
+	if version != backend.Version() {
+		return fmt.Errorf("%w: gateway serves %s but %s is configured", errLamassuAPIVersionMismatch, version, backend.Version())
+	}
+	return nil
+}
+
+// formatSerialNumber formats certificate serial numbers the way Lamassu
+// displays them, hex bytes separated by dashes.
+func formatSerialNumber(serialNumber *big.Int) string {
+	hex := fmt.Sprintf("%x", serialNumber)
+	if len(hex)%2 != 0 {
+		hex = "0" + hex
+	}
+
+	var b strings.Builder
+	for i, r := range hex {
+		if i > 0 && i%2 == 0 {
+			b.WriteRune('-')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// forwardedClientCertHeaderValue encodes a certificate the way Envoy fills
+// the X-Forwarded-Client-Cert header.
+func forwardedClientCertHeaderValue(crt *x509.Certificate) string {
+	params := url.Values{}
+	params.Add("Cert", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})))
+	return params.Encode()
+}
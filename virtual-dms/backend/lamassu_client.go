@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// lamassuClient sends JSON requests to one Lamassu service behind the
+// gateway, authenticated with the access token of the logged in operator.
+type lamassuClient struct {
+	serviceUrl url.URL
+	httpClient *http.Client
+}
+
+// passwordTokenSource gets operator tokens from the Lamassu Keycloak with
+// the password grant of the frontend client.
+type passwordTokenSource struct {
+	config     oauth2.Config
+	username   string
+	password   string
+	httpClient *http.Client
+}
+
+func (s *passwordTokenSource) Token() (*oauth2.Token, error) {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, s.httpClient)
+	return s.config.PasswordCredentialsToken(ctx, s.username, s.password)
+}
+
+// newLamassuTokenSource caches the operator token until it expires. Lamassu
+// is reached through the gateway with its self-signed certificate, so TLS is
+// not verified.
+func newLamassuTokenSource(gatewayUrl url.URL, username, password string) oauth2.TokenSource {
+	authUrl := gatewayUrl
+	authUrl.Host = "auth." + authUrl.Host
+	authUrl.Path = "auth/realms/lamassu/protocol/openid-connect"
+
+	return oauth2.ReuseTokenSource(nil, &passwordTokenSource{
+		config: oauth2.Config{
+			ClientID: "frontend",
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  authUrl.String() + "/auth",
+				TokenURL: authUrl.String() + "/token",
+			},
+		},
+		username: username,
+		password: password,
+		httpClient: &http.Client{
+			Transport: insecureLamassuTransport(),
+		},
+	})
+}
+
+func newLamassuClient(gatewayUrl url.URL, servicePath string, tokens oauth2.TokenSource) *lamassuClient {
+	gatewayUrl.Path = servicePath
+	return &lamassuClient{
+		serviceUrl: gatewayUrl,
+		httpClient: &http.Client{
+			Transport: &oauth2.Transport{
+				Source: tokens,
+				Base:   insecureLamassuTransport(),
+			},
+		},
+	}
+}
+
+// lamassuStatusError is a Lamassu answer with a status code other than 2xx.
+type lamassuStatusError struct {
+	statusCode int
+	body       string
+}
+
+func (e *lamassuStatusError) Error() string {
+	return fmt.Sprintf("response with status code %d: %s", e.statusCode, e.body)
+}
+
+// StatusCode matches the errors of the EST client.
+func (e *lamassuStatusError) StatusCode() int {
+	return e.statusCode
+}
+
+func insecureLamassuTransport() *http.Transport {
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+}
+
+// do sends a request and decodes the response into out, any 2xx status code
+// is a success as the newer API answers creations with 201.
+func (c *lamassuClient) do(ctx context.Context, method, requestPath string, query url.Values, body interface{}, out interface{}) error {
+	if c == nil {
+		return errOperatorNotLoggedIn
+	}
+
+	requestUrl := c.serviceUrl
+	requestUrl.Path = path.Join(requestUrl.Path, requestPath)
+	if strings.HasSuffix(requestPath, "/") {
+		// v2 collections are routed with a trailing slash
+		requestUrl.Path += "/"
+	}
+	requestUrl.RawQuery = query.Encode()
+
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, requestUrl.String(), reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return &lamassuStatusError{statusCode: resp.StatusCode, body: string(respBody)}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
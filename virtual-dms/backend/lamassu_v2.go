@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/globalsign/est"
+)
+
+// lamassuV2Backend talks to Lamassu v2: DMSs are approved by an operator and
+// get a certificate from Lamassu, devices enroll against the EST server of
+// the device manager.
+type lamassuV2Backend struct {
+	gatewayUrl url.URL
+	dmsClient  *lamassuClient
+	caClient   *lamassuClient
+}
+
+func newLamassuV2Backend(gatewayUrl url.URL) *lamassuV2Backend {
+	return &lamassuV2Backend{
+		gatewayUrl: gatewayUrl,
+	}
+}
+
+type v2DMSSubject struct {
+	CommonName       string `json:"common_name"`
+	Organization     string `json:"organization"`
+	OrganizationUnit string `json:"organization_unit"`
+	Country          string `json:"country"`
+	State            string `json:"state"`
+	Locality         string `json:"locality"`
+}
+
+type v2DMSKeyMetadata struct {
+	KeyType string `json:"type"`
+	KeyBits int    `json:"bits"`
+}
+
+// v2DMS carries timestamps in milliseconds and the certificate as a base64
+// encoded PEM.
+type v2DMS struct {
+	Name              string           `json:"name"`
+	Status            string           `json:"status"`
+	SerialNumber      string           `json:"serial_number"`
+	KeyMetadata       v2DMSKeyMetadata `json:"key_metadata"`
+	Subject           v2DMSSubject     `json:"subject"`
+	AuthorizedCAs     []string         `json:"authorized_cas"`
+	CreationTimestamp int64            `json:"creation_timestamp"`
+	Certificate       string           `json:"certificate,omitempty"`
+}
+
+type v2CreateDMSOutput struct {
+	DMS        v2DMS  `json:"dms"`
+	PrivateKey string `json:"private_key"`
+}
+
+type v2DMSList struct {
+	TotalDMSs int     `json:"total_dmss"`
+	DMSs      []v2DMS `json:"dmss"`
+}
+
+func (b *lamassuV2Backend) Version() LamassuAPIVersion {
+	return LamassuAPIVersionV2
+}
+
+func (b *lamassuV2Backend) Capabilities() LamassuCapabilities {
+	return LamassuCapabilities{
+		DMSApproval:  true,
+		Reenroll:     true,
+		ServerKeyGen: true,
+		Revocation:   true,
+	}
+}
+
+func (b *lamassuV2Backend) Probe(ctx context.Context) error {
+	return probeLamassuBackend(ctx, b, b.gatewayUrl)
+}
+
+func (b *lamassuV2Backend) Login(username, password string) error {
+	tokens := newLamassuTokenSource(b.gatewayUrl, username, password)
+	b.dmsClient = newLamassuClient(b.gatewayUrl, "api/dmsmanager", tokens)
+	b.caClient = newLamassuClient(b.gatewayUrl, "api/ca", tokens)
+	return nil
+}
+
+func (b *lamassuV2Backend) CreateDMS(ctx context.Context, name string) (*LamassuDMS, *rsa.PrivateKey, error) {
+	var output v2CreateDMSOutput
+	err := b.dmsClient.do(ctx, http.MethodPost, "v1/", nil, map[string]interface{}{
+		"subject": v2DMSSubject{
+			CommonName:       name,
+			Organization:     "Lamassu",
+			OrganizationUnit: "IT",
+			Country:          "ES",
+		},
+		"key_metadata": v2DMSKeyMetadata{
+			KeyType: "RSA",
+			KeyBits: 4096,
+		},
+	}, &output)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if output.PrivateKey == "" {
+		return nil, nil, errors.New("DMS manager did not return the DMS private key")
+	}
+
+	keyPEM, err := base64.StdEncoding.DecodeString(output.PrivateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decoding private key: %v", err)
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, errors.New("error decoding private key: invalid PEM block")
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing private key: %v", err)
+	}
+
+	dms := lamassuDMSFromV2(output.DMS)
+	return &dms, key, nil
+}
+
+func (b *lamassuV2Backend) GetDMS(ctx context.Context, name string) (*LamassuDMS, error) {
+	var output v2DMS
+	err := b.dmsClient.do(ctx, http.MethodGet, "v1/"+name, nil, nil, &output)
+	if err != nil {
+		return nil, err
+	}
+
+	dms := lamassuDMSFromV2(output)
+	return &dms, nil
+}
+
+func (b *lamassuV2Backend) ListDMSs(ctx context.Context) ([]LamassuDMS, error) {
+	const pageSize = 100
+
+	dmss := []LamassuDMS{}
+	for {
+		query := url.Values{}
+		query.Set("limit", strconv.Itoa(pageSize))
+		if len(dmss) > 0 {
+			query.Set("offset", strconv.Itoa(len(dmss)))
+		}
+
+		var page v2DMSList
+		err := b.dmsClient.do(ctx, http.MethodGet, "v1/", query, nil, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dms := range page.DMSs {
+			dmss = append(dmss, lamassuDMSFromV2(dms))
+		}
+
+		if len(page.DMSs) == 0 || len(dmss) >= page.TotalDMSs {
+			return dmss, nil
+		}
+	}
+}
+
+func (b *lamassuV2Backend) UpdateDMSStatus(ctx context.Context, name string, status LamassuDMSStatus) (*LamassuDMS, error) {
+	var output v2DMS
+	err := b.dmsClient.do(ctx, http.MethodPut, "v1/"+name+"/status", nil, map[string]string{
+		"status": string(status),
+	}, &output)
+	if err != nil {
+		return nil, err
+	}
+
+	dms := lamassuDMSFromV2(output)
+	return &dms, nil
+}
+
+func (b *lamassuV2Backend) UpdateDMSAuthorizedCAs(ctx context.Context, name string, authorizedCAs []string) (*LamassuDMS, error) {
+	var output v2DMS
+	err := b.dmsClient.do(ctx, http.MethodPut, "v1/"+name+"/auth", nil, map[string][]string{
+		"authorized_cas": authorizedCAs,
+	}, &output)
+	if err != nil {
+		return nil, err
+	}
+
+	dms := lamassuDMSFromV2(output)
+	return &dms, nil
+}
+
+func (b *lamassuV2Backend) RevokeCertificate(ctx context.Context, caName, serialNumber, reason string) error {
+	return b.caClient.do(ctx, http.MethodDelete, "v1/pki/"+caName+"/cert/"+serialNumber, nil, map[string]string{
+		"revocation_reason": reason,
+	}, nil)
+}
+
+// estClient authenticates the DMS over mTLS. The device manager serves one
+// EST endpoint per CA, reenrollments go to the endpoint without CA.
+func (b *lamassuV2Backend) estClient(identity DMSIdentity, caName string, forwardedCrt *x509.Certificate) *est.Client {
+	additionalHeaders := map[string]string{}
+	if forwardedCrt != nil {
+		additionalHeaders["X-Forwarded-Client-Cert"] = forwardedClientCertHeaderValue(forwardedCrt)
+	}
+
+	client := &est.Client{
+		Host:                  b.gatewayUrl.Host + "/api/devmanager",
+		AdditionalPathSegment: caName,
+		AdditionalHeaders:     additionalHeaders,
+		InsecureSkipVerify:    true,
+	}
+	if identity.Certificate != nil {
+		client.Certificates = []*x509.Certificate{identity.Certificate}
+		client.PrivateKey = identity.PrivateKey
+	}
+	return client
+}
+
+func (b *lamassuV2Backend) Enroll(ctx context.Context, identity DMSIdentity, caName string, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	var forwardedCrt *x509.Certificate
+	if identity.Forwarded {
+		forwardedCrt = identity.Certificate
+	}
+	return b.estClient(identity, caName, forwardedCrt).Enroll(ctx, csr)
+}
+
+// Reenroll authenticates the DMS over mTLS and vouches for the device by
+// forwarding its current certificate, as a TLS terminating proxy would.
+func (b *lamassuV2Backend) Reenroll(ctx context.Context, identity DMSIdentity, deviceCrt *x509.Certificate, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	return b.estClient(identity, "", deviceCrt).Reenroll(ctx, csr)
+}
+
+func (b *lamassuV2Backend) ServerKeyGen(ctx context.Context, identity DMSIdentity, caName string, csr *x509.CertificateRequest) (*x509.Certificate, interface{}, error) {
+	var forwardedCrt *x509.Certificate
+	if identity.Forwarded {
+		forwardedCrt = identity.Certificate
+	}
+
+	crt, keyBytes, err := b.estClient(identity, caName, forwardedCrt).ServerKeyGen(ctx, csr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(keyBytes)
+	return crt, key, err
+}
+
+// CACerts is served without authentication.
+func (b *lamassuV2Backend) CACerts(ctx context.Context, identity DMSIdentity, caName string) ([]*x509.Certificate, error) {
+	return b.estClient(DMSIdentity{}, caName, nil).CACerts(ctx)
+}
+
+func lamassuDMSFromV2(dms v2DMS) LamassuDMS {
+	lamassuDMS := LamassuDMS{
+		Name:          dms.Name,
+		Status:        LamassuDMSStatus(dms.Status),
+		SerialNumber:  dms.SerialNumber,
+		CommonName:    dms.Subject.CommonName,
+		KeyType:       dms.KeyMetadata.KeyType,
+		KeyBits:       dms.KeyMetadata.KeyBits,
+		AuthorizedCAs: dms.AuthorizedCAs,
+	}
+
+	if dms.CreationTimestamp > 0 {
+		lamassuDMS.CreationTimestamp = time.UnixMilli(dms.CreationTimestamp)
+	}
+	if dms.Certificate != "" {
+		lamassuDMS.Certificate, _ = decodeB64PEMCertificate(dms.Certificate)
+	}
+	return lamassuDMS
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/globalsign/est"
+)
+
+// lamassuV3Backend talks to the newer Lamassu API over plain HTTP. DMSs are
+// identified by their name, are active as soon as they are created and serve
+// EST under the DMS manager with the DMS as path segment, so the enrollment CA
+// is the one configured in the DMS rather than the one asked for.
+type lamassuV3Backend struct {
+	gatewayUrl url.URL
+	dmsClient  *lamassuClient
+	caClient   *lamassuClient
+}
+
+func newLamassuV3Backend(gatewayUrl url.URL) *lamassuV3Backend {
+	return &lamassuV3Backend{
+		gatewayUrl: gatewayUrl,
+	}
+}
+
+type v3DMS struct {
+	ID         string                 `json:"id"`
+	Name       string                 `json:"name"`
+	CreationTS time.Time              `json:"creation_ts"`
+	Metadata   map[string]interface{} `json:"metadata"`
+	Settings   v3DMSSettings          `json:"settings"`
+}
+
+// v3DMSSettings keeps the settings the simulator does not manage untouched, so
+// updating the authorized CAs does not reset them.
+type v3DMSSettings struct {
+	EnrollmentSettings     map[string]interface{} `json:"enrollment_settings"`
+	ReenrollmentSettings   map[string]interface{} `json:"reenrollment_settings"`
+	ServerKeyGenSettings   map[string]interface{} `json:"server_keygen_settings"`
+	CADistributionSettings map[string]interface{} `json:"ca_distribution_settings"`
+}
+
+type v3DMSList struct {
+	Next string  `json:"next"`
+	List []v3DMS `json:"list"`
+}
+
+var v3RevocationReasons = map[string]string{
+	"unspecified":          "Unspecified",
+	"keycompromise":        "KeyCompromise",
+	"cacompromise":         "CACompromise",
+	"affiliationchanged":   "AffiliationChanged",
+	"superseded":           "Superseded",
+	"cessationofoperation": "CessationOfOperation",
+	"certificatehold":      "CertificateHold",
+}
+
+func (b *lamassuV3Backend) Version() LamassuAPIVersion {
+	return LamassuAPIVersionV3
+}
+
+func (b *lamassuV3Backend) Capabilities() LamassuCapabilities {
+	return LamassuCapabilities{
+		DMSApproval:  false,
+		Reenroll:     true,
+		ServerKeyGen: true,
+		Revocation:   true,
+	}
+}
+
+func (b *lamassuV3Backend) Probe(ctx context.Context) error {
+	return probeLamassuBackend(ctx, b, b.gatewayUrl)
+}
+
+func (b *lamassuV3Backend) Login(username, password string) error {
+	tokens := newLamassuTokenSource(b.gatewayUrl, username, password)
+	b.dmsClient = newLamassuClient(b.gatewayUrl, "api/dmsmanager", tokens)
+	b.caClient = newLamassuClient(b.gatewayUrl, "api/ca", tokens)
+	return nil
+}
+
+// CreateDMS registers a DMS that leaves device authentication to the vDMS.
+// The newer API does not issue DMS certificates, so the vDMS identifies
+// itself with a self-signed certificate for a locally generated key, which
+// also signs its receipts and backlog retries.
+func (b *lamassuV3Backend) CreateDMS(ctx context.Context, name string) (*LamassuDMS, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	crt, err := selfSignedDMSCertificate(name, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body := v3DMS{
+		ID:       name,
+		Name:     name,
+		Metadata: map[string]interface{}{},
+		Settings: v3DMSSettings{
+			EnrollmentSettings: map[string]interface{}{
+				"enrollment_protocol": "EST_RFC7030",
+				"enrollment_options_ESTRFC7030": map[string]interface{}{
+					"auth_mode": "NO_AUTH",
+				},
+				"device_provisioning_profile": map[string]interface{}{
+					"icon":       "BiSolidCreditCardFront",
+					"icon_color": "#25ee32-#222222",
+					"metadata":   map[string]interface{}{},
+					"tags":       []string{"vdms"},
+				},
+				"enrollment_ca":                 "",
+				"registration_mode":             "JITP",
+				"enable_replaceable_enrollment": true,
+			},
+			ReenrollmentSettings: map[string]interface{}{
+				"additional_validation_cas": []string{},
+				"reenrollment_delta":        "100d",
+				"enable_expired_renewal":    true,
+			},
+			ServerKeyGenSettings: map[string]interface{}{
+				"enabled": true,
+				"key": map[string]interface{}{
+					"type": "RSA",
+					"bits": 4096,
+				},
+			},
+			CADistributionSettings: map[string]interface{}{
+				"include_lamassu_system_ca": true,
+				"include_enrollment_ca":     true,
+				"managed_cas":               []string{},
+			},
+		},
+	}
+
+	var dms v3DMS
+	err = b.dmsClient.do(ctx, http.MethodPost, "v1/dms", nil, body, &dms)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lamassuDMS := lamassuDMSFromV3(dms)
+	lamassuDMS.Certificate = crt
+	return &lamassuDMS, key, nil
+}
+
+func selfSignedDMSCertificate(name string, key *rsa.PrivateKey) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   name,
+			Organization: []string{"Lamassu"},
+		},
+		NotBefore:   time.Now().Add(-time.Minute),
+		NotAfter:    time.Now().AddDate(1, 0, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func (b *lamassuV3Backend) getDMS(ctx context.Context, name string) (*v3DMS, error) {
+	var dms v3DMS
+	err := b.dmsClient.do(ctx, http.MethodGet, "v1/dms/"+name, nil, nil, &dms)
+	if err != nil {
+		return nil, err
+	}
+	return &dms, nil
+}
+
+func (b *lamassuV3Backend) GetDMS(ctx context.Context, name string) (*LamassuDMS, error) {
+	dms, err := b.getDMS(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	lamassuDMS := lamassuDMSFromV3(*dms)
+	return &lamassuDMS, nil
+}
+
+func (b *lamassuV3Backend) ListDMSs(ctx context.Context) ([]LamassuDMS, error) {
+	dmss := []LamassuDMS{}
+	bookmark := ""
+	for {
+		query := url.Values{}
+		query.Set("page_size", "100")
+		if bookmark != "" {
+			query.Set("bookmark", bookmark)
+		}
+
+		var page v3DMSList
+		err := b.dmsClient.do(ctx, http.MethodGet, "v1/dms", query, nil, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dms := range page.List {
+			dmss = append(dmss, lamassuDMSFromV3(dms))
+		}
+
+		if page.Next == "" || len(page.List) == 0 {
+			return dmss, nil
+		}
+		bookmark = page.Next
+	}
+}
+
+func (b *lamassuV3Backend) UpdateDMSStatus(ctx context.Context, name string, status LamassuDMSStatus) (*LamassuDMS, error) {
+	return nil, errNotSupported
+}
+
+// UpdateDMSAuthorizedCAs enrolls with the first CA and distributes all of
+// them to the devices.
+func (b *lamassuV3Backend) UpdateDMSAuthorizedCAs(ctx context.Context, name string, authorizedCAs []string) (*LamassuDMS, error) {
+	dms, err := b.getDMS(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if dms.Settings.EnrollmentSettings == nil {
+		dms.Settings.EnrollmentSettings = map[string]interface{}{}
+	}
+	if dms.Settings.CADistributionSettings == nil {
+		dms.Settings.CADistributionSettings = map[string]interface{}{}
+	}
+
+	enrollmentCA := ""
+	if len(authorizedCAs) > 0 {
+		enrollmentCA = authorizedCAs[0]
+	}
+	dms.Settings.EnrollmentSettings["enrollment_ca"] = enrollmentCA
+	dms.Settings.CADistributionSettings["managed_cas"] = authorizedCAs
+
+	var updated v3DMS
+	err = b.dmsClient.do(ctx, http.MethodPut, "v1/dms/"+name, nil, dms, &updated)
+	if err != nil {
+		return nil, err
+	}
+
+	lamassuDMS := lamassuDMSFromV3(updated)
+	return &lamassuDMS, nil
+}
+
+// RevokeCertificate changes the certificate status, certificates are looked
+// up by serial number alone so the CA name is not needed.
+func (b *lamassuV3Backend) RevokeCertificate(ctx context.Context, caName, serialNumber, reason string) error {
+	revocationReason, ok := v3RevocationReasons[reason]
+	if !ok {
+		revocationReason = v3RevocationReasons["unspecified"]
+	}
+
+	return b.caClient.do(ctx, http.MethodPost, "v1/certificates/"+serialNumber+"/status", nil, map[string]string{
+		"status":            "REVOKED",
+		"revocation_reason": revocationReason,
+	}, nil)
+}
+
+func (b *lamassuV3Backend) estClient(identity DMSIdentity, forwardedCrt *x509.Certificate) *est.Client {
+	additionalHeaders := map[string]string{}
+	if forwardedCrt != nil {
+		additionalHeaders["X-Forwarded-Client-Cert"] = forwardedClientCertHeaderValue(forwardedCrt)
+	}
+
+	client := &est.Client{
+		Host:                  b.gatewayUrl.Host + "/api/dmsmanager",
+		AdditionalPathSegment: identity.Name,
+		AdditionalHeaders:     additionalHeaders,
+		InsecureSkipVerify:    true,
+	}
+	if identity.Certificate != nil {
+		client.Certificates = []*x509.Certificate{identity.Certificate}
+		client.PrivateKey = identity.PrivateKey
+	}
+	return client
+}
+
+func (b *lamassuV3Backend) Enroll(ctx context.Context, identity DMSIdentity, caName string, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	var forwardedCrt *x509.Certificate
+	if identity.Forwarded {
+		forwardedCrt = identity.Certificate
+	}
+	return b.estClient(identity, forwardedCrt).Enroll(ctx, csr)
+}
+
+func (b *lamassuV3Backend) Reenroll(ctx context.Context, identity DMSIdentity, deviceCrt *x509.Certificate, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	return b.estClient(identity, deviceCrt).Reenroll(ctx, csr)
+}
+
+func (b *lamassuV3Backend) ServerKeyGen(ctx context.Context, identity DMSIdentity, caName string, csr *x509.CertificateRequest) (*x509.Certificate, interface{}, error) {
+	var forwardedCrt *x509.Certificate
+	if identity.Forwarded {
+		forwardedCrt = identity.Certificate
+	}
+
+	crt, keyBytes, err := b.estClient(identity, forwardedCrt).ServerKeyGen(ctx, csr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(keyBytes)
+	return crt, key, err
+}
+
+// CACerts returns the CAs distributed by the DMS, which include its
+// enrollment CA.
+func (b *lamassuV3Backend) CACerts(ctx context.Context, identity DMSIdentity, caName string) ([]*x509.Certificate, error) {
+	return b.estClient(identity, nil).CACerts(ctx)
+}
+
+func lamassuDMSFromV3(dms v3DMS) LamassuDMS {
+	authorizedCAs := []string{}
+	if enrollmentCA, ok := dms.Settings.EnrollmentSettings["enrollment_ca"].(string); ok && enrollmentCA != "" {
+		authorizedCAs = append(authorizedCAs, enrollmentCA)
+	}
+	if managedCAs, ok := dms.Settings.CADistributionSettings["managed_cas"].([]interface{}); ok {
+		for _, ca := range managedCAs {
+			caName, ok := ca.(string)
+			if !ok || caName == "" || (len(authorizedCAs) > 0 && authorizedCAs[0] == caName) {
+				continue
+			}
+			authorizedCAs = append(authorizedCAs, caName)
+		}
+	}
+
+	return LamassuDMS{
+		Name:              dms.ID,
+		Status:            LamassuDMSStatusApproved,
+		CommonName:        dms.Name,
+		AuthorizedCAs:     authorizedCAs,
+		CreationTimestamp: dms.CreationTS,
+	}
+}
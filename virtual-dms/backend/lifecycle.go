@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.Version=... -X main.Commit=... -X main.BuildDate=...".
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+type BuildInfo struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit,omitempty"`
+	BuildDate string    `json:"build_date,omitempty"`
+	GoVersion string    `json:"go_version"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type ReadinessCheck struct {
+	Name   string `json:"name"`
+	Ready  bool   `json:"ready"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type ReadinessReport struct {
+	Ready  bool             `json:"ready"`
+	Checks []ReadinessCheck `json:"checks"`
+}
+
+// Lifecycle tracks the requests a shutdown has to wait for and tells the
+// probes whether the vDMS is going away.
+type Lifecycle struct {
+	lock         sync.Mutex
+	startedAt    time.Time
+	shuttingDown bool
+	enrollments  sync.WaitGroup
+	// ctx is cancelled when the shutdown starts, so the enrollments waiting
+	// for an operator stop waiting.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewLifecycle() *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Lifecycle{
+		startedAt: time.Now(),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+func (l *Lifecycle) ShuttingDown() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.shuttingDown
+}
+
+// TrackEnrollment wraps a device facing handler so that a shutdown waits for
+// the enrollment to finish. New enrollments are turned away once the shutdown
+// started, devices retry them against another replica. The request context is
+// cancelled when the shutdown starts.
+func (l *Lifecycle) TrackEnrollment(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l.lock.Lock()
+		if l.shuttingDown {
+			l.lock.Unlock()
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "The DMS is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		l.enrollments.Add(1)
+		l.lock.Unlock()
+
+		defer l.enrollments.Done()
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-l.ctx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// Shutdown drains the vDMS: it waits for the enrollments in flight, stops the
+// scheduled jobs, closes the console and finally the HTTP server. Enrollments
+// waiting for an operator are failed right away, whatever is still running
+// when the context expires is cut off.
+func (l *Lifecycle) Shutdown(ctx context.Context, srv *http.Server) {
+	l.lock.Lock()
+	l.shuttingDown = true
+	l.lock.Unlock()
+	l.cancel()
+
+	drained := make(chan struct{})
+	go func() {
+		l.enrollments.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Println("enrollments in flight drained")
+	case <-ctx.Done():
+		log.Println("shutdown deadline reached with enrollments in flight")
+	}
+
+	// Stop waits for the jobs that are running, a backlog retry may be
+	// forwarding an enrollment.
+	select {
+	case <-SingeltonInstance.CronInstance.Stop().Done():
+	case <-ctx.Done():
+		log.Println("shutdown deadline reached with scheduled jobs running")
+	}
+
+	closeConsoleConnection()
+
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Println("error shutting down HTTP server:", err)
+		srv.Close()
+	}
+}
+
+// closeConsoleConnection tells the console the server is going away. Hijacked
+// connections are not closed by http.Server.Shutdown.
+func closeConsoleConnection() {
+	webSocketWriteLock.Lock()
+	defer webSocketWriteLock.Unlock()
+
+	c := SingeltonInstance.ActiveWebSocketConnection
+	if c == nil {
+		return
+	}
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	err := c.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+	if err != nil {
+		log.Println("error closing console connection:", err)
+	}
+	c.Close()
+}
+
+func (l *Lifecycle) BuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		StartedAt: l.startedAt,
+	}
+
+	// Binaries built without ldflags still carry the VCS revision.
+	if buildInfo, ok := debug.ReadBuildInfo(); ok && info.Commit == "" {
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Commit = setting.Value
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			}
+		}
+	}
+
+	return info
+}
+
+// Readiness tells whether the vDMS can enroll devices: the gateway must be
+// reachable and the DMS approved with a certificate that is currently valid.
+func (l *Lifecycle) Readiness() ReadinessReport {
+	checks := []ReadinessCheck{}
+
+	if l.ShuttingDown() {
+		checks = append(checks, ReadinessCheck{Name: "lifecycle", Ready: false, Detail: "shutting down"})
+	} else {
+		checks = append(checks, ReadinessCheck{Name: "lifecycle", Ready: true})
+	}
+
+	linkState := SingeltonInstance.EnrollmentBacklog.LinkState()
+	checks = append(checks, ReadinessCheck{
+		Name:   "gateway",
+		Ready:  linkState == GatewayLinkStateUp,
+		Detail: fmt.Sprintf("link %s", linkState),
+	})
+
+	dms := currentDMS()
+	dmsStatus := dms.Status
+	checks = append(checks, ReadinessCheck{
+		Name:   "dms_approval",
+		Ready:  dmsStatus == DMSStatusIdle || dmsStatus == DMSStatusEnrolling,
+		Detail: fmt.Sprintf("status %s", dmsStatus),
+	})
+
+	certificateCheck := ReadinessCheck{Name: "dms_certificate"}
+	crt := dms.Certificate
+	now := time.Now()
+	switch {
+	case crt == nil:
+		certificateCheck.Detail = "no certificate"
+	case now.Before(crt.NotBefore):
+		certificateCheck.Detail = fmt.Sprintf("not valid before %s", crt.NotBefore.Format(time.RFC3339))
+	case now.After(crt.NotAfter):
+		certificateCheck.Detail = fmt.Sprintf("expired on %s", crt.NotAfter.Format(time.RFC3339))
+	default:
+		certificateCheck.Ready = true
+		certificateCheck.Detail = fmt.Sprintf("valid until %s", crt.NotAfter.Format(time.RFC3339))
+	}
+	checks = append(checks, certificateCheck)
+
+	report := ReadinessReport{Ready: true, Checks: checks}
+	for _, check := range checks {
+		report.Ready = report.Ready && check.Ready
+	}
+	return report
+}
+
+// RegisterRoutes mounts the probes. They are left out of authentication, the
+// orchestrator calls them without credentials.
+func (l *Lifecycle) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/healthz", l.livenessRoute).Methods("GET")
+	router.HandleFunc("/readyz", l.readinessRoute).Methods("GET")
+	router.HandleFunc("/version", l.versionRoute).Methods("GET")
+}
+
+func (l *Lifecycle) livenessRoute(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (l *Lifecycle) readinessRoute(w http.ResponseWriter, r *http.Request) {
+	report := l.Readiness()
+	statusCode := http.StatusOK
+	if !report.Ready {
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeAPIJSON(w, statusCode, report)
+}
+
+func (l *Lifecycle) versionRoute(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, http.StatusOK, l.BuildInfo())
+}
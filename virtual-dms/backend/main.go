@@ -3,28 +3,31 @@ package main
 import (
 	"context"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/kelseyhightower/envconfig"
-	dmsManagerClient "github.com/lamassuiot/lamassuiot/pkg/dms-manager/client"
-	dmsApi "github.com/lamassuiot/lamassuiot/pkg/dms-manager/common/api"
-	estClient "github.com/lamassuiot/lamassuiot/pkg/est/client"
-	"github.com/lamassuiot/lamassuiot/pkg/utils"
-	"github.com/lamassuiot/lamassuiot/pkg/utils/client"
+	"github.com/lamassuiot/lamassu-simulation-tools/common/auth"
+	"github.com/lamassuiot/lamassu-simulation-tools/common/session"
 	"github.com/robfig/cron/v3"
 )
 
@@ -46,15 +49,23 @@ type DMSState struct {
 	SelectedCAForEnrollment      string
 	AutomaticEnrollment          bool
 	AutomaticCertificateTransfer bool
+	AutomaticReenrollment        bool
+	RepeatEnrollmentPolicy       RepeatEnrollmentPolicy
+	MaxActiveCertificatesPerSlot int
+	RevokeSupersededCertificates bool
 }
 
 type DMSStateSerialized struct {
-	Status                       DMSStatus `json:"status"`
-	Name                         string    `json:"name"`
-	AuthorizedCAs                []string  `json:"authorized_cas"`
-	SelectedCAForEnrollment      string    `json:"selected_ca_for_enrollment"`
-	AutomaticEnrollment          bool      `json:"automatic_enrollment"`
-	AutomaticCertificateTransfer bool      `json:"automatic_certificate_transfer"`
+	Status                       DMSStatus              `json:"status"`
+	Name                         string                 `json:"name"`
+	AuthorizedCAs                []string               `json:"authorized_cas"`
+	SelectedCAForEnrollment      string                 `json:"selected_ca_for_enrollment"`
+	AutomaticEnrollment          bool                   `json:"automatic_enrollment"`
+	AutomaticCertificateTransfer bool                   `json:"automatic_certificate_transfer"`
+	AutomaticReenrollment        bool                   `json:"automatic_reenrollment"`
+	RepeatEnrollmentPolicy       RepeatEnrollmentPolicy `json:"repeat_enrollment_policy"`
+	MaxActiveCertificatesPerSlot int                    `json:"max_active_certificates_per_slot"`
+	RevokeSupersededCertificates bool                   `json:"revoke_superseded_certificates"`
 }
 
 func (s *DMSState) Serialize() DMSStateSerialized {
@@ -63,6 +74,11 @@ func (s *DMSState) Serialize() DMSStateSerialized {
 		authCAs = s.AuthorizedCAs
 	}
 
+	repeatEnrollmentPolicy := s.RepeatEnrollmentPolicy
+	if repeatEnrollmentPolicy == "" {
+		repeatEnrollmentPolicy = RepeatEnrollmentPolicyAllow
+	}
+
 	return DMSStateSerialized{
 		Status:                       s.Status,
 		Name:                         s.Name,
@@ -70,6 +86,10 @@ func (s *DMSState) Serialize() DMSStateSerialized {
 		SelectedCAForEnrollment:      s.SelectedCAForEnrollment,
 		AutomaticEnrollment:          s.AutomaticEnrollment,
 		AutomaticCertificateTransfer: s.AutomaticCertificateTransfer,
+		AutomaticReenrollment:        s.AutomaticReenrollment,
+		RepeatEnrollmentPolicy:       repeatEnrollmentPolicy,
+		MaxActiveCertificatesPerSlot: s.MaxActiveCertificatesPerSlot,
+		RevokeSupersededCertificates: s.RevokeSupersededCertificates,
 	}
 }
 
@@ -85,6 +105,7 @@ const (
 )
 
 type EnrollmentInProcess struct {
+	ID                            string
 	Status                        EnrollmentStatus
 	RequestingDate                time.Time
 	DeviceModel                   string
@@ -97,9 +118,28 @@ type EnrollmentInProcess struct {
 	SerialNumber                  string
 	ExpirationDate                time.Time
 	AuthorizedCertificateTransfer bool
+	Reenrollment                  bool
+	PreviousSerialNumber          string
+	DeviceCertificate             *x509.Certificate
+	ManifestClaimed               bool
+	ClaimCode                     string
+	ClaimExpiresAt                time.Time
+	SupersedesSerialNumbers       []string
+	// RedeemedCredentialID is the token or claim code that approved the
+	// enrollment, it is restored if the enrollment fails afterwards.
+	RedeemedCredentialID string
+	// ApprovedBy and TransferApprovedBy are the users that approved each
+	// step, they stay empty for automatic approvals.
+	ApprovedBy         string
+	TransferApprovedBy string
+	// Rejected stops the enrollment at the approval step it is waiting on.
+	Rejected        bool
+	RejectionReason string
+	RejectedBy      string
 }
 
 type EnrollmentInProcessSerialized struct {
+	ID                            string           `json:"id"`
 	Status                        EnrollmentStatus `json:"status"`
 	RequestingDate                time.Time        `json:"requesting_date"`
 	DeviceModel                   string           `json:"device_model"`
@@ -112,6 +152,12 @@ type EnrollmentInProcessSerialized struct {
 	SerialNumber                  string           `json:"serial_number"`
 	ExpirationDate                time.Time        `json:"expiration_date"`
 	AuthorizedCertificateTransfer bool             `json:"authorized_certificate_transfer"`
+	Reenrollment                  bool             `json:"reenrollment"`
+	PreviousSerialNumber          string           `json:"previous_serial_number"`
+	AwaitingClaim                 bool             `json:"awaiting_claim"`
+	Supersedes                    []string         `json:"supersedes"`
+	ApprovedBy                    string           `json:"approved_by,omitempty"`
+	TransferApprovedBy            string           `json:"transfer_approved_by,omitempty"`
 }
 
 func (s *EnrollmentInProcess) Serialize() EnrollmentInProcessSerialized {
@@ -156,6 +202,7 @@ func (s *EnrollmentInProcess) Serialize() EnrollmentInProcessSerialized {
 	}
 
 	return EnrollmentInProcessSerialized{
+		ID:                            s.ID,
 		Status:                        s.Status,
 		RequestingDate:                s.RequestingDate,
 		DeviceModel:                   s.DeviceModel,
@@ -168,35 +215,99 @@ func (s *EnrollmentInProcess) Serialize() EnrollmentInProcessSerialized {
 		ExpirationDate:                s.ExpirationDate,
 		AuthorizedCertificateTransfer: s.AuthorizedCertificateTransfer,
 		IssuingCA:                     s.IssuingCA,
+		Reenrollment:                  s.Reenrollment,
+		PreviousSerialNumber:          s.PreviousSerialNumber,
+		AwaitingClaim:                 s.ClaimCode != "" && !s.AuthorizedEnrollment,
+		Supersedes:                    s.SupersedesSerialNumbers,
+		ApprovedBy:                    s.ApprovedBy,
+		TransferApprovedBy:            s.TransferApprovedBy,
 	}
 }
 
 type EnrolledIdentity struct {
-	EnrolledTimestamp time.Time
-	SerialNumber      string
-	DeviceID          string
-	DeviceSlot        string
-	IssuingCA         string
-	IssuingDuration   time.Duration
+	EnrolledTimestamp    time.Time
+	SerialNumber         string
+	DeviceID             string
+	DeviceSlot           string
+	IssuingCA            string
+	IssuingDuration      time.Duration
+	Renewals             int
+	LastRenewalTimestamp time.Time
+	PreviousSerialNumber string
+	Status               EnrolledIdentityStatus
+	ExpirationDate       time.Time
+	Supersedes           []string
+	SupersededBy         string
+	SupersededTimestamp  time.Time
+	RevocationError      string
+	ApprovedBy           string
+	TransferApprovedBy   string
+	// Receipt is the CMS signed enrollment receipt handed to the device.
+	Receipt []byte
 }
 
 type EnrolledIdentitySerialized struct {
-	EnrolledTimestamp int    `json:"enrolled_timestamp"`
-	SerialNumber      string `json:"serial_number"`
-	DeviceID          string `json:"device_id"`
-	DeviceSlot        string `json:"device_slot"`
-	IssuingCA         string `json:"issuing_ca"`
-	IssuingDuration   int    `json:"issuing_duration"`
+	EnrolledTimestamp    int                    `json:"enrolled_timestamp"`
+	SerialNumber         string                 `json:"serial_number"`
+	DeviceID             string                 `json:"device_id"`
+	DeviceSlot           string                 `json:"device_slot"`
+	IssuingCA            string                 `json:"issuing_ca"`
+	IssuingDuration      int                    `json:"issuing_duration"`
+	Renewals             int                    `json:"renewals"`
+	LastRenewalTimestamp int                    `json:"last_renewal_timestamp"`
+	PreviousSerialNumber string                 `json:"previous_serial_number"`
+	Status               EnrolledIdentityStatus `json:"status"`
+	ExpirationDate       int                    `json:"expiration_date"`
+	Supersedes           []string               `json:"supersedes"`
+	SupersededBy         string                 `json:"superseded_by"`
+	SupersededTimestamp  int                    `json:"superseded_timestamp"`
+	RevocationError      string                 `json:"revocation_error,omitempty"`
+	ApprovedBy           string                 `json:"approved_by,omitempty"`
+	TransferApprovedBy   string                 `json:"transfer_approved_by,omitempty"`
+	ActiveCertificates   int                    `json:"active_certificates"`
+	HasReceipt           bool                   `json:"has_receipt"`
 }
 
 func (s *EnrolledIdentity) Serialize() EnrolledIdentitySerialized {
+	lastRenewal := 0
+	if !s.LastRenewalTimestamp.IsZero() {
+		lastRenewal = int(s.LastRenewalTimestamp.UnixMilli())
+	}
+
+	status := s.Status
+	if status == "" {
+		status = EnrolledIdentityStatusActive
+	}
+
+	supersededTimestamp := 0
+	if !s.SupersededTimestamp.IsZero() {
+		supersededTimestamp = int(s.SupersededTimestamp.UnixMilli())
+	}
+
+	supersedes := []string{}
+	if s.Supersedes != nil {
+		supersedes = s.Supersedes
+	}
+
 	return EnrolledIdentitySerialized{
-		EnrolledTimestamp: int(s.EnrolledTimestamp.UnixMilli()),
-		SerialNumber:      s.SerialNumber,
-		DeviceID:          s.DeviceID,
-		DeviceSlot:        s.DeviceSlot,
-		IssuingCA:         s.IssuingCA,
-		IssuingDuration:   int(s.IssuingDuration.Seconds()),
+		EnrolledTimestamp:    int(s.EnrolledTimestamp.UnixMilli()),
+		SerialNumber:         s.SerialNumber,
+		DeviceID:             s.DeviceID,
+		DeviceSlot:           s.DeviceSlot,
+		IssuingCA:            s.IssuingCA,
+		IssuingDuration:      int(s.IssuingDuration.Seconds()),
+		Renewals:             s.Renewals,
+		LastRenewalTimestamp: lastRenewal,
+		PreviousSerialNumber: s.PreviousSerialNumber,
+		Status:               status,
+		ExpirationDate:       int(s.ExpirationDate.UnixMilli()),
+		Supersedes:           supersedes,
+		SupersededBy:         s.SupersededBy,
+		SupersededTimestamp:  supersededTimestamp,
+		RevocationError:      s.RevocationError,
+		ApprovedBy:           s.ApprovedBy,
+		TransferApprovedBy:   s.TransferApprovedBy,
+		HasReceipt:           s.Receipt != nil,
 	}
 }
 
@@ -206,15 +317,79 @@ type Singelton struct {
 	ActiveWebSocketConnection *websocket.Conn
 	DMS                       DMSState
 	EnrollmentInProcess       *EnrollmentInProcess
-	DMSManagerClient          dmsManagerClient.LamassuDMSManagerClient
+	Lamassu                   LamassuBackend
 	CronInstance              *cron.Cron
 	PeriodicDMSCheckCronID    cron.EntryID
 	EnrolledIdentities        []EnrolledIdentity
 	LamassuGatewayURL         url.URL
+	Recorder                  *session.Recorder
+	Webhooks                  *WebhookManager
+	EnrollmentBacklog         *EnrollmentBacklog
+	DeviceManifest            *DeviceManifest
+	EnrollmentCredentials     *EnrollmentCredentialStore
+	DMSIdentityMode           DMSIdentityMode
+	TrustedProxies            []*net.IPNet
+	ForwardedClientCertHeader string
+	Auth                      *auth.Authenticator
 }
 
 var SingeltonInstance *Singelton
 
+// stateLock guards the DMS state, the enrollment in process and the ledger of
+// enrolled identities, which are shared by the device handlers, the console,
+// the REST API and the cron jobs. It is never held while calling Lamassu or
+// writing to the console.
+var stateLock sync.Mutex
+
+// currentDMS returns a copy of the DMS state.
+func currentDMS() DMSState {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	return SingeltonInstance.DMS
+}
+
+// updateDMS changes the DMS state under the state lock.
+func updateDMS(update func(current *DMSState)) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	update(&SingeltonInstance.DMS)
+}
+
+// updateEnrollment changes an enrollment under the state lock, the console
+// and the REST API read the enrollment in process while it is driven.
+func updateEnrollment(enrollment *EnrollmentInProcess, update func(enrollment *EnrollmentInProcess)) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	update(enrollment)
+}
+
+// enrollmentSnapshot returns a copy of the enrollment, including the
+// approvals given so far.
+func enrollmentSnapshot(enrollment *EnrollmentInProcess) EnrollmentInProcess {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	return *enrollment
+}
+
+// startEnrollment makes the enrollment the one in process, which the console
+// and the REST API approve or reject.
+func startEnrollment(enrollment *EnrollmentInProcess) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	SingeltonInstance.DMS.Status = DMSStatusEnrolling
+	SingeltonInstance.EnrollmentInProcess = enrollment
+}
+
+// releaseDMS returns the DMS to idle once the enrollment in process is done.
+// Enrollments rejected before they were started leave the status untouched.
+func releaseDMS(enrollment *EnrollmentInProcess) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if SingeltonInstance.EnrollmentInProcess == enrollment {
+		SingeltonInstance.DMS.Status = DMSStatusIdle
+	}
+}
+
 type Cfg struct {
 	OperatorUsername string `json:"operator_username"`
 	OperatorPassword string `json:"operator_password"`
@@ -229,280 +404,501 @@ type CfgSelectedCAForEnrollment struct {
 type CfgAutoTransfer struct {
 	AutoTransfer bool `json:"auto_transfer"`
 }
+type CfgAutoReenrollment struct {
+	AutoReenroll bool `json:"auto_reenroll"`
+}
+type CfgRepeatEnrollment struct {
+	Policy                       string `json:"policy"`
+	MaxActiveCertificatesPerSlot int    `json:"max_active_certificates_per_slot"`
+	RevokeSuperseded             bool   `json:"revoke_superseded"`
+}
 
+// WebSocketMessage is a message sent to the console. ID is the one of the
+// command being answered, updates pushed by the vDMS have none.
 type WebSocketMessage struct {
-	Type      string      `json:"type"`
-	Message   interface{} `json:"message"`
-	Timestamp time.Time   `json:"timestamp"`
+	Type      string         `json:"type"`
+	ID        string         `json:"id,omitempty"`
+	Message   interface{}    `json:"message"`
+	Error     *ProtocolError `json:"error,omitempty"`
+	Timestamp time.Time      `json:"timestamp"`
+}
+
+type CfgAddWebhook struct {
+	URL    string             `json:"url"`
+	Secret string             `json:"secret"`
+	Events []WebhookEventType `json:"events"`
+}
+type CfgRemoveWebhook struct {
+	ID string `json:"id"`
+}
+type AuthQueuedTransfer struct {
+	ID string `json:"id"`
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+// AuthEnrollment optionally names the enrollment in process an approval is
+// meant for, so it is not applied to an enrollment that replaced it.
+type AuthEnrollment struct {
+	ID string `json:"id"`
+}
+type RejectEnrollment struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+type CfgImportDeviceManifest struct {
+	Format  ManifestFormat `json:"format"`
+	Content string         `json:"content"`
+	Replace bool           `json:"replace"`
+}
+type CfgManifestDevice struct {
+	SerialNumber string `json:"serial_number"`
+}
+type CfgEnforceManifest struct {
+	Enforce bool `json:"enforce"`
+}
+type CfgIssueEnrollmentToken struct {
+	SerialNumber string `json:"serial_number"`
+	TTLSeconds   int    `json:"ttl_seconds"`
+}
+type CfgRevokeEnrollmentToken struct {
+	ID string `json:"id"`
+}
+type CfgClaimDevice struct {
+	SerialNumber string `json:"serial_number"`
+	ClaimCode    string `json:"claim_code"`
 }
 
-func messageHandler(inMessage WebSocketMessage, connection *websocket.Conn) {
-	switch inMessage.Type {
-	case "GET_CFG":
+func (c *Cfg) validate() error {
+	if c.OperatorUsername == "" {
+		return missingField("operator_username")
+	}
+	if c.DMSName == "" {
+		return missingField("dms_name")
+	}
+	return nil
+}
+
+func (c *CfgSelectedCAForEnrollment) validate() error {
+	if c.SelectedCA == "" {
+		return missingField("selected_ca")
+	}
+	return nil
+}
+
+func (c *CfgAddWebhook) validate() error {
+	if c.URL == "" {
+		return missingField("url")
+	}
+	return nil
+}
+
+func (c *CfgRemoveWebhook) validate() error {
+	if c.ID == "" {
+		return missingField("id")
+	}
+	return nil
+}
+
+func (c *AuthQueuedTransfer) validate() error {
+	if c.ID == "" {
+		return missingField("id")
+	}
+	return nil
+}
+
+func (c *CfgImportDeviceManifest) validate() error {
+	if c.Content == "" {
+		return missingField("content")
+	}
+	return nil
+}
+
+func (c *CfgManifestDevice) validate() error {
+	if c.SerialNumber == "" {
+		return missingField("serial_number")
+	}
+	return nil
+}
+
+func (c *CfgIssueEnrollmentToken) validate() error {
+	if c.TTLSeconds < 0 {
+		return invalidField("ttl_seconds", errors.New("must not be negative"))
+	}
+	return nil
+}
+
+func (c *CfgRevokeEnrollmentToken) validate() error {
+	if c.ID == "" {
+		return missingField("id")
+	}
+	return nil
+}
+
+func (c *CfgClaimDevice) validate() error {
+	if c.SerialNumber == "" {
+		return missingField("serial_number")
+	}
+	if c.ClaimCode == "" {
+		return missingField("claim_code")
+	}
+	return nil
+}
+
+// upgrader checks origins with the authenticator once it is configured.
+var upgrader = websocket.Upgrader{}
+
+// messageHandler runs a console command and answers it with an ACK, or the
+// WELCOME of the handshake, carrying the ID of the command. Commands sent
+// without an ID are only answered when they fail, as older consoles expect.
+func messageHandler(principal *auth.Principal, inMessage IncomingWebSocketMessage) {
+	if inMessage.Type == "HELLO" {
+		welcome, err := handleHello(principal, inMessage.Message)
+		if err != nil {
+			sendProtocolError(inMessage.ID, err)
+			return
+		}
+
 		sendWebSocketMessage(
 			WebSocketMessage{
-				Type:      "DMS_UPDATE",
-				Message:   SingeltonInstance.DMS.Serialize(),
+				Type:      "WELCOME",
+				ID:        inMessage.ID,
+				Message:   welcome,
 				Timestamp: time.Now(),
 			},
 		)
+		return
+	}
+
+	result, err := handleCommand(principal, inMessage)
+	if err != nil {
+		sendProtocolError(inMessage.ID, err)
+		return
+	}
+
+	if inMessage.ID != "" {
+		sendWebSocketMessage(
+			WebSocketMessage{
+				Type: "ACK",
+				ID:   inMessage.ID,
+				Message: AckMessage{
+					Command: inMessage.Type,
+					Result:  result,
+				},
+				Timestamp: time.Now(),
+			},
+		)
+	}
+}
+
+func handleCommand(principal *auth.Principal, inMessage IncomingWebSocketMessage) (interface{}, error) {
+	if err := authorizeCommand(principal, inMessage.Type); err != nil {
+		return nil, err
+	}
+
+	switch inMessage.Type {
+	case "GET_CFG":
+		sendDMSUpdate()
+		sendEnrolledIdentitiesUpdate()
 
 	case "CFG":
-		bytesIn, err := json.Marshal(inMessage.Message)
+		var cfg Cfg
+		if err := decodeCommand(inMessage.Message, &cfg); err != nil {
+			return nil, err
+		}
+
+		err := SingeltonInstance.Lamassu.Login(cfg.OperatorUsername, cfg.OperatorPassword)
 		if err != nil {
-			sendWebSocketMessage(
-				WebSocketMessage{
-					Type:      "ERROR",
-					Message:   "Error parsing command 1",
-					Timestamp: time.Now(),
-				},
-			)
-			return
+			return nil, lamassuError("Error creating DMS Client", err)
 		}
-		var cfg Cfg
-		json.Unmarshal(bytesIn, &cfg)
-
-		dmsUrl := SingeltonInstance.LamassuGatewayURL
-		dmsUrl.Path = "api/dmsmanager"
-		authUrl := SingeltonInstance.LamassuGatewayURL
-		authUrl.Host = "auth." + authUrl.Host
-		dmsCli, err := dmsManagerClient.NewLamassuDMSManagerClientConfig(client.BaseClientConfigurationuration{
-			URL:        &dmsUrl,
-			AuthMethod: client.AuthMethodJWT,
-			AuthMethodConfig: &client.JWTConfig{
-				Username:      cfg.OperatorUsername,
-				Password:      cfg.OperatorPassword,
-				URL:           &authUrl,
-				CACertificate: "",
-				Insecure:      true,
-			},
-			Insecure: true,
-		})
 
+		dms, key, err := SingeltonInstance.Lamassu.CreateDMS(context.Background(), cfg.DMSName)
 		if err != nil {
-			sendWebSocketMessage(
-				WebSocketMessage{
-					Type:      "ERROR",
-					Message:   "Error creating DMS Client: " + err.Error(),
-					Timestamp: time.Now(),
-				},
-			)
-			return
+			return nil, lamassuError("Error creating DMS Instance", err)
 		}
 
-		dms, err := dmsCli.CreateDMS(context.Background(), &dmsApi.CreateDMSInput{
-			Subject: dmsApi.Subject{
-				CommonName:       cfg.DMSName,
-				Organization:     "Lamassu",
-				OrganizationUnit: "IT",
-				Country:          "ES",
-			},
-			KeyMetadata: dmsApi.KeyMetadata{
-				KeyType: dmsApi.RSA,
-				KeyBits: 4096,
-			},
+		updateDMS(func(current *DMSState) {
+			*current = DMSState{
+				Status:      DMSStatusAwaitingAuth,
+				Name:        cfg.DMSName,
+				Certificate: dms.Certificate,
+				PrivateKey:  key,
+			}
 		})
-
+		err = scheduleDMSStatusCheck()
 		if err != nil {
-			sendWebSocketMessage(
-				WebSocketMessage{
-					Type:      "ERROR",
-					Message:   "Error creating DMS Instance: " + err.Error(),
-					Timestamp: time.Now(),
-				},
-			)
-			return
+			return nil, newProtocolError(ProtocolErrorInternal, "Error creating DMS Instance", err)
+		}
+
+		sendDMSUpdate()
+
+	case "CFG_SELECTED_CA_FOR_ENROLLMENT":
+		var cfgSelectedCAForEnrollment CfgSelectedCAForEnrollment
+		if err := decodeCommand(inMessage.Message, &cfgSelectedCAForEnrollment); err != nil {
+			return nil, err
+		}
+
+		updateDMS(func(current *DMSState) {
+			current.SelectedCAForEnrollment = cfgSelectedCAForEnrollment.SelectedCA
+		})
+		sendDMSUpdate()
+
+	case "CFG_AUTO_ENROLLMENT":
+		var cfgAutoEnrollment CfgAutoEnrollment
+		if err := decodeCommand(inMessage.Message, &cfgAutoEnrollment); err != nil {
+			return nil, err
+		}
+
+		updateDMS(func(current *DMSState) {
+			current.AutomaticEnrollment = cfgAutoEnrollment.AutoEnroll
+		})
+		sendDMSUpdate()
+
+	case "CFG_AUTO_TRANSFER":
+		var cfgAutoTransfer CfgAutoTransfer
+		if err := decodeCommand(inMessage.Message, &cfgAutoTransfer); err != nil {
+			return nil, err
+		}
+
+		updateDMS(func(current *DMSState) {
+			current.AutomaticCertificateTransfer = cfgAutoTransfer.AutoTransfer
+		})
+		sendDMSUpdate()
+
+	case "CFG_AUTO_REENROLLMENT":
+		var cfgAutoReenrollment CfgAutoReenrollment
+		if err := decodeCommand(inMessage.Message, &cfgAutoReenrollment); err != nil {
+			return nil, err
+		}
+
+		updateDMS(func(current *DMSState) {
+			current.AutomaticReenrollment = cfgAutoReenrollment.AutoReenroll
+		})
+		sendDMSUpdate()
+
+	case "CFG_REPEAT_ENROLLMENT":
+		var cfgRepeatEnrollment CfgRepeatEnrollment
+		if err := decodeCommand(inMessage.Message, &cfgRepeatEnrollment); err != nil {
+			return nil, err
 		}
 
-		keyPEMString, err := base64.StdEncoding.DecodeString(dms.PrivateKey.(string))
+		policy, err := parseRepeatEnrollmentPolicy(cfgRepeatEnrollment.Policy)
 		if err != nil {
-			sendWebSocketMessage(
-				WebSocketMessage{
-					Type:      "ERROR",
-					Message:   "Error decoding private key: " + err.Error(),
-					Timestamp: time.Now(),
-				},
-			)
-			return
+			return nil, invalidField("policy", err)
 		}
 
-		keyBlock, _ := pem.Decode(keyPEMString)
+		updateDMS(func(current *DMSState) {
+			current.RepeatEnrollmentPolicy = policy
+			current.MaxActiveCertificatesPerSlot = cfgRepeatEnrollment.MaxActiveCertificatesPerSlot
+			current.RevokeSupersededCertificates = cfgRepeatEnrollment.RevokeSuperseded
+		})
+		sendDMSUpdate()
 
-		key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	case "AUTH_ENROLL":
+		err := approveEnrollmentInProcess(inMessage.Message, func(enrollment *EnrollmentInProcess) {
+			enrollment.ApprovedBy = principal.Username
+			enrollment.AuthorizedEnrollment = true
+		})
 		if err != nil {
-			sendWebSocketMessage(
-				WebSocketMessage{
-					Type:      "ERROR",
-					Message:   "Error parsing private key: " + err.Error(),
-					Timestamp: time.Now(),
-				},
-			)
-			return
+			return nil, err
 		}
 
-		SingeltonInstance.DMS = DMSState{
-			Status:     DMSStatusAwaitingAuth,
-			Name:       cfg.DMSName,
-			PrivateKey: key,
-		}
-		checkID, err := SingeltonInstance.CronInstance.AddFunc("0/5 * * * * *", func() {
-			dms, err := dmsCli.GetDMSByName(context.Background(), &dmsApi.GetDMSByNameInput{
-				Name: SingeltonInstance.DMS.Name,
-			})
-			if err != nil {
-				sendWebSocketMessage(
-					WebSocketMessage{
-						Type:      "ERROR",
-						Message:   "Error checking DMS status: " + err.Error(),
-						Timestamp: time.Now(),
-					},
-				)
-				return
-			}
+	case "AUTH_TRANSFER":
+		err := approveEnrollmentInProcess(inMessage.Message, func(enrollment *EnrollmentInProcess) {
+			enrollment.TransferApprovedBy = principal.Username
+			enrollment.AuthorizedCertificateTransfer = true
+		})
+		if err != nil {
+			return nil, err
+		}
 
-			if dms.Status != dmsApi.DMSStatusApproved {
-				return
+	case "REJECT_ENROLLMENT":
+		// Without a payload the enrollment in process is rejected.
+		var rejectEnrollment RejectEnrollment
+		if len(inMessage.Message) > 0 {
+			if err := decodeCommand(inMessage.Message, &rejectEnrollment); err != nil {
+				return nil, err
 			}
+		}
 
-			SingeltonInstance.DMS.AuthorizedCAs = dms.AuthorizedCAs
-			if len(dms.AuthorizedCAs) > 0 && SingeltonInstance.DMS.SelectedCAForEnrollment == "" {
-				SingeltonInstance.DMS.SelectedCAForEnrollment = dms.AuthorizedCAs[0]
-			}
-			SingeltonInstance.DMS.Status = DMSStatusIdle
-			SingeltonInstance.DMS.Certificate = dms.X509Asset.Certificate
-
-			sendWebSocketMessage(
-				WebSocketMessage{
-					Type:      "DMS_UPDATE",
-					Message:   SingeltonInstance.DMS.Serialize(),
-					Timestamp: time.Now(),
-				},
-			)
+		return nil, rejectPendingEnrollment(principal, rejectEnrollment.ID, rejectEnrollment.Reason)
 
-			// SingeltonInstance.CronInstance.Remove(SingeltonInstance.PeriodicDMSCheckCronID)
-		})
+	case "GET_ENROLLMENT_BACKLOG":
+		sendEnrollmentBacklogUpdate()
+
+	case "AUTH_QUEUED_TRANSFER":
+		var authQueuedTransfer AuthQueuedTransfer
+		if err := decodeCommand(inMessage.Message, &authQueuedTransfer); err != nil {
+			return nil, err
+		}
+
+		err := SingeltonInstance.EnrollmentBacklog.AuthorizeTransfer(authQueuedTransfer.ID, principal.Username)
 		if err != nil {
-			sendWebSocketMessage(
-				WebSocketMessage{
-					Type:      "ERROR",
-					Message:   "Error creating DMS Instance: " + err.Error(),
-					Timestamp: time.Now(),
-				},
-			)
-			return
+			return nil, newProtocolError(ProtocolErrorRejected, "Error authorizing certificate transfer", err)
 		}
-		SingeltonInstance.PeriodicDMSCheckCronID = checkID
 
-		sendWebSocketMessage(
-			WebSocketMessage{
-				Type:      "DMS_UPDATE",
-				Message:   SingeltonInstance.DMS.Serialize(),
-				Timestamp: time.Now(),
-			},
-		)
+	case "GET_DEVICE_MANIFEST":
+		sendDeviceManifestUpdate()
 
-	case "CFG_SELECTED_CA_FOR_ENROLLMENT":
-		bytesIn, err := json.Marshal(inMessage.Message)
+	case "IMPORT_DEVICE_MANIFEST":
+		var cfgImportDeviceManifest CfgImportDeviceManifest
+		if err := decodeCommand(inMessage.Message, &cfgImportDeviceManifest); err != nil {
+			return nil, err
+		}
+
+		imported, err := SingeltonInstance.DeviceManifest.Import(cfgImportDeviceManifest.Format, []byte(cfgImportDeviceManifest.Content), cfgImportDeviceManifest.Replace)
 		if err != nil {
-			sendWebSocketMessage(
-				WebSocketMessage{
-					Type:      "ERROR",
-					Message:   "Error parsing command 1",
-					Timestamp: time.Now(),
-				},
-			)
-			return
+			return nil, newProtocolError(ProtocolErrorRejected, "Error importing device manifest", err)
 		}
+		return ManifestImportResult{Imported: imported}, nil
 
-		var cfgSelectedCAForEnrollment CfgSelectedCAForEnrollment
-		json.Unmarshal(bytesIn, &cfgSelectedCAForEnrollment)
+	case "ADD_MANIFEST_DEVICE":
+		var manifestDevice ManifestDevice
+		if err := decodeCommand(inMessage.Message, &manifestDevice); err != nil {
+			return nil, err
+		}
 
-		if len(cfgSelectedCAForEnrollment.SelectedCA) > 0 {
-			SingeltonInstance.DMS.SelectedCAForEnrollment = cfgSelectedCAForEnrollment.SelectedCA
-		} else {
-			return
+		err := SingeltonInstance.DeviceManifest.AddDevice(manifestDevice)
+		if err != nil {
+			return nil, newProtocolError(ProtocolErrorRejected, "Error registering device", err)
 		}
 
-		sendWebSocketMessage(
-			WebSocketMessage{
-				Type:      "DMS_UPDATE",
-				Message:   SingeltonInstance.DMS.Serialize(),
-				Timestamp: time.Now(),
-			},
-		)
+	case "REMOVE_MANIFEST_DEVICE", "RESET_MANIFEST_DEVICE":
+		var cfgManifestDevice CfgManifestDevice
+		if err := decodeCommand(inMessage.Message, &cfgManifestDevice); err != nil {
+			return nil, err
+		}
 
-	case "CFG_AUTO_ENROLLMENT":
-		bytesIn, err := json.Marshal(inMessage.Message)
+		var err error
+		if inMessage.Type == "REMOVE_MANIFEST_DEVICE" {
+			err = SingeltonInstance.DeviceManifest.RemoveDevice(cfgManifestDevice.SerialNumber)
+		} else {
+			err = SingeltonInstance.DeviceManifest.ResetDevice(cfgManifestDevice.SerialNumber)
+		}
 		if err != nil {
-			sendWebSocketMessage(
-				WebSocketMessage{
-					Type:      "ERROR",
-					Message:   "Error parsing command 1",
-					Timestamp: time.Now(),
-				},
-			)
-			return
+			return nil, newProtocolError(ProtocolErrorRejected, "Error updating device manifest", err)
 		}
 
-		var cfgAutoEnrollment CfgAutoEnrollment
-		json.Unmarshal(bytesIn, &cfgAutoEnrollment)
+	case "CFG_ENFORCE_MANIFEST":
+		var cfgEnforceManifest CfgEnforceManifest
+		if err := decodeCommand(inMessage.Message, &cfgEnforceManifest); err != nil {
+			return nil, err
+		}
+
+		SingeltonInstance.DeviceManifest.SetEnforced(cfgEnforceManifest.Enforce)
 
-		SingeltonInstance.DMS.AutomaticEnrollment = cfgAutoEnrollment.AutoEnroll
-		fmt.Println(SingeltonInstance.DMS.AutomaticEnrollment)
-		fmt.Println(SingeltonInstance.DMS.AutomaticCertificateTransfer)
+	case "GET_ENROLLMENT_TOKENS":
+		sendEnrollmentTokensUpdate()
+
+	case "ISSUE_ENROLLMENT_TOKEN":
+		var cfgIssueEnrollmentToken CfgIssueEnrollmentToken
+		if err := decodeCommand(inMessage.Message, &cfgIssueEnrollmentToken); err != nil {
+			return nil, err
+		}
+
+		issued, err := SingeltonInstance.EnrollmentCredentials.IssueToken(cfgIssueEnrollmentToken.SerialNumber, time.Duration(cfgIssueEnrollmentToken.TTLSeconds)*time.Second)
+		if err != nil {
+			return nil, newProtocolError(ProtocolErrorRejected, "Error issuing enrollment token", err)
+		}
 
 		sendWebSocketMessage(
 			WebSocketMessage{
-				Type:      "DMS_UPDATE",
-				Message:   SingeltonInstance.DMS.Serialize(),
+				Type:      "ENROLLMENT_TOKEN_ISSUED",
+				ID:        inMessage.ID,
+				Message:   issued,
 				Timestamp: time.Now(),
 			},
 		)
+		return issued, nil
 
-	case "CFG_AUTO_TRANSFER":
-		bytesIn, err := json.Marshal(inMessage.Message)
+	case "REVOKE_ENROLLMENT_TOKEN":
+		var cfgRevokeEnrollmentToken CfgRevokeEnrollmentToken
+		if err := decodeCommand(inMessage.Message, &cfgRevokeEnrollmentToken); err != nil {
+			return nil, err
+		}
+
+		err := SingeltonInstance.EnrollmentCredentials.Revoke(cfgRevokeEnrollmentToken.ID)
 		if err != nil {
-			sendWebSocketMessage(
-				WebSocketMessage{
-					Type:      "ERROR",
-					Message:   "Error parsing command 1",
-					Timestamp: time.Now(),
-				},
-			)
-			return
+			return nil, newProtocolError(ProtocolErrorRejected, "Error revoking enrollment token", err)
 		}
 
-		var cfgAutoTransfer CfgAutoTransfer
-		json.Unmarshal(bytesIn, &cfgAutoTransfer)
+	case "CLAIM_DEVICE":
+		var cfgClaimDevice CfgClaimDevice
+		if err := decodeCommand(inMessage.Message, &cfgClaimDevice); err != nil {
+			return nil, err
+		}
+
+		err := claimDevice(cfgClaimDevice.SerialNumber, cfgClaimDevice.ClaimCode)
+		if err != nil {
+			return nil, newProtocolError(ProtocolErrorRejected, "Error claiming device", err)
+		}
 
-		SingeltonInstance.DMS.AutomaticCertificateTransfer = cfgAutoTransfer.AutoTransfer
-		fmt.Println(SingeltonInstance.DMS.AutomaticEnrollment)
-		fmt.Println(SingeltonInstance.DMS.AutomaticCertificateTransfer)
+	case "GET_WEBHOOKS":
+		sendWebhooksUpdate()
 
-		sendWebSocketMessage(
-			WebSocketMessage{
-				Type:      "DMS_UPDATE",
-				Message:   SingeltonInstance.DMS.Serialize(),
-				Timestamp: time.Now(),
-			},
-		)
+	case "ADD_WEBHOOK":
+		var cfgAddWebhook CfgAddWebhook
+		if err := decodeCommand(inMessage.Message, &cfgAddWebhook); err != nil {
+			return nil, err
+		}
 
-	case "AUTH_ENROLL":
-		if SingeltonInstance.EnrollmentInProcess != nil {
-			SingeltonInstance.EnrollmentInProcess.AuthorizedEnrollment = true
+		subscription, err := SingeltonInstance.Webhooks.AddSubscription(WebhookSubscription{
+			URL:    cfgAddWebhook.URL,
+			Secret: cfgAddWebhook.Secret,
+			Events: cfgAddWebhook.Events,
+		})
+		if err != nil {
+			return nil, newProtocolError(ProtocolErrorRejected, "Error adding webhook", err)
 		}
+		return subscription.Serialize(), nil
 
-	case "AUTH_TRANSFER":
-		if SingeltonInstance.EnrollmentInProcess != nil {
-			SingeltonInstance.EnrollmentInProcess.AuthorizedCertificateTransfer = true
+	case "REMOVE_WEBHOOK":
+		var cfgRemoveWebhook CfgRemoveWebhook
+		if err := decodeCommand(inMessage.Message, &cfgRemoveWebhook); err != nil {
+			return nil, err
 		}
+
+		err := SingeltonInstance.Webhooks.RemoveSubscription(cfgRemoveWebhook.ID)
+		if err != nil {
+			return nil, newProtocolError(ProtocolErrorRejected, "Error removing webhook", err)
+		}
+
+	case "ADMIN_LOGIN":
+		return nil, adminLogin(inMessage.Message)
+
+	case "ADMIN_LIST_DMSS":
+		return nil, sendDMSList()
+
+	case "ADMIN_ADOPT_DMS":
+		return nil, adoptDMS(inMessage.Message)
+
+	case "ADMIN_UPDATE_DMS_STATUS":
+		return nil, updateDMSStatus(inMessage.Message)
+
+	case "ADMIN_UPDATE_DMS_AUTHORIZED_CAS":
+		return nil, updateDMSAuthorizedCAs(inMessage.Message)
+
+	default:
+		return nil, newProtocolError(ProtocolErrorUnknownCommand, "Unknown command "+inMessage.Type, nil)
 	}
+
+	return nil, nil
 }
 
+func sendDMSUpdate() {
+	dms := currentDMS()
+	sendWebSocketMessage(
+		WebSocketMessage{
+			Type:      "DMS_UPDATE",
+			Message:   dms.Serialize(),
+			Timestamp: time.Now(),
+		},
+	)
+}
+
+// webSocketWriteLock serializes writes to the console connection, messages are
+// sent from the HTTP handlers, the cron jobs and the webhook deliveries. It
+// also guards the connection itself. It is never taken before stateLock.
+var webSocketWriteLock sync.Mutex
+
 func sendWebSocketMessage(message WebSocketMessage) {
 	outBytes, err := json.Marshal(&message)
 	if err != nil {
@@ -512,6 +908,9 @@ func sendWebSocketMessage(message WebSocketMessage) {
 
 	color.Cyan("<< Sending messgae: " + string(outBytes))
 
+	webSocketWriteLock.Lock()
+	defer webSocketWriteLock.Unlock()
+
 	if SingeltonInstance.ActiveWebSocketConnection == nil {
 		return
 	}
@@ -530,27 +929,26 @@ func enrollRoute(w http.ResponseWriter, r *http.Request) {
 		// 		http.StatusBadRequest)
 		// }
 
-		SingeltonInstance.DMS.Status = DMSStatusEnrolling
-
-		SingeltonInstance.EnrollmentInProcess = &EnrollmentInProcess{
+		dms := currentDMS()
+		enrollment := &EnrollmentInProcess{
+			ID:                            newRandomID(),
 			AuthorizedEnrollment:          false,
 			AuthorizedCertificateTransfer: false,
-			IssuingCA:                     SingeltonInstance.DMS.SelectedCAForEnrollment,
+			IssuingCA:                     dms.SelectedCAForEnrollment,
 		}
 
-		if SingeltonInstance.DMS.AutomaticCertificateTransfer {
-			SingeltonInstance.EnrollmentInProcess.AuthorizedCertificateTransfer = true
+		if dms.AutomaticCertificateTransfer {
+			enrollment.AuthorizedCertificateTransfer = true
 		}
 
-		if SingeltonInstance.DMS.AutomaticEnrollment {
-			SingeltonInstance.EnrollmentInProcess.AuthorizedEnrollment = true
+		if dms.AutomaticEnrollment {
+			enrollment.AuthorizedEnrollment = true
 		}
 
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			SingeltonInstance.DMS.Status = DMSStatusIdle
-			http.Error(w, "Error reading request body",
-				http.StatusInternalServerError)
+			enrollmentFailed(w, enrollment, "Error reading request body", http.StatusInternalServerError)
+			return
 		}
 
 		type EnrollMessage struct {
@@ -563,181 +961,373 @@ func enrollRoute(w http.ResponseWriter, r *http.Request) {
 		var enrollMsg EnrollMessage
 		err = json.Unmarshal(body, &enrollMsg)
 		if err != nil {
-			SingeltonInstance.DMS.Status = DMSStatusIdle
-			http.Error(w, "Error parsing request body",
-				http.StatusInternalServerError)
+			enrollmentFailed(w, enrollment, "Error parsing request body", http.StatusInternalServerError)
+			return
 		}
 
-		SingeltonInstance.EnrollmentInProcess.DeviceID = enrollMsg.SerialNumber
-		SingeltonInstance.EnrollmentInProcess.DeviceModel = enrollMsg.Model
-		SingeltonInstance.EnrollmentInProcess.DeviceSlot = enrollMsg.Slot
-		SingeltonInstance.EnrollmentInProcess.RequestingDate = time.Now()
+		enrollment.DeviceID = enrollMsg.SerialNumber
+		enrollment.DeviceModel = enrollMsg.Model
+		enrollment.DeviceSlot = enrollMsg.Slot
+		enrollment.RequestingDate = time.Now()
 
-		decodedCsr, err := base64.StdEncoding.DecodeString(enrollMsg.CertificateRequest)
+		csr, err := decodeCertificateRequest(enrollMsg.CertificateRequest)
 		if err != nil {
-			SingeltonInstance.DMS.Status = DMSStatusIdle
-			http.Error(w, "Error decoding csr body",
-				http.StatusInternalServerError)
+			enrollmentFailed(w, enrollment, "Error inflating csr body", http.StatusInternalServerError)
+			return
 		}
 
-		parsedCsrPem, _ := pem.Decode(decodedCsr)
-		csr, err := x509.ParseCertificateRequest(parsedCsrPem.Bytes)
+		enrollment.CertificateSigningRequest = csr
+
+		err = SingeltonInstance.DeviceManifest.Claim(enrollMsg.SerialNumber, enrollMsg.Model, enrollMsg.Slot, csr.PublicKey)
 		if err != nil {
-			SingeltonInstance.DMS.Status = DMSStatusIdle
-			http.Error(w, "Error inflating csr body",
-				http.StatusInternalServerError)
+			enrollmentFailed(w, enrollment, "Error enrolling device: "+err.Error(), http.StatusForbidden)
+			return
 		}
+		enrollment.ManifestClaimed = true
 
-		SingeltonInstance.EnrollmentInProcess.CertificateSigningRequest = csr
-		SingeltonInstance.EnrollmentInProcess.Status = EnrollingStatusStep1
-		sendWebSocketMessage(
-			WebSocketMessage{
-				Type:      "ENROLLING_PROCESS_UPDATE",
-				Message:   SingeltonInstance.EnrollmentInProcess.Serialize(),
-				Timestamp: time.Now(),
-			},
-		)
+		err = authorizeWithEnrollmentSecret(r, enrollment)
+		if err != nil {
+			enrollmentFailed(w, enrollment, "Error enrolling device: "+err.Error(), http.StatusForbidden)
+			return
+		}
 
-		for {
-			if SingeltonInstance.EnrollmentInProcess.AuthorizedEnrollment {
-				break
-			}
-			time.Sleep(1 * time.Second)
+		err = applyRepeatEnrollmentPolicy(enrollment)
+		if err != nil {
+			enrollmentFailed(w, enrollment, "Error enrolling device: "+err.Error(), http.StatusConflict)
+			return
 		}
 
-		devManagerUrl := SingeltonInstance.LamassuGatewayURL
-		devManagerUrl.Path = "api/devmanager"
+		startEnrollment(enrollment)
+		processEnrollment(r.Context(), w, enrollment)
+	} else {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+
+}
 
-		client, err := estClient.NewESTClient(
-			nil,
-			&devManagerUrl,
-			SingeltonInstance.DMS.Certificate,
-			SingeltonInstance.DMS.PrivateKey,
-			nil,
-			true,
-		)
-		if err != nil {
-			SingeltonInstance.DMS.Status = DMSStatusIdle
-			http.Error(w, "Error creating EST client",
-				http.StatusInternalServerError)
+// processEnrollment drives an enrollment, or a re-enrollment, through the
+// approval steps shown in the console and answers the device once the
+// certificate transfer is authorized. The approvals are no longer waited for
+// once the context is done.
+func processEnrollment(ctx context.Context, w http.ResponseWriter, enrollment *EnrollmentInProcess) {
+	updateEnrollment(enrollment, func(enrollment *EnrollmentInProcess) {
+		enrollment.Status = EnrollingStatusStep1
+	})
+	sendEnrollmentUpdate(enrollment)
+
+	dispatchWebhookEvent(WebhookEventEnrollmentRequested, enrollment, "")
+	if snapshot := enrollmentSnapshot(enrollment); !snapshot.AuthorizedEnrollment {
+		dispatchWebhookEvent(WebhookEventAwaitingApproval, enrollment, "")
+	}
+
+	for {
+		snapshot := enrollmentSnapshot(enrollment)
+		if snapshot.AuthorizedEnrollment {
+			break
+		}
+		if snapshot.Rejected {
+			enrollmentFailed(w, enrollment, "Error enrolling device: "+snapshot.rejectionMessage(), http.StatusForbidden)
+			return
+		}
+		if !snapshot.ClaimExpiresAt.IsZero() && time.Now().After(snapshot.ClaimExpiresAt) {
+			enrollmentFailed(w, enrollment, "Error enrolling device: the device was not claimed before its claim code expired", http.StatusForbidden)
+			return
+		}
+		if !waitForApproval(ctx, w, enrollment) {
+			return
 		}
+	}
 
-		ctx := context.Background()
-		// ctx = context.WithValue(ctx, estClient.WithXForwardedClientCertHeader, SingeltonInstance.DMS.Certificate)
-		crt, err := client.Enroll(ctx, SingeltonInstance.EnrollmentInProcess.IssuingCA, SingeltonInstance.EnrollmentInProcess.CertificateSigningRequest)
-		if err != nil {
-			SingeltonInstance.DMS.Status = DMSStatusIdle
-			http.Error(w, "Error enrolling device",
-				http.StatusInternalServerError)
+	var crt *x509.Certificate
+	var err error
+	if enrollment.Reenrollment {
+		crt, err = SingeltonInstance.Lamassu.Reenroll(context.Background(), dmsIdentity(), enrollment.DeviceCertificate, enrollment.CertificateSigningRequest)
+	} else {
+		crt, err = SingeltonInstance.Lamassu.Enroll(context.Background(), dmsIdentity(), enrollment.IssuingCA, enrollment.CertificateSigningRequest)
+	}
+	if err != nil && !enrollment.Reenrollment && isGatewayUnreachable(err) {
+		releaseDMS(enrollment)
+		SingeltonInstance.EnrollmentBacklog.setLinkState(GatewayLinkStateDown)
+		snapshot := enrollmentSnapshot(enrollment)
+		item := SingeltonInstance.EnrollmentBacklog.Enqueue(&snapshot, err)
+		writeEnrollmentAccepted(w, *item)
+		return
+	} else if err != nil {
+		enrollmentFailed(w, enrollment, "Error enrolling device: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	updateEnrollment(enrollment, func(enrollment *EnrollmentInProcess) {
+		enrollment.Status = EnrollingStatusStep2
+	})
+	sendEnrollmentUpdate(enrollment)
+
+	time.Sleep(time.Second * 2)
+	updateEnrollment(enrollment, func(enrollment *EnrollmentInProcess) {
+		enrollment.Certificate = crt
+		enrollment.SerialNumber = formatSerialNumber(crt.SerialNumber)
+		enrollment.ExpirationDate = crt.NotAfter
+		enrollment.Status = EnrollingStatusStep3
+	})
+	sendEnrollmentUpdate(enrollment)
+
+	dispatchWebhookEvent(WebhookEventCertificateIssued, enrollment, "")
+	if snapshot := enrollmentSnapshot(enrollment); !snapshot.AuthorizedCertificateTransfer {
+		dispatchWebhookEvent(WebhookEventAwaitingApproval, enrollment, "")
+	}
+
+	for {
+		snapshot := enrollmentSnapshot(enrollment)
+		if snapshot.AuthorizedCertificateTransfer {
+			break
+		}
+		if snapshot.Rejected {
+			// The certificate is already issued by Lamassu, it is just never
+			// handed to the device.
+			enrollmentFailed(w, enrollment, "Error enrolling device: "+snapshot.rejectionMessage(), http.StatusForbidden)
+			return
+		}
+		if !waitForApproval(ctx, w, enrollment) {
 			return
 		}
+	}
 
-		SingeltonInstance.EnrollmentInProcess.Status = EnrollingStatusStep2
+	updateEnrollment(enrollment, func(enrollment *EnrollmentInProcess) {
+		enrollment.Status = EnrollingStatusStep4
+	})
+	sendEnrollmentUpdate(enrollment)
 
-		sendWebSocketMessage(
-			WebSocketMessage{
-				Type:      "ENROLLING_PROCESS_UPDATE",
-				Message:   SingeltonInstance.EnrollmentInProcess.Serialize(),
-				Timestamp: time.Now(),
-			},
-		)
+	if enrollment.Reenrollment {
+		renewEnrolledIdentity(enrollment)
+	} else {
+		recordEnrolledIdentity(enrollment)
+	}
+	releaseDMS(enrollment)
+	writeEnrollResponse(w, crt)
+}
 
-		time.Sleep(time.Second * 2)
-		SingeltonInstance.EnrollmentInProcess.Certificate = crt
-		SingeltonInstance.EnrollmentInProcess.SerialNumber = utils.InsertNth(utils.ToHexInt(crt.SerialNumber), 2)
-		SingeltonInstance.EnrollmentInProcess.ExpirationDate = crt.NotAfter
-		SingeltonInstance.EnrollmentInProcess.Status = EnrollingStatusStep3
-		sendWebSocketMessage(
-			WebSocketMessage{
-				Type:      "ENROLLING_PROCESS_UPDATE",
-				Message:   SingeltonInstance.EnrollmentInProcess.Serialize(),
-				Timestamp: time.Now(),
-			},
-		)
+func sendEnrollmentUpdate(enrollment *EnrollmentInProcess) {
+	snapshot := enrollmentSnapshot(enrollment)
+	sendWebSocketMessage(
+		WebSocketMessage{
+			Type:      "ENROLLING_PROCESS_UPDATE",
+			Message:   snapshot.Serialize(),
+			Timestamp: time.Now(),
+		},
+	)
+}
 
-		for {
-			if SingeltonInstance.EnrollmentInProcess.AuthorizedCertificateTransfer {
-				break
-			}
-			time.Sleep(1 * time.Second)
-		}
+// waitForApproval waits before the next approval check. It fails the
+// enrollment and returns false when the device went away or the vDMS is
+// shutting down.
+func waitForApproval(ctx context.Context, w http.ResponseWriter, enrollment *EnrollmentInProcess) bool {
+	select {
+	case <-time.After(1 * time.Second):
+		return true
+	case <-ctx.Done():
+		w.Header().Set("Retry-After", "5")
+		enrollmentFailed(w, enrollment, "Error enrolling device: the DMS stopped waiting for the approval", http.StatusServiceUnavailable)
+		return false
+	}
+}
 
-		SingeltonInstance.EnrollmentInProcess.Status = EnrollingStatusStep4
-		sendWebSocketMessage(
-			WebSocketMessage{
-				Type:      "ENROLLING_PROCESS_UPDATE",
-				Message:   SingeltonInstance.EnrollmentInProcess.Serialize(),
-				Timestamp: time.Now(),
-			},
-		)
+func decodeCertificateRequest(b64Pem string) (*x509.CertificateRequest, error) {
+	decodedCsr, err := base64.StdEncoding.DecodeString(b64Pem)
+	if err != nil {
+		return nil, err
+	}
 
-		SingeltonInstance.EnrolledIdentities = append(SingeltonInstance.EnrolledIdentities, EnrolledIdentity{
-			EnrolledTimestamp: SingeltonInstance.EnrollmentInProcess.RequestingDate,
-			SerialNumber:      SingeltonInstance.EnrollmentInProcess.SerialNumber,
-			DeviceID:          SingeltonInstance.EnrollmentInProcess.DeviceID,
-			DeviceSlot:        SingeltonInstance.EnrollmentInProcess.DeviceSlot,
-			IssuingCA:         SingeltonInstance.EnrollmentInProcess.IssuingCA,
-			IssuingDuration:   SingeltonInstance.EnrollmentInProcess.Certificate.NotAfter.Sub(SingeltonInstance.EnrollmentInProcess.Certificate.NotBefore),
-		})
+	parsedCsrPem, _ := pem.Decode(decodedCsr)
+	if parsedCsrPem == nil {
+		return nil, errors.New("invalid PEM block")
+	}
+
+	return x509.ParseCertificateRequest(parsedCsrPem.Bytes)
+}
+
+// scheduleDMSStatusCheck polls Lamassu until the DMS is approved, replacing
+// the check of a previously configured DMS.
+func scheduleDMSStatusCheck() error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	if SingeltonInstance.PeriodicDMSCheckCronID != 0 {
+		SingeltonInstance.CronInstance.Remove(SingeltonInstance.PeriodicDMSCheckCronID)
+	}
 
-		serializedEnrolledIdentites := make([]EnrolledIdentitySerialized, 0)
-		for _, v := range SingeltonInstance.EnrolledIdentities {
-			serialized := v.Serialize()
-			serializedEnrolledIdentites = append(serializedEnrolledIdentites, serialized)
+	checkID, err := SingeltonInstance.CronInstance.AddFunc("0/5 * * * * *", func() {
+		name := currentDMS().Name
+		dms, err := SingeltonInstance.Lamassu.GetDMS(context.Background(), name)
+		if err != nil {
+			sendProtocolError("", lamassuError("Error checking DMS status", err))
+			return
 		}
 
-		sendWebSocketMessage(
-			WebSocketMessage{
-				Type:      "ENROLLED_IDENTITES_UPDATE",
-				Message:   serializedEnrolledIdentites,
-				Timestamp: time.Now(),
-			},
-		)
-		type EnrollMessageOut struct {
-			IssuingCA   string `json:"issuing_ca"`
-			Certificate string `json:"certificate"`
+		if dms.Status != LamassuDMSStatusApproved {
+			return
 		}
 
-		pem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})
-		encodedCert := base64.StdEncoding.EncodeToString(pem)
+		updateDMS(func(current *DMSState) {
+			// Another DMS may have been configured while Lamassu answered.
+			if current.Name != name {
+				return
+			}
 
-		enrollMessageOutBytes, _ := json.Marshal(EnrollMessageOut{
-			IssuingCA:   crt.Issuer.CommonName,
-			Certificate: encodedCert,
+			current.AuthorizedCAs = dms.AuthorizedCAs
+			if len(dms.AuthorizedCAs) > 0 && current.SelectedCAForEnrollment == "" {
+				current.SelectedCAForEnrollment = dms.AuthorizedCAs[0]
+			}
+			current.Status = DMSStatusIdle
+			// Lamassu only returns a certificate for the DMSs it issued one to,
+			// otherwise the certificate the DMS was created or adopted with is kept.
+			if dms.Certificate != nil {
+				current.Certificate = dms.Certificate
+			}
 		})
 
-		w.Write(enrollMessageOutBytes)
-	} else {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		sendDMSUpdate()
+
+		// SingeltonInstance.CronInstance.Remove(SingeltonInstance.PeriodicDMSCheckCronID)
+	})
+	if err != nil {
+		return err
 	}
 
+	SingeltonInstance.PeriodicDMSCheckCronID = checkID
+	return nil
+}
+
+// recordEnrolledIdentity adds a completed enrollment to the ledger and pushes
+// the updated ledger to the console.
+func recordEnrolledIdentity(enrollment *EnrollmentInProcess) {
+	snapshot := enrollmentSnapshot(enrollment)
+	receipt := issueEnrollmentReceipt(&snapshot)
+
+	stateLock.Lock()
+	SingeltonInstance.EnrolledIdentities = append(SingeltonInstance.EnrolledIdentities, EnrolledIdentity{
+		EnrolledTimestamp:  snapshot.RequestingDate,
+		SerialNumber:       snapshot.SerialNumber,
+		DeviceID:           snapshot.DeviceID,
+		DeviceSlot:         snapshot.DeviceSlot,
+		IssuingCA:          snapshot.IssuingCA,
+		IssuingDuration:    snapshot.Certificate.NotAfter.Sub(snapshot.Certificate.NotBefore),
+		Status:             EnrolledIdentityStatusActive,
+		ExpirationDate:     snapshot.Certificate.NotAfter,
+		Supersedes:         snapshot.SupersedesSerialNumbers,
+		ApprovedBy:         snapshot.ApprovedBy,
+		TransferApprovedBy: snapshot.TransferApprovedBy,
+		Receipt:            receipt,
+	})
+	stateLock.Unlock()
+
+	supersedeEnrolledIdentities(&snapshot)
+	SingeltonInstance.DeviceManifest.MarkEnrolled(snapshot.DeviceID, snapshot.DeviceSlot, snapshot.SerialNumber)
+
+	sendEnrolledIdentitiesUpdate()
+}
+
+func serializeEnrolledIdentities() []EnrolledIdentitySerialized {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	serializedEnrolledIdentites := make([]EnrolledIdentitySerialized, 0)
+	for _, v := range SingeltonInstance.EnrolledIdentities {
+		serialized := v.Serialize()
+		serialized.ActiveCertificates = len(activeIdentities(v.DeviceID, v.DeviceSlot))
+		serializedEnrolledIdentites = append(serializedEnrolledIdentites, serialized)
+	}
+	return serializedEnrolledIdentites
+}
+
+func sendEnrolledIdentitiesUpdate() {
+	sendWebSocketMessage(
+		WebSocketMessage{
+			Type:      "ENROLLED_IDENTITES_UPDATE",
+			Message:   serializeEnrolledIdentities(),
+			Timestamp: time.Now(),
+		},
+	)
+}
+
+func writeEnrollResponse(w http.ResponseWriter, crt *x509.Certificate) {
+	type EnrollMessageOut struct {
+		IssuingCA   string `json:"issuing_ca"`
+		Certificate string `json:"certificate"`
+		Receipt     string `json:"receipt,omitempty"`
+	}
+
+	pem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})
+	encodedCert := base64.StdEncoding.EncodeToString(pem)
+
+	encodedReceipt := ""
+	if receipt := enrollmentReceipt(formatSerialNumber(crt.SerialNumber)); receipt != nil {
+		encodedReceipt = base64.StdEncoding.EncodeToString(receipt)
+	}
+
+	enrollMessageOutBytes, _ := json.Marshal(EnrollMessageOut{
+		IssuingCA:   crt.Issuer.CommonName,
+		Certificate: encodedCert,
+		Receipt:     encodedReceipt,
+	})
+
+	w.Write(enrollMessageOutBytes)
+}
+
+// enrollmentFailed releases the DMS, notifies webhook subscribers and answers
+// the device with the given error.
+func enrollmentFailed(w http.ResponseWriter, enrollment *EnrollmentInProcess, message string, statusCode int) {
+	releaseDMS(enrollment)
+	if enrollment.ManifestClaimed {
+		SingeltonInstance.DeviceManifest.MarkFailed(enrollment.DeviceID, enrollment.DeviceSlot)
+	}
+	if snapshot := enrollmentSnapshot(enrollment); snapshot.RedeemedCredentialID != "" {
+		SingeltonInstance.EnrollmentCredentials.Restore(snapshot.RedeemedCredentialID)
+	}
+	dispatchWebhookEvent(WebhookEventEnrollmentFailed, enrollment, message)
+	http.Error(w, message, statusCode)
 }
 
 func mainRoute(w http.ResponseWriter, r *http.Request) {
+	principal := SingeltonInstance.Auth.Authenticate(r)
+	if principal == nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Print("upgrade:", err)
 		return
 	}
 	// defer c.Close()
+	webSocketWriteLock.Lock()
 	SingeltonInstance.ActiveWebSocketConnection = c
+	webSocketWriteLock.Unlock()
 
 	for {
 		_, message, err := c.ReadMessage()
 		if err != nil {
 			log.Println("read err:", err)
-			SingeltonInstance.ActiveWebSocketConnection = nil
+			webSocketWriteLock.Lock()
+			if SingeltonInstance.ActiveWebSocketConnection == c {
+				SingeltonInstance.ActiveWebSocketConnection = nil
+			}
+			webSocketWriteLock.Unlock()
 			break
 		}
 
-		var inMessage WebSocketMessage
+		var inMessage IncomingWebSocketMessage
 		color.HiGreen(">> Incoming message: " + string(message))
 		err = json.Unmarshal(message, &inMessage)
-		if err == nil {
-			messageHandler(inMessage, c)
+		if err != nil {
+			sendProtocolError("", newProtocolError(ProtocolErrorInvalidMessage, "Error parsing message", err))
 			continue
 		}
-		fmt.Println("err parsing message:", err)
+		if inMessage.Type == "" {
+			sendProtocolError(inMessage.ID, missingField("type"))
+			continue
+		}
+		messageHandler(principal, inMessage)
 	}
 }
 
@@ -777,8 +1367,45 @@ func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		os.Exit(runHashPassword(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify-receipt" {
+		os.Exit(runVerifyReceipt(os.Args[2:]))
+	}
+
 	type Config struct {
-		LamassuGateway string `required:"true" split_words:"true"`
+		LamassuGateway            string            `required:"true" split_words:"true"`
+		LamassuAPIVersion         string            `envconfig:"LAMASSU_API_VERSION" default:"v2"`
+		RecordSessionFile         string            `split_words:"true"`
+		WebhooksFile              string            `split_words:"true"`
+		BacklogFile               string            `split_words:"true" default:"enrollment-backlog.json"`
+		BacklogRetention          time.Duration     `split_words:"true" default:"24h"`
+		TLSCertFile               string            `envconfig:"TLS_CERT_FILE"`
+		TLSKeyFile                string            `envconfig:"TLS_KEY_FILE"`
+		DMSIdentityMode           string            `envconfig:"DMS_IDENTITY_MODE" default:"MTLS"`
+		TrustedProxies            []string          `split_words:"true"`
+		ForwardedClientCertHeader string            `split_words:"true"`
+		DeviceManifestFile        string            `split_words:"true"`
+		DeviceManifestStateFile   string            `split_words:"true" default:"device-manifest.json"`
+		EnrollmentTokensFile      string            `split_words:"true" default:"enrollment-tokens.json"`
+		APITokens                 []string          `envconfig:"API_TOKENS"`
+		AuthMode                  string            `split_words:"true"`
+		AuthAllowAnonymous        bool              `split_words:"true"`
+		AuthUsersFile             string            `split_words:"true"`
+		AuthSessionTTL            time.Duration     `envconfig:"AUTH_SESSION_TTL" default:"8h"`
+		AllowedOrigins            []string          `split_words:"true"`
+		OIDCIssuer                string            `envconfig:"OIDC_ISSUER"`
+		OIDCClientID              string            `envconfig:"OIDC_CLIENT_ID"`
+		OIDCClientSecret          string            `envconfig:"OIDC_CLIENT_SECRET"`
+		OIDCRedirectURL           string            `envconfig:"OIDC_REDIRECT_URL"`
+		OIDCRolesClaim            string            `envconfig:"OIDC_ROLES_CLAIM" default:"realm_access.roles"`
+		OIDCRoleMapping           map[string]string `envconfig:"OIDC_ROLE_MAPPING"`
+		OIDCInsecureSkipVerify    bool              `envconfig:"OIDC_INSECURE_SKIP_VERIFY"`
+		ShutdownTimeout           time.Duration     `split_words:"true" default:"30s"`
 	}
 	var config Config
 	err := envconfig.Process("", &config)
@@ -796,26 +1423,203 @@ func main() {
 		os.Exit(1)
 	}
 
+	var recorder *session.Recorder
+	if config.RecordSessionFile != "" {
+		recorder, err = session.NewRecorder(config.RecordSessionFile)
+		if err != nil {
+			fmt.Println("error opening session recording file:", err)
+			os.Exit(1)
+		}
+		defer recorder.Close()
+	}
+
+	lamassuAPIVersion, err := parseLamassuAPIVersion(config.LamassuAPIVersion)
+	if err != nil {
+		fmt.Println("error parsing Lamassu API version:", err)
+		os.Exit(1)
+	}
+
+	lamassu := newLamassuBackend(lamassuAPIVersion, *gatewayUrl)
+	err = lamassu.Probe(context.Background())
+	if errors.Is(err, errLamassuAPIVersionMismatch) {
+		fmt.Println("error probing Lamassu API:", err)
+		os.Exit(1)
+	} else if err != nil {
+		// The gateway may come up later, enrollments are queued meanwhile.
+		log.Println("could not probe the Lamassu API version:", err)
+	}
+	log.Printf("using Lamassu API %s with capabilities %+v\n", lamassu.Version(), lamassu.Capabilities())
+
+	dmsIdentityMode, err := parseDMSIdentityMode(config.DMSIdentityMode)
+	if err != nil {
+		fmt.Println("error parsing DMS identity mode:", err)
+		os.Exit(1)
+	}
+
+	trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		fmt.Println("error parsing trusted proxies:", err)
+		os.Exit(1)
+	}
+
+	forwardedClientCertHeader := config.ForwardedClientCertHeader
+	if forwardedClientCertHeader == "" {
+		forwardedClientCertHeader = defaultForwardedClientCertHeader
+	}
+
+	backlog, err := NewEnrollmentBacklog(config.BacklogFile)
+	if err != nil {
+		fmt.Println("error loading enrollment backlog:", err)
+		os.Exit(1)
+	}
+
+	manifest, err := NewDeviceManifest(config.DeviceManifestStateFile)
+	if err != nil {
+		fmt.Println("error loading device manifest:", err)
+		os.Exit(1)
+	}
+
+	credentials, err := NewEnrollmentCredentialStore(config.EnrollmentTokensFile)
+	if err != nil {
+		fmt.Println("error loading enrollment tokens:", err)
+		os.Exit(1)
+	}
+
+	authenticator, err := auth.NewAuthenticator(auth.Config{
+		Mode:           config.AuthMode,
+		AllowAnonymous: config.AuthAllowAnonymous,
+		UsersFile:      config.AuthUsersFile,
+		SessionTTL:     config.AuthSessionTTL,
+		AllowedOrigins: config.AllowedOrigins,
+		APITokens:      config.APITokens,
+		OIDC: auth.OIDCConfig{
+			Issuer:             config.OIDCIssuer,
+			ClientID:           config.OIDCClientID,
+			ClientSecret:       config.OIDCClientSecret,
+			RedirectURL:        config.OIDCRedirectURL,
+			RolesClaim:         config.OIDCRolesClaim,
+			RoleMapping:        config.OIDCRoleMapping,
+			InsecureSkipVerify: config.OIDCInsecureSkipVerify,
+		},
+		Title:        "Virtual DMS",
+		CookiePrefix: "vdms",
+		ErrorWriter:  writeAuthError,
+	})
+	if err != nil {
+		fmt.Println("error configuring authentication:", err)
+		os.Exit(1)
+	}
+	if authenticator.Mode() == auth.AuthModeNone {
+		log.Println("console authentication disabled, every console user acts as an admin")
+	}
+	upgrader.CheckOrigin = authenticator.CheckOrigin
+
 	SingeltonInstance = &Singelton{
 		ActiveWebSocketConnection: nil,
 		DMS: DMSState{
 			Status: DMSStatusEmpty,
 		},
-		CronInstance:       c,
-		EnrolledIdentities: []EnrolledIdentity{},
-		LamassuGatewayURL:  *gatewayUrl,
+		CronInstance:          c,
+		EnrolledIdentities:    []EnrolledIdentity{},
+		LamassuGatewayURL:     *gatewayUrl,
+		Recorder:              recorder,
+		Lamassu:               newRecordingLamassuBackend(lamassu, recorder),
+		Webhooks:              NewWebhookManager(sendWebhooksUpdate),
+		EnrollmentBacklog:     backlog,
+		DeviceManifest:        manifest,
+		EnrollmentCredentials: credentials,
+
+		DMSIdentityMode:           dmsIdentityMode,
+		TrustedProxies:            trustedProxies,
+		ForwardedClientCertHeader: forwardedClientCertHeader,
+		Auth:                      authenticator,
 	}
 
+	if config.WebhooksFile != "" {
+		err = SingeltonInstance.Webhooks.LoadSubscriptionsFile(config.WebhooksFile)
+		if err != nil {
+			fmt.Println("error loading webhooks file:", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.DeviceManifestFile != "" {
+		// Importing a manifest at startup implies only registered devices
+		// may enroll.
+		_, err = SingeltonInstance.DeviceManifest.ImportFile(config.DeviceManifestFile)
+		if err != nil {
+			fmt.Println("error importing device manifest:", err)
+			os.Exit(1)
+		}
+		SingeltonInstance.DeviceManifest.SetEnforced(true)
+	}
+
+	// Probe right away so readiness does not wait for the first scheduled run.
+	go SingeltonInstance.EnrollmentBacklog.ProbeGateway()
+	_, err = c.AddFunc("0/10 * * * * *", SingeltonInstance.EnrollmentBacklog.ProbeGateway)
+	if err != nil {
+		fmt.Println("error scheduling gateway probe:", err)
+		os.Exit(1)
+	}
+
+	_, err = c.AddFunc("* * * * * *", SingeltonInstance.EnrollmentBacklog.RetryDue)
+	if err != nil {
+		fmt.Println("error scheduling enrollment backlog retries:", err)
+		os.Exit(1)
+	}
+
+	_, err = c.AddFunc("0 * * * * *", func() {
+		SingeltonInstance.EnrollmentBacklog.Prune(config.BacklogRetention)
+	})
+	if err != nil {
+		fmt.Println("error scheduling enrollment backlog pruning:", err)
+		os.Exit(1)
+	}
+
+	lifecycle := NewLifecycle()
+
 	spa := spaHandler{staticPath: "build", indexPath: "index.html"}
 	router := mux.NewRouter()
+	lifecycle.RegisterRoutes(router)
+	router.HandleFunc("/ws-schema.json", webSocketSchemaRoute).Methods("GET")
 	router.PathPrefix("/ws").HandlerFunc(mainRoute)
-	router.PathPrefix("/enroll").HandlerFunc(enrollRoute)
-	router.PathPrefix("/").Handler(spa)
+	router.HandleFunc("/enroll/{id}", recordExchanges(session.RecordKindEnroll, enrollStatusRoute)).Methods("GET")
+	router.PathPrefix("/enroll").HandlerFunc(lifecycle.TrackEnrollment(recordExchanges(session.RecordKindEnroll, enrollRoute)))
+	router.HandleFunc("/reenroll", lifecycle.TrackEnrollment(recordExchanges(session.RecordKindEnroll, reenrollRoute))).Methods("POST")
+	registerAPIRoutes(router.PathPrefix("/api/v1").Subrouter(), authenticator)
+	authenticator.RegisterRoutes(router)
+	router.PathPrefix("/").Handler(authenticator.RequireConsole(spa))
 
 	srv := &http.Server{
 		Handler: router,
 		Addr:    ":7002",
 	}
 
-	log.Fatal(srv.ListenAndServe())
+	go func() {
+		var err error
+		if config.TLSCertFile != "" && config.TLSKeyFile != "" {
+			// Client certificates are requested but not verified by the TLS
+			// stack, devices are authenticated by reenrollRoute against the
+			// enrollment ledger and the issuing CA chain.
+			srv.TLSConfig = &tls.Config{
+				ClientAuth: tls.RequestClientCert,
+			}
+			err = srv.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.Printf("received %s, shutting down within %s\n", sig, config.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	lifecycle.Shutdown(ctx, srv)
+	log.Println("shutdown complete")
 }
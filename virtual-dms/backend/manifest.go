@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type ManifestSlotStatus string
+
+const (
+	ManifestSlotStatusPending   ManifestSlotStatus = "PENDING"
+	ManifestSlotStatusEnrolling ManifestSlotStatus = "ENROLLING"
+	ManifestSlotStatusEnrolled  ManifestSlotStatus = "ENROLLED"
+	ManifestSlotStatusFailed    ManifestSlotStatus = "FAILED"
+)
+
+type ManifestFormat string
+
+const (
+	ManifestFormatCSV  ManifestFormat = "csv"
+	ManifestFormatJSON ManifestFormat = "json"
+)
+
+type ManifestSlotProgress struct {
+	Status       ManifestSlotStatus `json:"status"`
+	SerialNumber string             `json:"serial_number,omitempty"`
+	UpdatedAt    time.Time          `json:"updated_at"`
+}
+
+// ManifestDevice is a pre-registered device. An empty AllowedSlots list only
+// allows the default slot.
+type ManifestDevice struct {
+	SerialNumber         string                           `json:"serial_number"`
+	Model                string                           `json:"model"`
+	AllowedSlots         []string                         `json:"allowed_slots"`
+	PublicKeyFingerprint string                           `json:"public_key_fingerprint,omitempty"`
+	RegisteredAt         time.Time                        `json:"registered_at"`
+	Slots                map[string]*ManifestSlotProgress `json:"slots"`
+	LastRejection        string                           `json:"last_rejection,omitempty"`
+}
+
+func (d *ManifestDevice) allowedSlots() []string {
+	if len(d.AllowedSlots) == 0 {
+		return []string{"default"}
+	}
+	return d.AllowedSlots
+}
+
+func (d *ManifestDevice) allowsSlot(slot string) bool {
+	for _, allowed := range d.allowedSlots() {
+		if allowed == slot {
+			return true
+		}
+	}
+	return false
+}
+
+type DeviceManifestSerialized struct {
+	Enforced bool             `json:"enforced"`
+	Devices  []ManifestDevice `json:"devices"`
+}
+
+// DeviceManifest holds the devices the DMS is allowed to enroll and tracks how
+// far each of their slots has got. Once enforced, enrollment requests from
+// devices that are not registered, or for slots already enrolled, are rejected.
+type DeviceManifest struct {
+	lock     sync.Mutex
+	path     string
+	enforced bool
+	devices  map[string]*ManifestDevice
+}
+
+func NewDeviceManifest(path string) (*DeviceManifest, error) {
+	manifest := &DeviceManifest{
+		path:    path,
+		devices: map[string]*ManifestDevice{},
+	}
+
+	if path == "" {
+		return manifest, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var serialized DeviceManifestSerialized
+	err = json.Unmarshal(content, &serialized)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing device manifest: %v", err)
+	}
+
+	manifest.enforced = serialized.Enforced
+	for i := range serialized.Devices {
+		device := serialized.Devices[i]
+		manifest.devices[device.SerialNumber] = &device
+	}
+
+	return manifest, nil
+}
+
+// persist must be called while holding the lock.
+func (m *DeviceManifest) persist() {
+	if m.path == "" {
+		return
+	}
+
+	content, err := json.MarshalIndent(m.serialize(), "", "  ")
+	if err != nil {
+		log.Println("error serializing device manifest:", err)
+		return
+	}
+
+	tmpPath := m.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, content, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, m.path)
+	}
+	if err != nil {
+		log.Println("error persisting device manifest:", err)
+	}
+}
+
+// ImportFile imports a manifest file, the format is taken from its extension.
+func (m *DeviceManifest) ImportFile(path string) (int, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	format := ManifestFormatJSON
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		format = ManifestFormatCSV
+	}
+
+	return m.Import(format, content, false)
+}
+
+type ManifestImportResult struct {
+	Imported int `json:"imported"`
+}
+
+// Import registers the devices of a CSV or JSON manifest. Devices that were
+// already registered keep their enrollment progress. With replace, devices
+// missing from the manifest are removed.
+func (m *DeviceManifest) Import(format ManifestFormat, content []byte, replace bool) (int, error) {
+	var devices []ManifestDevice
+	var err error
+	switch format {
+	case ManifestFormatCSV:
+		devices, err = parseCSVManifest(bytes.NewReader(content))
+	case ManifestFormatJSON:
+		err = json.Unmarshal(content, &devices)
+	default:
+		err = fmt.Errorf("unknown manifest format %s", format)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, device := range devices {
+		if device.SerialNumber == "" {
+			return 0, fmt.Errorf("manifest entry without serial number")
+		}
+	}
+
+	m.lock.Lock()
+	if replace {
+		imported := map[string]bool{}
+		for _, device := range devices {
+			imported[device.SerialNumber] = true
+		}
+		for serialNumber := range m.devices {
+			if !imported[serialNumber] {
+				delete(m.devices, serialNumber)
+			}
+		}
+	}
+	for _, device := range devices {
+		m.register(device)
+	}
+	m.persist()
+	m.lock.Unlock()
+
+	sendDeviceManifestUpdate()
+	return len(devices), nil
+}
+
+func (m *DeviceManifest) AddDevice(device ManifestDevice) error {
+	if device.SerialNumber == "" {
+		return fmt.Errorf("serial number is required")
+	}
+
+	m.lock.Lock()
+	m.register(device)
+	m.persist()
+	m.lock.Unlock()
+
+	sendDeviceManifestUpdate()
+	return nil
+}
+
+// register must be called while holding the lock.
+func (m *DeviceManifest) register(device ManifestDevice) {
+	device.PublicKeyFingerprint = normalizeFingerprint(device.PublicKeyFingerprint)
+	device.Slots = map[string]*ManifestSlotProgress{}
+	device.RegisteredAt = time.Now()
+
+	if existing, ok := m.devices[device.SerialNumber]; ok {
+		device.RegisteredAt = existing.RegisteredAt
+		device.Slots = existing.Slots
+	}
+
+	for _, slot := range device.allowedSlots() {
+		if _, ok := device.Slots[slot]; !ok {
+			device.Slots[slot] = &ManifestSlotProgress{Status: ManifestSlotStatusPending, UpdatedAt: device.RegisteredAt}
+		}
+	}
+
+	m.devices[device.SerialNumber] = &device
+}
+
+func (m *DeviceManifest) RemoveDevice(serialNumber string) error {
+	m.lock.Lock()
+	if _, ok := m.devices[serialNumber]; !ok {
+		m.lock.Unlock()
+		return fmt.Errorf("device %s is not registered", serialNumber)
+	}
+	delete(m.devices, serialNumber)
+	m.persist()
+	m.lock.Unlock()
+
+	sendDeviceManifestUpdate()
+	return nil
+}
+
+// ResetDevice makes every slot of the device enrollable again, for devices
+// that are re-provisioned at the factory.
+func (m *DeviceManifest) ResetDevice(serialNumber string) error {
+	m.lock.Lock()
+	device, ok := m.devices[serialNumber]
+	if !ok {
+		m.lock.Unlock()
+		return fmt.Errorf("device %s is not registered", serialNumber)
+	}
+	for _, progress := range device.Slots {
+		progress.Status = ManifestSlotStatusPending
+		progress.SerialNumber = ""
+		progress.UpdatedAt = time.Now()
+	}
+	device.LastRejection = ""
+	m.persist()
+	m.lock.Unlock()
+
+	sendDeviceManifestUpdate()
+	return nil
+}
+
+func (m *DeviceManifest) SetEnforced(enforced bool) {
+	m.lock.Lock()
+	m.enforced = enforced
+	m.persist()
+	m.lock.Unlock()
+
+	sendDeviceManifestUpdate()
+}
+
+// Claim checks an enrollment request against the manifest and marks the slot
+// as enrolling. It fails for unknown devices, slots or models, for keys that
+// do not match the registered fingerprint and for slots already consumed.
+func (m *DeviceManifest) Claim(serialNumber, model, slot string, publicKey crypto.PublicKey) error {
+	m.lock.Lock()
+	defer func() {
+		m.persist()
+		m.lock.Unlock()
+		sendDeviceManifestUpdate()
+	}()
+
+	if !m.enforced {
+		if device, ok := m.devices[serialNumber]; ok {
+			m.setSlotStatus(device, slot, ManifestSlotStatusEnrolling, "")
+		}
+		return nil
+	}
+
+	device, ok := m.devices[serialNumber]
+	if !ok {
+		return fmt.Errorf("device %s is not registered", serialNumber)
+	}
+
+	reject := func(err error) error {
+		device.LastRejection = err.Error()
+		return err
+	}
+
+	if device.Model != "" && device.Model != model {
+		return reject(fmt.Errorf("device %s is registered as model %s, not %s", serialNumber, device.Model, model))
+	}
+
+	if !device.allowsSlot(slot) {
+		return reject(fmt.Errorf("slot %s is not allowed for device %s", slot, serialNumber))
+	}
+
+	if device.PublicKeyFingerprint != "" {
+		fingerprint, err := publicKeyFingerprint(publicKey)
+		if err != nil {
+			return reject(err)
+		}
+		if fingerprint != device.PublicKeyFingerprint {
+			return reject(fmt.Errorf("public key of device %s does not match the registered fingerprint", serialNumber))
+		}
+	}
+
+	if progress, ok := device.Slots[slot]; ok {
+		switch progress.Status {
+		case ManifestSlotStatusEnrolling:
+			return reject(fmt.Errorf("slot %s of device %s is already being enrolled", slot, serialNumber))
+		case ManifestSlotStatusEnrolled:
+			return reject(fmt.Errorf("slot %s of device %s has already been enrolled", slot, serialNumber))
+		}
+	}
+
+	device.LastRejection = ""
+	m.setSlotStatus(device, slot, ManifestSlotStatusEnrolling, "")
+	return nil
+}
+
+// MarkEnrolled consumes the slot once the certificate has been handed over.
+func (m *DeviceManifest) MarkEnrolled(serialNumber, slot, certificateSerialNumber string) {
+	m.updateSlot(serialNumber, slot, ManifestSlotStatusEnrolled, certificateSerialNumber)
+}
+
+// MarkFailed releases a slot claimed by an enrollment that did not complete.
+func (m *DeviceManifest) MarkFailed(serialNumber, slot string) {
+	m.updateSlot(serialNumber, slot, ManifestSlotStatusFailed, "")
+}
+
+func (m *DeviceManifest) updateSlot(serialNumber, slot string, status ManifestSlotStatus, certificateSerialNumber string) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	device, ok := m.devices[serialNumber]
+	if !ok {
+		m.lock.Unlock()
+		return
+	}
+	m.setSlotStatus(device, slot, status, certificateSerialNumber)
+	m.persist()
+	m.lock.Unlock()
+
+	sendDeviceManifestUpdate()
+}
+
+// setSlotStatus must be called while holding the lock.
+func (m *DeviceManifest) setSlotStatus(device *ManifestDevice, slot string, status ManifestSlotStatus, certificateSerialNumber string) {
+	if device.Slots == nil {
+		device.Slots = map[string]*ManifestSlotProgress{}
+	}
+	progress, ok := device.Slots[slot]
+	if !ok {
+		progress = &ManifestSlotProgress{}
+		device.Slots[slot] = progress
+	}
+	progress.Status = status
+	progress.SerialNumber = certificateSerialNumber
+	progress.UpdatedAt = time.Now()
+}
+
+func (m *DeviceManifest) Serialize() DeviceManifestSerialized {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.serialize()
+}
+
+// serialize must be called while holding the lock.
+func (m *DeviceManifest) serialize() DeviceManifestSerialized {
+	serialized := DeviceManifestSerialized{
+		Enforced: m.enforced,
+		Devices:  []ManifestDevice{},
+	}
+	for _, device := range m.devices {
+		serialized.Devices = append(serialized.Devices, *device)
+	}
+	sort.Slice(serialized.Devices, func(i, j int) bool {
+		return serialized.Devices[i].SerialNumber < serialized.Devices[j].SerialNumber
+	})
+	return serialized
+}
+
+// parseCSVManifest reads a manifest with a serial_number, model, allowed_slots
+// and public_key_fingerprint header. Allowed slots are separated by "|".
+func parseCSVManifest(r io.Reader) ([]ManifestDevice, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return []ManifestDevice{}, nil
+	}
+
+	columns := map[string]int{}
+	for i, column := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	if _, ok := columns["serial_number"]; !ok {
+		return nil, fmt.Errorf("manifest has no serial_number column")
+	}
+
+	field := func(row []string, column string) string {
+		i, ok := columns[column]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	devices := []ManifestDevice{}
+	for _, row := range rows[1:] {
+		device := ManifestDevice{
+			SerialNumber:         field(row, "serial_number"),
+			Model:                field(row, "model"),
+			PublicKeyFingerprint: field(row, "public_key_fingerprint"),
+		}
+		for _, slot := range strings.Split(field(row, "allowed_slots"), "|") {
+			if slot = strings.TrimSpace(slot); slot != "" {
+				device.AllowedSlots = append(device.AllowedSlots, slot)
+			}
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// publicKeyFingerprint is the hex encoded SHA-256 of the DER SubjectPublicKeyInfo.
+func publicKeyFingerprint(publicKey crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToLower(strings.TrimSpace(fingerprint))
+	fingerprint = strings.TrimPrefix(fingerprint, "sha256:")
+	return strings.ReplaceAll(fingerprint, ":", "")
+}
+
+func sendDeviceManifestUpdate() {
+	sendWebSocketMessage(
+		WebSocketMessage{
+			Type:      "DEVICE_MANIFEST_UPDATE",
+			Message:   SingeltonInstance.DeviceManifest.Serialize(),
+			Timestamp: time.Now(),
+		},
+	)
+}
+
+func manifestRoute(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SingeltonInstance.DeviceManifest.Serialize())
+
+	case http.MethodPost, http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusInternalServerError)
+			return
+		}
+
+		format := ManifestFormatJSON
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			format = ManifestFormatCSV
+		}
+
+		// PUT replaces the whole manifest, POST merges into it.
+		imported, err := SingeltonInstance.DeviceManifest.Import(format, body, r.Method == http.MethodPut)
+		if err != nil {
+			http.Error(w, "Error importing manifest: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"imported": imported})
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+func manifestDeviceRoute(w http.ResponseWriter, r *http.Request) {
+	err := SingeltonInstance.DeviceManifest.RemoveDevice(mux.Vars(r)["serial_number"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func manifestDeviceResetRoute(w http.ResponseWriter, r *http.Request) {
+	err := SingeltonInstance.DeviceManifest.ResetDevice(mux.Vars(r)["serial_number"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCSVManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []ManifestDevice
+		wantErr bool
+	}{
+		{
+			name: "all columns",
+			content: "serial_number,model,allowed_slots,public_key_fingerprint\n" +
+				"SN-1,gateway,default|backup,ab:cd\n",
+			want: []ManifestDevice{
+				{SerialNumber: "SN-1", Model: "gateway", AllowedSlots: []string{"default", "backup"}, PublicKeyFingerprint: "ab:cd"},
+			},
+		},
+		{
+			name: "columns in any order and case",
+			content: "Model, SERIAL_NUMBER\n" +
+				"sensor,SN-1\n" +
+				"sensor,SN-2\n",
+			want: []ManifestDevice{
+				{SerialNumber: "SN-1", Model: "sensor"},
+				{SerialNumber: "SN-2", Model: "sensor"},
+			},
+		},
+		{
+			name: "spaces and empty slots are dropped",
+			content: "serial_number,allowed_slots\n" +
+				" SN-1 , default | | backup |\n",
+			want: []ManifestDevice{
+				{SerialNumber: "SN-1", AllowedSlots: []string{"default", "backup"}},
+			},
+		},
+		{
+			name: "short rows leave missing columns empty",
+			content: "serial_number,model,allowed_slots\n" +
+				"SN-1\n",
+			want: []ManifestDevice{
+				{SerialNumber: "SN-1"},
+			},
+		},
+		{
+			name:    "empty manifest",
+			content: "",
+			want:    []ManifestDevice{},
+		},
+		{
+			name:    "header only",
+			content: "serial_number,model\n",
+			want:    []ManifestDevice{},
+		},
+		{
+			name:    "missing serial number column",
+			content: "model,allowed_slots\nsensor,default\n",
+			wantErr: true,
+		},
+		{
+			name:    "malformed CSV",
+			content: "serial_number\n\"SN-1\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCSVManifest(strings.NewReader(tt.content))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseCSVManifest() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCSVManifest() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCSVManifest() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
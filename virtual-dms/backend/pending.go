@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lamassuiot/lamassu-simulation-tools/common/auth"
+)
+
+type PendingEnrollmentSource string
+
+const (
+	// PendingEnrollmentSourceInProcess is the enrollment the DMS is currently
+	// driving, the device is waiting for the answer.
+	PendingEnrollmentSourceInProcess PendingEnrollmentSource = "IN_PROCESS"
+	// PendingEnrollmentSourceBacklog is a queued enrollment, the device polls
+	// for its certificate.
+	PendingEnrollmentSourceBacklog PendingEnrollmentSource = "BACKLOG"
+)
+
+type PendingEnrollmentStage string
+
+const (
+	PendingEnrollmentStageEnrollment PendingEnrollmentStage = "ENROLLMENT"
+	PendingEnrollmentStageTransfer   PendingEnrollmentStage = "TRANSFER"
+)
+
+// PendingEnrollment is an enrollment waiting on an operator approval.
+type PendingEnrollment struct {
+	ID             string                  `json:"id"`
+	Source         PendingEnrollmentSource `json:"source"`
+	Stage          PendingEnrollmentStage  `json:"stage"`
+	RequestingDate time.Time               `json:"requesting_date"`
+	DeviceID       string                  `json:"device_id"`
+	DeviceModel    string                  `json:"device_model"`
+	DeviceSlot     string                  `json:"device_slot"`
+	IssuingCA      string                  `json:"issuing_ca"`
+	Reenrollment   bool                    `json:"reenrollment"`
+	SerialNumber   string                  `json:"serial_number,omitempty"`
+}
+
+func (s *EnrollmentInProcess) rejectionMessage() string {
+	return rejectionMessage(s.RejectionReason)
+}
+
+func rejectionMessage(reason string) string {
+	if reason == "" {
+		return "the enrollment was rejected by the operator"
+	}
+	return "the enrollment was rejected by the operator: " + reason
+}
+
+// pendingStage tells which approval the enrollment in process is waiting on,
+// if any. Callers hold stateLock.
+func (s *EnrollmentInProcess) pendingStage() (PendingEnrollmentStage, bool) {
+	if s.Rejected || SingeltonInstance.DMS.Status != DMSStatusEnrolling {
+		return "", false
+	}
+
+	switch {
+	case s.Status == EnrollingStatusStep1 && !s.AuthorizedEnrollment:
+		return PendingEnrollmentStageEnrollment, true
+	case s.Status == EnrollingStatusStep3 && !s.AuthorizedCertificateTransfer:
+		return PendingEnrollmentStageTransfer, true
+	}
+	return "", false
+}
+
+func pendingEnrollments() []PendingEnrollment {
+	pending := []PendingEnrollment{}
+
+	stateLock.Lock()
+	if enrollment := SingeltonInstance.EnrollmentInProcess; enrollment != nil {
+		if stage, ok := enrollment.pendingStage(); ok {
+			pending = append(pending, PendingEnrollment{
+				ID:             enrollment.ID,
+				Source:         PendingEnrollmentSourceInProcess,
+				Stage:          stage,
+				RequestingDate: enrollment.RequestingDate,
+				DeviceID:       enrollment.DeviceID,
+				DeviceModel:    enrollment.DeviceModel,
+				DeviceSlot:     enrollment.DeviceSlot,
+				IssuingCA:      enrollment.IssuingCA,
+				Reenrollment:   enrollment.Reenrollment,
+				SerialNumber:   enrollment.SerialNumber,
+			})
+		}
+	}
+	stateLock.Unlock()
+
+	for _, item := range SingeltonInstance.EnrollmentBacklog.Serialize().Backlog {
+		if item.Status != QueuedEnrollmentStatusAwaitingTransfer || item.AuthorizedCertificateTransfer {
+			continue
+		}
+
+		serialNumber := ""
+		if crt, err := item.certificate(); err == nil {
+			serialNumber = formatSerialNumber(crt.SerialNumber)
+		}
+		pending = append(pending, PendingEnrollment{
+			ID:             item.ID,
+			Source:         PendingEnrollmentSourceBacklog,
+			Stage:          PendingEnrollmentStageTransfer,
+			RequestingDate: item.RequestingDate,
+			DeviceID:       item.DeviceID,
+			DeviceModel:    item.DeviceModel,
+			DeviceSlot:     item.DeviceSlot,
+			IssuingCA:      item.IssuingCA,
+			SerialNumber:   serialNumber,
+		})
+	}
+
+	return pending
+}
+
+func findPendingEnrollment(id string) (PendingEnrollment, error) {
+	for _, pending := range pendingEnrollments() {
+		if pending.ID == id {
+			return pending, nil
+		}
+	}
+	return PendingEnrollment{}, newProtocolError(ProtocolErrorNotFound, "Pending enrollment not found", fmt.Errorf("no enrollment with id %s is waiting for approval", id))
+}
+
+// approvePendingEnrollment approves the step the enrollment is waiting on
+// through the same commands the console sends.
+func approvePendingEnrollment(principal *auth.Principal, id string) error {
+	pending, err := findPendingEnrollment(id)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case pending.Source == PendingEnrollmentSourceBacklog:
+		_, err = dispatchCommand(principal, "AUTH_QUEUED_TRANSFER", AuthQueuedTransfer{ID: pending.ID})
+	case pending.Stage == PendingEnrollmentStageTransfer:
+		_, err = dispatchCommand(principal, "AUTH_TRANSFER", AuthEnrollment{ID: pending.ID})
+	default:
+		_, err = dispatchCommand(principal, "AUTH_ENROLL", AuthEnrollment{ID: pending.ID})
+	}
+	return err
+}
+
+// approveEnrollmentInProcess applies the approval of an AUTH_ENROLL or
+// AUTH_TRANSFER command to the enrollment in process. The id is compared when
+// the command runs, the enrollment looked up by the caller may have finished
+// meanwhile.
+func approveEnrollmentInProcess(raw json.RawMessage, approve func(enrollment *EnrollmentInProcess)) error {
+	var approval AuthEnrollment
+	if len(raw) > 0 && string(raw) != "null" {
+		if err := decodeCommand(raw, &approval); err != nil {
+			return err
+		}
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	enrollment := SingeltonInstance.EnrollmentInProcess
+	if enrollment == nil {
+		return newProtocolError(ProtocolErrorInvalidState, "No enrollment in process", nil)
+	}
+	if approval.ID != "" && approval.ID != enrollment.ID {
+		return newProtocolError(ProtocolErrorInvalidState, "Enrollment no longer in process", fmt.Errorf("enrollment %s is in process instead of %s", enrollment.ID, approval.ID))
+	}
+	approve(enrollment)
+	return nil
+}
+
+// rejectPendingEnrollment fails a pending enrollment, an empty id selects the
+// enrollment in process.
+func rejectPendingEnrollment(principal *auth.Principal, id string, reason string) error {
+	if id == "" {
+		stateLock.Lock()
+		if enrollment := SingeltonInstance.EnrollmentInProcess; enrollment != nil {
+			id = enrollment.ID
+		}
+		stateLock.Unlock()
+
+		if id == "" {
+			return newProtocolError(ProtocolErrorInvalidState, "No enrollment in process", nil)
+		}
+	}
+
+	pending, err := findPendingEnrollment(id)
+	if err != nil {
+		return err
+	}
+
+	if pending.Source == PendingEnrollmentSourceBacklog {
+		err = SingeltonInstance.EnrollmentBacklog.RejectTransfer(pending.ID, reason, principal.Username)
+		if err != nil {
+			return newProtocolError(ProtocolErrorRejected, "Error rejecting enrollment", err)
+		}
+		return nil
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	enrollment := SingeltonInstance.EnrollmentInProcess
+	if enrollment == nil || enrollment.ID != pending.ID {
+		return newProtocolError(ProtocolErrorInvalidState, "Enrollment no longer in process", fmt.Errorf("enrollment %s is no longer in process", pending.ID))
+	}
+	enrollment.RejectionReason = reason
+	enrollment.RejectedBy = principal.Username
+	enrollment.Rejected = true
+	return nil
+}
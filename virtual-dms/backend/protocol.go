@@ -0,0 +1,277 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lamassuiot/lamassu-simulation-tools/common/auth"
+)
+
+// WebSocketProtocolVersion is the version of the console protocol described by
+// websocket-protocol.schema.json. Consoles that skip the HELLO handshake are
+// served as version 1 clients.
+const WebSocketProtocolVersion = 1
+
+//go:embed websocket-protocol.schema.json
+var webSocketProtocolSchema []byte
+
+// IncomingWebSocketMessage is a command sent by the console. The payload is
+// kept raw so each command decodes it into its own type.
+type IncomingWebSocketMessage struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Message json.RawMessage `json:"message,omitempty"`
+}
+
+type ProtocolErrorCode string
+
+const (
+	// ProtocolErrorInvalidMessage is returned for messages that are not valid
+	// JSON or do not follow the envelope of the protocol.
+	ProtocolErrorInvalidMessage     ProtocolErrorCode = "INVALID_MESSAGE"
+	ProtocolErrorUnsupportedVersion ProtocolErrorCode = "UNSUPPORTED_PROTOCOL_VERSION"
+	ProtocolErrorUnknownCommand     ProtocolErrorCode = "UNKNOWN_COMMAND"
+	ProtocolErrorNotFound           ProtocolErrorCode = "NOT_FOUND"
+	ProtocolErrorUnauthorized       ProtocolErrorCode = "UNAUTHORIZED"
+	// ProtocolErrorForbidden is returned when the role of the user does not
+	// allow the command.
+	ProtocolErrorForbidden    ProtocolErrorCode = "FORBIDDEN"
+	ProtocolErrorMissingField ProtocolErrorCode = "MISSING_FIELD"
+	ProtocolErrorInvalidField ProtocolErrorCode = "INVALID_FIELD"
+	// ProtocolErrorInvalidState is returned when the command does not apply to
+	// the current state of the DMS, such as approving an enrollment when none
+	// is in process.
+	ProtocolErrorInvalidState ProtocolErrorCode = "INVALID_STATE"
+	// ProtocolErrorRejected is returned when the vDMS refuses the command, the
+	// cause tells why.
+	ProtocolErrorRejected ProtocolErrorCode = "REJECTED"
+	// ProtocolErrorUpstream is returned when Lamassu or another external
+	// service fails, the cause holds the upstream error.
+	ProtocolErrorUpstream ProtocolErrorCode = "UPSTREAM_ERROR"
+	ProtocolErrorInternal ProtocolErrorCode = "INTERNAL_ERROR"
+)
+
+// ProtocolError is the error reported to the console. Message is meant for
+// humans while Code and Field let scripts react to the failure.
+type ProtocolError struct {
+	Code    ProtocolErrorCode `json:"code"`
+	Message string            `json:"message"`
+	Field   string            `json:"field,omitempty"`
+	Cause   string            `json:"cause,omitempty"`
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Cause == "" {
+		return e.Message
+	}
+	return e.Message + ": " + e.Cause
+}
+
+func newProtocolError(code ProtocolErrorCode, message string, cause error) *ProtocolError {
+	protocolError := &ProtocolError{
+		Code:    code,
+		Message: message,
+	}
+	if cause != nil {
+		protocolError.Cause = cause.Error()
+	}
+	return protocolError
+}
+
+func missingField(field string) *ProtocolError {
+	return &ProtocolError{
+		Code:    ProtocolErrorMissingField,
+		Message: "Missing required field " + field,
+		Field:   field,
+	}
+}
+
+func invalidField(field string, cause error) *ProtocolError {
+	protocolError := newProtocolError(ProtocolErrorInvalidField, "Invalid value for field "+field, cause)
+	protocolError.Field = field
+	return protocolError
+}
+
+type HelloMessage struct {
+	ProtocolVersions []int  `json:"protocol_versions"`
+	Client           string `json:"client"`
+}
+
+func (m *HelloMessage) validate() error {
+	if len(m.ProtocolVersions) == 0 {
+		return missingField("protocol_versions")
+	}
+	return nil
+}
+
+type WelcomeMessage struct {
+	ProtocolVersion     int                 `json:"protocol_version"`
+	User                auth.Principal      `json:"user"`
+	SchemaURL           string              `json:"schema_url"`
+	LamassuAPIVersion   LamassuAPIVersion   `json:"lamassu_api_version"`
+	LamassuCapabilities LamassuCapabilities `json:"lamassu_capabilities"`
+	Commands            []string            `json:"commands"`
+}
+
+type AckMessage struct {
+	Command string      `json:"command"`
+	Result  interface{} `json:"result,omitempty"`
+}
+
+// webSocketCommands lists the commands understood by handleCommand, it is
+// announced in the handshake and must match the schema.
+var webSocketCommands = []string{
+	"HELLO",
+	"GET_CFG",
+	"CFG",
+	"CFG_SELECTED_CA_FOR_ENROLLMENT",
+	"CFG_AUTO_ENROLLMENT",
+	"CFG_AUTO_TRANSFER",
+	"CFG_AUTO_REENROLLMENT",
+	"CFG_REPEAT_ENROLLMENT",
+	"AUTH_ENROLL",
+	"AUTH_TRANSFER",
+	"REJECT_ENROLLMENT",
+	"GET_ENROLLMENT_BACKLOG",
+	"AUTH_QUEUED_TRANSFER",
+	"GET_DEVICE_MANIFEST",
+	"IMPORT_DEVICE_MANIFEST",
+	"ADD_MANIFEST_DEVICE",
+	"REMOVE_MANIFEST_DEVICE",
+	"RESET_MANIFEST_DEVICE",
+	"CFG_ENFORCE_MANIFEST",
+	"GET_ENROLLMENT_TOKENS",
+	"ISSUE_ENROLLMENT_TOKEN",
+	"REVOKE_ENROLLMENT_TOKEN",
+	"CLAIM_DEVICE",
+	"GET_WEBHOOKS",
+	"ADD_WEBHOOK",
+	"REMOVE_WEBHOOK",
+	"ADMIN_LOGIN",
+	"ADMIN_LIST_DMSS",
+	"ADMIN_ADOPT_DMS",
+	"ADMIN_UPDATE_DMS_STATUS",
+	"ADMIN_UPDATE_DMS_AUTHORIZED_CAS",
+}
+
+// commandRoles is the role each command requires, commands not listed are
+// for admins.
+var commandRoles = map[string]auth.Role{
+	"HELLO":                  auth.RoleViewer,
+	"GET_CFG":                auth.RoleViewer,
+	"GET_ENROLLMENT_BACKLOG": auth.RoleViewer,
+	"GET_DEVICE_MANIFEST":    auth.RoleViewer,
+	"GET_ENROLLMENT_TOKENS":  auth.RoleViewer,
+	"GET_WEBHOOKS":           auth.RoleViewer,
+	"AUTH_ENROLL":            auth.RoleApprover,
+	"AUTH_TRANSFER":          auth.RoleApprover,
+	"REJECT_ENROLLMENT":      auth.RoleApprover,
+	"AUTH_QUEUED_TRANSFER":   auth.RoleApprover,
+	"CLAIM_DEVICE":           auth.RoleApprover,
+}
+
+func commandRole(command string) auth.Role {
+	if role, ok := commandRoles[command]; ok {
+		return role
+	}
+	return auth.RoleAdmin
+}
+
+// authorizeCommand checks the role of the user and records the commands
+// that change the DMS in the audit log.
+func authorizeCommand(principal *auth.Principal, command string) error {
+	required := commandRole(command)
+	if !principal.Role.Allows(required) {
+		auth.AuditLog(principal, command, "denied")
+		return newProtocolError(ProtocolErrorForbidden, fmt.Sprintf("The %s role is required to run %s", required, command), nil)
+	}
+
+	if required != auth.RoleViewer {
+		auth.AuditLog(principal, command, "")
+	}
+	return nil
+}
+
+// decodeCommand decodes the payload of a command, reporting the offending
+// field when a value has the wrong type. Payloads implementing validate are
+// checked for required fields afterwards.
+func decodeCommand(raw json.RawMessage, out interface{}) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return missingField("message")
+	}
+
+	err := json.Unmarshal(raw, out)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return invalidField(typeErr.Field, fmt.Errorf("expected %s but got %s", typeErr.Type, typeErr.Value))
+	} else if err != nil {
+		return newProtocolError(ProtocolErrorInvalidMessage, "Error parsing command", err)
+	}
+
+	if v, ok := out.(interface{ validate() error }); ok {
+		return v.validate()
+	}
+	return nil
+}
+
+// toProtocolError keeps the errors returned by the commands as they are and
+// reports anything else as an internal error.
+func toProtocolError(err error) *ProtocolError {
+	var protocolError *ProtocolError
+	if errors.As(err, &protocolError) {
+		return protocolError
+	}
+	return newProtocolError(ProtocolErrorInternal, "Error processing command", err)
+}
+
+// sendProtocolError reports an error to the console. The message keeps the
+// human readable text older consoles display.
+func sendProtocolError(id string, err error) {
+	protocolError := toProtocolError(err)
+	sendWebSocketMessage(
+		WebSocketMessage{
+			Type:      "ERROR",
+			ID:        id,
+			Message:   protocolError.Error(),
+			Error:     protocolError,
+			Timestamp: time.Now(),
+		},
+	)
+}
+
+func handleHello(principal *auth.Principal, raw json.RawMessage) (WelcomeMessage, error) {
+	var hello HelloMessage
+	if err := decodeCommand(raw, &hello); err != nil {
+		return WelcomeMessage{}, err
+	}
+
+	supported := false
+	for _, version := range hello.ProtocolVersions {
+		if version == WebSocketProtocolVersion {
+			supported = true
+		}
+	}
+	if !supported {
+		protocolError := newProtocolError(ProtocolErrorUnsupportedVersion, fmt.Sprintf("Protocol version %d is required", WebSocketProtocolVersion), nil)
+		protocolError.Field = "protocol_versions"
+		return WelcomeMessage{}, protocolError
+	}
+
+	return WelcomeMessage{
+		ProtocolVersion:     WebSocketProtocolVersion,
+		User:                *principal,
+		SchemaURL:           "/ws-schema.json",
+		LamassuAPIVersion:   SingeltonInstance.Lamassu.Version(),
+		LamassuCapabilities: SingeltonInstance.Lamassu.Capabilities(),
+		Commands:            webSocketCommands,
+	}, nil
+}
+
+func webSocketSchemaRoute(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(webSocketProtocolSchema)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mozilla.org/pkcs7"
+)
+
+const enrollmentReceiptVersion = 1
+
+type EnrollmentApproval string
+
+const (
+	// EnrollmentApprovalAutomatic covers automatic enrollment as well as
+	// enrollments approved by a claim code or an enrollment token.
+	EnrollmentApprovalAutomatic EnrollmentApproval = "AUTOMATIC"
+	EnrollmentApprovalOperator  EnrollmentApproval = "OPERATOR"
+)
+
+type EnrollmentReceiptDecision struct {
+	Enrollment         EnrollmentApproval `json:"enrollment"`
+	ApprovedBy         string             `json:"approved_by,omitempty"`
+	Transfer           EnrollmentApproval `json:"certificate_transfer"`
+	TransferApprovedBy string             `json:"transfer_approved_by,omitempty"`
+}
+
+// EnrollmentReceipt is the content signed by the DMS for each certificate it
+// hands to a device.
+type EnrollmentReceipt struct {
+	Version                 int                       `json:"version"`
+	EnrollmentID            string                    `json:"enrollment_id"`
+	IssuedAt                time.Time                 `json:"issued_at"`
+	DMSName                 string                    `json:"dms_name"`
+	DeviceID                string                    `json:"device_id"`
+	DeviceSlot              string                    `json:"device_slot"`
+	DeviceModel             string                    `json:"device_model"`
+	PublicKeyFingerprint    string                    `json:"public_key_fingerprint"`
+	CertificateSerialNumber string                    `json:"certificate_serial_number"`
+	IssuingCA               string                    `json:"issuing_ca"`
+	Reenrollment            bool                      `json:"reenrollment"`
+	PreviousSerialNumber    string                    `json:"previous_serial_number,omitempty"`
+	Decision                EnrollmentReceiptDecision `json:"decision"`
+}
+
+func approvalOf(approvedBy string) EnrollmentApproval {
+	if approvedBy == "" {
+		return EnrollmentApprovalAutomatic
+	}
+	return EnrollmentApprovalOperator
+}
+
+// newEnrollmentReceipt describes a completed enrollment. The fingerprint is
+// taken from the CSR so the receipt binds the key the device asked for.
+func newEnrollmentReceipt(enrollment *EnrollmentInProcess) (EnrollmentReceipt, error) {
+	if enrollment.Certificate == nil {
+		return EnrollmentReceipt{}, errors.New("the enrollment has no certificate")
+	}
+
+	publicKey := enrollment.Certificate.PublicKey
+	if enrollment.CertificateSigningRequest != nil {
+		publicKey = enrollment.CertificateSigningRequest.PublicKey
+	}
+	fingerprint, err := publicKeyFingerprint(publicKey)
+	if err != nil {
+		return EnrollmentReceipt{}, err
+	}
+
+	return EnrollmentReceipt{
+		Version:                 enrollmentReceiptVersion,
+		EnrollmentID:            enrollment.ID,
+		IssuedAt:                time.Now().UTC(),
+		DMSName:                 currentDMS().Name,
+		DeviceID:                enrollment.DeviceID,
+		DeviceSlot:              enrollment.DeviceSlot,
+		DeviceModel:             enrollment.DeviceModel,
+		PublicKeyFingerprint:    fingerprint,
+		CertificateSerialNumber: formatSerialNumber(enrollment.Certificate.SerialNumber),
+		IssuingCA:               enrollment.IssuingCA,
+		Reenrollment:            enrollment.Reenrollment,
+		PreviousSerialNumber:    enrollment.PreviousSerialNumber,
+		Decision: EnrollmentReceiptDecision{
+			Enrollment:         approvalOf(enrollment.ApprovedBy),
+			ApprovedBy:         enrollment.ApprovedBy,
+			Transfer:           approvalOf(enrollment.TransferApprovedBy),
+			TransferApprovedBy: enrollment.TransferApprovedBy,
+		},
+	}, nil
+}
+
+// signEnrollmentReceipt wraps the receipt in a CMS SignedData signed with the
+// DMS key. The DMS certificate is embedded so it can be verified offline.
+func signEnrollmentReceipt(receipt EnrollmentReceipt) ([]byte, error) {
+	dms := currentDMS()
+	if dms.Certificate == nil || dms.PrivateKey == nil {
+		return nil, errors.New("the DMS has no certificate")
+	}
+
+	content, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	signedData, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		return nil, err
+	}
+	signedData.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+
+	err = signedData.AddSigner(dms.Certificate, dms.PrivateKey, pkcs7.SignerInfoConfig{})
+	if err != nil {
+		return nil, err
+	}
+
+	return signedData.Finish()
+}
+
+// issueEnrollmentReceipt returns the signed receipt of the enrollment, or nil
+// if it could not be signed. A missing receipt does not fail the enrollment.
+func issueEnrollmentReceipt(enrollment *EnrollmentInProcess) []byte {
+	receipt, err := newEnrollmentReceipt(enrollment)
+	if err == nil {
+		var signed []byte
+		signed, err = signEnrollmentReceipt(receipt)
+		if err == nil {
+			return signed
+		}
+	}
+
+	fmt.Printf("error issuing enrollment receipt for %s: %v\n", enrollment.SerialNumber, err)
+	return nil
+}
+
+// enrollmentReceipt returns the receipt recorded in the ledger for the given
+// certificate serial number.
+func enrollmentReceipt(serialNumber string) []byte {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	for _, identity := range SingeltonInstance.EnrolledIdentities {
+		if identity.SerialNumber == serialNumber {
+			return identity.Receipt
+		}
+	}
+	return nil
+}
+
+func apiLedgerReceiptRoute(w http.ResponseWriter, r *http.Request) {
+	receipt := enrollmentReceipt(mux.Vars(r)["serial_number"])
+	if receipt == nil {
+		writeAPIError(w, 0, newProtocolError(ProtocolErrorNotFound, "Enrollment receipt not found", nil))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=signed-data")
+	w.Write(receipt)
+}
+
+// decodeEnrollmentReceipt accepts DER, PEM or base64 encoded DER, so a
+// receipt can be checked as stored by the device or as downloaded from the API.
+func decodeEnrollmentReceipt(data []byte) ([]byte, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes, nil
+	}
+
+	trimmed := strings.TrimSpace(string(data))
+	if decoded, err := base64.StdEncoding.DecodeString(trimmed); err == nil {
+		return decoded, nil
+	}
+
+	if len(data) > 0 && data[0] == 0x30 {
+		return data, nil
+	}
+	return nil, errors.New("receipt is neither DER, PEM nor base64")
+}
+
+func readCertificateFile(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	certificates := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, crt)
+	}
+
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no PEM certificate found in %s", path)
+	}
+	return certificates, nil
+}
+
+// verifyEnrollmentReceipt checks the signature of the receipt and, when given,
+// that the DMS certificate chains to the trusted CAs. It works offline.
+func verifyEnrollmentReceipt(der []byte, roots *x509.CertPool) (*EnrollmentReceipt, *x509.Certificate, error) {
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing receipt: %v", err)
+	}
+
+	if roots != nil {
+		err = p7.VerifyWithChain(roots)
+	} else {
+		err = p7.Verify()
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid receipt signature: %v", err)
+	}
+
+	var receipt EnrollmentReceipt
+	err = json.Unmarshal(p7.Content, &receipt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decoding receipt content: %v", err)
+	}
+	if receipt.Version != enrollmentReceiptVersion {
+		return nil, nil, fmt.Errorf("unsupported receipt version %d", receipt.Version)
+	}
+
+	return &receipt, p7.GetOnlySigner(), nil
+}
+
+// runVerifyReceipt implements the verify-receipt command.
+func runVerifyReceipt(args []string) int {
+	flags := flag.NewFlagSet("verify-receipt", flag.ExitOnError)
+	receiptPath := flags.String("receipt", "", "path to the enrollment receipt (DER, PEM or base64)")
+	caPath := flags.String("ca", "", "PEM file with the CAs the DMS certificate must chain to")
+	certificatePath := flags.String("certificate", "", "PEM device certificate the receipt must match")
+	flags.Parse(args)
+
+	if *receiptPath == "" {
+		fmt.Println("missing -receipt flag")
+		return 1
+	}
+
+	data, err := ioutil.ReadFile(*receiptPath)
+	if err != nil {
+		fmt.Println("error reading receipt:", err)
+		return 1
+	}
+	der, err := decodeEnrollmentReceipt(data)
+	if err != nil {
+		fmt.Println("error decoding receipt:", err)
+		return 1
+	}
+
+	var roots *x509.CertPool
+	if *caPath != "" {
+		caCerts, err := readCertificateFile(*caPath)
+		if err != nil {
+			fmt.Println("error reading CA certificates:", err)
+			return 1
+		}
+		roots = x509.NewCertPool()
+		for _, caCert := range caCerts {
+			roots.AddCert(caCert)
+		}
+	}
+
+	receipt, signer, err := verifyEnrollmentReceipt(der, roots)
+	if err != nil {
+		fmt.Println("receipt verification failed:", err)
+		return 1
+	}
+
+	if *certificatePath != "" {
+		certificates, err := readCertificateFile(*certificatePath)
+		if err != nil {
+			fmt.Println("error reading device certificate:", err)
+			return 1
+		}
+		crt := certificates[0]
+		if serialNumber := formatSerialNumber(crt.SerialNumber); serialNumber != receipt.CertificateSerialNumber {
+			fmt.Printf("receipt verification failed: receipt is for certificate %s, not %s\n", receipt.CertificateSerialNumber, serialNumber)
+			return 1
+		}
+		if fingerprint, _ := publicKeyFingerprint(crt.PublicKey); fingerprint != receipt.PublicKeyFingerprint {
+			fmt.Printf("receipt verification failed: receipt is for public key %s, not %s\n", receipt.PublicKeyFingerprint, fingerprint)
+			return 1
+		}
+	}
+
+	fmt.Println("receipt signature valid")
+	if signer != nil {
+		fmt.Printf("signed by: %s\n", signer.Subject.String())
+	}
+	if roots == nil {
+		fmt.Println("warning: the DMS certificate was not checked against a CA, use -ca to do so")
+	}
+	content, _ := json.MarshalIndent(receipt, "", "  ")
+	fmt.Println(string(content))
+	return 0
+}
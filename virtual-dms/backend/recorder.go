@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/lamassuiot/lamassu-simulation-tools/common/session"
+)
+
+const recordedBodyNotJSONKey = "raw"
+
+func toRawJSON(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// bodyToRawJSON keeps JSON bodies as-is so they can be replayed verbatim and
+// wraps anything else in an object to keep the session file valid JSON Lines.
+func bodyToRawJSON(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+
+	if json.Valid(body) {
+		return body
+	}
+
+	return toRawJSON(map[string]string{recordedBodyNotJSONKey: string(body)})
+}
+
+func certificateToPEMString(crt *x509.Certificate) string {
+	if crt == nil {
+		return ""
+	}
+
+	return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw}))
+}
+
+func certificateRequestToPEMString(csr *x509.CertificateRequest) string {
+	if csr == nil {
+		return ""
+	}
+
+	return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))
+}
+
+// -------------------------------------------------------------
+
+type statusRecorderResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *statusRecorderResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusRecorderResponseWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// recordExchanges wraps a device facing handler so that every request and its
+// response are appended to the active session.
+func recordExchanges(kind session.RecordKind, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if SingeltonInstance.Recorder == nil {
+			next(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusInternalServerError)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		rw := &statusRecorderResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		start := time.Now()
+		next(rw, r)
+
+		SingeltonInstance.Recorder.Record(session.Record{
+			Kind:       kind,
+			Operation:  r.Method + " " + r.URL.Path,
+			Timestamp:  start,
+			DurationMs: time.Since(start).Milliseconds(),
+			Request:    bodyToRawJSON(body),
+			StatusCode: rw.statusCode,
+			Response:   bodyToRawJSON(rw.body.Bytes()),
+		})
+	}
+}
+
+// -------------------------------------------------------------
+
+// recordingLamassuBackend records the exchanges with Lamassu. EST operations
+// are recorded as session.RecordKindEST and DMS operations as
+// session.RecordKindDMSManager.
+type recordingLamassuBackend struct {
+	LamassuBackend
+	recorder *session.Recorder
+}
+
+func newRecordingLamassuBackend(inner LamassuBackend, recorder *session.Recorder) LamassuBackend {
+	if recorder == nil {
+		return inner
+	}
+
+	return &recordingLamassuBackend{
+		LamassuBackend: inner,
+		recorder:       recorder,
+	}
+}
+
+type estRecordRequest struct {
+	APS                string `json:"aps,omitempty"`
+	CertificateRequest string `json:"certificate_request,omitempty"`
+	DeviceCertificate  string `json:"device_certificate,omitempty"`
+}
+
+type estRecordResponse struct {
+	Certificates []string `json:"certificates,omitempty"`
+}
+
+type dmsRecordRequest struct {
+	Name          string   `json:"name,omitempty"`
+	Status        string   `json:"status,omitempty"`
+	AuthorizedCAs []string `json:"authorized_cas,omitempty"`
+}
+
+type revocationRecordRequest struct {
+	CAName       string `json:"ca_name"`
+	SerialNumber string `json:"serial_number"`
+	Reason       string `json:"reason"`
+}
+
+func (c *recordingLamassuBackend) record(kind session.RecordKind, operation string, start time.Time, req interface{}, resp interface{}, err error) {
+	record := session.Record{
+		Kind:       kind,
+		Operation:  operation,
+		Timestamp:  start,
+		DurationMs: time.Since(start).Milliseconds(),
+		Request:    toRawJSON(req),
+	}
+
+	if err != nil {
+		record.Error = err.Error()
+		record.StatusCode = upstreamStatusCode(err)
+	} else {
+		record.Response = toRawJSON(resp)
+	}
+
+	c.recorder.Record(record)
+}
+
+// upstreamStatusCode is the status code Lamassu answered a failed call with,
+// zero when it did not answer.
+func upstreamStatusCode(err error) int {
+	var statusErr interface{ StatusCode() int }
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode()
+	}
+	return 0
+}
+
+func (c *recordingLamassuBackend) recordEST(operation string, start time.Time, req estRecordRequest, crts []*x509.Certificate, err error) {
+	resp := estRecordResponse{}
+	for _, crt := range crts {
+		resp.Certificates = append(resp.Certificates, certificateToPEMString(crt))
+	}
+	c.record(session.RecordKindEST, operation, start, req, resp, err)
+}
+
+// CreateDMS only records the DMS description, the private key is never
+// written to the session file.
+func (c *recordingLamassuBackend) CreateDMS(ctx context.Context, name string) (*LamassuDMS, *rsa.PrivateKey, error) {
+	start := time.Now()
+	dms, key, err := c.LamassuBackend.CreateDMS(ctx, name)
+	var resp interface{}
+	if err == nil {
+		resp = serializeLamassuDMS(*dms)
+	}
+	c.record(session.RecordKindDMSManager, "CreateDMS", start, dmsRecordRequest{Name: name}, resp, err)
+	return dms, key, err
+}
+
+func (c *recordingLamassuBackend) GetDMS(ctx context.Context, name string) (*LamassuDMS, error) {
+	start := time.Now()
+	dms, err := c.LamassuBackend.GetDMS(ctx, name)
+	var resp interface{}
+	if err == nil {
+		resp = serializeLamassuDMS(*dms)
+	}
+	c.record(session.RecordKindDMSManager, "GetDMS", start, dmsRecordRequest{Name: name}, resp, err)
+	return dms, err
+}
+
+func (c *recordingLamassuBackend) ListDMSs(ctx context.Context) ([]LamassuDMS, error) {
+	start := time.Now()
+	dmss, err := c.LamassuBackend.ListDMSs(ctx)
+	resp := []LamassuDMSSerialized{}
+	for _, dms := range dmss {
+		resp = append(resp, serializeLamassuDMS(dms))
+	}
+	c.record(session.RecordKindDMSManager, "ListDMSs", start, nil, resp, err)
+	return dmss, err
+}
+
+func (c *recordingLamassuBackend) UpdateDMSStatus(ctx context.Context, name string, status LamassuDMSStatus) (*LamassuDMS, error) {
+	start := time.Now()
+	dms, err := c.LamassuBackend.UpdateDMSStatus(ctx, name, status)
+	var resp interface{}
+	if err == nil {
+		resp = serializeLamassuDMS(*dms)
+	}
+	c.record(session.RecordKindDMSManager, "UpdateDMSStatus", start, dmsRecordRequest{Name: name, Status: string(status)}, resp, err)
+	return dms, err
+}
+
+func (c *recordingLamassuBackend) UpdateDMSAuthorizedCAs(ctx context.Context, name string, authorizedCAs []string) (*LamassuDMS, error) {
+	start := time.Now()
+	dms, err := c.LamassuBackend.UpdateDMSAuthorizedCAs(ctx, name, authorizedCAs)
+	var resp interface{}
+	if err == nil {
+		resp = serializeLamassuDMS(*dms)
+	}
+	c.record(session.RecordKindDMSManager, "UpdateDMSAuthorizedCAs", start, dmsRecordRequest{Name: name, AuthorizedCAs: authorizedCAs}, resp, err)
+	return dms, err
+}
+
+func (c *recordingLamassuBackend) RevokeCertificate(ctx context.Context, caName, serialNumber, reason string) error {
+	start := time.Now()
+	err := c.LamassuBackend.RevokeCertificate(ctx, caName, serialNumber, reason)
+	c.record(session.RecordKindDMSManager, "RevokeCertificate", start, revocationRecordRequest{CAName: caName, SerialNumber: serialNumber, Reason: reason}, nil, err)
+	return err
+}
+
+func (c *recordingLamassuBackend) Enroll(ctx context.Context, identity DMSIdentity, caName string, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	start := time.Now()
+	crt, err := c.LamassuBackend.Enroll(ctx, identity, caName, csr)
+	c.recordEST("Enroll", start, estRecordRequest{APS: caName, CertificateRequest: certificateRequestToPEMString(csr)}, []*x509.Certificate{crt}, err)
+	return crt, err
+}
+
+func (c *recordingLamassuBackend) Reenroll(ctx context.Context, identity DMSIdentity, deviceCrt *x509.Certificate, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	start := time.Now()
+	crt, err := c.LamassuBackend.Reenroll(ctx, identity, deviceCrt, csr)
+	c.recordEST("Reenroll", start, estRecordRequest{CertificateRequest: certificateRequestToPEMString(csr), DeviceCertificate: certificateToPEMString(deviceCrt)}, []*x509.Certificate{crt}, err)
+	return crt, err
+}
+
+// ServerKeyGen never records the generated private key, only the certificate.
+func (c *recordingLamassuBackend) ServerKeyGen(ctx context.Context, identity DMSIdentity, caName string, csr *x509.CertificateRequest) (*x509.Certificate, interface{}, error) {
+	start := time.Now()
+	crt, key, err := c.LamassuBackend.ServerKeyGen(ctx, identity, caName, csr)
+	c.recordEST("ServerKeyGen", start, estRecordRequest{APS: caName, CertificateRequest: certificateRequestToPEMString(csr)}, []*x509.Certificate{crt}, err)
+	return crt, key, err
+}
+
+func (c *recordingLamassuBackend) CACerts(ctx context.Context, identity DMSIdentity, caName string) ([]*x509.Certificate, error) {
+	start := time.Now()
+	crts, err := c.LamassuBackend.CACerts(ctx, identity, caName)
+	c.recordEST("CACerts", start, estRecordRequest{APS: caName}, crts, err)
+	return crts, err
+}
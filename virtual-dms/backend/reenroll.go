@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// reenrollRoute renews the certificate of an already enrolled device slot. The
+// device authenticates with its current certificate, either as the TLS client
+// certificate when the vDMS listens over TLS, forwarded by a trusted TLS
+// terminating proxy, or in the request body together with a CSR for the same
+// key as proof of possession.
+func reenrollRoute(w http.ResponseWriter, r *http.Request) {
+	if !SingeltonInstance.Lamassu.Capabilities().Reenroll {
+		http.Error(w, "Re-enrollment is not supported by the Lamassu API", http.StatusNotImplemented)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+
+	type ReenrollMessage struct {
+		SerialNumber       string `json:"serial_number"`
+		Model              string `json:"model"`
+		Slot               string `json:"slot"`
+		Certificate        string `json:"certificate"`
+		CertificateRequest string `json:"certificate_request"`
+	}
+
+	var reenrollMsg ReenrollMessage
+	err = json.Unmarshal(body, &reenrollMsg)
+	if err != nil {
+		http.Error(w, "Error parsing request body", http.StatusBadRequest)
+		return
+	}
+
+	csr, err := decodeCertificateRequest(reenrollMsg.CertificateRequest)
+	if err != nil {
+		http.Error(w, "Error inflating csr body", http.StatusBadRequest)
+		return
+	}
+
+	deviceCrt, err := reenrollDeviceCertificate(r, reenrollMsg.Certificate, csr)
+	if err != nil {
+		http.Error(w, "Error authenticating device: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	identity, err := findEnrolledIdentity(deviceCrt, reenrollMsg.SerialNumber, reenrollMsg.Slot)
+	if err != nil {
+		http.Error(w, "Error authenticating device: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	err = verifyDeviceCertificateChain(deviceCrt, identity.IssuingCA)
+	if err != nil {
+		http.Error(w, "Error authenticating device: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	dms := currentDMS()
+	enrollment := &EnrollmentInProcess{
+		ID:                            newRandomID(),
+		RequestingDate:                time.Now(),
+		DeviceModel:                   reenrollMsg.Model,
+		IssuingCA:                     identity.IssuingCA,
+		DeviceID:                      identity.DeviceID,
+		DeviceSlot:                    identity.DeviceSlot,
+		CertificateSigningRequest:     csr,
+		AuthorizedEnrollment:          dms.AutomaticReenrollment,
+		AuthorizedCertificateTransfer: dms.AutomaticCertificateTransfer,
+		Reenrollment:                  true,
+		PreviousSerialNumber:          identity.SerialNumber,
+		DeviceCertificate:             deviceCrt,
+	}
+
+	startEnrollment(enrollment)
+	processEnrollment(r.Context(), w, enrollment)
+}
+
+// reenrollDeviceCertificate returns the certificate the device authenticates
+// with. Certificates sent in the body are only accepted if the CSR is signed
+// by the certified key, the TLS handshake, ours or the proxy's, already proves
+// possession.
+func reenrollDeviceCertificate(r *http.Request, b64Certificate string, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0], nil
+	}
+
+	forwardedCrt, err := forwardedClientCertificate(r)
+	if err != nil {
+		return nil, err
+	}
+	if forwardedCrt != nil {
+		return forwardedCrt, nil
+	}
+
+	if b64Certificate == "" {
+		return nil, errors.New("no client certificate presented")
+	}
+
+	decodedCrt, err := base64.StdEncoding.DecodeString(b64Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	crtBlock, _ := pem.Decode(decodedCrt)
+	if crtBlock == nil {
+		return nil, errors.New("invalid certificate PEM block")
+	}
+
+	crt, err := x509.ParseCertificate(crtBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csr signature: %v", err)
+	}
+
+	crtPublicKey, err := x509.MarshalPKIXPublicKey(crt.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	csrPublicKey, err := x509.MarshalPKIXPublicKey(csr.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(crtPublicKey, csrPublicKey) {
+		return nil, errors.New("csr key does not match the certificate key")
+	}
+
+	return crt, nil
+}
+
+// findEnrolledIdentity returns a copy of the ledger entry of the certificate,
+// which must belong to the device and slot asking for the renewal.
+func findEnrolledIdentity(crt *x509.Certificate, deviceID string, slot string) (*EnrolledIdentity, error) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	serialNumber := formatSerialNumber(crt.SerialNumber)
+	for _, identity := range SingeltonInstance.EnrolledIdentities {
+		if identity.SerialNumber != serialNumber {
+			continue
+		}
+
+		if identity.DeviceID != deviceID || identity.DeviceSlot != slot {
+			return nil, fmt.Errorf("certificate %s was not issued to slot %s of device %s", serialNumber, slot, deviceID)
+		}
+		if identity.Status == EnrolledIdentityStatusSuperseded || identity.Status == EnrolledIdentityStatusRevoked {
+			return nil, fmt.Errorf("certificate %s has been superseded by %s", serialNumber, identity.SupersededBy)
+		}
+		return &identity, nil
+	}
+
+	return nil, fmt.Errorf("certificate %s was not enrolled through this DMS", serialNumber)
+}
+
+// verifyDeviceCertificateChain checks the certificate against the CA
+// certificates published by the Lamassu EST server for the issuing CA.
+func verifyDeviceCertificateChain(crt *x509.Certificate, issuingCA string) error {
+	caCerts, err := SingeltonInstance.Lamassu.CACerts(context.Background(), dmsIdentity(), issuingCA)
+	if err != nil {
+		return fmt.Errorf("could not get CA certificates of %s: %v", issuingCA, err)
+	}
+
+	roots := x509.NewCertPool()
+	for _, caCert := range caCerts {
+		roots.AddCert(caCert)
+	}
+
+	_, err = crt.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// renewEnrolledIdentity replaces the serial number of the ledger entry with
+// the one of the renewed certificate and pushes the ledger to the console.
+func renewEnrolledIdentity(enrollment *EnrollmentInProcess) {
+	snapshot := enrollmentSnapshot(enrollment)
+	receipt := issueEnrollmentReceipt(&snapshot)
+
+	renewed := false
+	stateLock.Lock()
+	for i := range SingeltonInstance.EnrolledIdentities {
+		identity := &SingeltonInstance.EnrolledIdentities[i]
+		if identity.SerialNumber != snapshot.PreviousSerialNumber {
+			continue
+		}
+
+		identity.PreviousSerialNumber = identity.SerialNumber
+		identity.SerialNumber = snapshot.SerialNumber
+		identity.IssuingDuration = snapshot.Certificate.NotAfter.Sub(snapshot.Certificate.NotBefore)
+		identity.ExpirationDate = snapshot.Certificate.NotAfter
+		identity.Renewals++
+		identity.LastRenewalTimestamp = time.Now()
+		identity.Receipt = receipt
+		renewed = true
+		break
+	}
+	stateLock.Unlock()
+
+	if !renewed {
+		// The entry vanished while the renewal was awaiting approval.
+		recordEnrolledIdentity(enrollment)
+		return
+	}
+	sendEnrolledIdentitiesUpdate()
+}
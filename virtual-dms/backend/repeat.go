@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RepeatEnrollmentPolicy decides what happens when a device enrolls a slot
+// that already has an active certificate in the ledger.
+type RepeatEnrollmentPolicy string
+
+const (
+	// RepeatEnrollmentPolicyAllow issues another certificate, up to
+	// MaxActiveCertificatesPerSlot active certificates when it is set.
+	RepeatEnrollmentPolicyAllow RepeatEnrollmentPolicy = "ALLOW"
+	// RepeatEnrollmentPolicyReject refuses the enrollment.
+	RepeatEnrollmentPolicyReject RepeatEnrollmentPolicy = "REJECT"
+	// RepeatEnrollmentPolicySupersede treats the enrollment as a
+	// re-enrollment, the active certificates of the slot are superseded by the
+	// new one and optionally revoked.
+	RepeatEnrollmentPolicySupersede RepeatEnrollmentPolicy = "SUPERSEDE"
+)
+
+func parseRepeatEnrollmentPolicy(policy string) (RepeatEnrollmentPolicy, error) {
+	switch RepeatEnrollmentPolicy(policy) {
+	case "", RepeatEnrollmentPolicyAllow:
+		return RepeatEnrollmentPolicyAllow, nil
+	case RepeatEnrollmentPolicyReject:
+		return RepeatEnrollmentPolicyReject, nil
+	case RepeatEnrollmentPolicySupersede:
+		return RepeatEnrollmentPolicySupersede, nil
+	}
+	return "", fmt.Errorf("unknown repeat enrollment policy %s", policy)
+}
+
+type EnrolledIdentityStatus string
+
+const (
+	EnrolledIdentityStatusActive     EnrolledIdentityStatus = "ACTIVE"
+	EnrolledIdentityStatusSuperseded EnrolledIdentityStatus = "SUPERSEDED"
+	EnrolledIdentityStatusRevoked    EnrolledIdentityStatus = "REVOKED"
+)
+
+// isActive tells whether the identity still holds a valid certificate.
+func (s *EnrolledIdentity) isActive() bool {
+	if s.Status != "" && s.Status != EnrolledIdentityStatusActive {
+		return false
+	}
+	return s.ExpirationDate.IsZero() || time.Now().Before(s.ExpirationDate)
+}
+
+// activeIdentities returns the ledger indexes of the active certificates of a
+// device slot. Callers hold stateLock.
+func activeIdentities(deviceID, slot string) []int {
+	indexes := []int{}
+	for i, identity := range SingeltonInstance.EnrolledIdentities {
+		if identity.DeviceID == deviceID && identity.DeviceSlot == slot && identity.isActive() {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// applyRepeatEnrollmentPolicy checks an enrollment against the certificates
+// the slot already has. With the supersede policy the serial numbers to
+// supersede are kept in the enrollment until its certificate is issued.
+func applyRepeatEnrollmentPolicy(enrollment *EnrollmentInProcess) error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	active := activeIdentities(enrollment.DeviceID, enrollment.DeviceSlot)
+	if len(active) == 0 {
+		return nil
+	}
+
+	switch SingeltonInstance.DMS.RepeatEnrollmentPolicy {
+	case RepeatEnrollmentPolicyReject:
+		return fmt.Errorf("slot %s of device %s already has an active certificate", enrollment.DeviceSlot, enrollment.DeviceID)
+
+	case RepeatEnrollmentPolicySupersede:
+		enrollment.SupersedesSerialNumbers = []string{}
+		for _, i := range active {
+			enrollment.SupersedesSerialNumbers = append(enrollment.SupersedesSerialNumbers, SingeltonInstance.EnrolledIdentities[i].SerialNumber)
+		}
+		return nil
+
+	default:
+		max := SingeltonInstance.DMS.MaxActiveCertificatesPerSlot
+		if max > 0 && len(active) >= max {
+			return fmt.Errorf("slot %s of device %s already has %d active certificates", enrollment.DeviceSlot, enrollment.DeviceID, len(active))
+		}
+		return nil
+	}
+}
+
+// supersedeEnrolledIdentities links the certificates replaced by an enrollment
+// to the new certificate, revoking them if the DMS is configured to.
+func supersedeEnrolledIdentities(enrollment *EnrollmentInProcess) {
+	superseded := []EnrolledIdentity{}
+
+	stateLock.Lock()
+	revoke := SingeltonInstance.DMS.RevokeSupersededCertificates
+	for _, serialNumber := range enrollment.SupersedesSerialNumbers {
+		for i := range SingeltonInstance.EnrolledIdentities {
+			identity := &SingeltonInstance.EnrolledIdentities[i]
+			if identity.SerialNumber != serialNumber {
+				continue
+			}
+
+			identity.Status = EnrolledIdentityStatusSuperseded
+			identity.SupersededBy = enrollment.SerialNumber
+			identity.SupersededTimestamp = time.Now()
+			superseded = append(superseded, *identity)
+		}
+	}
+	stateLock.Unlock()
+
+	if !revoke {
+		return
+	}
+
+	// Lamassu is called without holding the state lock, the outcome is
+	// recorded in the ledger once it answered.
+	for _, identity := range superseded {
+		err := revokeCertificate(identity.IssuingCA, identity.SerialNumber, "superseded")
+
+		stateLock.Lock()
+		for i := range SingeltonInstance.EnrolledIdentities {
+			entry := &SingeltonInstance.EnrolledIdentities[i]
+			if entry.SerialNumber != identity.SerialNumber {
+				continue
+			}
+			if err != nil {
+				entry.RevocationError = err.Error()
+			} else {
+				entry.Status = EnrolledIdentityStatusRevoked
+			}
+		}
+		stateLock.Unlock()
+
+		if err != nil {
+			sendProtocolError("", lamassuError("Error revoking superseded certificate "+identity.SerialNumber, err))
+		}
+	}
+}
+
+// revokeCertificate revokes a certificate through the Lamassu CA API with the
+// operator credentials the DMS was configured with.
+func revokeCertificate(caName, serialNumber, reason string) error {
+	return SingeltonInstance.Lamassu.RevokeCertificate(context.Background(), caName, serialNumber, reason)
+}
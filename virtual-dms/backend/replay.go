@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lamassuiot/lamassu-simulation-tools/common/session"
+)
+
+type ReplayResult struct {
+	Record           session.Record
+	StatusCode       int
+	DurationMs       int64
+	Error            string
+	Differences      []string
+	RecordedProfile  *CertificateProfile
+	ReplayedProfile  *CertificateProfile
+	TimingDeltaRatio float64
+	// Skipped tells why the exchange was not replayed.
+	Skipped string
+}
+
+// UpstreamResult pairs an upstream call of the recorded session with the
+// same call made by the target vDMS during the replay. Either side is nil when
+// only one of the sessions made the call.
+type UpstreamResult struct {
+	Call             string
+	Recorded         *session.Record
+	Replayed         *session.Record
+	Differences      []string
+	TimingDeltaRatio float64
+}
+
+// CertificateProfile holds the certificate fields that are expected to stay
+// stable between Lamassu releases. Serial numbers and validity dates change on
+// every issuance so only the validity duration is compared.
+type CertificateProfile struct {
+	Subject            string
+	Issuer             string
+	SignatureAlgorithm string
+	PublicKeyAlgorithm string
+	KeyUsage           x509.KeyUsage
+	ExtKeyUsage        []x509.ExtKeyUsage
+	IsCA               bool
+	ValidityDuration   time.Duration
+	DNSNames           []string
+}
+
+func NewCertificateProfile(crt *x509.Certificate) *CertificateProfile {
+	extKeyUsage := append([]x509.ExtKeyUsage{}, crt.ExtKeyUsage...)
+	sort.Slice(extKeyUsage, func(i, j int) bool { return extKeyUsage[i] < extKeyUsage[j] })
+
+	return &CertificateProfile{
+		Subject:            crt.Subject.String(),
+		Issuer:             crt.Issuer.String(),
+		SignatureAlgorithm: crt.SignatureAlgorithm.String(),
+		PublicKeyAlgorithm: crt.PublicKeyAlgorithm.String(),
+		KeyUsage:           crt.KeyUsage,
+		ExtKeyUsage:        extKeyUsage,
+		IsCA:               crt.IsCA,
+		ValidityDuration:   crt.NotAfter.Sub(crt.NotBefore),
+		DNSNames:           crt.DNSNames,
+	}
+}
+
+func (p *CertificateProfile) Diff(other *CertificateProfile) []string {
+	diffs := []string{}
+	compare := func(field string, recorded, replayed interface{}) {
+		if fmt.Sprint(recorded) != fmt.Sprint(replayed) {
+			diffs = append(diffs, fmt.Sprintf("%s: recorded `%v`, replayed `%v`", field, recorded, replayed))
+		}
+	}
+
+	compare("subject", p.Subject, other.Subject)
+	compare("issuer", p.Issuer, other.Issuer)
+	compare("signature algorithm", p.SignatureAlgorithm, other.SignatureAlgorithm)
+	compare("public key algorithm", p.PublicKeyAlgorithm, other.PublicKeyAlgorithm)
+	compare("key usage", p.KeyUsage, other.KeyUsage)
+	compare("extended key usage", p.ExtKeyUsage, other.ExtKeyUsage)
+	compare("is CA", p.IsCA, other.IsCA)
+	compare("validity duration", p.ValidityDuration, other.ValidityDuration)
+	compare("DNS names", p.DNSNames, other.DNSNames)
+
+	return diffs
+}
+
+// parseEnrollResponseCertificate extracts the certificate from a vDMS /enroll
+// response body. A nil certificate is returned if the body has none.
+func parseEnrollResponseCertificate(body []byte) *x509.Certificate {
+	var enrollResp struct {
+		Certificate string `json:"certificate"`
+	}
+	if err := json.Unmarshal(body, &enrollResp); err != nil || enrollResp.Certificate == "" {
+		return nil
+	}
+
+	decodedCert, err := base64.StdEncoding.DecodeString(enrollResp.Certificate)
+	if err != nil {
+		return nil
+	}
+
+	certBlock, _ := pem.Decode(decodedCert)
+	if certBlock == nil {
+		return nil
+	}
+
+	crt, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil
+	}
+	return crt
+}
+
+// acceptedEnrollmentID returns the id of a queued enrollment from the body of
+// a 202 answer to /enroll, empty if the body has none.
+func acceptedEnrollmentID(body []byte) string {
+	var accepted struct {
+		EnrollmentID string `json:"enrollment_id"`
+	}
+	if err := json.Unmarshal(body, &accepted); err != nil {
+		return ""
+	}
+	return accepted.EnrollmentID
+}
+
+// replayEnrollRecord re-issues a device exchange. The polls of queued
+// enrollments are sent to the id the replay got for the recorded one, which
+// enrollmentIDs maps and is filled as the 202 answers come.
+func replayEnrollRecord(httpClient *http.Client, target string, record session.Record, enrollmentIDs map[string]string) ReplayResult {
+	result := ReplayResult{Record: record}
+
+	method := http.MethodPost
+	path := "/enroll"
+	if parts := strings.SplitN(record.Operation, " ", 2); len(parts) == 2 {
+		method = parts[0]
+		path = parts[1]
+	}
+
+	if method == http.MethodGet && strings.HasPrefix(path, "/enroll/") {
+		recordedID := strings.TrimPrefix(path, "/enroll/")
+		replayedID, ok := enrollmentIDs[recordedID]
+		if !ok {
+			result.Skipped = fmt.Sprintf("enrollment %s was not queued by the replay", recordedID)
+			return result
+		}
+		path = "/enroll/" + replayedID
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(target, "/")+path, bytes.NewReader(record.Request))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		result.DurationMs = time.Since(start).Milliseconds()
+		result.Error = err.Error()
+		result.Differences = append(result.Differences, "request failed: "+err.Error())
+		return result
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	result.DurationMs = time.Since(start).Milliseconds()
+	result.StatusCode = resp.StatusCode
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	if record.StatusCode != resp.StatusCode {
+		result.Differences = append(result.Differences, fmt.Sprintf("status code: recorded `%d`, replayed `%d`", record.StatusCode, resp.StatusCode))
+	}
+
+	if recordedID := acceptedEnrollmentID(record.Response); recordedID != "" {
+		if replayedID := acceptedEnrollmentID(body); replayedID != "" {
+			enrollmentIDs[recordedID] = replayedID
+		}
+	}
+
+	if recordedCrt := parseEnrollResponseCertificate(record.Response); recordedCrt != nil {
+		result.RecordedProfile = NewCertificateProfile(recordedCrt)
+	}
+	if replayedCrt := parseEnrollResponseCertificate(body); replayedCrt != nil {
+		result.ReplayedProfile = NewCertificateProfile(replayedCrt)
+	}
+
+	switch {
+	case result.RecordedProfile != nil && result.ReplayedProfile != nil:
+		result.Differences = append(result.Differences, result.RecordedProfile.Diff(result.ReplayedProfile)...)
+	case result.RecordedProfile != nil:
+		result.Differences = append(result.Differences, "certificate: recorded a certificate, replay returned none")
+	case result.ReplayedProfile != nil:
+		result.Differences = append(result.Differences, "certificate: recorded no certificate, replay returned one")
+	}
+
+	if record.DurationMs > 0 {
+		result.TimingDeltaRatio = float64(result.DurationMs-record.DurationMs) / float64(record.DurationMs)
+	}
+
+	return result
+}
+
+func isUpstreamRecord(record session.Record) bool {
+	return record.Kind == session.RecordKindEST || record.Kind == session.RecordKindDMSManager
+}
+
+// diffUpstreamCalls pairs the upstream calls of both sessions by kind and
+// operation, in the order they were made, and compares their outcome, status
+// code, timing and response.
+func diffUpstreamCalls(recorded, replayed []session.Record) []UpstreamResult {
+	calls := []string{}
+	recordedCalls := map[string][]session.Record{}
+	replayedCalls := map[string][]session.Record{}
+	group := func(records []session.Record, grouped map[string][]session.Record) {
+		for _, record := range records {
+			if !isUpstreamRecord(record) {
+				continue
+			}
+			call := string(record.Kind) + " " + record.Operation
+			if _, ok := recordedCalls[call]; !ok {
+				if _, ok := replayedCalls[call]; !ok {
+					calls = append(calls, call)
+				}
+			}
+			grouped[call] = append(grouped[call], record)
+		}
+	}
+	group(recorded, recordedCalls)
+	group(replayed, replayedCalls)
+
+	results := []UpstreamResult{}
+	for _, call := range calls {
+		recordedCall, replayedCall := recordedCalls[call], replayedCalls[call]
+		for i := 0; i < len(recordedCall) || i < len(replayedCall); i++ {
+			result := UpstreamResult{Call: call}
+			switch {
+			case i >= len(replayedCall):
+				result.Recorded = &recordedCall[i]
+				result.Differences = append(result.Differences, "call: not made by the replay")
+			case i >= len(recordedCall):
+				result.Replayed = &replayedCall[i]
+				result.Differences = append(result.Differences, "call: not made in the recorded session")
+			default:
+				result.Recorded = &recordedCall[i]
+				result.Replayed = &replayedCall[i]
+				result.Differences = diffUpstreamCall(*result.Recorded, *result.Replayed)
+				if result.Recorded.DurationMs > 0 {
+					result.TimingDeltaRatio = float64(result.Replayed.DurationMs-result.Recorded.DurationMs) / float64(result.Recorded.DurationMs)
+				}
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+func diffUpstreamCall(recorded, replayed session.Record) []string {
+	diffs := []string{}
+	if recorded.StatusCode != replayed.StatusCode {
+		diffs = append(diffs, fmt.Sprintf("status code: recorded `%d`, replayed `%d`", recorded.StatusCode, replayed.StatusCode))
+	}
+	switch {
+	case recorded.Error == "" && replayed.Error != "":
+		return append(diffs, fmt.Sprintf("outcome: recorded a success, replay failed with `%s`", replayed.Error))
+	case recorded.Error != "" && replayed.Error == "":
+		return append(diffs, fmt.Sprintf("outcome: recorded the error `%s`, replay succeeded", recorded.Error))
+	case recorded.Error != "":
+		return diffs
+	}
+
+	if recorded.Kind == session.RecordKindEST {
+		return append(diffs, diffESTResponses(recorded.Response, replayed.Response)...)
+	}
+	return append(diffs, diffDMSResponses(recorded.Response, replayed.Response)...)
+}
+
+func diffESTResponses(recordedBody, replayedBody json.RawMessage) []string {
+	var recorded, replayed estRecordResponse
+	json.Unmarshal(recordedBody, &recorded)
+	json.Unmarshal(replayedBody, &replayed)
+
+	if len(recorded.Certificates) != len(replayed.Certificates) {
+		return []string{fmt.Sprintf("certificates: recorded %d, replayed %d", len(recorded.Certificates), len(replayed.Certificates))}
+	}
+
+	diffs := []string{}
+	for i := range recorded.Certificates {
+		recordedCrt, recordedErr := decodeB64PEMCertificate(recorded.Certificates[i])
+		replayedCrt, replayedErr := decodeB64PEMCertificate(replayed.Certificates[i])
+		if recordedErr != nil || replayedErr != nil {
+			continue
+		}
+		for _, diff := range NewCertificateProfile(recordedCrt).Diff(NewCertificateProfile(replayedCrt)) {
+			diffs = append(diffs, fmt.Sprintf("certificate %d %s", i+1, diff))
+		}
+	}
+	return diffs
+}
+
+// diffDMSResponses compares the DMS fields that do not change between two
+// runs, the serial number and creation time of a new DMS always do.
+func diffDMSResponses(recordedBody, replayedBody json.RawMessage) []string {
+	var recordedList, replayedList []LamassuDMSSerialized
+	if json.Unmarshal(recordedBody, &recordedList) == nil && json.Unmarshal(replayedBody, &replayedList) == nil {
+		if len(recordedList) != len(replayedList) {
+			return []string{fmt.Sprintf("DMSs: recorded %d, replayed %d", len(recordedList), len(replayedList))}
+		}
+		return nil
+	}
+
+	var recorded, replayed LamassuDMSSerialized
+	if json.Unmarshal(recordedBody, &recorded) != nil || json.Unmarshal(replayedBody, &replayed) != nil {
+		return nil
+	}
+
+	diffs := []string{}
+	compare := func(field string, recorded, replayed interface{}) {
+		if fmt.Sprint(recorded) != fmt.Sprint(replayed) {
+			diffs = append(diffs, fmt.Sprintf("%s: recorded `%v`, replayed `%v`", field, recorded, replayed))
+		}
+	}
+	compare("DMS status", recorded.Status, replayed.Status)
+	compare("DMS key type", recorded.KeyType, replayed.KeyType)
+	compare("DMS key bits", recorded.KeyBits, replayed.KeyBits)
+	compare("DMS authorized CAs", recorded.AuthorizedCAs, replayed.AuthorizedCAs)
+	compare("DMS certificate", recorded.HasCertificate, replayed.HasCertificate)
+	return diffs
+}
+
+// upstreamStatus is how the report shows the outcome of an upstream call.
+func upstreamStatus(record *session.Record) string {
+	switch {
+	case record == nil:
+		return "-"
+	case record.StatusCode != 0:
+		return fmt.Sprint(record.StatusCode)
+	case record.Error != "":
+		return "error"
+	}
+	return "ok"
+}
+
+func upstreamDuration(record *session.Record) string {
+	if record == nil {
+		return "-"
+	}
+	return fmt.Sprint(record.DurationMs)
+}
+
+func writeReplayReport(w io.Writer, sessionPath, target string, records []session.Record, results []ReplayResult, upstreamResults []UpstreamResult) {
+	failed := 0
+	for _, result := range results {
+		if len(result.Differences) > 0 {
+			failed++
+		}
+	}
+	upstreamFailed := 0
+	for _, result := range upstreamResults {
+		if len(result.Differences) > 0 {
+			upstreamFailed++
+		}
+	}
+
+	fmt.Fprintf(w, "# vDMS replay report\n\n")
+	fmt.Fprintf(w, "- Session: `%s`\n", sessionPath)
+	fmt.Fprintf(w, "- Target: `%s`\n", target)
+	fmt.Fprintf(w, "- Generated: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "- Replayed exchanges: %d (%d with differences)\n", len(results), failed)
+	if upstreamResults != nil {
+		fmt.Fprintf(w, "- Upstream calls: %d (%d with differences)\n", len(upstreamResults), upstreamFailed)
+	}
+	fmt.Fprintf(w, "\n")
+
+	fmt.Fprintf(w, "## Enrollment exchanges\n\n")
+	fmt.Fprintf(w, "| # | Request | Recorded status | Replayed status | Recorded ms | Replayed ms | Timing delta | Result |\n")
+	fmt.Fprintf(w, "|---|---------|-----------------|-----------------|-------------|-------------|--------------|--------|\n")
+	for i, result := range results {
+		outcome := "OK"
+		if result.Skipped != "" {
+			outcome = "skipped, " + result.Skipped
+		} else if len(result.Differences) > 0 {
+			outcome = fmt.Sprintf("%d differences", len(result.Differences))
+		}
+		fmt.Fprintf(w, "| %d | %s | %d | %d | %d | %d | %+.0f%% | %s |\n",
+			i+1, result.Record.Operation, result.Record.StatusCode, result.StatusCode,
+			result.Record.DurationMs, result.DurationMs, result.TimingDeltaRatio*100, outcome,
+		)
+	}
+	fmt.Fprintf(w, "\n")
+
+	for i, result := range results {
+		if len(result.Differences) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "### Exchange %d (%s)\n\n", i+1, result.Record.Timestamp.Format(time.RFC3339))
+		for _, diff := range result.Differences {
+			fmt.Fprintf(w, "- %s\n", diff)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	fmt.Fprintf(w, "## Upstream calls\n\n")
+	if upstreamResults == nil {
+		fmt.Fprintf(w, "Not compared, pass -replayed-session with the session recorded by the target vDMS.\n\n")
+	} else {
+		fmt.Fprintf(w, "| # | Call | Recorded status | Replayed status | Recorded ms | Replayed ms | Timing delta | Result |\n")
+		fmt.Fprintf(w, "|---|------|-----------------|-----------------|-------------|-------------|--------------|--------|\n")
+		for i, result := range upstreamResults {
+			outcome := "OK"
+			if len(result.Differences) > 0 {
+				outcome = fmt.Sprintf("%d differences", len(result.Differences))
+			}
+			fmt.Fprintf(w, "| %d | %s | %s | %s | %s | %s | %+.0f%% | %s |\n",
+				i+1, result.Call, upstreamStatus(result.Recorded), upstreamStatus(result.Replayed),
+				upstreamDuration(result.Recorded), upstreamDuration(result.Replayed), result.TimingDeltaRatio*100, outcome,
+			)
+		}
+		fmt.Fprintf(w, "\n")
+
+		for i, result := range upstreamResults {
+			if len(result.Differences) == 0 {
+				continue
+			}
+
+			fmt.Fprintf(w, "### Upstream call %d (%s)\n\n", i+1, result.Call)
+			for _, diff := range result.Differences {
+				fmt.Fprintf(w, "- %s\n", diff)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	}
+
+	type upstreamSummary struct {
+		calls      int
+		errors     int
+		durationMs int64
+	}
+	upstream := map[string]*upstreamSummary{}
+	keys := []string{}
+	for _, record := range records {
+		// The compared calls are in the tables above.
+		if record.Kind == session.RecordKindEnroll || (upstreamResults != nil && isUpstreamRecord(record)) {
+			continue
+		}
+
+		key := string(record.Kind) + " " + record.Operation
+		if _, ok := upstream[key]; !ok {
+			upstream[key] = &upstreamSummary{}
+			keys = append(keys, key)
+		}
+		upstream[key].calls++
+		upstream[key].durationMs += record.DurationMs
+		if record.Error != "" {
+			upstream[key].errors++
+		}
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "## Recorded calls not replayed\n\n")
+	if len(keys) == 0 {
+		fmt.Fprintf(w, "None recorded.\n")
+		return
+	}
+
+	fmt.Fprintf(w, "| Call | Count | Errors | Mean ms |\n")
+	fmt.Fprintf(w, "|------|-------|--------|---------|\n")
+	for _, key := range keys {
+		summary := upstream[key]
+		fmt.Fprintf(w, "| %s | %d | %d | %d |\n", key, summary.calls, summary.errors, summary.durationMs/int64(summary.calls))
+	}
+}
+
+// runReplay implements the "replay" subcommand. Every recorded /enroll
+// exchange is re-issued against the target vDMS, which in turn talks to the
+// new Lamassu backend, and the responses are compared with the recorded ones.
+// When the target records its own session, its calls to Lamassu are compared
+// with the recorded ones too.
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	sessionPath := flags.String("session", "", "path to the recorded session file (JSON Lines)")
+	target := flags.String("target", "http://localhost:7002", "URL of the vDMS to replay the session against")
+	reportPath := flags.String("report", "", "path of the Markdown report, defaults to stdout")
+	timeout := flags.Duration("timeout", 2*time.Minute, "timeout for each replayed request")
+	replayedSessionPath := flags.String("replayed-session", "", "path of the session the target vDMS records (RECORD_SESSION_FILE), its upstream calls are compared with the recorded ones")
+	flags.Parse(args)
+
+	if *sessionPath == "" {
+		fmt.Println("missing -session flag")
+		return 1
+	}
+
+	records, err := session.Read(*sessionPath)
+	if err != nil {
+		fmt.Println("error reading session:", err)
+		return 1
+	}
+
+	httpClient := &http.Client{Timeout: *timeout}
+	results := []ReplayResult{}
+	enrollmentIDs := map[string]string{}
+	replayStart := time.Now()
+	for _, record := range records {
+		if record.Kind != session.RecordKindEnroll {
+			continue
+		}
+
+		result := replayEnrollRecord(httpClient, *target, record, enrollmentIDs)
+		if result.Skipped != "" {
+			fmt.Printf("skipped %s recorded at %s: %s\n", record.Operation, record.Timestamp.Format(time.RFC3339), result.Skipped)
+		} else {
+			fmt.Printf("replayed %s recorded at %s: %d differences\n", record.Operation, record.Timestamp.Format(time.RFC3339), len(result.Differences))
+		}
+		results = append(results, result)
+	}
+
+	var upstreamResults []UpstreamResult
+	if *replayedSessionPath != "" {
+		replayedRecords, err := session.Read(*replayedSessionPath)
+		if err != nil {
+			fmt.Println("error reading replayed session:", err)
+			return 1
+		}
+
+		// The target may append to a file holding earlier sessions.
+		replayed := []session.Record{}
+		for _, record := range replayedRecords {
+			if !record.Timestamp.Before(replayStart) {
+				replayed = append(replayed, record)
+			}
+		}
+		// The calls the recorded vDMS made before its first enrollment, at
+		// startup or from the console, are not replayed.
+		recorded := []session.Record{}
+		for i, record := range records {
+			if record.Kind == session.RecordKindEnroll {
+				recorded = records[i:]
+				break
+			}
+		}
+		upstreamResults = diffUpstreamCalls(recorded, replayed)
+	}
+
+	var out io.Writer = os.Stdout
+	if *reportPath != "" {
+		file, err := os.Create(*reportPath)
+		if err != nil {
+			fmt.Println("error creating report:", err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+
+	writeReplayReport(out, *sessionPath, *target, records, results, upstreamResults)
+
+	for _, result := range results {
+		if len(result.Differences) > 0 {
+			return 2
+		}
+	}
+	for _, result := range upstreamResults {
+		if len(result.Differences) > 0 {
+			return 2
+		}
+	}
+	return 0
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lamassuiot/lamassu-simulation-tools/common/session"
+)
+
+func TestDiffUpstreamCalls(t *testing.T) {
+	dms := func(status LamassuDMSStatus) json.RawMessage {
+		return toRawJSON(LamassuDMSSerialized{Name: "dms", Status: status, AuthorizedCAs: []string{"ca"}})
+	}
+	call := func(kind session.RecordKind, operation string, statusCode int, errMessage string, response json.RawMessage) session.Record {
+		return session.Record{Kind: kind, Operation: operation, DurationMs: 100, StatusCode: statusCode, Error: errMessage, Response: response}
+	}
+
+	tests := []struct {
+		name      string
+		recorded  []session.Record
+		replayed  []session.Record
+		wantCalls int
+		wantDiffs int
+	}{
+		{
+			name:      "same calls",
+			recorded:  []session.Record{call(session.RecordKindDMSManager, "GetDMS", 0, "", dms(LamassuDMSStatusApproved))},
+			replayed:  []session.Record{call(session.RecordKindDMSManager, "GetDMS", 0, "", dms(LamassuDMSStatusApproved))},
+			wantCalls: 1,
+			wantDiffs: 0,
+		},
+		{
+			name:      "different DMS status",
+			recorded:  []session.Record{call(session.RecordKindDMSManager, "GetDMS", 0, "", dms(LamassuDMSStatusApproved))},
+			replayed:  []session.Record{call(session.RecordKindDMSManager, "GetDMS", 0, "", dms(LamassuDMSStatusRevoked))},
+			wantCalls: 1,
+			wantDiffs: 1,
+		},
+		{
+			name:      "rejected by the replay",
+			recorded:  []session.Record{call(session.RecordKindEST, "Enroll", 0, "", nil)},
+			replayed:  []session.Record{call(session.RecordKindEST, "Enroll", 403, "forbidden", nil)},
+			wantCalls: 1,
+			wantDiffs: 2,
+		},
+		{
+			name:      "same error",
+			recorded:  []session.Record{call(session.RecordKindEST, "Enroll", 403, "forbidden", nil)},
+			replayed:  []session.Record{call(session.RecordKindEST, "Enroll", 403, "forbidden", nil)},
+			wantCalls: 1,
+			wantDiffs: 0,
+		},
+		{
+			name: "missing and extra calls",
+			recorded: []session.Record{
+				call(session.RecordKindEST, "Enroll", 0, "", nil),
+				call(session.RecordKindEST, "Enroll", 0, "", nil),
+			},
+			replayed: []session.Record{
+				call(session.RecordKindEST, "Enroll", 0, "", nil),
+				call(session.RecordKindEST, "CACerts", 0, "", nil),
+			},
+			wantCalls: 3,
+			wantDiffs: 2,
+		},
+		{
+			name:      "device exchanges are left out",
+			recorded:  []session.Record{call(session.RecordKindEnroll, "POST /enroll", 200, "", nil)},
+			replayed:  []session.Record{call(session.RecordKindMQTTPublish, "telemetry", 0, "", nil)},
+			wantCalls: 0,
+			wantDiffs: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := diffUpstreamCalls(tt.recorded, tt.replayed)
+			diffs := 0
+			for _, result := range results {
+				diffs += len(result.Differences)
+			}
+			if len(results) != tt.wantCalls || diffs != tt.wantDiffs {
+				t.Errorf("diffUpstreamCalls() = %d calls with %d differences, want %d with %d: %+v", len(results), diffs, tt.wantCalls, tt.wantDiffs, results)
+			}
+		})
+	}
+}
+
+func TestReplayEnrollRecordMapsEnrollmentIDs(t *testing.T) {
+	polled := ""
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"enrollment_id":"replayed","status":"QUEUED"}`))
+			return
+		}
+		polled = r.URL.Path
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"enrollment_id":"replayed","status":"QUEUED"}`))
+	}))
+	defer target.Close()
+
+	enrollmentIDs := map[string]string{}
+	queued := session.Record{
+		Kind:       session.RecordKindEnroll,
+		Operation:  "POST /enroll",
+		StatusCode: http.StatusAccepted,
+		Response:   json.RawMessage(`{"enrollment_id":"recorded","status":"QUEUED"}`),
+	}
+	if result := replayEnrollRecord(target.Client(), target.URL, queued, enrollmentIDs); len(result.Differences) > 0 {
+		t.Fatalf("replayEnrollRecord() differences = %v", result.Differences)
+	}
+
+	poll := session.Record{Kind: session.RecordKindEnroll, Operation: "GET /enroll/recorded", StatusCode: http.StatusAccepted}
+	replayEnrollRecord(target.Client(), target.URL, poll, enrollmentIDs)
+	if polled != "/enroll/replayed" {
+		t.Errorf("polled %q, want /enroll/replayed", polled)
+	}
+
+	unknown := session.Record{Kind: session.RecordKindEnroll, Operation: "GET /enroll/other"}
+	if result := replayEnrollRecord(target.Client(), target.URL, unknown, enrollmentIDs); result.Skipped == "" {
+		t.Error("replayEnrollRecord() replayed the poll of an enrollment the replay did not queue")
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type EnrollmentCredentialKind string
+
+const (
+	// EnrollmentCredentialToken is issued by the DMS and handed to the device
+	// out of band, e.g. flashed at the factory.
+	EnrollmentCredentialToken EnrollmentCredentialKind = "TOKEN"
+	// EnrollmentCredentialClaimCode is generated and shown by the device. It is
+	// registered once an operator claims the device in the console.
+	EnrollmentCredentialClaimCode EnrollmentCredentialKind = "CLAIM_CODE"
+)
+
+const (
+	EnrollmentTokenHeader = "X-Enrollment-Token"
+	ClaimCodeHeader       = "X-Claim-Code"
+
+	defaultEnrollmentTokenTTL = 24 * time.Hour
+	defaultClaimCodeTTL       = 15 * time.Minute
+)
+
+var (
+	oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+	claimCodeFormat      = regexp.MustCompile(`^[A-Z2-9]{4}-[A-Z2-9]{4}$`)
+)
+
+var (
+	errUnknownEnrollmentCredential = errors.New("unknown enrollment token")
+	errUsedEnrollmentCredential    = errors.New("enrollment token has already been used")
+)
+
+// EnrollmentCredential proves an enrollment request comes from a legitimate
+// device. Only the SHA-256 of the secret is kept.
+type EnrollmentCredential struct {
+	ID           string                   `json:"id"`
+	Kind         EnrollmentCredentialKind `json:"kind"`
+	SecretHash   string                   `json:"secret_hash"`
+	SerialNumber string                   `json:"serial_number"`
+	CreatedAt    time.Time                `json:"created_at"`
+	ExpiresAt    time.Time                `json:"expires_at"`
+	UsedAt       *time.Time               `json:"used_at,omitempty"`
+}
+
+type EnrollmentCredentialSerialized struct {
+	ID           string                   `json:"id"`
+	Kind         EnrollmentCredentialKind `json:"kind"`
+	SerialNumber string                   `json:"serial_number"`
+	CreatedAt    time.Time                `json:"created_at"`
+	ExpiresAt    time.Time                `json:"expires_at"`
+	UsedAt       *time.Time               `json:"used_at,omitempty"`
+	Expired      bool                     `json:"expired"`
+}
+
+func (c *EnrollmentCredential) Serialize() EnrollmentCredentialSerialized {
+	return EnrollmentCredentialSerialized{
+		ID:           c.ID,
+		Kind:         c.Kind,
+		SerialNumber: c.SerialNumber,
+		CreatedAt:    c.CreatedAt,
+		ExpiresAt:    c.ExpiresAt,
+		UsedAt:       c.UsedAt,
+		Expired:      time.Now().After(c.ExpiresAt),
+	}
+}
+
+// IssuedEnrollmentToken is only sent once, when the token is created.
+type IssuedEnrollmentToken struct {
+	ID           string    `json:"id"`
+	Token        string    `json:"token"`
+	SerialNumber string    `json:"serial_number"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+type EnrollmentCredentialStore struct {
+	lock        sync.Mutex
+	path        string
+	credentials []*EnrollmentCredential
+}
+
+func NewEnrollmentCredentialStore(path string) (*EnrollmentCredentialStore, error) {
+	store := &EnrollmentCredentialStore{
+		path:        path,
+		credentials: []*EnrollmentCredential{},
+	}
+
+	if path == "" {
+		return store, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, &store.credentials)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing enrollment tokens: %v", err)
+	}
+
+	return store, nil
+}
+
+// persist must be called while holding the lock.
+func (s *EnrollmentCredentialStore) persist() {
+	if s.path == "" {
+		return
+	}
+
+	content, err := json.MarshalIndent(s.credentials, "", "  ")
+	if err != nil {
+		log.Println("error serializing enrollment tokens:", err)
+		return
+	}
+
+	tmpPath := s.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, content, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		log.Println("error persisting enrollment tokens:", err)
+	}
+}
+
+func (s *EnrollmentCredentialStore) add(kind EnrollmentCredentialKind, secret, serialNumber string, ttl time.Duration) *EnrollmentCredential {
+	credential := &EnrollmentCredential{
+		ID:           newRandomID(),
+		Kind:         kind,
+		SecretHash:   hashEnrollmentSecret(secret),
+		SerialNumber: serialNumber,
+		CreatedAt:    time.Now(),
+		ExpiresAt:    time.Now().Add(ttl),
+	}
+
+	s.lock.Lock()
+	s.credentials = append(s.credentials, credential)
+	s.persist()
+	s.lock.Unlock()
+
+	sendEnrollmentTokensUpdate()
+	return credential
+}
+
+// IssueToken creates a one-time token bound to the serial number.
+func (s *EnrollmentCredentialStore) IssueToken(serialNumber string, ttl time.Duration) (IssuedEnrollmentToken, error) {
+	if serialNumber == "" {
+		return IssuedEnrollmentToken{}, fmt.Errorf("serial number is required")
+	}
+	if ttl <= 0 {
+		ttl = defaultEnrollmentTokenTTL
+	}
+
+	token := newRandomID()
+	credential := s.add(EnrollmentCredentialToken, token, serialNumber, ttl)
+	return IssuedEnrollmentToken{
+		ID:           credential.ID,
+		Token:        token,
+		SerialNumber: serialNumber,
+		ExpiresAt:    credential.ExpiresAt,
+	}, nil
+}
+
+// Claim registers the claim code an operator read from the device.
+func (s *EnrollmentCredentialStore) Claim(serialNumber, claimCode string) error {
+	claimCode = normalizeClaimCode(claimCode)
+	if serialNumber == "" {
+		return fmt.Errorf("serial number is required")
+	}
+	if !claimCodeFormat.MatchString(claimCode) {
+		return fmt.Errorf("invalid claim code %s", claimCode)
+	}
+
+	s.add(EnrollmentCredentialClaimCode, claimCode, serialNumber, defaultClaimCodeTTL)
+	return nil
+}
+
+func (s *EnrollmentCredentialStore) Revoke(id string) error {
+	s.lock.Lock()
+	idx := -1
+	for i, credential := range s.credentials {
+		if credential.ID == id {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		s.lock.Unlock()
+		return fmt.Errorf("enrollment token with id %s not found", id)
+	}
+	s.credentials = append(s.credentials[:idx], s.credentials[idx+1:]...)
+	s.persist()
+	s.lock.Unlock()
+
+	sendEnrollmentTokensUpdate()
+	return nil
+}
+
+// Redeem consumes the credential matching the secret and returns its id. It
+// fails if there is none, or if it is expired, already used or bound to
+// another device.
+func (s *EnrollmentCredentialStore) Redeem(kind EnrollmentCredentialKind, secret, serialNumber string) (string, error) {
+	hash := hashEnrollmentSecret(secret)
+
+	s.lock.Lock()
+	var match *EnrollmentCredential
+	for _, credential := range s.credentials {
+		if credential.Kind == kind && subtle.ConstantTimeCompare([]byte(credential.SecretHash), []byte(hash)) == 1 {
+			match = credential
+		}
+	}
+
+	var err error
+	switch {
+	case match == nil:
+		err = errUnknownEnrollmentCredential
+	case match.UsedAt != nil:
+		err = errUsedEnrollmentCredential
+	case time.Now().After(match.ExpiresAt):
+		err = fmt.Errorf("enrollment token expired at %s", match.ExpiresAt.Format(time.RFC3339))
+	case match.SerialNumber != serialNumber:
+		err = fmt.Errorf("enrollment token is not bound to device %s", serialNumber)
+	default:
+		now := time.Now()
+		match.UsedAt = &now
+		s.persist()
+	}
+	s.lock.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+
+	sendEnrollmentTokensUpdate()
+	return match.ID, nil
+}
+
+// Restore makes a redeemed credential usable again, the enrollment it
+// approved failed before the device got its certificate.
+func (s *EnrollmentCredentialStore) Restore(id string) {
+	s.lock.Lock()
+	restored := false
+	for _, credential := range s.credentials {
+		if credential.ID == id && credential.UsedAt != nil {
+			credential.UsedAt = nil
+			restored = true
+		}
+	}
+	if restored {
+		s.persist()
+	}
+	s.lock.Unlock()
+
+	if restored {
+		sendEnrollmentTokensUpdate()
+	}
+}
+
+func (s *EnrollmentCredentialStore) Serialize() []EnrollmentCredentialSerialized {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	serialized := make([]EnrollmentCredentialSerialized, 0)
+	for _, credential := range s.credentials {
+		serialized = append(serialized, credential.Serialize())
+	}
+	sort.Slice(serialized, func(i, j int) bool { return serialized[i].CreatedAt.After(serialized[j].CreatedAt) })
+	return serialized
+}
+
+func hashEnrollmentSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeClaimCode(claimCode string) string {
+	return strings.ToUpper(strings.TrimSpace(claimCode))
+}
+
+// enrollmentSecret returns the token or claim code of an enrollment request.
+// Headers take precedence over the CSR challengePassword attribute.
+func enrollmentSecret(r *http.Request, csr *x509.CertificateRequest) (EnrollmentCredentialKind, string) {
+	if token := strings.TrimSpace(r.Header.Get(EnrollmentTokenHeader)); token != "" {
+		return EnrollmentCredentialToken, token
+	}
+	if claimCode := r.Header.Get(ClaimCodeHeader); claimCode != "" {
+		return EnrollmentCredentialClaimCode, normalizeClaimCode(claimCode)
+	}
+
+	challengePassword := csrChallengePassword(csr)
+	if challengePassword == "" {
+		return "", ""
+	}
+	if claimCodeFormat.MatchString(normalizeClaimCode(challengePassword)) {
+		return EnrollmentCredentialClaimCode, normalizeClaimCode(challengePassword)
+	}
+	return EnrollmentCredentialToken, challengePassword
+}
+
+// csrChallengePassword extracts the PKCS#9 challengePassword attribute, which
+// crypto/x509 does not expose.
+func csrChallengePassword(csr *x509.CertificateRequest) string {
+	var tbs struct {
+		Version       int
+		Subject       asn1.RawValue
+		PublicKey     asn1.RawValue
+		RawAttributes []asn1.RawValue `asn1:"tag:0"`
+	}
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs); err != nil {
+		return ""
+	}
+
+	for _, rawAttribute := range tbs.RawAttributes {
+		var attribute struct {
+			Type   asn1.ObjectIdentifier
+			Values []asn1.RawValue `asn1:"set"`
+		}
+		if _, err := asn1.Unmarshal(rawAttribute.FullBytes, &attribute); err != nil {
+			continue
+		}
+		if !attribute.Type.Equal(oidChallengePassword) || len(attribute.Values) == 0 {
+			continue
+		}
+
+		var challengePassword string
+		if _, err := asn1.Unmarshal(attribute.Values[0].FullBytes, &challengePassword); err == nil {
+			return challengePassword
+		}
+	}
+	return ""
+}
+
+// authorizeWithEnrollmentSecret applies the token or claim code of the
+// request. A valid token approves the enrollment and the certificate
+// transfer. A claim code that has not been claimed yet leaves the enrollment
+// waiting for an operator to claim the device, expired claims and claims of
+// another device are refused.
+func authorizeWithEnrollmentSecret(r *http.Request, enrollment *EnrollmentInProcess) error {
+	kind, secret := enrollmentSecret(r, enrollment.CertificateSigningRequest)
+	switch kind {
+	case EnrollmentCredentialToken:
+		id, err := SingeltonInstance.EnrollmentCredentials.Redeem(kind, secret, enrollment.DeviceID)
+		if err != nil {
+			return err
+		}
+		enrollment.RedeemedCredentialID = id
+
+	case EnrollmentCredentialClaimCode:
+		id, err := SingeltonInstance.EnrollmentCredentials.Redeem(kind, secret, enrollment.DeviceID)
+		// The claim of an earlier enrollment of the device, e.g. of another
+		// slot, has been used up, this one has to be claimed again.
+		if errors.Is(err, errUnknownEnrollmentCredential) || errors.Is(err, errUsedEnrollmentCredential) {
+			enrollment.ClaimCode = secret
+			enrollment.ClaimExpiresAt = time.Now().Add(defaultClaimCodeTTL)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		enrollment.RedeemedCredentialID = id
+
+	default:
+		return nil
+	}
+
+	enrollment.AuthorizedEnrollment = true
+	enrollment.AuthorizedCertificateTransfer = true
+	return nil
+}
+
+// claimDevice registers a claim code and approves the enrollment in process if
+// it is waiting for that very code.
+func claimDevice(serialNumber, claimCode string) error {
+	err := SingeltonInstance.EnrollmentCredentials.Claim(serialNumber, claimCode)
+	if err != nil {
+		return err
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	enrollment := SingeltonInstance.EnrollmentInProcess
+	if enrollment == nil || enrollment.ClaimCode == "" || enrollment.DeviceID != serialNumber {
+		return nil
+	}
+
+	id, err := SingeltonInstance.EnrollmentCredentials.Redeem(EnrollmentCredentialClaimCode, enrollment.ClaimCode, serialNumber)
+	if err != nil {
+		// The device is waiting with a different code, the claim is kept for
+		// its next attempt.
+		return nil
+	}
+
+	enrollment.RedeemedCredentialID = id
+	enrollment.AuthorizedCertificateTransfer = true
+	enrollment.AuthorizedEnrollment = true
+	return nil
+}
+
+func sendEnrollmentTokensUpdate() {
+	sendWebSocketMessage(
+		WebSocketMessage{
+			Type:      "ENROLLMENT_TOKENS_UPDATE",
+			Message:   SingeltonInstance.EnrollmentCredentials.Serialize(),
+			Timestamp: time.Now(),
+		},
+	)
+}
+
+func tokensRoute(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SingeltonInstance.EnrollmentCredentials.Serialize())
+
+	case http.MethodPost:
+		var issueToken CfgIssueEnrollmentToken
+		err := json.NewDecoder(r.Body).Decode(&issueToken)
+		if err != nil {
+			http.Error(w, "Error parsing request body", http.StatusBadRequest)
+			return
+		}
+
+		issued, err := SingeltonInstance.EnrollmentCredentials.IssueToken(issueToken.SerialNumber, time.Duration(issueToken.TTLSeconds)*time.Second)
+		if err != nil {
+			http.Error(w, "Error issuing enrollment token: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(issued)
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+func tokenRoute(w http.ResponseWriter, r *http.Request) {
+	err := SingeltonInstance.EnrollmentCredentials.Revoke(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEnrollmentCredentialStoreRestore(t *testing.T) {
+	store, err := NewEnrollmentCredentialStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := SingeltonInstance
+	SingeltonInstance = &Singelton{EnrollmentCredentials: store}
+	defer func() { SingeltonInstance = previous }()
+
+	issued, err := store.IssueToken("device-1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := store.Redeem(EnrollmentCredentialToken, issued.Token, "device-1")
+	if err != nil {
+		t.Fatalf("Redeem() error = %v", err)
+	}
+	if id != issued.ID {
+		t.Errorf("Redeem() = %s, want %s", id, issued.ID)
+	}
+	if _, err := store.Redeem(EnrollmentCredentialToken, issued.Token, "device-1"); err == nil {
+		t.Fatal("Redeem() of a used token succeeded")
+	}
+
+	store.Restore(id)
+	if _, err := store.Redeem(EnrollmentCredentialToken, issued.Token, "device-1"); err != nil {
+		t.Errorf("Redeem() of a restored token error = %v", err)
+	}
+}
+
+func TestAuthorizeWithEnrollmentSecretClaimCode(t *testing.T) {
+	store, err := NewEnrollmentCredentialStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := SingeltonInstance
+	SingeltonInstance = &Singelton{EnrollmentCredentials: store}
+	defer func() { SingeltonInstance = previous }()
+
+	for serialNumber, claimCode := range map[string]string{
+		"device-1": "AAAA-2222",
+		"device-2": "BBBB-3333",
+		"device-3": "CCCC-4444",
+	} {
+		if err := store.Claim(serialNumber, claimCode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, credential := range store.credentials {
+		if credential.SerialNumber == "device-3" {
+			credential.ExpiresAt = time.Now().Add(-time.Minute)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		serialNumber string
+		claimCode    string
+		wantErr      bool
+		wantWaiting  bool
+	}{
+		{
+			name:         "claimed",
+			serialNumber: "device-1",
+			claimCode:    "AAAA-2222",
+		},
+		{
+			name:         "not claimed yet",
+			serialNumber: "device-4",
+			claimCode:    "DDDD-5555",
+			wantWaiting:  true,
+		},
+		{
+			name:         "claim already used",
+			serialNumber: "device-1",
+			claimCode:    "AAAA-2222",
+			wantWaiting:  true,
+		},
+		{
+			name:         "claimed for another device",
+			serialNumber: "device-1",
+			claimCode:    "BBBB-3333",
+			wantErr:      true,
+		},
+		{
+			name:         "claim expired",
+			serialNumber: "device-3",
+			claimCode:    "CCCC-4444",
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/enroll", nil)
+			r.Header.Set(ClaimCodeHeader, tt.claimCode)
+			enrollment := &EnrollmentInProcess{DeviceID: tt.serialNumber}
+
+			err := authorizeWithEnrollmentSecret(r, enrollment)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("authorizeWithEnrollmentSecret() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if waiting := enrollment.ClaimCode != ""; waiting != tt.wantWaiting {
+				t.Errorf("waiting for a claim = %v, want %v", waiting, tt.wantWaiting)
+			}
+			if authorized := enrollment.AuthorizedEnrollment; authorized != (!tt.wantErr && !tt.wantWaiting) {
+				t.Errorf("authorized = %v", authorized)
+			}
+		})
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type WebhookEventType string
+
+const (
+	WebhookEventEnrollmentRequested WebhookEventType = "ENROLLMENT_REQUESTED"
+	WebhookEventAwaitingApproval    WebhookEventType = "AWAITING_APPROVAL"
+	WebhookEventCertificateIssued   WebhookEventType = "CERTIFICATE_ISSUED"
+	WebhookEventEnrollmentFailed    WebhookEventType = "ENROLLMENT_FAILED"
+)
+
+var webhookEventTypes = []WebhookEventType{
+	WebhookEventEnrollmentRequested,
+	WebhookEventAwaitingApproval,
+	WebhookEventCertificateIssued,
+	WebhookEventEnrollmentFailed,
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryStatusPending   WebhookDeliveryStatus = "PENDING"
+	WebhookDeliveryStatusRetrying  WebhookDeliveryStatus = "RETRYING"
+	WebhookDeliveryStatusDelivered WebhookDeliveryStatus = "DELIVERED"
+	WebhookDeliveryStatusFailed    WebhookDeliveryStatus = "FAILED"
+)
+
+const (
+	webhookMaxAttempts     = 5
+	webhookInitialBackoff  = 2 * time.Second
+	webhookDeliveryTimeout = 10 * time.Second
+	webhookDeliveryLogSize = 100
+)
+
+type WebhookSubscription struct {
+	ID     string             `json:"id"`
+	URL    string             `json:"url"`
+	Secret string             `json:"secret"`
+	Events []WebhookEventType `json:"events"`
+}
+
+type WebhookSubscriptionSerialized struct {
+	ID        string             `json:"id"`
+	URL       string             `json:"url"`
+	HasSecret bool               `json:"has_secret"`
+	Events    []WebhookEventType `json:"events"`
+}
+
+// Serialize never exposes the HMAC secret to the console.
+func (s *WebhookSubscription) Serialize() WebhookSubscriptionSerialized {
+	return WebhookSubscriptionSerialized{
+		ID:        s.ID,
+		URL:       s.URL,
+		HasSecret: s.Secret != "",
+		Events:    s.Events,
+	}
+}
+
+func (s *WebhookSubscription) subscribedTo(event WebhookEventType) bool {
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the body POSTed to every subscriber.
+type WebhookPayload struct {
+	ID         string                         `json:"id"`
+	Event      WebhookEventType               `json:"event"`
+	Timestamp  time.Time                      `json:"timestamp"`
+	Enrollment *EnrollmentInProcessSerialized `json:"enrollment,omitempty"`
+	DMS        DMSStateSerialized             `json:"dms"`
+	Error      string                         `json:"error,omitempty"`
+}
+
+type WebhookDelivery struct {
+	ID             string                `json:"id"`
+	SubscriptionID string                `json:"subscription_id"`
+	URL            string                `json:"url"`
+	Event          WebhookEventType      `json:"event"`
+	Status         WebhookDeliveryStatus `json:"status"`
+	Attempts       int                   `json:"attempts"`
+	LastStatusCode int                   `json:"last_status_code"`
+	LastError      string                `json:"last_error"`
+	CreatedAt      time.Time             `json:"created_at"`
+	NextRetryAt    *time.Time            `json:"next_retry_at,omitempty"`
+}
+
+type WebhookManager struct {
+	lock          sync.Mutex
+	subscriptions []WebhookSubscription
+	deliveries    []*WebhookDelivery
+	httpClient    *http.Client
+	onUpdate      func()
+}
+
+// NewWebhookManager creates a manager with no subscriptions. onUpdate is called
+// every time the subscriptions or the delivery log change.
+func NewWebhookManager(onUpdate func()) *WebhookManager {
+	return &WebhookManager{
+		subscriptions: []WebhookSubscription{},
+		deliveries:    []*WebhookDelivery{},
+		httpClient:    &http.Client{Timeout: webhookDeliveryTimeout},
+		onUpdate:      onUpdate,
+	}
+}
+
+// LoadSubscriptionsFile loads a JSON array of subscriptions, so demo pipelines
+// can be wired without going through the console.
+func (m *WebhookManager) LoadSubscriptionsFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var subscriptions []WebhookSubscription
+	err = json.Unmarshal(content, &subscriptions)
+	if err != nil {
+		return err
+	}
+
+	for _, subscription := range subscriptions {
+		_, err := m.AddSubscription(subscription)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *WebhookManager) AddSubscription(subscription WebhookSubscription) (WebhookSubscription, error) {
+	if subscription.URL == "" {
+		return subscription, fmt.Errorf("webhook url is required")
+	}
+
+	if len(subscription.Events) == 0 {
+		subscription.Events = webhookEventTypes
+	}
+
+	for _, event := range subscription.Events {
+		valid := false
+		for _, known := range webhookEventTypes {
+			if event == known {
+				valid = true
+			}
+		}
+		if !valid {
+			return subscription, fmt.Errorf("unknown webhook event type %s", event)
+		}
+	}
+
+	if subscription.ID == "" {
+		subscription.ID = newRandomID()
+	}
+
+	m.lock.Lock()
+	m.subscriptions = append(m.subscriptions, subscription)
+	m.lock.Unlock()
+
+	m.notifyUpdate()
+	return subscription, nil
+}
+
+func (m *WebhookManager) RemoveSubscription(id string) error {
+	m.lock.Lock()
+	idx := -1
+	for i, subscription := range m.subscriptions {
+		if subscription.ID == id {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		m.lock.Unlock()
+		return fmt.Errorf("webhook with id %s not found", id)
+	}
+	m.subscriptions = append(m.subscriptions[:idx], m.subscriptions[idx+1:]...)
+	m.lock.Unlock()
+
+	m.notifyUpdate()
+	return nil
+}
+
+func (m *WebhookManager) SerializeSubscriptions() []WebhookSubscriptionSerialized {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	serialized := make([]WebhookSubscriptionSerialized, 0)
+	for _, subscription := range m.subscriptions {
+		serialized = append(serialized, subscription.Serialize())
+	}
+	return serialized
+}
+
+func (m *WebhookManager) SerializeDeliveries() []WebhookDelivery {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	serialized := make([]WebhookDelivery, 0)
+	for i := len(m.deliveries) - 1; i >= 0; i-- {
+		serialized = append(serialized, *m.deliveries[i])
+	}
+	return serialized
+}
+
+// Dispatch sends the payload to every subscription interested in the event.
+// Deliveries run in the background so enrollments are never held back by a
+// slow or unreachable subscriber.
+func (m *WebhookManager) Dispatch(payload WebhookPayload) {
+	if m == nil {
+		return
+	}
+
+	payload.ID = newRandomID()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("error serializing webhook payload:", err)
+		return
+	}
+
+	m.lock.Lock()
+	subscriptions := []WebhookSubscription{}
+	for _, subscription := range m.subscriptions {
+		if subscription.subscribedTo(payload.Event) {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, subscription := range subscriptions {
+		delivery := &WebhookDelivery{
+			ID:             payload.ID + "-" + subscription.ID,
+			SubscriptionID: subscription.ID,
+			URL:            subscription.URL,
+			Event:          payload.Event,
+			Status:         WebhookDeliveryStatusPending,
+			CreatedAt:      time.Now(),
+		}
+
+		m.lock.Lock()
+		m.deliveries = append(m.deliveries, delivery)
+		if len(m.deliveries) > webhookDeliveryLogSize {
+			m.deliveries = m.deliveries[len(m.deliveries)-webhookDeliveryLogSize:]
+		}
+		m.lock.Unlock()
+
+		go m.deliver(subscription, delivery, payload.ID, body)
+	}
+
+	if len(subscriptions) > 0 {
+		m.notifyUpdate()
+	}
+}
+
+func (m *WebhookManager) deliver(subscription WebhookSubscription, delivery *WebhookDelivery, payloadID string, body []byte) {
+	backoff := webhookInitialBackoff
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		statusCode, err := m.post(subscription, delivery.Event, payloadID, body)
+
+		m.lock.Lock()
+		delivery.Attempts = attempt
+		delivery.LastStatusCode = statusCode
+		delivery.LastError = ""
+		delivery.NextRetryAt = nil
+		if err != nil {
+			delivery.LastError = err.Error()
+		}
+
+		if err == nil {
+			delivery.Status = WebhookDeliveryStatusDelivered
+		} else if attempt == webhookMaxAttempts {
+			delivery.Status = WebhookDeliveryStatusFailed
+		} else {
+			nextRetry := time.Now().Add(backoff)
+			delivery.Status = WebhookDeliveryStatusRetrying
+			delivery.NextRetryAt = &nextRetry
+		}
+		status := delivery.Status
+		m.lock.Unlock()
+
+		m.notifyUpdate()
+		if status != WebhookDeliveryStatusRetrying {
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (m *WebhookManager) post(subscription WebhookSubscription, event WebhookEventType, payloadID string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-VDMS-Event", string(event))
+	req.Header.Set("X-VDMS-Delivery", payloadID)
+	req.Header.Set("X-VDMS-Timestamp", timestamp)
+	if subscription.Secret != "" {
+		req.Header.Set("X-VDMS-Signature", "sha256="+signWebhookPayload(subscription.Secret, timestamp, body))
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("subscriber responded with status code %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (m *WebhookManager) notifyUpdate() {
+	if m.onUpdate != nil {
+		m.onUpdate()
+	}
+}
+
+// signWebhookPayload computes the HMAC-SHA256 of "<timestamp>.<body>". Including
+// the timestamp lets subscribers reject replayed deliveries.
+func signWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newRandomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// dispatchWebhookEvent notifies subscribers using the current DMS state and
+// the given enrollment, which may be nil.
+func dispatchWebhookEvent(event WebhookEventType, enrollment *EnrollmentInProcess, errMsg string) {
+	dms := currentDMS()
+	payload := WebhookPayload{
+		Event:     event,
+		Timestamp: time.Now(),
+		DMS:       dms.Serialize(),
+		Error:     errMsg,
+	}
+
+	if enrollment != nil {
+		snapshot := enrollmentSnapshot(enrollment)
+		serialized := snapshot.Serialize()
+		payload.Enrollment = &serialized
+	}
+
+	SingeltonInstance.Webhooks.Dispatch(payload)
+}
+
+func sendWebhooksUpdate() {
+	sendWebSocketMessage(
+		WebSocketMessage{
+			Type: "WEBHOOKS_UPDATE",
+			Message: map[string]interface{}{
+				"subscriptions": SingeltonInstance.Webhooks.SerializeSubscriptions(),
+				"deliveries":    SingeltonInstance.Webhooks.SerializeDeliveries(),
+			},
+			Timestamp: time.Now(),
+		},
+	)
+}
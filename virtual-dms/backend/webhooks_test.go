@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestSignWebhookPayload(t *testing.T) {
+	body := []byte(`{"event":"CERTIFICATE_ISSUED"}`)
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      []byte
+		want      string
+	}{
+		{
+			name:      "signs timestamp and body",
+			secret:    "s3cr3t",
+			timestamp: "1700000000",
+			body:      body,
+			want:      "42fd1c1672ea6b14c7432bb171bbb7331ec7ddecebc3fcab541332be903e6043",
+		},
+		{
+			name:      "timestamp is part of the signature",
+			secret:    "s3cr3t",
+			timestamp: "1700000001",
+			body:      body,
+			want:      "751a387cdeb306894946d2fd794297a4bcd2ef8466ca379248b81769ccead4e4",
+		},
+		{
+			name:      "secret is part of the signature",
+			secret:    "other",
+			timestamp: "1700000000",
+			body:      body,
+			want:      "acfef195a3ea3b1a8299c2522c9c1c1aa12f078774aa229242b022ff74f880db",
+		},
+		{
+			name:      "empty body",
+			secret:    "s3cr3t",
+			timestamp: "1700000000",
+			body:      nil,
+			want:      "f63f1341b06e485fe1fe78cbfd5f6d4cee0d492c21bbc3333af817254d0db38a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := signWebhookPayload(tt.secret, tt.timestamp, tt.body)
+			if got != tt.want {
+				t.Errorf("signWebhookPayload() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -13,6 +13,12 @@ import * as dmsSelector from "ducks/features/dms/reducer"
 import { useDispatch } from "react-redux"
 import { ActionType } from "ducks/features/websocket/actionTypes"
 import { ArrowSeparator } from "components/ArrowSeparator"
+import { WebhooksPanel } from "components/WebhooksPanel"
+import { BacklogPanel } from "components/BacklogPanel"
+import { ManifestPanel } from "components/ManifestPanel"
+import { TokensPanel } from "components/TokensPanel"
+import { LedgerPanel } from "components/LedgerPanel"
+import { AdminPanel } from "components/AdminPanel"
 import CheckIcon from "@mui/icons-material/Check"
 
 const Android12Switch = styled(Switch)(({ theme }) => ({
@@ -176,59 +182,63 @@ const App = () => {
                             {
                                 dmsState.status === "EMPTY"
                                     ? (
-                                        <Grid item xs={3} container>
-                                            <Box bgcolor="#1F2933" component={Paper} padding="30px 40px 40px 40px" flex="1">
-                                                <Grid container spacing="80px">
-                                                    <Grid item xs={12} container spacing="30px">
-                                                        <Grid item container flexDirection="column">
-                                                            <Grid item>
-                                                                <Typography color="#B2B3B7" fontSize="23px" fontWeight="400">Operator Username</Typography>
-                                                            </Grid>
-                                                            <Grid item>
-                                                                <TextField label="" variant="standard" value={operatorUsername} fullWidth onChange={(ev) => { setOperatorUsername(ev.target.value) }} />
-                                                            </Grid>
-                                                        </Grid>
-                                                        <Grid item container flexDirection="column">
-                                                            <Grid item>
-                                                                <Typography color="#B2B3B7" fontSize="23px" fontWeight="400">Operator Password</Typography>
+                                        <>
+                                            <Grid item xs={3} container>
+                                                <Box bgcolor="#1F2933" component={Paper} padding="30px 40px 40px 40px" flex="1">
+                                                    <Grid container spacing="80px">
+                                                        <Grid item xs={12} container spacing="30px">
+                                                            <Grid item container flexDirection="column">
+                                                                <Grid item>
+                                                                    <Typography color="#B2B3B7" fontSize="23px" fontWeight="400">Operator Username</Typography>
+                                                                </Grid>
+                                                                <Grid item>
+                                                                    <TextField label="" variant="standard" value={operatorUsername} fullWidth onChange={(ev) => { setOperatorUsername(ev.target.value) }} />
+                                                                </Grid>
                                                             </Grid>
-                                                            <Grid item>
-                                                                <TextField label="" variant="standard" value={operatorPassword} fullWidth onChange={(ev) => { setOperatorPassword(ev.target.value) }} />
+                                                            <Grid item container flexDirection="column">
+                                                                <Grid item>
+                                                                    <Typography color="#B2B3B7" fontSize="23px" fontWeight="400">Operator Password</Typography>
+                                                                </Grid>
+                                                                <Grid item>
+                                                                    <TextField label="" variant="standard" value={operatorPassword} fullWidth onChange={(ev) => { setOperatorPassword(ev.target.value) }} />
+                                                                </Grid>
                                                             </Grid>
                                                         </Grid>
-                                                    </Grid>
-                                                    <Grid item xs={12} container spacing="30px">
-                                                        <Grid item container flexDirection="column">
-                                                            <Grid item>
-                                                                <Typography color="#B2B3B7" fontSize="23px" fontWeight="400">DMS Name</Typography>
-                                                            </Grid>
-                                                            <Grid item>
-                                                                <TextField label="" variant="standard" fullWidth value={registerDMSName} onChange={(ev) => setRegisterDMSName(ev.target.value)} />
+                                                        <Grid item xs={12} container spacing="30px">
+                                                            <Grid item container flexDirection="column">
+                                                                <Grid item>
+                                                                    <Typography color="#B2B3B7" fontSize="23px" fontWeight="400">DMS Name</Typography>
+                                                                </Grid>
+                                                                <Grid item>
+                                                                    <TextField label="" variant="standard" fullWidth value={registerDMSName} onChange={(ev) => setRegisterDMSName(ev.target.value)} />
+                                                                </Grid>
                                                             </Grid>
-                                                        </Grid>
-                                                        <Grid item container flexDirection="column">
-                                                            <Grid item>
-                                                                <Button variant="contained" onClick={() => {
-                                                                    dispatch({
-                                                                        type: ActionType.WS_SEND_MESSAGE,
-                                                                        value: {
-                                                                            type: "CFG",
-                                                                            time: Date.now(),
-                                                                            message: {
-                                                                                operator_username: operatorUsername,
-                                                                                operator_password: operatorPassword,
-                                                                                dms_name: registerDMSName
+                                                            <Grid item container flexDirection="column">
+                                                                <Grid item>
+                                                                    <Button variant="contained" onClick={() => {
+                                                                        dispatch({
+                                                                            type: ActionType.WS_SEND_MESSAGE,
+                                                                            value: {
+                                                                                type: "CFG",
+                                                                                time: Date.now(),
+                                                                                message: {
+                                                                                    operator_username: operatorUsername,
+                                                                                    operator_password: operatorPassword,
+                                                                                    dms_name: registerDMSName
+                                                                                }
                                                                             }
-                                                                        }
-                                                                    })
-                                                                }}>Register</Button>
+                                                                        })
+                                                                    }}>Register</Button>
+                                                                </Grid>
                                                             </Grid>
                                                         </Grid>
                                                     </Grid>
-                                                </Grid>
-                                            </Box>
-                                        </Grid>
-
+                                                </Box>
+                                            </Grid>
+                                            <Grid item xs={9} container>
+                                                <AdminPanel />
+                                            </Grid>
+                                        </>
                                     )
                                     : (
                                         <Grid item container direction={"column"} spacing={"40px"} sx={{ padding: "60px 0px" }}>
@@ -471,6 +481,24 @@ const App = () => {
                                                     </Box>
                                                 </Grid>
                                             </Grid>
+                                            <Grid item xs="auto" container>
+                                                <WebhooksPanel />
+                                            </Grid>
+                                            <Grid item xs="auto" container>
+                                                <BacklogPanel />
+                                            </Grid>
+                                            <Grid item xs="auto" container>
+                                                <ManifestPanel />
+                                            </Grid>
+                                            <Grid item xs="auto" container>
+                                                <TokensPanel />
+                                            </Grid>
+                                            <Grid item xs="auto" container>
+                                                <LedgerPanel />
+                                            </Grid>
+                                            <Grid item xs="auto" container>
+                                                <AdminPanel />
+                                            </Grid>
                                         </Grid>
                                     )
                             }
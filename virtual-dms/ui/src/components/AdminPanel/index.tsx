@@ -0,0 +1,163 @@
+import React, { useState } from "react"
+import { Box, Button, Grid, MenuItem, Paper, Select, Table, TableBody, TableCell, TableHead, TableRow, TextField, Typography } from "@mui/material"
+import { useDispatch } from "react-redux"
+import moment from "moment"
+import { useAppSelector } from "ducks/hooks"
+import * as adminSelector from "ducks/features/admin/reducer"
+import { ActionType } from "ducks/features/websocket/actionTypes"
+
+const dmsStatuses = ["PENDING_APPROVAL", "APPROVED", "REJECTED", "REVOKED", "EXPIRED"]
+
+export const AdminPanel: React.FC = () => {
+    const dispatch = useDispatch()
+    const adminState = useAppSelector((state: any) => adminSelector.getState(state))
+
+    const [operatorUsername, setOperatorUsername] = useState("")
+    const [operatorPassword, setOperatorPassword] = useState("")
+    const [editedAuthorizedCAs, setEditedAuthorizedCAs] = useState<{ [name: string]: string }>({})
+    const [adoptingDMS, setAdoptingDMS] = useState("")
+    const [adoptPrivateKey, setAdoptPrivateKey] = useState("")
+    const [adoptCertificate, setAdoptCertificate] = useState("")
+
+    const sendCommand = (type: string, message: any) => {
+        dispatch({
+            type: ActionType.WS_SEND_MESSAGE,
+            value: {
+                type: type,
+                message: message,
+                time: Date.now()
+            }
+        })
+    }
+
+    return (
+        <Box bgcolor="#1F2933" component={Paper} padding="20px" flex="1">
+            <Grid container spacing={2}>
+                <Grid item xs={12} container alignItems="center">
+                    <Grid item xs>
+                        <Typography color="#B2B3B7" fontSize="23px" fontWeight="400">Lamassu DMSs</Typography>
+                    </Grid>
+                    <Grid item xs="auto">
+                        <Button variant="outlined" onClick={() => sendCommand("ADMIN_LIST_DMSS", {})}>Refresh</Button>
+                    </Grid>
+                </Grid>
+                {
+                    !adminState.loggedIn && (
+                        <Grid item xs={12} container spacing={2} alignItems="flex-end">
+                            <Grid item xs>
+                                <TextField label="Operator Username" variant="standard" fullWidth value={operatorUsername} onChange={(ev) => setOperatorUsername(ev.target.value)} />
+                            </Grid>
+                            <Grid item xs>
+                                <TextField label="Operator Password" type="password" variant="standard" fullWidth value={operatorPassword} onChange={(ev) => setOperatorPassword(ev.target.value)} />
+                            </Grid>
+                            <Grid item xs="auto">
+                                <Button variant="contained" disabled={operatorUsername === ""} onClick={() => {
+                                    sendCommand("ADMIN_LOGIN", {
+                                        operator_username: operatorUsername,
+                                        operator_password: operatorPassword
+                                    })
+                                    setOperatorPassword("")
+                                }}>Log In</Button>
+                            </Grid>
+                        </Grid>
+                    )
+                }
+                {
+                    adminState.loggedIn && (
+                        <Grid item xs={12}>
+                            <Table size="small">
+                                <TableHead>
+                                    <TableRow>
+                                        <TableCell>Name</TableCell>
+                                        <TableCell>Status</TableCell>
+                                        <TableCell>Key</TableCell>
+                                        <TableCell>Created</TableCell>
+                                        <TableCell>Authorized CAs</TableCell>
+                                        <TableCell>Actions</TableCell>
+                                    </TableRow>
+                                </TableHead>
+                                <TableBody>
+                                    {
+                                        adminState.dmss.map((dms) => (
+                                            <TableRow key={dms.name} selected={dms.adopted}>
+                                                <TableCell>{dms.name}{dms.adopted ? " (this vDMS)" : ""}</TableCell>
+                                                <TableCell>
+                                                    <Select value={dms.status} size="small" variant="standard" onChange={(ev) => sendCommand("ADMIN_UPDATE_DMS_STATUS", { name: dms.name, status: ev.target.value })}>
+                                                        {
+                                                            dmsStatuses.map((status) => (
+                                                                <MenuItem key={status} value={status}>{status}</MenuItem>
+                                                            ))
+                                                        }
+                                                    </Select>
+                                                </TableCell>
+                                                <TableCell>{dms.key_type} {dms.key_bits}</TableCell>
+                                                <TableCell>{dms.creation_timestamp ? moment(dms.creation_timestamp).format("DD/MM/YYYY HH:mm:ss") : "-"}</TableCell>
+                                                <TableCell>
+                                                    <TextField
+                                                        variant="standard"
+                                                        size="small"
+                                                        fullWidth
+                                                        value={editedAuthorizedCAs[dms.name] ?? dms.authorized_cas.join(", ")}
+                                                        onChange={(ev) => setEditedAuthorizedCAs({ ...editedAuthorizedCAs, [dms.name]: ev.target.value })}
+                                                    />
+                                                </TableCell>
+                                                <TableCell>
+                                                    <Grid container spacing={1} wrap="nowrap">
+                                                        <Grid item>
+                                                            <Button size="small" variant="outlined" disabled={editedAuthorizedCAs[dms.name] === undefined} onClick={() => {
+                                                                sendCommand("ADMIN_UPDATE_DMS_AUTHORIZED_CAS", {
+                                                                    name: dms.name,
+                                                                    authorized_cas: editedAuthorizedCAs[dms.name].split(",").map((ca) => ca.trim()).filter((ca) => ca !== "")
+                                                                })
+                                                                const others = { ...editedAuthorizedCAs }
+                                                                delete others[dms.name]
+                                                                setEditedAuthorizedCAs(others)
+                                                            }}>Save CAs</Button>
+                                                        </Grid>
+                                                        <Grid item>
+                                                            <Button size="small" variant="contained" disabled={dms.adopted} onClick={() => setAdoptingDMS(dms.name)}>Adopt</Button>
+                                                        </Grid>
+                                                    </Grid>
+                                                </TableCell>
+                                            </TableRow>
+                                        ))
+                                    }
+                                </TableBody>
+                            </Table>
+                        </Grid>
+                    )
+                }
+                {
+                    adoptingDMS !== "" && (
+                        <Grid item xs={12} container spacing={2} alignItems="flex-end">
+                            <Grid item xs={12}>
+                                <Typography color="#B2B3B7" fontSize="15px" fontWeight="400">Adopt {adoptingDMS}, its private key never leaves the DMS that created it and has to be imported</Typography>
+                            </Grid>
+                            <Grid item xs={6}>
+                                <TextField label="Private Key (PEM)" variant="standard" multiline minRows={3} fullWidth value={adoptPrivateKey} onChange={(ev) => setAdoptPrivateKey(ev.target.value)} />
+                            </Grid>
+                            <Grid item xs={6}>
+                                <TextField label="Certificate (PEM, optional)" variant="standard" multiline minRows={3} fullWidth value={adoptCertificate} onChange={(ev) => setAdoptCertificate(ev.target.value)} />
+                            </Grid>
+                            <Grid item xs="auto">
+                                <Button variant="contained" disabled={adoptPrivateKey === ""} onClick={() => {
+                                    sendCommand("ADMIN_ADOPT_DMS", {
+                                        name: adoptingDMS,
+                                        private_key: btoa(adoptPrivateKey.trim() + "\n"),
+                                        certificate: adoptCertificate !== "" ? btoa(adoptCertificate.trim() + "\n") : ""
+                                    })
+                                    setAdoptingDMS("")
+                                    setAdoptPrivateKey("")
+                                    setAdoptCertificate("")
+                                }}>Adopt</Button>
+                            </Grid>
+                            <Grid item xs="auto">
+                                <Button variant="outlined" onClick={() => setAdoptingDMS("")}>Cancel</Button>
+                            </Grid>
+                        </Grid>
+                    )
+                }
+            </Grid>
+        </Box>
+    )
+}
@@ -0,0 +1,125 @@
+import React, { useEffect } from "react"
+import { Box, Button, Grid, Paper, Table, TableBody, TableCell, TableHead, TableRow, Typography } from "@mui/material"
+import { useDispatch } from "react-redux"
+import moment from "moment"
+import { useAppSelector } from "ducks/hooks"
+import * as backlogSelector from "ducks/features/backlog/reducer"
+import { ActionType } from "ducks/features/websocket/actionTypes"
+
+const linkStateColors: { [state: string]: string } = {
+    UNKNOWN: "#B2B3B7",
+    UP: "#25ee32",
+    DOWN: "#FF5A5A"
+}
+
+const formatDate = (date?: Date) => {
+    return date ? moment(date).format("DD/MM/YYYY HH:mm:ss") : "-"
+}
+
+export const BacklogPanel: React.FC = () => {
+    const dispatch = useDispatch()
+    const backlogState = useAppSelector((state: any) => backlogSelector.getState(state))
+
+    useEffect(() => {
+        dispatch({
+            type: ActionType.WS_SEND_MESSAGE,
+            value: {
+                type: "GET_ENROLLMENT_BACKLOG",
+                time: Date.now()
+            }
+        })
+    }, [])
+
+    const sendCommand = (type: string, message: any) => {
+        dispatch({
+            type: ActionType.WS_SEND_MESSAGE,
+            value: {
+                type: type,
+                message: message,
+                time: Date.now()
+            }
+        })
+    }
+
+    return (
+        <Box bgcolor="#1F2933" component={Paper} padding="20px" flex="1">
+            <Grid container spacing={2}>
+                <Grid item xs={12} container alignItems="center">
+                    <Grid item xs>
+                        <Typography color="#B2B3B7" fontSize="23px" fontWeight="400">Enrollment Backlog</Typography>
+                    </Grid>
+                    <Grid item xs="auto">
+                        <Typography color={linkStateColors[backlogState.linkState]} fontSize="18px" fontWeight="400">Gateway {backlogState.linkState}</Typography>
+                    </Grid>
+                </Grid>
+                <Grid item xs={6}>
+                    <Typography color="#B2B3B7" fontSize="15px" fontWeight="400">Last Gateway Check</Typography>
+                    <Typography color="#DEE2E7" fontSize="18px" fontWeight="400">{formatDate(backlogState.lastLinkCheck)}</Typography>
+                </Grid>
+                <Grid item xs={6}>
+                    <Typography color="#B2B3B7" fontSize="15px" fontWeight="400">Next Retry</Typography>
+                    <Typography color="#DEE2E7" fontSize="18px" fontWeight="400">{formatDate(backlogState.nextRetryAt)}</Typography>
+                </Grid>
+                <Grid item xs={12}>
+                    {
+                        backlogState.backlog.length > 0
+                            ? (
+                                <Table size="small">
+                                    <TableHead>
+                                        <TableRow>
+                                            <TableCell>Queued</TableCell>
+                                            <TableCell>Device ID</TableCell>
+                                            <TableCell>Slot</TableCell>
+                                            <TableCell>CA</TableCell>
+                                            <TableCell>Status</TableCell>
+                                            <TableCell>Attempts</TableCell>
+                                            <TableCell>Next Retry</TableCell>
+                                            <TableCell>Last Error</TableCell>
+                                            <TableCell>Actions</TableCell>
+                                        </TableRow>
+                                    </TableHead>
+                                    <TableBody>
+                                        {
+                                            backlogState.backlog.map((item) => (
+                                                <TableRow key={item.id}>
+                                                    <TableCell>{formatDate(item.queued_at)}</TableCell>
+                                                    <TableCell>{item.device_id}</TableCell>
+                                                    <TableCell>{item.device_slot}</TableCell>
+                                                    <TableCell>{item.issuing_ca}</TableCell>
+                                                    <TableCell>{item.status}</TableCell>
+                                                    <TableCell>{item.attempts}</TableCell>
+                                                    <TableCell>{item.status === "QUEUED" ? formatDate(item.next_retry_at) : "-"}</TableCell>
+                                                    <TableCell>{item.last_error}</TableCell>
+                                                    <TableCell>
+                                                        <Grid container spacing={1} wrap="nowrap">
+                                                            {
+                                                                item.status === "AWAITING_TRANSFER" && (
+                                                                    <Grid item>
+                                                                        <Button size="small" variant="contained" onClick={() => sendCommand("AUTH_QUEUED_TRANSFER", { id: item.id })}>Transfer</Button>
+                                                                    </Grid>
+                                                                )
+                                                            }
+                                                            {
+                                                                (item.status === "QUEUED" || item.status === "AWAITING_TRANSFER") && (
+                                                                    <Grid item>
+                                                                        <Button size="small" variant="outlined" onClick={() => sendCommand("REJECT_ENROLLMENT", { id: item.id })}>Reject</Button>
+                                                                    </Grid>
+                                                                )
+                                                            }
+                                                        </Grid>
+                                                    </TableCell>
+                                                </TableRow>
+                                            ))
+                                        }
+                                    </TableBody>
+                                </Table>
+                            )
+                            : (
+                                <Typography color="#DEE2E7" fontStyle="italic" fontSize="18px" fontWeight="400">No enrollment is waiting for the gateway</Typography>
+                            )
+                    }
+                </Grid>
+            </Grid>
+        </Box>
+    )
+}
@@ -0,0 +1,150 @@
+import React from "react"
+import { Box, FormControlLabel, Grid, MenuItem, Paper, Select, Switch, Table, TableBody, TableCell, TableHead, TableRow, TextField, Typography } from "@mui/material"
+import { useDispatch } from "react-redux"
+import moment from "moment"
+import { useAppSelector } from "ducks/hooks"
+import * as dmsSelector from "ducks/features/dms/reducer"
+import { ActionType } from "ducks/features/websocket/actionTypes"
+
+const identityStatusColors: { [status: string]: string } = {
+    ACTIVE: "#25ee32",
+    SUPERSEDED: "#FFA32A",
+    REVOKED: "#FF5A5A"
+}
+
+const formatTimestamp = (timestamp: number) => {
+    return timestamp ? moment(timestamp).format("DD/MM/YYYY HH:mm:ss") : "-"
+}
+
+export const LedgerPanel: React.FC = () => {
+    const dispatch = useDispatch()
+    const dmsState = useAppSelector((state: any) => dmsSelector.getState(state))
+
+    const configureRepeatEnrollment = (policy: string, maxActiveCertificatesPerSlot: number, revokeSuperseded: boolean) => {
+        dispatch({
+            type: ActionType.WS_SEND_MESSAGE,
+            value: {
+                type: "CFG_REPEAT_ENROLLMENT",
+                message: {
+                    policy: policy,
+                    max_active_certificates_per_slot: maxActiveCertificatesPerSlot,
+                    revoke_superseded: revokeSuperseded
+                },
+                time: Date.now()
+            }
+        })
+    }
+
+    // Every identity of a slot carries the count of the whole slot.
+    const activeCertificatesBySlot: { [slot: string]: number } = {}
+    dmsState.enrolledIdentities.forEach((identity) => {
+        const slot = `${identity.device_id} / ${identity.device_slot}`
+        if (activeCertificatesBySlot[slot] === undefined) {
+            activeCertificatesBySlot[slot] = identity.active_certificates
+        }
+    })
+
+    return (
+        <Box bgcolor="#1F2933" component={Paper} padding="20px" flex="1">
+            <Grid container spacing={2}>
+                <Grid item xs={12}>
+                    <Typography color="#B2B3B7" fontSize="23px" fontWeight="400">Enrolled Identities</Typography>
+                </Grid>
+                <Grid item xs={12} container spacing={4} alignItems="flex-end">
+                    <Grid item xs="auto">
+                        <Typography color="#B2B3B7" fontSize="15px" fontWeight="400">Repeated enrollments</Typography>
+                        <Select
+                            value={dmsState.repeatEnrollmentPolicy}
+                            onChange={(ev) => configureRepeatEnrollment(ev.target.value, dmsState.maxActiveCertificatesPerSlot, dmsState.revokeSupersededCertificates)}
+                            size="small"
+                            variant="standard"
+                        >
+                            <MenuItem value="ALLOW">Allow</MenuItem>
+                            <MenuItem value="REJECT">Reject</MenuItem>
+                            <MenuItem value="SUPERSEDE">Supersede</MenuItem>
+                        </Select>
+                    </Grid>
+                    {
+                        dmsState.repeatEnrollmentPolicy === "ALLOW" && (
+                            <Grid item xs={3}>
+                                <TextField
+                                    label="Max active certificates per slot"
+                                    helperText="0 means unlimited"
+                                    type="number"
+                                    variant="standard"
+                                    fullWidth
+                                    value={dmsState.maxActiveCertificatesPerSlot}
+                                    onChange={(ev) => configureRepeatEnrollment(dmsState.repeatEnrollmentPolicy, Math.max(0, parseInt(ev.target.value) || 0), dmsState.revokeSupersededCertificates)}
+                                />
+                            </Grid>
+                        )
+                    }
+                    {
+                        dmsState.repeatEnrollmentPolicy === "SUPERSEDE" && (
+                            <Grid item xs="auto">
+                                <FormControlLabel
+                                    label="Revoke superseded certificates"
+                                    control={<Switch checked={dmsState.revokeSupersededCertificates} onChange={(ev, checked) => configureRepeatEnrollment(dmsState.repeatEnrollmentPolicy, dmsState.maxActiveCertificatesPerSlot, checked)} />}
+                                />
+                            </Grid>
+                        )
+                    }
+                </Grid>
+                {
+                    Object.keys(activeCertificatesBySlot).length > 0 && (
+                        <Grid item xs={12} container spacing={2}>
+                            {
+                                Object.keys(activeCertificatesBySlot).sort().map((slot) => (
+                                    <Grid item xs={3} key={slot}>
+                                        <Typography color="#B2B3B7" fontSize="15px" fontWeight="400">{slot}</Typography>
+                                        <Typography color="#DEE2E7" fontSize="18px" fontWeight="400">{activeCertificatesBySlot[slot]} active</Typography>
+                                    </Grid>
+                                ))
+                            }
+                        </Grid>
+                    )
+                }
+                <Grid item xs={12}>
+                    {
+                        dmsState.enrolledIdentities.length > 0
+                            ? (
+                                <Table size="small">
+                                    <TableHead>
+                                        <TableRow>
+                                            <TableCell>Enrolled</TableCell>
+                                            <TableCell>Device ID</TableCell>
+                                            <TableCell>Slot</TableCell>
+                                            <TableCell>Serial Number</TableCell>
+                                            <TableCell>CA</TableCell>
+                                            <TableCell>Status</TableCell>
+                                            <TableCell>Superseded By</TableCell>
+                                            <TableCell>Expiration</TableCell>
+                                        </TableRow>
+                                    </TableHead>
+                                    <TableBody>
+                                        {
+                                            dmsState.enrolledIdentities.map((identity) => (
+                                                <TableRow key={identity.serial_number}>
+                                                    <TableCell>{formatTimestamp(identity.enrolled_timestamp)}</TableCell>
+                                                    <TableCell>{identity.device_id}</TableCell>
+                                                    <TableCell>{identity.device_slot}</TableCell>
+                                                    <TableCell>{identity.serial_number}</TableCell>
+                                                    <TableCell>{identity.issuing_ca}</TableCell>
+                                                    <TableCell sx={{ color: identityStatusColors[identity.status] }} title={identity.revocation_error}>{identity.status}</TableCell>
+                                                    <TableCell>{identity.superseded_by !== "" ? `${identity.superseded_by} (${formatTimestamp(identity.superseded_timestamp)})` : "-"}</TableCell>
+                                                    <TableCell>{formatTimestamp(identity.expiration_date)}</TableCell>
+                                                </TableRow>
+                                            ))
+                                        }
+                                    </TableBody>
+                                </Table>
+                            )
+                            : (
+                                <Typography color="#DEE2E7" fontStyle="italic" fontSize="18px" fontWeight="400">No device has been enrolled yet</Typography>
+                            )
+                    }
+                </Grid>
+            </Grid>
+        </Box>
+    )
+}
@@ -0,0 +1,178 @@
+import React, { useEffect, useState } from "react"
+import { Box, Button, Checkbox, FormControlLabel, Grid, IconButton, MenuItem, Paper, Select, Switch, Table, TableBody, TableCell, TableHead, TableRow, TextField, Typography } from "@mui/material"
+import DeleteOutlineOutlinedIcon from "@mui/icons-material/DeleteOutlineOutlined"
+import ReplayIcon from "@mui/icons-material/Replay"
+import { useDispatch } from "react-redux"
+import { useAppSelector } from "ducks/hooks"
+import * as manifestSelector from "ducks/features/manifest/reducer"
+import { ActionType } from "ducks/features/websocket/actionTypes"
+
+const slotStatusColors: { [status: string]: string } = {
+    PENDING: "#B2B3B7",
+    ENROLLING: "#FFA32A",
+    ENROLLED: "#25ee32",
+    FAILED: "#FF5A5A"
+}
+
+export const ManifestPanel: React.FC = () => {
+    const dispatch = useDispatch()
+    const manifestState = useAppSelector((state: any) => manifestSelector.getState(state))
+
+    const [serialNumber, setSerialNumber] = useState("")
+    const [model, setModel] = useState("")
+    const [allowedSlots, setAllowedSlots] = useState("")
+    const [importFormat, setImportFormat] = useState("csv")
+    const [importContent, setImportContent] = useState("")
+    const [importReplace, setImportReplace] = useState(false)
+
+    useEffect(() => {
+        dispatch({
+            type: ActionType.WS_SEND_MESSAGE,
+            value: {
+                type: "GET_DEVICE_MANIFEST",
+                time: Date.now()
+            }
+        })
+    }, [])
+
+    const sendCommand = (type: string, message: any) => {
+        dispatch({
+            type: ActionType.WS_SEND_MESSAGE,
+            value: {
+                type: type,
+                message: message,
+                time: Date.now()
+            }
+        })
+    }
+
+    return (
+        <Box bgcolor="#1F2933" component={Paper} padding="20px" flex="1">
+            <Grid container spacing={2}>
+                <Grid item xs={12} container alignItems="center">
+                    <Grid item xs>
+                        <Typography color="#B2B3B7" fontSize="23px" fontWeight="400">Device Manifest</Typography>
+                    </Grid>
+                    <Grid item xs="auto">
+                        <FormControlLabel
+                            label="Only enroll registered devices"
+                            control={<Switch checked={manifestState.enforced} onChange={(ev, checked) => sendCommand("CFG_ENFORCE_MANIFEST", { enforce: checked })} />}
+                        />
+                    </Grid>
+                </Grid>
+                <Grid item xs={12}>
+                    {
+                        manifestState.devices.length > 0
+                            ? (
+                                <Table size="small">
+                                    <TableHead>
+                                        <TableRow>
+                                            <TableCell>Serial Number</TableCell>
+                                            <TableCell>Model</TableCell>
+                                            <TableCell>Slots</TableCell>
+                                            <TableCell>Last Rejection</TableCell>
+                                            <TableCell>Actions</TableCell>
+                                        </TableRow>
+                                    </TableHead>
+                                    <TableBody>
+                                        {
+                                            manifestState.devices.map((device) => (
+                                                <TableRow key={device.serial_number}>
+                                                    <TableCell>{device.serial_number}</TableCell>
+                                                    <TableCell>{device.model}</TableCell>
+                                                    <TableCell>
+                                                        {
+                                                            Object.keys(device.slots).sort().map((slot) => (
+                                                                <Typography key={slot} fontSize="13px" color={slotStatusColors[device.slots[slot].status]}>
+                                                                    {slot}: {device.slots[slot].status}{device.slots[slot].serial_number ? ` (${device.slots[slot].serial_number})` : ""}
+                                                                </Typography>
+                                                            ))
+                                                        }
+                                                    </TableCell>
+                                                    <TableCell>{device.last_rejection}</TableCell>
+                                                    <TableCell>
+                                                        <IconButton title="Reset slots" onClick={() => sendCommand("RESET_MANIFEST_DEVICE", { serial_number: device.serial_number })}>
+                                                            <ReplayIcon />
+                                                        </IconButton>
+                                                        <IconButton title="Remove" onClick={() => sendCommand("REMOVE_MANIFEST_DEVICE", { serial_number: device.serial_number })}>
+                                                            <DeleteOutlineOutlinedIcon />
+                                                        </IconButton>
+                                                    </TableCell>
+                                                </TableRow>
+                                            ))
+                                        }
+                                    </TableBody>
+                                </Table>
+                            )
+                            : (
+                                <Typography color="#DEE2E7" fontStyle="italic" fontSize="18px" fontWeight="400">No device has been registered</Typography>
+                            )
+                    }
+                </Grid>
+                <Grid item xs={12} container spacing={2} alignItems="flex-end">
+                    <Grid item xs>
+                        <TextField label="Serial Number" variant="standard" fullWidth value={serialNumber} onChange={(ev) => setSerialNumber(ev.target.value)} />
+                    </Grid>
+                    <Grid item xs>
+                        <TextField label="Model" variant="standard" fullWidth value={model} onChange={(ev) => setModel(ev.target.value)} />
+                    </Grid>
+                    <Grid item xs>
+                        <TextField label="Allowed Slots" placeholder="default, backup" variant="standard" fullWidth value={allowedSlots} onChange={(ev) => setAllowedSlots(ev.target.value)} />
+                    </Grid>
+                    <Grid item xs="auto">
+                        <Button variant="contained" disabled={serialNumber === ""} onClick={() => {
+                            sendCommand("ADD_MANIFEST_DEVICE", {
+                                serial_number: serialNumber,
+                                model: model,
+                                allowed_slots: allowedSlots.split(",").map((slot) => slot.trim()).filter((slot) => slot !== "")
+                            })
+                            setSerialNumber("")
+                            setModel("")
+                            setAllowedSlots("")
+                        }}>Register Device</Button>
+                    </Grid>
+                </Grid>
+                <Grid item xs={12} container spacing={2} alignItems="flex-end">
+                    <Grid item xs={12}>
+                        <TextField label="Import Manifest" variant="standard" multiline minRows={3} fullWidth value={importContent} onChange={(ev) => setImportContent(ev.target.value)} />
+                    </Grid>
+                    <Grid item xs="auto">
+                        <Button variant="outlined" component="label">
+                            Load File
+                            <input type="file" accept=".csv,.json" hidden onChange={(ev) => {
+                                const file = ev.target.files?.[0]
+                                if (file === undefined) {
+                                    return
+                                }
+                                setImportFormat(file.name.toLowerCase().endsWith(".csv") ? "csv" : "json")
+                                file.text().then(setImportContent)
+                            }} />
+                        </Button>
+                    </Grid>
+                    <Grid item xs="auto">
+                        <Select value={importFormat} onChange={(ev) => setImportFormat(ev.target.value)} size="small" variant="standard">
+                            <MenuItem value="csv">CSV</MenuItem>
+                            <MenuItem value="json">JSON</MenuItem>
+                        </Select>
+                    </Grid>
+                    <Grid item xs>
+                        <FormControlLabel
+                            label="Remove devices missing from the manifest"
+                            control={<Checkbox checked={importReplace} onChange={(ev, checked) => setImportReplace(checked)} />}
+                        />
+                    </Grid>
+                    <Grid item xs="auto">
+                        <Button variant="contained" disabled={importContent === ""} onClick={() => {
+                            sendCommand("IMPORT_DEVICE_MANIFEST", {
+                                format: importFormat,
+                                content: importContent,
+                                replace: importReplace
+                            })
+                            setImportContent("")
+                        }}>Import</Button>
+                    </Grid>
+                </Grid>
+            </Grid>
+        </Box>
+    )
+}
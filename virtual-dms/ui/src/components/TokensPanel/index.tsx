@@ -0,0 +1,139 @@
+import React, { useEffect, useState } from "react"
+import { Box, Button, Grid, IconButton, Paper, Table, TableBody, TableCell, TableHead, TableRow, TextField, Typography } from "@mui/material"
+import DeleteOutlineOutlinedIcon from "@mui/icons-material/DeleteOutlineOutlined"
+import { useDispatch } from "react-redux"
+import moment from "moment"
+import { useAppSelector } from "ducks/hooks"
+import * as tokensSelector from "ducks/features/tokens/reducer"
+import { ActionType } from "ducks/features/websocket/actionTypes"
+
+const formatDate = (date?: Date) => {
+    return date ? moment(date).format("DD/MM/YYYY HH:mm:ss") : "-"
+}
+
+export const TokensPanel: React.FC = () => {
+    const dispatch = useDispatch()
+    const tokensState = useAppSelector((state: any) => tokensSelector.getState(state))
+
+    const [claimSerialNumber, setClaimSerialNumber] = useState("")
+    const [claimCode, setClaimCode] = useState("")
+    const [tokenSerialNumber, setTokenSerialNumber] = useState("")
+    const [tokenTTLHours, setTokenTTLHours] = useState("24")
+
+    useEffect(() => {
+        dispatch({
+            type: ActionType.WS_SEND_MESSAGE,
+            value: {
+                type: "GET_ENROLLMENT_TOKENS",
+                time: Date.now()
+            }
+        })
+    }, [])
+
+    const sendCommand = (type: string, message: any) => {
+        dispatch({
+            type: ActionType.WS_SEND_MESSAGE,
+            value: {
+                type: type,
+                message: message,
+                time: Date.now()
+            }
+        })
+    }
+
+    return (
+        <Box bgcolor="#1F2933" component={Paper} padding="20px" flex="1">
+            <Grid container spacing={2}>
+                <Grid item xs={12}>
+                    <Typography color="#B2B3B7" fontSize="23px" fontWeight="400">Claim Device</Typography>
+                </Grid>
+                <Grid item xs={12} container spacing={2} alignItems="flex-end">
+                    <Grid item xs>
+                        <TextField label="Serial Number" variant="standard" fullWidth value={claimSerialNumber} onChange={(ev) => setClaimSerialNumber(ev.target.value)} />
+                    </Grid>
+                    <Grid item xs>
+                        <TextField label="Claim Code" placeholder="ABCD-EFGH" variant="standard" fullWidth value={claimCode} onChange={(ev) => setClaimCode(ev.target.value.toUpperCase())} />
+                    </Grid>
+                    <Grid item xs="auto">
+                        <Button variant="contained" disabled={claimSerialNumber === "" || claimCode === ""} onClick={() => {
+                            sendCommand("CLAIM_DEVICE", {
+                                serial_number: claimSerialNumber,
+                                claim_code: claimCode
+                            })
+                            setClaimSerialNumber("")
+                            setClaimCode("")
+                        }}>Claim</Button>
+                    </Grid>
+                </Grid>
+                <Grid item xs={12}>
+                    <Typography color="#B2B3B7" fontSize="23px" fontWeight="400">Enrollment Tokens</Typography>
+                </Grid>
+                <Grid item xs={12} container spacing={2} alignItems="flex-end">
+                    <Grid item xs>
+                        <TextField label="Serial Number" variant="standard" fullWidth value={tokenSerialNumber} onChange={(ev) => setTokenSerialNumber(ev.target.value)} />
+                    </Grid>
+                    <Grid item xs={2}>
+                        <TextField label="Valid For (hours)" type="number" variant="standard" fullWidth value={tokenTTLHours} onChange={(ev) => setTokenTTLHours(ev.target.value)} />
+                    </Grid>
+                    <Grid item xs="auto">
+                        <Button variant="contained" disabled={tokenSerialNumber === ""} onClick={() => {
+                            sendCommand("ISSUE_ENROLLMENT_TOKEN", {
+                                serial_number: tokenSerialNumber,
+                                ttl_seconds: Math.max(0, Math.round(parseFloat(tokenTTLHours) * 3600) || 0)
+                            })
+                            setTokenSerialNumber("")
+                        }}>Issue Token</Button>
+                    </Grid>
+                </Grid>
+                {
+                    tokensState.lastIssued && (
+                        <Grid item xs={12}>
+                            <Typography color="#B2B3B7" fontSize="15px" fontWeight="400">Issued token, it will not be shown again</Typography>
+                            <Typography color="#DEE2E7" fontSize="18px" fontWeight="400" sx={{ wordBreak: "break-all" }}>{tokensState.lastIssued.token}</Typography>
+                        </Grid>
+                    )
+                }
+                <Grid item xs={12}>
+                    {
+                        tokensState.credentials.length > 0
+                            ? (
+                                <Table size="small">
+                                    <TableHead>
+                                        <TableRow>
+                                            <TableCell>Kind</TableCell>
+                                            <TableCell>Serial Number</TableCell>
+                                            <TableCell>Created</TableCell>
+                                            <TableCell>Expires</TableCell>
+                                            <TableCell>Status</TableCell>
+                                            <TableCell>Actions</TableCell>
+                                        </TableRow>
+                                    </TableHead>
+                                    <TableBody>
+                                        {
+                                            tokensState.credentials.map((credential) => (
+                                                <TableRow key={credential.id}>
+                                                    <TableCell>{credential.kind}</TableCell>
+                                                    <TableCell>{credential.serial_number}</TableCell>
+                                                    <TableCell>{formatDate(credential.created_at)}</TableCell>
+                                                    <TableCell>{formatDate(credential.expires_at)}</TableCell>
+                                                    <TableCell>{credential.used_at ? `Used ${formatDate(credential.used_at)}` : (credential.expired ? "Expired" : "Valid")}</TableCell>
+                                                    <TableCell>
+                                                        <IconButton title="Revoke" onClick={() => sendCommand("REVOKE_ENROLLMENT_TOKEN", { id: credential.id })}>
+                                                            <DeleteOutlineOutlinedIcon />
+                                                        </IconButton>
+                                                    </TableCell>
+                                                </TableRow>
+                                            ))
+                                        }
+                                    </TableBody>
+                                </Table>
+                            )
+                            : (
+                                <Typography color="#DEE2E7" fontStyle="italic" fontSize="18px" fontWeight="400">No enrollment token or claim code is registered</Typography>
+                            )
+                    }
+                </Grid>
+            </Grid>
+        </Box>
+    )
+}
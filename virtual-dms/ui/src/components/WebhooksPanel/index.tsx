@@ -0,0 +1,136 @@
+import React, { useEffect, useState } from "react"
+import { Box, Button, Grid, IconButton, Paper, Table, TableBody, TableCell, TableHead, TableRow, TextField, Typography } from "@mui/material"
+import DeleteOutlineOutlinedIcon from "@mui/icons-material/DeleteOutlineOutlined"
+import { useDispatch } from "react-redux"
+import moment from "moment"
+import { useAppSelector } from "ducks/hooks"
+import * as webhooksSelector from "ducks/features/webhooks/reducer"
+import { ActionType } from "ducks/features/websocket/actionTypes"
+
+const deliveryStatusColors: { [status: string]: string } = {
+    PENDING: "#B2B3B7",
+    RETRYING: "#FFA32A",
+    DELIVERED: "#25ee32",
+    FAILED: "#FF5A5A"
+}
+
+export const WebhooksPanel: React.FC = () => {
+    const dispatch = useDispatch()
+    const webhooksState = useAppSelector((state: any) => webhooksSelector.getState(state))
+
+    const [url, setURL] = useState("")
+    const [secret, setSecret] = useState("")
+
+    useEffect(() => {
+        dispatch({
+            type: ActionType.WS_SEND_MESSAGE,
+            value: {
+                type: "GET_WEBHOOKS",
+                time: Date.now()
+            }
+        })
+    }, [])
+
+    return (
+        <Box bgcolor="#1F2933" component={Paper} padding="20px" flex="1">
+            <Grid container spacing={2}>
+                <Grid item xs={12}>
+                    <Typography color="#B2B3B7" fontSize="23px" fontWeight="400">Webhooks</Typography>
+                </Grid>
+                {
+                    webhooksState.subscriptions.map((subscription) => (
+                        <Grid item xs={12} container key={subscription.id} alignItems="center">
+                            <Grid item xs>
+                                <Typography color="#DEE2E7" fontSize="18px" fontWeight="400">{subscription.url}</Typography>
+                                <Typography color="#B2B3B7" fontSize="13px" fontWeight="400">
+                                    {subscription.events.join(", ")}{subscription.has_secret ? " - signed" : ""}
+                                </Typography>
+                            </Grid>
+                            <Grid item xs="auto">
+                                <IconButton onClick={() => {
+                                    dispatch({
+                                        type: ActionType.WS_SEND_MESSAGE,
+                                        value: {
+                                            type: "REMOVE_WEBHOOK",
+                                            message: {
+                                                id: subscription.id
+                                            },
+                                            time: Date.now()
+                                        }
+                                    })
+                                }}>
+                                    <DeleteOutlineOutlinedIcon />
+                                </IconButton>
+                            </Grid>
+                        </Grid>
+                    ))
+                }
+                <Grid item xs={12} container spacing={2} alignItems="flex-end">
+                    <Grid item xs>
+                        <TextField label="URL" variant="standard" fullWidth value={url} onChange={(ev) => setURL(ev.target.value)} />
+                    </Grid>
+                    <Grid item xs={3}>
+                        <TextField label="Secret" variant="standard" type="password" fullWidth value={secret} onChange={(ev) => setSecret(ev.target.value)} />
+                    </Grid>
+                    <Grid item xs="auto">
+                        <Button variant="contained" disabled={url === ""} onClick={() => {
+                            dispatch({
+                                type: ActionType.WS_SEND_MESSAGE,
+                                value: {
+                                    type: "ADD_WEBHOOK",
+                                    message: {
+                                        url: url,
+                                        secret: secret,
+                                        events: []
+                                    },
+                                    time: Date.now()
+                                }
+                            })
+                            setURL("")
+                            setSecret("")
+                        }}>Add Webhook</Button>
+                    </Grid>
+                </Grid>
+                <Grid item xs={12}>
+                    <Typography color="#B2B3B7" fontSize="15px" fontWeight="400">Delivery Log</Typography>
+                    {
+                        webhooksState.deliveries.length > 0
+                            ? (
+                                <Table size="small">
+                                    <TableHead>
+                                        <TableRow>
+                                            <TableCell>Date</TableCell>
+                                            <TableCell>Event</TableCell>
+                                            <TableCell>URL</TableCell>
+                                            <TableCell>Status</TableCell>
+                                            <TableCell>Attempts</TableCell>
+                                            <TableCell>Last Response</TableCell>
+                                            <TableCell>Next Retry</TableCell>
+                                        </TableRow>
+                                    </TableHead>
+                                    <TableBody>
+                                        {
+                                            webhooksState.deliveries.map((delivery) => (
+                                                <TableRow key={delivery.id}>
+                                                    <TableCell>{moment(delivery.created_at).format("DD/MM/YYYY HH:mm:ss")}</TableCell>
+                                                    <TableCell>{delivery.event}</TableCell>
+                                                    <TableCell>{delivery.url}</TableCell>
+                                                    <TableCell sx={{ color: deliveryStatusColors[delivery.status] }}>{delivery.status}</TableCell>
+                                                    <TableCell>{delivery.attempts}</TableCell>
+                                                    <TableCell>{delivery.last_error !== "" ? delivery.last_error : delivery.last_status_code}</TableCell>
+                                                    <TableCell>{delivery.next_retry_at ? moment(delivery.next_retry_at).format("HH:mm:ss") : "-"}</TableCell>
+                                                </TableRow>
+                                            ))
+                                        }
+                                    </TableBody>
+                                </Table>
+                            )
+                            : (
+                                <Typography color="#DEE2E7" fontStyle="italic" fontSize="18px" fontWeight="400">No webhook has been delivered yet</Typography>
+                            )
+                    }
+                </Grid>
+            </Grid>
+        </Box>
+    )
+}
@@ -1,9 +1,19 @@
 import * as enrollProcesorActions from "./features/enrollProcesor/actionTypes"
 import * as dmsActions from "./features/dms/actionTypes"
 import * as webSocketsActions from "./features/websocket/actionTypes"
+import * as webhooksActions from "./features/webhooks/actionTypes"
+import * as backlogActions from "./features/backlog/actionTypes"
+import * as manifestActions from "./features/manifest/actionTypes"
+import * as tokensActions from "./features/tokens/actionTypes"
+import * as adminActions from "./features/admin/actionTypes"
 
 export const actions = {
     enrollProcesorActions,
     dmsActions,
-    webSocketsActions
+    webSocketsActions,
+    webhooksActions,
+    backlogActions,
+    manifestActions,
+    tokensActions,
+    adminActions
 }
@@ -0,0 +1,4 @@
+/* eslint-disable no-unused-vars */
+export enum ActionType {
+    DMS_LIST = "DMS_LIST",
+}
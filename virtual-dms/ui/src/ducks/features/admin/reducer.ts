@@ -0,0 +1,44 @@
+import { RootState } from "ducks/reducers"
+import { actions } from "ducks/actions"
+
+export interface LamassuDMS {
+    name: string
+    status: string
+    serial_number: string
+    common_name: string
+    key_type: string
+    key_bits: number
+    authorized_cas: Array<string>
+    creation_timestamp: number
+    has_certificate: boolean
+    adopted: boolean
+}
+
+export interface AdminState {
+    loggedIn: boolean,
+    dmss: Array<LamassuDMS>,
+}
+
+const initialState = {
+    loggedIn: false,
+    dmss: []
+}
+
+export const adminReducer = (state = initialState, action: any) => {
+    switch (action.type) {
+    case actions.adminActions.ActionType.DMS_LIST:
+        // The list is only sent once the operator clients are logged in.
+        return Object.assign({}, state, {
+            loggedIn: true,
+            dmss: action.value.message
+        })
+    }
+    return state
+}
+
+const getSelector = (state: RootState): AdminState => state.admin
+
+export const getState = (state: RootState): AdminState => {
+    const reducer = getSelector(state)
+    return reducer
+}
@@ -0,0 +1,4 @@
+/* eslint-disable no-unused-vars */
+export enum ActionType {
+    ENROLLMENT_BACKLOG_UPDATE = "ENROLLMENT_BACKLOG_UPDATE",
+}
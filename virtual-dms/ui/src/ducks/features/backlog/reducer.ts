@@ -0,0 +1,52 @@
+import { RootState } from "ducks/reducers"
+import { actions } from "ducks/actions"
+
+export interface QueuedEnrollment {
+    id: string
+    status: string
+    requesting_date: Date
+    queued_at: Date
+    device_model: string
+    device_id: string
+    device_slot: string
+    issuing_ca: string
+    authorized_certificate_transfer: boolean
+    attempts: number
+    last_error?: string
+    next_retry_at: Date
+    finished_at?: Date
+}
+
+export interface EnrollmentBacklogState {
+    linkState: string,
+    lastLinkCheck?: Date,
+    nextRetryAt?: Date,
+    backlog: Array<QueuedEnrollment>,
+}
+
+const initialState = {
+    linkState: "UNKNOWN",
+    lastLinkCheck: undefined,
+    nextRetryAt: undefined,
+    backlog: []
+}
+
+export const enrollmentBacklogReducer = (state = initialState, action: any) => {
+    switch (action.type) {
+    case actions.backlogActions.ActionType.ENROLLMENT_BACKLOG_UPDATE:
+        return Object.assign({}, state, {
+            linkState: action.value.message.link_state,
+            lastLinkCheck: action.value.message.last_link_check,
+            nextRetryAt: action.value.message.next_retry_at,
+            backlog: action.value.message.backlog
+        })
+    }
+    return state
+}
+
+const getSelector = (state: RootState): EnrollmentBacklogState => state.backlog
+
+export const getState = (state: RootState): EnrollmentBacklogState => {
+    const reducer = getSelector(state)
+    return reducer
+}
@@ -1,13 +1,20 @@
 import { RootState } from "ducks/reducers"
 import { actions } from "ducks/actions"
 
-interface EnrolledIdentity {
-    enrolled_timestamp: Date
+export interface EnrolledIdentity {
+    enrolled_timestamp: number
     serial_number: string
     device_id: string
     device_slot: string
     issuing_ca: string
     issuing_duration: number
+    status: string
+    expiration_date: number
+    supersedes: Array<string> | null
+    superseded_by: string
+    superseded_timestamp: number
+    revocation_error?: string
+    active_certificates: number
 }
 
 export interface DMSState {
@@ -18,6 +25,9 @@ export interface DMSState {
     deviceSlot: string,
     autoEnrollment: boolean,
     autoCertificateTransfer: boolean,
+    repeatEnrollmentPolicy: string,
+    maxActiveCertificatesPerSlot: number,
+    revokeSupersededCertificates: boolean,
     enrolledIdentities: Array<EnrolledIdentity>,
 }
 
@@ -28,6 +38,9 @@ const initialState = {
     selectedCA: "",
     autoEnrollment: false,
     autoCertificateTransfer: false,
+    repeatEnrollmentPolicy: "ALLOW",
+    maxActiveCertificatesPerSlot: 0,
+    revokeSupersededCertificates: false,
     enrolledIdentities: []
 }
 
@@ -42,7 +55,10 @@ export const dmsReducer = (state = initialState, action: any) => {
             authorizedCAs: action.value.message.authorized_cas,
             selectedCA: action.value.message.selected_ca_for_enrollment,
             autoEnrollment: action.value.message.automatic_enrollment,
-            autoCertificateTransfer: action.value.message.automatic_certificate_transfer
+            autoCertificateTransfer: action.value.message.automatic_certificate_transfer,
+            repeatEnrollmentPolicy: action.value.message.repeat_enrollment_policy,
+            maxActiveCertificatesPerSlot: action.value.message.max_active_certificates_per_slot,
+            revokeSupersededCertificates: action.value.message.revoke_superseded_certificates
         })
     case actions.dmsActions.ActionType.ENROLLED_IDENTITES_UPDATE:
         return Object.assign({}, state, {
@@ -0,0 +1,4 @@
+/* eslint-disable no-unused-vars */
+export enum ActionType {
+    DEVICE_MANIFEST_UPDATE = "DEVICE_MANIFEST_UPDATE",
+}
@@ -0,0 +1,46 @@
+import { RootState } from "ducks/reducers"
+import { actions } from "ducks/actions"
+
+export interface ManifestSlotProgress {
+    status: string
+    serial_number?: string
+    updated_at: Date
+}
+
+export interface ManifestDevice {
+    serial_number: string
+    model: string
+    allowed_slots: Array<string> | null
+    public_key_fingerprint?: string
+    registered_at: Date
+    slots: { [slot: string]: ManifestSlotProgress }
+    last_rejection?: string
+}
+
+export interface DeviceManifestState {
+    enforced: boolean,
+    devices: Array<ManifestDevice>,
+}
+
+const initialState = {
+    enforced: false,
+    devices: []
+}
+
+export const deviceManifestReducer = (state = initialState, action: any) => {
+    switch (action.type) {
+    case actions.manifestActions.ActionType.DEVICE_MANIFEST_UPDATE:
+        return Object.assign({}, state, {
+            enforced: action.value.message.enforced,
+            devices: action.value.message.devices
+        })
+    }
+    return state
+}
+
+const getSelector = (state: RootState): DeviceManifestState => state.manifest
+
+export const getState = (state: RootState): DeviceManifestState => {
+    const reducer = getSelector(state)
+    return reducer
+}
@@ -0,0 +1,5 @@
+/* eslint-disable no-unused-vars */
+export enum ActionType {
+    ENROLLMENT_TOKENS_UPDATE = "ENROLLMENT_TOKENS_UPDATE",
+    ENROLLMENT_TOKEN_ISSUED = "ENROLLMENT_TOKEN_ISSUED",
+}
@@ -0,0 +1,52 @@
+import { RootState } from "ducks/reducers"
+import { actions } from "ducks/actions"
+
+export interface EnrollmentCredential {
+    id: string
+    kind: string
+    serial_number: string
+    created_at: Date
+    expires_at: Date
+    used_at?: Date
+    expired: boolean
+}
+
+export interface IssuedEnrollmentToken {
+    id: string
+    token: string
+    serial_number: string
+    expires_at: Date
+}
+
+export interface EnrollmentTokensState {
+    credentials: Array<EnrollmentCredential>,
+    lastIssued?: IssuedEnrollmentToken,
+}
+
+const initialState = {
+    credentials: [],
+    lastIssued: undefined
+}
+
+export const enrollmentTokensReducer = (state = initialState, action: any) => {
+    switch (action.type) {
+    case actions.tokensActions.ActionType.ENROLLMENT_TOKENS_UPDATE:
+        return Object.assign({}, state, {
+            credentials: action.value.message
+        })
+    case actions.tokensActions.ActionType.ENROLLMENT_TOKEN_ISSUED:
+        // The token is only sent once, the console keeps it until it is
+        // replaced by the next one.
+        return Object.assign({}, state, {
+            lastIssued: action.value.message
+        })
+    }
+    return state
+}
+
+const getSelector = (state: RootState): EnrollmentTokensState => state.tokens
+
+export const getState = (state: RootState): EnrollmentTokensState => {
+    const reducer = getSelector(state)
+    return reducer
+}
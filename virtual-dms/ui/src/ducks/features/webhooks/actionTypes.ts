@@ -0,0 +1,4 @@
+/* eslint-disable no-unused-vars */
+export enum ActionType {
+    WEBHOOKS_UPDATE = "WEBHOOKS_UPDATE",
+}
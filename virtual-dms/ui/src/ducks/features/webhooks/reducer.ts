@@ -0,0 +1,50 @@
+import { RootState } from "ducks/reducers"
+import { actions } from "ducks/actions"
+
+export interface WebhookSubscription {
+    id: string
+    url: string
+    has_secret: boolean
+    events: Array<string>
+}
+
+export interface WebhookDelivery {
+    id: string
+    subscription_id: string
+    url: string
+    event: string
+    status: string
+    attempts: number
+    last_status_code: number
+    last_error: string
+    created_at: Date
+    next_retry_at?: Date
+}
+
+export interface WebhooksState {
+    subscriptions: Array<WebhookSubscription>,
+    deliveries: Array<WebhookDelivery>,
+}
+
+const initialState = {
+    subscriptions: [],
+    deliveries: []
+}
+
+export const webhooksReducer = (state = initialState, action: any) => {
+    switch (action.type) {
+    case actions.webhooksActions.ActionType.WEBHOOKS_UPDATE:
+        return Object.assign({}, state, {
+            subscriptions: action.value.message.subscriptions,
+            deliveries: action.value.message.deliveries
+        })
+    }
+    return state
+}
+
+const getSelector = (state: RootState): WebhooksState => state.webhooks
+
+export const getState = (state: RootState): WebhooksState => {
+    const reducer = getSelector(state)
+    return reducer
+}
@@ -1,5 +1,14 @@
+export interface ProtocolErrorModel {
+    code: string,
+    message: string,
+    field?: string,
+    cause?: string
+}
+
 export interface MessageModel {
     type: string,
+    id?: string,
     timestamp: Date,
-    message: any
+    message: any,
+    error?: ProtocolErrorModel
 }
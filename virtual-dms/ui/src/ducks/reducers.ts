@@ -1,18 +1,33 @@
 import { combineReducers } from "redux"
 import { dmsReducer, DMSState } from "./features/dms/reducer"
 import { enrollProcesorReducer, EnrollProcesorState } from "./features/enrollProcesor/reducer"
+import { webhooksReducer, WebhooksState } from "./features/webhooks/reducer"
 import { websocketReducer, WebSocketState } from "./features/websocket/reducer"
+import { enrollmentBacklogReducer, EnrollmentBacklogState } from "./features/backlog/reducer"
+import { deviceManifestReducer, DeviceManifestState } from "./features/manifest/reducer"
+import { enrollmentTokensReducer, EnrollmentTokensState } from "./features/tokens/reducer"
+import { adminReducer, AdminState } from "./features/admin/reducer"
 
 export type RootState = {
   enrollProcesor: EnrollProcesorState,
   websocket: WebSocketState,
   dms: DMSState,
+  webhooks: WebhooksState,
+  backlog: EnrollmentBacklogState,
+  manifest: DeviceManifestState,
+  tokens: EnrollmentTokensState,
+  admin: AdminState,
 }
 
 const reducers = combineReducers({
     enrollProcesor: enrollProcesorReducer,
     websocket: websocketReducer,
-    dms: dmsReducer
+    dms: dmsReducer,
+    webhooks: webhooksReducer,
+    backlog: enrollmentBacklogReducer,
+    manifest: deviceManifestReducer,
+    tokens: enrollmentTokensReducer,
+    admin: adminReducer
 })
 
 export default reducers
@@ -3,6 +3,11 @@ import { MessageModel } from "./models"
 import { ActionType as ActionTypeDMS } from "./features/dms/actionTypes"
 import { ActionType as ActionTypeEnrollProcess } from "./features/enrollProcesor/actionTypes"
 import { ActionType as ActionTypeWS } from "./features/websocket/actionTypes"
+import { ActionType as ActionTypeWebhooks } from "./features/webhooks/actionTypes"
+import { ActionType as ActionTypeBacklog } from "./features/backlog/actionTypes"
+import { ActionType as ActionTypeManifest } from "./features/manifest/actionTypes"
+import { ActionType as ActionTypeTokens } from "./features/tokens/actionTypes"
+import { ActionType as ActionTypeAdmin } from "./features/admin/actionTypes"
 
 function * message (action: any) {
     console.log(action)
@@ -22,6 +27,30 @@ function * message (action: any) {
     case ActionTypeDMS.ENROLLED_IDENTITES_UPDATE:
         yield put({ type: ActionTypeDMS.ENROLLED_IDENTITES_UPDATE, value: msg })
         break
+
+    case ActionTypeWebhooks.WEBHOOKS_UPDATE:
+        yield put({ type: ActionTypeWebhooks.WEBHOOKS_UPDATE, value: msg })
+        break
+
+    case ActionTypeBacklog.ENROLLMENT_BACKLOG_UPDATE:
+        yield put({ type: ActionTypeBacklog.ENROLLMENT_BACKLOG_UPDATE, value: msg })
+        break
+
+    case ActionTypeManifest.DEVICE_MANIFEST_UPDATE:
+        yield put({ type: ActionTypeManifest.DEVICE_MANIFEST_UPDATE, value: msg })
+        break
+
+    case ActionTypeTokens.ENROLLMENT_TOKENS_UPDATE:
+        yield put({ type: ActionTypeTokens.ENROLLMENT_TOKENS_UPDATE, value: msg })
+        break
+
+    case ActionTypeTokens.ENROLLMENT_TOKEN_ISSUED:
+        yield put({ type: ActionTypeTokens.ENROLLMENT_TOKEN_ISSUED, value: msg })
+        break
+
+    case ActionTypeAdmin.DMS_LIST:
+        yield put({ type: ActionTypeAdmin.DMS_LIST, value: msg })
+        break
     }
 }
 function * mySaga () {